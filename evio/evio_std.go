@@ -8,12 +8,9 @@ import (
 	"errors"
 	"io"
 	"net"
-	"os"
-	"os/signal"
 	"runtime"
 	"sync"
 	"sync/atomic"
-	"syscall"
 	"time"
 )
 
@@ -138,14 +135,6 @@ func stdserve(events Events, listeners []*listener) error {
 		})
 	}
 
-	go func() {
-		quit := make(chan os.Signal, 1)
-		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-		defer signal.Stop(quit)
-		<-quit
-		s.signalShutdown(errClosing)
-	}()
-
 	var ferr error
 	defer func() {
 		// wait on a signal for shutdown
@@ -16,6 +16,8 @@ import (
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/tidwall/evio/internal"
 )
 
 func TestServe(t *testing.T) {
@@ -457,6 +459,70 @@ func TestReuseInputBuffer(t *testing.T) {
 
 }
 
+func TestWakePendingOutput(t *testing.T) {
+	testWakePendingOutput(t, "tcp://:9990")
+	testWakePendingOutput(t, "tcp-net://:9990")
+}
+
+func testWakePendingOutput(t *testing.T, addr string) {
+	// The output is larger than the socket buffers, so it is still pending
+	// when the connection is woken.
+	big := make([]byte, 32<<20)
+	var events Events
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if in == nil {
+			return []byte("woken"), None
+		}
+		go c.Wake()
+		return big, None
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	events.Serving = func(_ Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", ":9990")
+			must(err)
+			defer c.Close()
+			c.Write([]byte("packet"))
+			time.Sleep(time.Second / 5)
+			c.SetReadDeadline(time.Now().Add(5 * time.Second))
+			out := make([]byte, len(big)+len("woken"))
+			if _, err := io.ReadFull(c, out); err != nil {
+				t.Errorf("%s: %v", addr, err)
+				return
+			}
+			if string(out[len(big):]) != "woken" {
+				t.Errorf("%s: expected 'woken', got '%s'", addr, out[len(big):])
+			}
+		}()
+		return
+	}
+	must(Serve(events, addr))
+}
+
+func TestTriggerAfterClose(t *testing.T) {
+	p := internal.OpenPoll()
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The pipe likely reuses the descriptors of the poll.
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	if err := p.Trigger(nil); err == nil {
+		t.Fatal("expected an error")
+	}
+	w.Write([]byte("x"))
+	buf := make([]byte, 8)
+	if n, _ := r.Read(buf); string(buf[:n]) != "x" {
+		t.Fatalf("expected 'x', got %q", buf[:n])
+	}
+}
+
 func TestReuseport(t *testing.T) {
 	var events Events
 	events.Serving = func(s Server) (action Action) {
@@ -11,7 +11,6 @@ import (
 	"io"
 	"net"
 	"os"
-	"os/signal"
 	"runtime"
 	"sync"
 	"sync/atomic"
@@ -117,14 +116,6 @@ func serve(events Events, listeners []*listener) error {
 		}
 	}
 
-	go func() {
-		quit := make(chan os.Signal, 1)
-		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-		defer signal.Stop(quit)
-		<-quit
-		s.signalShutdown()
-	}()
-
 	defer func() {
 		// wait on a signal for shutdown
 		s.waitForShutdown()
@@ -428,7 +419,8 @@ func loopWake(s *server, l *loop, c *conn) error {
 	out, action := s.events.Data(c, nil)
 	c.action = action
 	if len(out) > 0 {
-		c.out = append([]byte{}, out...)
+		// The output of a previous event may not be written yet.
+		c.out = append(c.out, out...)
 	}
 	if len(c.out) != 0 || c.action != None {
 		l.poll.ModReadWrite(c.fd)
@@ -7,6 +7,7 @@
 package internal
 
 import (
+	"sync"
 	"syscall"
 )
 
@@ -15,6 +16,11 @@ type Poll struct {
 	fd      int
 	changes []syscall.Kevent_t
 	notes   noteQueue
+
+	// mu guards closed: once the descriptor is closed, its number may be
+	// reused by a connection which late triggers must not write to.
+	mu     sync.RWMutex
+	closed bool
 }
 
 // OpenPoll ...
@@ -39,11 +45,19 @@ func OpenPoll() *Poll {
 
 // Close ...
 func (p *Poll) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
 	return syscall.Close(p.fd)
 }
 
 // Trigger ...
 func (p *Poll) Trigger(note interface{}) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return syscall.EBADF
+	}
 	p.notes.Add(note)
 	_, err := syscall.Kevent(p.fd, []syscall.Kevent_t{{
 		Ident:  0,
@@ -6,6 +6,7 @@ package internal
 
 import (
 	"runtime"
+	"sync"
 	"syscall"
 	"unsafe"
 )
@@ -15,6 +16,11 @@ type Poll struct {
 	fd    int // epoll fd
 	wfd   int // wake fd
 	notes noteQueue
+
+	// mu guards closed: once the descriptors are closed, their numbers may
+	// be reused by connections which late triggers must not write to.
+	mu     sync.RWMutex
+	closed bool
 }
 
 // OpenPoll ...
@@ -37,6 +43,9 @@ func OpenPoll() *Poll {
 
 // Close ...
 func (p *Poll) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
 	if err := syscall.Close(p.wfd); err != nil {
 		return err
 	}
@@ -45,6 +54,11 @@ func (p *Poll) Close() error {
 
 // Trigger ...
 func (p *Poll) Trigger(note interface{}) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return syscall.EBADF
+	}
 	p.notes.Add(note)
 	var x uint64 = 1
 	_, err := syscall.Write(p.wfd, (*(*[8]byte)(unsafe.Pointer(&x)))[:])
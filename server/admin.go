@@ -0,0 +1,98 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// adminHandler serves the HTTP admin endpoints:
+//
+//	POST /backup   takes a backup, see Backup
+//	GET  /backups  lists the backups of backup_dir, oldest first
+//
+// The requests must carry "Authorization: Bearer <password>" if a password
+// is set.
+func (s *Server) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/backup", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		path, err := s.Backup()
+		if err == errBackupInProgress {
+			writeJSONError(w, http.StatusConflict, err.Error())
+			return
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"path": path})
+	})
+	mux.HandleFunc("/backups", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		names, err := listBackups(viper.GetString("backup_dir"))
+		if err != nil && !os.IsNotExist(err) {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if names == nil {
+			names = []string{}
+		}
+		writeJSON(w, http.StatusOK, map[string][]string{"backups": names})
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.password != "" && !s.adminAuthorized(r) {
+			writeJSONError(w, http.StatusUnauthorized, "authentication required")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) adminAuthorized(r *http.Request) bool {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(s.password)) == 1
+}
+
+// startAdmin serves the admin endpoints on addr in the background.
+func (s *Server) startAdmin(addr string) {
+	s.admin = &http.Server{Addr: addr, Handler: s.adminHandler()}
+	go func() {
+		if err := s.admin.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			s.logger.Error("admin server failed", zap.Error(err))
+		}
+	}()
+	s.logger.Info("admin server started", zap.String("addr", addr))
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
@@ -0,0 +1,166 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.chensl.me/redix/server/internal/aof"
+	"go.chensl.me/redix/server/internal/storage"
+	"go.uber.org/zap"
+)
+
+// openAOF replays the append only file and opens it for appending. The
+// commands must be registered already.
+func (s *Server) openAOF() error {
+	path := viper.GetString("appendfilename")
+	policy, err := aof.ParseFsyncPolicy(viper.GetString("appendfsync"))
+	if err != nil {
+		return err
+	}
+
+	var (
+		n     int
+		start = time.Now()
+		out   []byte
+		c     = &Context{out: &out}
+	)
+	err = aof.Load(path, s.logger, func(args [][]byte) error {
+		cmd := s.lookup(args[0])
+		if cmd == nil {
+			return fmt.Errorf("unknown command '%s'", args[0])
+		}
+		out = out[:0]
+		c.cmd = args[0]
+		c.Args = args[1:]
+		cmd.fn(c)
+		if len(out) > 0 && out[0] == '-' {
+			return errors.New(strings.TrimSpace(string(out[1:])))
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.logger.Info("AOF loaded",
+		zap.String("path", path),
+		zap.Int("commands", n),
+		zap.Duration("elapsed", time.Since(start)),
+	)
+
+	s.aof, err = aof.Open(path, policy, s.logger)
+	return err
+}
+
+// propagate appends a write command to the AOF, if enabled, and to the
+// replication stream. Commands depending on the current time or on the
+// state of the database are propagated in a form that replays to the same
+// result.
+func (s *Server) propagate(args ...[]byte) {
+	if s.aof != nil {
+		s.aof.Append(args)
+	}
+	s.feed(args)
+	s.invalidate(args)
+	if s.slotKeys != nil {
+		s.indexSlots(args)
+	}
+}
+
+func (s *Server) cmdBGREWRITEAOF(c *Context) {
+	if len(c.Args) != 0 {
+		c.ErrInvalidArgs()
+		return
+	}
+
+	if s.aof == nil {
+		c.AppendError("ERR Append only file is disabled")
+		return
+	}
+
+	rewrite, err := s.startRewriteAOF()
+	if err == aof.ErrRewriteInProgress {
+		c.AppendError("ERR Background append only file rewriting already in progress")
+		return
+	}
+	if err != nil {
+		s.logUnknownError("store.ForEach", err)
+		c.ErrUnknown(err)
+		return
+	}
+
+	// Cleanup waits for the rewrite before closing the AOF.
+	s.closer.AddRunning(1)
+	go func() {
+		defer s.closer.Done()
+		_ = rewrite()
+	}()
+
+	c.AppendString("Background append only file rewriting started")
+}
+
+// snapshotItem is a key copied by snapshot.
+type snapshotItem struct {
+	key, value []byte
+	expiresAt  time.Time
+}
+
+// snapshot copies every key of the store. The write commands don't run
+// meanwhile, see exec, so the copy matches the point where it's taken.
+func (s *Server) snapshot() ([]snapshotItem, error) {
+	var items []snapshotItem
+	err := s.store.ForEach(func(key, value []byte, expiresAt time.Time) error {
+		items = append(items, snapshotItem{
+			key:       append([]byte(nil), key...),
+			value:     append([]byte(nil), value...),
+			expiresAt: expiresAt,
+		})
+		return nil
+	})
+	return items, err
+}
+
+// startRewriteAOF snapshots the store and starts an AOF rewrite. The
+// returned function writes the new file and may run in the background.
+func (s *Server) startRewriteAOF() (func() error, error) {
+	// The snapshot matches the point where the AOF starts buffering.
+	items, err := s.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.aof.StartRewrite(); err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		start := time.Now()
+		err := s.aof.Rewrite(func(emit func(args ...[]byte) error) error {
+			for _, it := range items {
+				args := [][]byte{[]byte("SET"), it.key, it.value}
+				if !it.expiresAt.IsZero() {
+					args = append(args, []byte("PXAT"), storage.FormatInt(it.expiresAt.UnixMilli()))
+				}
+				if err := emit(args...); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			s.logger.Error("failed to rewrite AOF", zap.Error(err))
+			return err
+		}
+		s.logger.Info("AOF rewritten",
+			zap.Int("keys", len(items)),
+			zap.Duration("elapsed", time.Since(start)),
+		)
+		return nil
+	}, nil
+}
@@ -0,0 +1,58 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAOF(t *testing.T) {
+	cfg := map[string]interface{}{
+		"appendonly":     true,
+		"appendfilename": filepath.Join(t.TempDir(), "appendonly.aof"),
+		"appendfsync":    "always",
+	}
+
+	srv, c := newTestServer(t, cfg)
+	assert.Equal(t, "+OK\r\n", c.do("SET", "a", "1", "EX", "100"))
+	assert.Equal(t, ":2\r\n", c.do("INCR", "a"))
+	assert.Equal(t, "+OK\r\n", c.do("SET", "b", "1"))
+	assert.Equal(t, "+OK\r\n", c.do("RENAME", "b", "c"))
+	assert.Equal(t, ":1\r\n", c.do("EXPIRE", "c", "200"))
+	assert.Equal(t, "+OK\r\n", c.do("MSET", "d", "1", "e", "2"))
+	assert.Equal(t, ":1\r\n", c.do("DEL", "d"))
+	assert.NoError(t, srv.Cleanup())
+
+	check := func(c *testConn) {
+		assert.Equal(t, ":3\r\n", c.do("DBSIZE"))
+		assert.Equal(t, "$1\r\n2\r\n", c.do("GET", "a"))
+		assert.Equal(t, ":99\r\n", c.do("TTL", "a"))
+		assert.Equal(t, "$1\r\n1\r\n", c.do("GET", "c"))
+		assert.Equal(t, ":199\r\n", c.do("TTL", "c"))
+		assert.Equal(t, "$1\r\n2\r\n", c.do("GET", "e"))
+	}
+
+	srv, c = newTestServer(t, cfg)
+	check(c)
+	assert.Equal(t, "+Background append only file rewriting started\r\n", c.do("BGREWRITEAOF"))
+	assert.Equal(t, "+OK\r\n", c.do("SET", "f", "1"))
+	assert.NoError(t, srv.Cleanup())
+
+	srv, c = newTestServer(t, cfg)
+	defer srv.Cleanup()
+	assert.Equal(t, "$1\r\n1\r\n", c.do("GET", "f"))
+	assert.Equal(t, ":1\r\n", c.do("DEL", "f"))
+	check(c)
+}
+
+func TestAOFDisabled(t *testing.T) {
+	srv, c := newTestServer(t, nil)
+	defer srv.Cleanup()
+
+	assert.Equal(t, "-ERR Append only file is disabled\r\n", c.do("BGREWRITEAOF"))
+}
@@ -0,0 +1,347 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.chensl.me/redix/server/internal/storage"
+	"go.uber.org/zap"
+)
+
+const (
+	// backupTimeFormat names the backups, it sorts chronologically.
+	backupTimeFormat = "20060102T150405.000Z"
+	manifestName     = "MANIFEST.json"
+	// The backups are either written by the driver, see storage.Backuper,
+	// or as an RDB file.
+	formatNative = "native"
+	formatRDB    = "rdb"
+)
+
+var errBackupInProgress = errors.New("backup already in progress")
+
+// backupManifest describes a backup, it's written last.
+type backupManifest struct {
+	Driver    string    `json:"driver"`
+	Format    string    `json:"format"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Backup takes a consistent snapshot of the store, while serving requests,
+// into a new directory of backup_dir and returns its path. The oldest
+// backups are then removed according to backup_retention.
+func (s *Server) Backup() (string, error) {
+	if !atomic.CompareAndSwapInt32(&s.backingUp, 0, 1) {
+		return "", errBackupInProgress
+	}
+	defer atomic.StoreInt32(&s.backingUp, 0)
+
+	root := viper.GetString("backup_dir")
+	now := time.Now().UTC()
+	path := filepath.Join(root, now.Format(backupTimeFormat))
+	// The backup is written to a temporary directory which is renamed once
+	// complete, so that an interrupted backup is never restored.
+	tmp := filepath.Join(root, ".tmp-"+now.Format(backupTimeFormat))
+	if err := os.MkdirAll(tmp, 0700); err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp) //nolint:errcheck
+
+	start := time.Now()
+	m, err := s.writeBackup(tmp)
+	if err != nil {
+		s.logger.Error("failed to back up", zap.Error(err))
+		return "", err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return "", err
+	}
+	s.logger.Info("backup done",
+		zap.String("path", path),
+		zap.String("format", m.Format),
+		zap.Duration("elapsed", time.Since(start)),
+	)
+
+	if keep := viper.GetInt("backup_retention"); keep > 0 {
+		if err := pruneBackups(root, keep, s.logger); err != nil {
+			s.logger.Error("failed to remove old backups", zap.Error(err))
+		}
+	}
+	return path, nil
+}
+
+// writeBackup writes a snapshot of the store and its manifest to dir,
+// which exists and is empty.
+func (s *Server) writeBackup(dir string) (*backupManifest, error) {
+	m := &backupManifest{Driver: s.driver, CreatedAt: time.Now().UTC()}
+	var err error
+	if b, ok := storage.Unwrap(s.store).(storage.Backuper); ok {
+		m.Format = formatNative
+		err = b.Backup(dir)
+	} else {
+		m.Format = formatRDB
+		err = s.SaveRDB(filepath.Join(dir, "dump.rdb"))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, writeManifest(dir, m)
+}
+
+// RestoreBackup loads the backup in dir into the store, overwriting
+// existing keys. The backup may have been taken with another driver. The
+// restored keys are added to the AOF, if enabled.
+//
+// A native backup is a data directory of its driver, which writes to it
+// when opened (recovery, compactions, schema...), so it's restored from a
+// temporary copy made next to dir and the backup is left untouched.
+func (s *Server) RestoreBackup(dir string) error {
+	m, err := readManifest(dir)
+	if err != nil {
+		return err
+	}
+	if m.Format == formatNative {
+		tmp, err := os.MkdirTemp(filepath.Dir(dir), ".restore-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp) //nolint:errcheck
+		if err := copyDir(tmp, dir); err != nil {
+			return err
+		}
+		return s.loadBackup(tmp, m)
+	}
+	return s.loadBackup(dir, m)
+}
+
+// loadBackup loads the backup in dir described by m. A native backup is
+// opened with its driver, which may modify dir.
+func (s *Server) loadBackup(dir string, m *backupManifest) error {
+	if m.Format == formatRDB {
+		return s.LoadRDB(filepath.Join(dir, "dump.rdb"))
+	}
+	if m.Format != formatNative {
+		return fmt.Errorf("backup %s: unknown format %q", dir, m.Format)
+	}
+
+	snap, err := OpenStorage(m.Driver, dir, s.logger)
+	if err != nil {
+		return err
+	}
+	defer snap.Close()
+
+	var restored int
+	start := time.Now()
+	err = snap.ForEach(func(key, value []byte, expiresAt time.Time) error {
+		var ttl time.Duration
+		if !expiresAt.IsZero() {
+			if ttl = time.Until(expiresAt); ttl <= 0 {
+				return nil
+			}
+		}
+		key = append([]byte(nil), key...)
+		value = append([]byte(nil), value...)
+		if err := s.store.Set(key, value, storage.SetOptions{TTL: ttl}); err != nil {
+			return err
+		}
+		if ttl > 0 {
+			s.propagate([]byte("SET"), key, value, []byte("PXAT"), storage.FormatInt(expiresAt.UnixMilli()))
+		} else {
+			s.propagate([]byte("SET"), key, value)
+		}
+		restored++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if s.aof != nil {
+		if err := s.aof.Flush(); err != nil {
+			return err
+		}
+	}
+
+	s.logger.Info("backup restored",
+		zap.String("path", dir),
+		zap.String("driver", m.Driver),
+		zap.Int("keys", restored),
+		zap.Duration("elapsed", time.Since(start)),
+	)
+	return nil
+}
+
+// restoreBackup restores the configured backup unless the store already
+// has data, so that the option can be left in the configuration. "latest"
+// is the most recent backup of backup_dir.
+func (s *Server) restoreBackup(path string) error {
+	n, err := s.store.DBSize()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		s.logger.Info("store is not empty, skipping backup restore", zap.String("path", path))
+		return nil
+	}
+
+	if path == "latest" {
+		root := viper.GetString("backup_dir")
+		names, err := listBackups(root)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if len(names) == 0 {
+			s.logger.Warn("no backup to restore", zap.String("backup_dir", root))
+			return nil
+		}
+		path = filepath.Join(root, names[len(names)-1])
+	}
+	return s.RestoreBackup(path)
+}
+
+func (s *Server) cmdBACKUP(c *Context) {
+	if len(c.Args) != 0 {
+		c.ErrInvalidArgs()
+		return
+	}
+
+	path, err := s.Backup()
+	if err == errBackupInProgress {
+		c.AppendError("ERR Backup already in progress")
+		return
+	}
+	if err != nil {
+		c.AppendError("ERR " + err.Error())
+		return
+	}
+
+	c.AppendBulk([]byte(path))
+}
+
+// runScheduledBackups takes a backup every interval until the server is
+// cleaned up.
+func (s *Server) runScheduledBackups(interval time.Duration) {
+	defer s.closer.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closer.HasBeenClosed():
+			return
+		case <-ticker.C:
+		}
+		// Errors are logged by Backup.
+		_, _ = s.Backup()
+	}
+}
+
+// listBackups returns the names of the complete backups of root, oldest
+// first.
+func listBackups(root string) ([]string, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if _, err := time.Parse(backupTimeFormat, e.Name()); err != nil {
+			continue
+		}
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// pruneBackups removes the oldest backups of root but the last keep ones.
+func pruneBackups(root string, keep int, logger *zap.Logger) error {
+	names, err := listBackups(root)
+	if err != nil {
+		return err
+	}
+	for len(names) > keep {
+		path := filepath.Join(root, names[0])
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+		logger.Info("old backup removed", zap.String("path", path))
+		names = names[1:]
+	}
+	return nil
+}
+
+// copyDir copies the directories and regular files of src into dst, which
+// exists.
+func copyDir(dst, src string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == src {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case d.IsDir():
+			return os.Mkdir(target, 0700)
+		case d.Type().IsRegular():
+			return copyFile(target, path)
+		default:
+			return fmt.Errorf("backup: unexpected file %s", path)
+		}
+	})
+}
+
+func copyFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func writeManifest(dir string, m *backupManifest) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, manifestName), b, 0600)
+}
+
+func readManifest(dir string) (*backupManifest, error) {
+	b, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if err != nil {
+		return nil, err
+	}
+	var m backupManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("backup %s: %w", dir, err)
+	}
+	return &m, nil
+}
@@ -0,0 +1,173 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackup(t *testing.T) {
+	backupDir := t.TempDir()
+	srv, c := newTestServer(t, map[string]interface{}{"backup_dir": backupDir})
+	assert.Equal(t, "+OK\r\n", c.do("SET", "a", "1"))
+	assert.Equal(t, "+OK\r\n", c.do("SET", "b", "2", "EX", "100"))
+	assert.Equal(t, "-ERR wrong number of arguments for 'BACKUP' command\r\n", c.do("BACKUP", "x"))
+
+	path, err := srv.Backup()
+	require.NoError(t, err)
+	m, err := readManifest(path)
+	require.NoError(t, err)
+	assert.Equal(t, "memory", m.Driver)
+	assert.Equal(t, formatRDB, m.Format)
+	assert.FileExists(t, filepath.Join(path, "dump.rdb"))
+	assert.Equal(t, "+OK\r\n", c.do("SET", "c", "3"))
+	assert.NoError(t, srv.Cleanup())
+
+	srv, c = newTestServer(t, map[string]interface{}{
+		"backup_dir":     backupDir,
+		"backup_restore": "latest",
+	})
+	defer srv.Cleanup()
+	assert.Equal(t, ":2\r\n", c.do("DBSIZE"))
+	assert.Equal(t, "$1\r\n1\r\n", c.do("GET", "a"))
+	assert.Equal(t, ":99\r\n", c.do("TTL", "b"))
+	assert.Equal(t, "$-1\r\n", c.do("GET", "c"))
+}
+
+func TestBackupRetention(t *testing.T) {
+	backupDir := t.TempDir()
+	srv, c := newTestServer(t, map[string]interface{}{
+		"backup_dir":       backupDir,
+		"backup_retention": 2,
+	})
+	defer srv.Cleanup()
+
+	var paths []string
+	for i := 0; i < 3; i++ {
+		reply := c.do("BACKUP")
+		require.True(t, strings.HasPrefix(reply, "$"), reply)
+		paths = append(paths, strings.Split(reply, "\r\n")[1])
+		// The backups are named after the time.
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	names, err := listBackups(backupDir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.Base(paths[1]), filepath.Base(paths[2])}, names)
+}
+
+func TestBackupRestoreNative(t *testing.T) {
+	backupDir := t.TempDir()
+	srv, c := newTestServer(t, map[string]interface{}{
+		"driver":     "sqlite",
+		"data_dir":   t.TempDir(),
+		"backup_dir": backupDir,
+	})
+	assert.Equal(t, "+OK\r\n", c.do("SET", "a", "1"))
+	assert.Equal(t, "+OK\r\n", c.do("SET", "b", "2", "EX", "100"))
+	path, err := srv.Backup()
+	require.NoError(t, err)
+	m, err := readManifest(path)
+	require.NoError(t, err)
+	assert.Equal(t, "sqlite", m.Driver)
+	assert.Equal(t, formatNative, m.Format)
+	assert.NoError(t, srv.Cleanup())
+
+	before := readTree(t, path)
+
+	// The backup is restored into another driver.
+	srv, c = newTestServer(t, map[string]interface{}{
+		"driver":         "pebble",
+		"data_dir":       t.TempDir(),
+		"backup_restore": path,
+	})
+	assert.Equal(t, ":2\r\n", c.do("DBSIZE"))
+	assert.Equal(t, "$1\r\n1\r\n", c.do("GET", "a"))
+	// Both drivers keep the expire to the second, rounded down.
+	assert.Contains(t, []string{":98\r\n", ":99\r\n"}, c.do("TTL", "b"))
+	assert.NoError(t, srv.Cleanup())
+
+	// The backup was restored from a copy, the driver didn't touch it.
+	assert.Equal(t, before, readTree(t, path))
+	entries, err := os.ReadDir(backupDir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+// readTree returns the content of the files of dir by relative path.
+func readTree(t *testing.T, dir string) map[string]string {
+	files := make(map[string]string)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		files[rel] = string(b)
+		return nil
+	})
+	require.NoError(t, err)
+	return files
+}
+
+func TestAdmin(t *testing.T) {
+	backupDir := t.TempDir()
+	srv, _ := newTestServer(t, map[string]interface{}{
+		"backup_dir": backupDir,
+		"password":   "secret",
+	})
+	defer srv.Cleanup()
+	ts := httptest.NewServer(srv.adminHandler())
+	defer ts.Close()
+
+	do := func(method, path, password string) (int, map[string]interface{}) {
+		req, err := http.NewRequest(method, ts.URL+path, nil)
+		require.NoError(t, err)
+		if password != "" {
+			req.Header.Set("Authorization", "Bearer "+password)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var body map[string]interface{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		return resp.StatusCode, body
+	}
+
+	code, _ := do(http.MethodPost, "/backup", "")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = do(http.MethodPost, "/backup", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	code, body := do(http.MethodGet, "/backups", "secret")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []interface{}{}, body["backups"])
+
+	code, body = do(http.MethodPost, "/backup", "secret")
+	require.Equal(t, http.StatusOK, code)
+	path := body["path"].(string)
+	assert.DirExists(t, path)
+
+	code, body = do(http.MethodGet, "/backups", "secret")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []interface{}{filepath.Base(path)}, body["backups"])
+
+	code, _ = do(http.MethodGet, "/backup", "secret")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+}
@@ -0,0 +1,136 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+
+	"github.com/tidwall/evio"
+	"github.com/tidwall/redcon"
+	"go.chensl.me/redix/server/internal/storage"
+)
+
+// The consecutive commands with flagBatch read from one input buffer run in
+// batches of the store, see storage.Batcher, so that a pipeline of writes
+// costs one commit rather than one per command. Their replies are appended
+// as they run, in order, and a command which fails doesn't fail the others.
+// They are propagated once the batch is committed. A batch is never split:
+// the command which doesn't fit in it is dropped, its reply too, and it
+// starts the next batch.
+
+// writeBatch is the batch a connection runs its commands in.
+type writeBatch struct {
+	storage.Batch
+	// propagated are the commands to propagate after the commit.
+	propagated [][][]byte
+}
+
+// batches reports whether cmd runs in a batch. The writes proposed to Raft
+// and the offloaded ones don't, nor the writes which may grow a store
+// bounded by maxkeys or maxdisk, the keys being evicted before each of them.
+func (s *Server) batches(cmd *command) bool {
+	return s.batcher != nil && cmd.is(flagBatch) &&
+		s.raft.node == nil && !s.offloads(cmd) &&
+		(s.evict.index == nil || !cmd.is(flagGrow))
+}
+
+// runBatch runs args and the batch commands following it in data in
+// batches, and returns the rest of data.
+func (s *Server) runBatch(c *Context, args [][]byte, data, out []byte) ([]byte, []byte, evio.Action) {
+	var (
+		n      int
+		action evio.Action
+	)
+	for args != nil {
+		out, args, data, n, action = s.runWriteBatch(c, args, data, out)
+		if n == 0 && args != nil {
+			// args alone doesn't fit in a batch.
+			out, action = s.runCommand(c, args, out)
+			break
+		}
+	}
+	return out, data, action
+}
+
+// runWriteBatch runs args and the batch commands following it in data in a
+// single batch. It returns the command to run in the next batch if any,
+// the rest of data and the number of commands run. The batch holds execMu,
+// as a write command would.
+func (s *Server) runWriteBatch(c *Context, args [][]byte, data, out []byte) ([]byte, [][]byte, []byte, int, evio.Action) {
+	s.execMu.Lock()
+	defer s.execMu.Unlock()
+
+	start, n := len(out), 0
+	var (
+		action evio.Action
+		// The state before the last command, restored if it's dropped.
+		last       [][]byte
+		lastData   []byte
+		lastOut    int
+		propagated int
+	)
+	wb := new(writeBatch)
+	err := s.batcher.Batch(func(b storage.Batch) bool {
+		wb.Batch = b
+		c.batch = wb
+		defer func() { c.batch = nil }()
+		last, lastData, lastOut, propagated = args, data, len(out), len(wb.propagated)
+		out, action = s.runCommand(c, args, out)
+		n++
+		args = nil
+		if action != evio.None {
+			return false
+		}
+		// The arguments of the commands in the batch point into data
+		// until the end of dataHandler, args isn't reused.
+		complete, next, _, rest, err := redcon.ReadNextCommand(data, nil)
+		if err != nil || !complete || !s.batches(s.lookup(next[0])) {
+			return false
+		}
+		args, data = next, rest
+		return true
+	})
+	if err == storage.ErrBatchFull {
+		// The commands before the last one are committed.
+		args, data, out = last, lastData, out[:lastOut]
+		wb.propagated = wb.propagated[:propagated]
+		action = evio.None
+		n--
+		err = nil
+	}
+	if err != nil {
+		// Nothing was committed: none of the commands is propagated and
+		// each of them fails.
+		s.logUnknownError("store.Batch", err)
+		out = out[:start]
+		for i := 0; i < n; i++ {
+			out = redcon.AppendError(out, fmt.Sprintf("ERR unknown %q", err.Error()))
+		}
+		return out, args, data, n, action
+	}
+	for _, args := range wb.propagated {
+		s.propagate(args...)
+	}
+	return out, args, data, n, action
+}
+
+// storeOf returns the storage the batch commands use: the batch
+// of c if it runs in one.
+func (s *Server) storeOf(c *Context) storage.Batch {
+	if c.batch != nil {
+		return c.batch.Batch
+	}
+	return s.store
+}
+
+// propagateOf propagates a command of c once its batch is committed, or
+// right away if it doesn't run in one.
+func (s *Server) propagateOf(c *Context, args ...[]byte) {
+	if c.batch != nil {
+		c.batch.propagated = append(c.batch.propagated, append([][]byte(nil), args...))
+		return
+	}
+	s.propagate(args...)
+}
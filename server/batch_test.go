@@ -0,0 +1,199 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.chensl.me/redix/server/internal/client"
+	"go.chensl.me/redix/server/internal/storage"
+)
+
+func pipeline(cmds ...[]string) []byte {
+	var in []byte
+	for _, args := range cmds {
+		in = appendCommand(in, stringsToBytes(args))
+	}
+	return in
+}
+
+func TestBatch(t *testing.T) {
+	master, c := newTestServer(t, map[string]interface{}{
+		"driver":   "boltdb",
+		"data_dir": t.TempDir(),
+	})
+	require.NotNil(t, master.batcher)
+	m, port := serve(t, master)
+	replica, _ := newTestServer(t, map[string]interface{}{
+		"replicaof": "127.0.0.1 " + strconv.Itoa(port),
+	})
+	r, _ := serve(t, replica)
+	waitConnected(t, r)
+
+	// The failed commands don't fail the others of the batch, and the
+	// commands after a command which isn't batched run in another batch.
+	out, _ := master.dataHandler(c, pipeline(
+		[]string{"SET", "a", "1"},
+		[]string{"INCR", "a"},
+		[]string{"SET", "b", "x"},
+		[]string{"INCR", "b"},
+		[]string{"SETNX", "a", "3"},
+		[]string{"GET", "a"},
+		[]string{"DEL", "b", "z"},
+		[]string{"SET", "c", "1", "PXAT", "1"},
+		[]string{"MSET", "d", "1", "e", "2"},
+	))
+	assert.Equal(t, "+OK\r\n:2\r\n+OK\r\n"+
+		"-ERR value is not an integer or out of range\r\n"+
+		":0\r\n$1\r\n2\r\n:1\r\n+OK\r\n+OK\r\n", string(out))
+
+	// The writes of the batches are propagated in order.
+	assert.Equal(t, int64(1), do(t, m, "WAIT", 1, 5000))
+	assert.Equal(t, int64(3), do(t, r, "DBSIZE"))
+	assert.Equal(t, []byte("2"), do(t, r, "GET", "a"))
+	assert.Equal(t, []byte("2"), do(t, r, "GET", "e"))
+}
+
+type failingBatcher struct {
+	storage.Interface
+}
+
+func (b failingBatcher) Batch(next func(b storage.Batch) bool) error {
+	for next(b.Interface) {
+	}
+	return errors.New("no space left")
+}
+
+func TestBatchFailed(t *testing.T) {
+	srv, c := newTestServer(t, nil)
+	defer srv.Cleanup()
+	srv.batcher = failingBatcher{srv.store}
+
+	// Every command of a batch which fails to commit fails.
+	out, _ := srv.dataHandler(c, pipeline(
+		[]string{"SET", "a", "1"},
+		[]string{"INCR", "a"},
+		[]string{"PING"},
+		[]string{"DEL", "a"},
+	))
+	const failed = "-ERR unknown \"no space left\"\r\n"
+	assert.Equal(t, failed+failed+"+PONG\r\n"+failed, string(out))
+}
+
+// fullBatcher holds two writes per batch, and fails to commit its second
+// batch.
+type fullBatcher struct {
+	storage.Interface
+	batches int
+}
+
+func (b *fullBatcher) Batch(next func(b storage.Batch) bool) error {
+	b.batches++
+	v := &limitedBatch{Batch: b.Interface, left: 2}
+	for next(v) && !v.full {
+	}
+	if b.batches == 2 {
+		return errors.New("no space left")
+	}
+	if v.full {
+		return storage.ErrBatchFull
+	}
+	return nil
+}
+
+type limitedBatch struct {
+	storage.Batch
+	left int
+	full bool
+}
+
+func (b *limitedBatch) Set(key, value []byte, opts storage.SetOptions) error {
+	if b.full || b.left == 0 {
+		b.full = true
+		return storage.ErrBatchFull
+	}
+	b.left--
+	return b.Batch.Set(key, value, opts)
+}
+
+func TestBatchFull(t *testing.T) {
+	master, c := newTestServer(t, nil)
+	batcher := &fullBatcher{Interface: master.store}
+	master.batcher = batcher
+	m, port := serve(t, master)
+	replica, _ := newTestServer(t, map[string]interface{}{
+		"replicaof": "127.0.0.1 " + strconv.Itoa(port),
+	})
+	r, _ := serve(t, replica)
+	waitConnected(t, r)
+
+	// The command which doesn't fit in a batch starts the next one, and
+	// the commands of the first batch are propagated although the commit
+	// of the second one fails.
+	out, _ := master.dataHandler(c, pipeline(
+		[]string{"SET", "a", "1"},
+		[]string{"SET", "b", "2"},
+		[]string{"SET", "c", "3"},
+		[]string{"SET", "d", "4"},
+		[]string{"MSET", "e", "5", "f", "6"},
+		[]string{"SET", "g", "7"},
+	))
+	const failed = "-ERR unknown \"no space left\"\r\n"
+	assert.Equal(t, "+OK\r\n+OK\r\n"+failed+failed+failed+"+OK\r\n", string(out))
+	assert.Equal(t, 3, batcher.batches)
+
+	// The command which doesn't fit in a batch on its own runs alone.
+	out, _ = master.dataHandler(c, pipeline(
+		[]string{"MSET", "h", "8", "i", "9", "j", "10"},
+	))
+	assert.Equal(t, "+OK\r\n", string(out))
+	assert.Equal(t, 4, batcher.batches)
+
+	assert.Equal(t, int64(1), do(t, m, "WAIT", 1, 5000))
+	for key, val := range map[string]string{
+		"a": "1", "b": "2", "c": "", "d": "", "e": "", "g": "7", "j": "10",
+	} {
+		v, _ := do(t, r, "GET", key).([]byte)
+		assert.Equal(t, val, string(v), key)
+	}
+}
+
+func BenchmarkBatch(b *testing.B) {
+	const pipeline = 100
+
+	for _, driver := range []string{"badger", "boltdb"} {
+		for _, batch := range []bool{false, true} {
+			name := driver + "/batch_writes=" + strconv.FormatBool(batch)
+			b.Run(name, func(b *testing.B) {
+				srv, _ := newTestServer(b, map[string]interface{}{
+					"driver":       driver,
+					"data_dir":     b.TempDir(),
+					"batch_writes": batch,
+				})
+				_, port := serve(b, srv)
+				conn, err := client.Dial("127.0.0.1:"+strconv.Itoa(port), 5*time.Second)
+				require.NoError(b, err)
+				defer conn.Close()
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i += pipeline {
+					for j := 0; j < pipeline; j++ {
+						require.NoError(b, conn.Send("SET", "key:"+strconv.Itoa(i+j), "xxx"))
+					}
+					require.NoError(b, conn.Flush())
+					for j := 0; j < pipeline; j++ {
+						_, err := conn.Receive()
+						require.NoError(b, err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tidwall/redcon"
+	"go.chensl.me/redix/server/pkg/bytesconv"
+)
+
+// The clients are given an id when they connect, by which CLIENT TRACKING
+// REDIRECT finds the client to send the invalidations to. The messages sent
+// to a client by another one, e.g. the invalidations and the messages
+// published, are queued on its Context and written once its connection is
+// woken, between the replies of its commands.
+
+type clientsState struct {
+	mu     sync.Mutex
+	lastID int64
+	byID   map[int64]*Context
+}
+
+// addClient registers c and gives it an id.
+func (s *Server) addClient(c *Context) {
+	s.clients.mu.Lock()
+	defer s.clients.mu.Unlock()
+	if s.clients.byID == nil {
+		s.clients.byID = make(map[int64]*Context)
+	}
+	s.clients.lastID++
+	c.id = s.clients.lastID
+	s.clients.byID[c.id] = c
+}
+
+// removeClient forgets c once its connection is closed.
+func (s *Server) removeClient(c *Context) {
+	s.clients.mu.Lock()
+	defer s.clients.mu.Unlock()
+	delete(s.clients.byID, c.id)
+}
+
+// client returns the client id, if it is connected.
+func (s *Server) client(id int64) *Context {
+	s.clients.mu.Lock()
+	defer s.clients.mu.Unlock()
+	return s.clients.byID[id]
+}
+
+// push queues msg to be sent to c, and wakes its connection. msg returns
+// the message in the protocol of c, or nil to send nothing.
+func (c *Context) push(msg func(resp3 bool) []byte) {
+	c.pushMu.Lock()
+	b := msg(c.resp3)
+	if len(b) == 0 {
+		c.pushMu.Unlock()
+		return
+	}
+	c.pushed = append(c.pushed, b...)
+	c.pushMu.Unlock()
+	c.conn.Wake()
+}
+
+// appendPushed appends the messages queued for c to out.
+func (c *Context) appendPushed(out []byte) []byte {
+	c.pushMu.Lock()
+	defer c.pushMu.Unlock()
+	out = append(out, c.pushed...)
+	c.pushed = c.pushed[:0]
+	return out
+}
+
+// appendPush appends the header of a push message of n elements, an array
+// in RESP2.
+func appendPush(out []byte, n int, resp3 bool) []byte {
+	if !resp3 {
+		return redcon.AppendArray(out, n)
+	}
+	return append(strconv.AppendInt(append(out, '>'), int64(n), 10), '\r', '\n')
+}
+
+// appendNull appends a null, _ in RESP3.
+func appendNull(out []byte, resp3 bool) []byte {
+	if !resp3 {
+		return redcon.AppendNull(out)
+	}
+	return append(out, "_\r\n"...)
+}
+
+// HELLO [protover]
+func (s *Server) cmdHELLO(c *Context) {
+	if len(c.Args) > 1 {
+		c.AppendError("ERR Syntax error in HELLO option '" + string(c.Args[1]) + "'")
+		return
+	}
+	resp3 := c.resp3
+	if len(c.Args) == 1 {
+		switch bytesconv.BytesToString(c.Args[0]) {
+		case "2":
+			resp3 = false
+		case "3":
+			resp3 = true
+		default:
+			c.AppendError("NOPROTO unsupported protocol version")
+			return
+		}
+	}
+	c.pushMu.Lock()
+	c.resp3 = resp3
+	c.pushMu.Unlock()
+
+	proto, mode, role := int64(2), "standalone", "master"
+	if resp3 {
+		proto = 3
+	}
+	if s.cluster != nil {
+		mode = "cluster"
+	}
+	if atomic.LoadInt32(&s.repl.replica) == 1 {
+		role = "replica"
+	}
+	if resp3 {
+		*c.out = append(*c.out, "%5\r\n"...)
+	} else {
+		c.AppendArray(10)
+	}
+	c.AppendBulk([]byte("server"))
+	c.AppendBulk([]byte("redix"))
+	c.AppendBulk([]byte("proto"))
+	c.AppendInt(proto)
+	c.AppendBulk([]byte("id"))
+	c.AppendInt(c.id)
+	c.AppendBulk([]byte("mode"))
+	c.AppendBulk([]byte(mode))
+	c.AppendBulk([]byte("role"))
+	c.AppendBulk([]byte(role))
+}
+
+// CLIENT ID|GETREDIR|TRACKING|CACHING
+func (s *Server) cmdCLIENT(c *Context) {
+	if len(c.Args) == 0 {
+		c.ErrInvalidArgs()
+		return
+	}
+
+	sub := strings.ToUpper(bytesconv.BytesToString(c.Args[0]))
+	switch sub {
+	case "ID":
+		if len(c.Args) != 1 {
+			c.ErrInvalidArgs()
+			return
+		}
+		c.AppendInt(c.id)
+	case "GETREDIR":
+		if len(c.Args) != 1 {
+			c.ErrInvalidArgs()
+			return
+		}
+		c.AppendInt(s.trackingRedirect(c))
+	case "TRACKING":
+		s.clientTracking(c)
+	case "CACHING":
+		s.clientCaching(c)
+	default:
+		c.AppendError("ERR unknown subcommand '" + string(c.Args[0]) + "'. Try CLIENT HELP.")
+	}
+}
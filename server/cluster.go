@@ -0,0 +1,543 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.chensl.me/redix/server/internal/cluster"
+	"go.chensl.me/redix/server/internal/storage"
+	"go.chensl.me/redix/server/pkg/bytesconv"
+)
+
+// In cluster mode the keys are sharded across the nodes by hash slot, as in
+// Redis Cluster. The commands on the keys of the slots served by another
+// node are redirected with a MOVED error. While a slot is migrated with
+// CLUSTER SETSLOT and MIGRATE, the keys already moved are asked to the
+// target node with an ASK error.
+//
+// The keys of every slot are indexed in memory, so that migrating a slot
+// with CLUSTER GETKEYSINSLOT doesn't scan the store for each batch of keys.
+// The index is built when the server starts and is updated with the
+// propagated writes. The keys deleted by the expiration aren't propagated,
+// they are removed from the index once found missing.
+
+func (s *Server) openCluster() error {
+	host := viper.GetString("host")
+	ip := viper.GetString("cluster.announce_ip")
+	if parsed := net.ParseIP(host); ip == "" && parsed != nil && !parsed.IsUnspecified() {
+		ip = host
+	}
+	port := viper.GetInt("port")
+	busPort := viper.GetInt("cluster.bus_port")
+	if busPort == 0 {
+		busPort = port + 10000
+	}
+	var err error
+	s.cluster, err = cluster.Open(cluster.Config{
+		File:        viper.GetString("cluster.config_file"),
+		IP:          ip,
+		Port:        port,
+		BusPort:     busPort,
+		NodeTimeout: viper.GetDuration("cluster.node_timeout"),
+	}, s.logger)
+	if err != nil {
+		return err
+	}
+
+	s.slotKeys = cluster.NewSlotKeys()
+	return s.store.ForEach(func(key, _ []byte, _ time.Time) error {
+		s.slotKeys.Add(append([]byte(nil), key...))
+		return nil
+	})
+}
+
+// indexSlots updates the index of the keys by slot with the write command
+// args, which was propagated.
+func (s *Server) indexSlots(args [][]byte) {
+	cmd := s.lookup(args[0])
+	if cmd == nil {
+		return
+	}
+	keys := cmd.keys.keys(args)
+	switch cmd.name {
+	case "FLUSHALL", "FLUSHDB":
+		s.slotKeys.Clear()
+	case "DEL", "UNLINK":
+		s.slotKeys.Remove(keys...)
+	case "RENAME", "RENAMENX":
+		s.slotKeys.Remove(keys[0])
+		s.slotKeys.Add(keys[1])
+	default:
+		s.slotKeys.Add(keys...)
+	}
+}
+
+// clusterRedirection returns the error replied instead of running the command
+// in args, or "" if the command is served by this node. asking is set
+// after ASKING.
+func (s *Server) clusterRedirection(cmd *command, args [][]byte, asking bool) string {
+	keys := cmd.keys.keys(args)
+	if len(keys) == 0 {
+		return ""
+	}
+	slot := cluster.KeySlot(keys[0])
+	for _, key := range keys[1:] {
+		if cluster.KeySlot(key) != slot {
+			return "CROSSSLOT Keys in request don't hash to the same slot"
+		}
+	}
+
+	r := s.cluster.Route(slot)
+	switch {
+	case !r.Up:
+		// Every slot must be served, as with cluster-require-full-coverage
+		// in Redis.
+		return "CLUSTERDOWN The cluster is down"
+	case r.Mine && r.Migrating != "":
+		var missing int
+		for _, key := range keys {
+			ok, err := s.exists(key)
+			if err != nil {
+				s.logUnknownError("store.TTL", err)
+				return fmt.Sprintf("ERR unknown %q", err.Error())
+			}
+			if !ok {
+				missing++
+			}
+		}
+		switch {
+		case missing == 0:
+			return ""
+		case missing < len(keys):
+			return "TRYAGAIN Multiple keys request during rehashing of slot"
+		default:
+			return "ASK " + strconv.Itoa(slot) + " " + r.Migrating
+		}
+	case r.Mine:
+		return ""
+	case r.Importing != "" && (asking || cmd.name == "RESTORE-ASKING"):
+		return ""
+	default:
+		return "MOVED " + strconv.Itoa(slot) + " " + r.Owner
+	}
+}
+
+func (s *Server) errClusterDisabled(c *Context) bool {
+	if s.cluster == nil {
+		c.AppendError("ERR This instance has cluster support disabled")
+		return true
+	}
+	return false
+}
+
+func (s *Server) cmdASKING(c *Context) {
+	if s.errClusterDisabled(c) {
+		return
+	}
+	if len(c.Args) != 0 {
+		c.ErrInvalidArgs()
+		return
+	}
+	c.asking = true
+	c.AppendOK()
+}
+
+// cmdREADONLY serves READONLY and READWRITE, which are accepted for the
+// clients of Redis Cluster: there are no replicas to read from.
+func (s *Server) cmdREADONLY(c *Context) {
+	if s.errClusterDisabled(c) {
+		return
+	}
+	if len(c.Args) != 0 {
+		c.ErrInvalidArgs()
+		return
+	}
+	c.AppendOK()
+}
+
+func (s *Server) cmdCLUSTER(c *Context) {
+	if s.errClusterDisabled(c) {
+		return
+	}
+	if len(c.Args) == 0 {
+		c.ErrInvalidArgs()
+		return
+	}
+
+	sub := strings.ToUpper(bytesconv.BytesToString(c.Args[0]))
+	args := c.Args[1:]
+	nargs := map[string]int{
+		"INFO":            0,
+		"MYID":            0,
+		"NODES":           0,
+		"SLOTS":           0,
+		"SHARDS":          0,
+		"SAVECONFIG":      0,
+		"KEYSLOT":         1,
+		"COUNTKEYSINSLOT": 1,
+		"FORGET":          1,
+		"GETKEYSINSLOT":   2,
+	}
+	if n, ok := nargs[sub]; ok && len(args) != n {
+		c.ErrInvalidArgs()
+		return
+	}
+
+	switch sub {
+	case "INFO":
+		s.clusterInfo(c)
+	case "MYID":
+		c.AppendBulk([]byte(s.cluster.MyID()))
+	case "NODES":
+		s.clusterNodes(c)
+	case "SLOTS":
+		s.clusterSlots(c)
+	case "SHARDS":
+		s.clusterShards(c)
+	case "KEYSLOT":
+		c.AppendInt(int64(cluster.KeySlot(args[0])))
+	case "COUNTKEYSINSLOT":
+		slot, ok := parseSlot(c, args[0])
+		if !ok {
+			return
+		}
+		keys, err := s.keysInSlot(slot, -1)
+		if err != nil {
+			s.logUnknownError("store.TTL", err)
+			c.ErrUnknown(err)
+			return
+		}
+		c.AppendInt(int64(len(keys)))
+	case "GETKEYSINSLOT":
+		slot, ok := parseSlot(c, args[0])
+		if !ok {
+			return
+		}
+		count, err := storage.ParseInt(args[1])
+		if err != nil || count < 0 {
+			c.AppendError("ERR Invalid number of keys")
+			return
+		}
+		keys, err := s.keysInSlot(slot, int(count))
+		if err != nil {
+			s.logUnknownError("store.TTL", err)
+			c.ErrUnknown(err)
+			return
+		}
+		c.AppendBulkArray(keys)
+	case "MEET":
+		s.clusterMeet(c, args)
+	case "ADDSLOTS", "DELSLOTS", "ADDSLOTSRANGE", "DELSLOTSRANGE":
+		s.clusterSlotsChange(c, sub, args)
+	case "SETSLOT":
+		s.clusterSetSlot(c, args)
+	case "FORGET":
+		s.clusterReply(c, s.cluster.Forget(string(args[0])))
+	case "SAVECONFIG":
+		s.clusterReply(c, s.cluster.SaveConfig())
+	default:
+		c.AppendError("ERR unknown subcommand '" + string(c.Args[0]) + "'.")
+	}
+}
+
+// clusterReply replies OK, or the error of a change of the cluster state.
+// The errors of the cluster package are replies unless they come from
+// the configuration file.
+func (s *Server) clusterReply(c *Context, err error) {
+	if err == nil {
+		c.AppendOK()
+		return
+	}
+	if msg := err.Error(); strings.HasPrefix(msg, "ERR ") {
+		c.AppendError(msg)
+		return
+	}
+	s.logUnknownError("cluster", err)
+	c.ErrUnknown(err)
+}
+
+func parseSlot(c *Context, b []byte) (int, bool) {
+	slot, err := strconv.Atoi(bytesconv.BytesToString(b))
+	if err != nil || slot < 0 || slot >= cluster.Slots {
+		c.AppendError("ERR Invalid or out of range slot")
+		return 0, false
+	}
+	return slot, true
+}
+
+func (s *Server) clusterInfo(c *Context) {
+	info := s.cluster.Info()
+	state := "fail"
+	if info.Up {
+		state = "ok"
+	}
+	// A node which doesn't answer is only suspected to fail, the nodes
+	// don't agree on failures.
+	var b strings.Builder
+	fmt.Fprintf(&b, "cluster_enabled:1\r\n")
+	fmt.Fprintf(&b, "cluster_state:%s\r\n", state)
+	fmt.Fprintf(&b, "cluster_slots_assigned:%d\r\n", info.SlotsAssigned)
+	fmt.Fprintf(&b, "cluster_slots_ok:%d\r\n", info.SlotsAssigned-info.SlotsFail)
+	fmt.Fprintf(&b, "cluster_slots_pfail:%d\r\n", info.SlotsFail)
+	fmt.Fprintf(&b, "cluster_slots_fail:0\r\n")
+	fmt.Fprintf(&b, "cluster_known_nodes:%d\r\n", info.KnownNodes)
+	fmt.Fprintf(&b, "cluster_size:%d\r\n", info.Size)
+	fmt.Fprintf(&b, "cluster_current_epoch:%d\r\n", info.CurrentEpoch)
+	fmt.Fprintf(&b, "cluster_my_epoch:%d\r\n", info.MyEpoch)
+	c.AppendBulk([]byte(b.String()))
+}
+
+// clusterNodes replies the nodes in the format of Redis Cluster: id
+// ip:port@cport flags master ping-sent pong-recv config-epoch link-state
+// slots...
+func (s *Server) clusterNodes(c *Context) {
+	var b strings.Builder
+	for _, n := range s.cluster.Nodes() {
+		flags := "master"
+		if n.Myself {
+			flags = "myself,master"
+		}
+		if n.Fail {
+			flags += ",fail?"
+		}
+		var pong int64
+		if !n.Myself {
+			pong = n.PongReceived.UnixMilli()
+		}
+		link := "connected"
+		if !n.Connected {
+			link = "disconnected"
+		}
+		fmt.Fprintf(&b, "%s %s:%d@%d %s - 0 %d %d %s", n.ID, n.IP, n.Port, n.BusPort, flags, pong, n.Epoch, link)
+		for _, r := range n.Slots {
+			b.WriteString(" " + r.String())
+		}
+		for _, slot := range sortedSlots(n.Migrating) {
+			fmt.Fprintf(&b, " [%d->-%s]", slot, n.Migrating[slot])
+		}
+		for _, slot := range sortedSlots(n.Importing) {
+			fmt.Fprintf(&b, " [%d-<-%s]", slot, n.Importing[slot])
+		}
+		b.WriteString("\n")
+	}
+	c.AppendBulk([]byte(b.String()))
+}
+
+func sortedSlots(m map[int]string) []int {
+	var slots []int
+	for slot := 0; slot < cluster.Slots && len(slots) < len(m); slot++ {
+		if _, ok := m[slot]; ok {
+			slots = append(slots, slot)
+		}
+	}
+	return slots
+}
+
+// clusterSlots replies the ranges of slots with their node, sorted by
+// slot.
+func (s *Server) clusterSlots(c *Context) {
+	type entry struct {
+		r cluster.Range
+		n cluster.Node
+	}
+	var entries []entry
+	for _, n := range s.cluster.Nodes() {
+		for _, r := range n.Slots {
+			entries = append(entries, entry{r, n})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].r.Start < entries[j].r.Start })
+
+	c.AppendArray(len(entries))
+	for _, e := range entries {
+		c.AppendArray(3)
+		c.AppendInt(int64(e.r.Start))
+		c.AppendInt(int64(e.r.End))
+		c.AppendArray(3)
+		c.AppendBulk([]byte(e.n.IP))
+		c.AppendInt(int64(e.n.Port))
+		c.AppendBulk([]byte(e.n.ID))
+	}
+}
+
+// clusterShards replies a shard per node, every node being a master
+// without replicas.
+func (s *Server) clusterShards(c *Context) {
+	nodes := s.cluster.Nodes()
+	c.AppendArray(len(nodes))
+	for _, n := range nodes {
+		c.AppendArray(4)
+		c.AppendBulk([]byte("slots"))
+		c.AppendArray(2 * len(n.Slots))
+		for _, r := range n.Slots {
+			c.AppendInt(int64(r.Start))
+			c.AppendInt(int64(r.End))
+		}
+		c.AppendBulk([]byte("nodes"))
+		c.AppendArray(1)
+		health := "online"
+		if n.Fail {
+			health = "fail"
+		}
+		c.AppendArray(14)
+		for _, kv := range []struct {
+			k string
+			v interface{}
+		}{
+			{"id", n.ID},
+			{"port", n.Port},
+			{"ip", n.IP},
+			{"endpoint", n.IP},
+			{"role", "master"},
+			{"replication-offset", 0},
+			{"health", health},
+		} {
+			c.AppendBulk([]byte(kv.k))
+			switch v := kv.v.(type) {
+			case int:
+				c.AppendInt(int64(v))
+			case string:
+				c.AppendBulk([]byte(v))
+			}
+		}
+	}
+}
+
+// keysInSlot returns up to count keys of slot, all of them if count is
+// negative. The keys of the index found expired are removed from it.
+func (s *Server) keysInSlot(slot, count int) ([][]byte, error) {
+	var keys [][]byte
+	for _, key := range s.slotKeys.Keys(slot) {
+		if len(keys) == count {
+			break
+		}
+		ok, err := s.exists(key)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			s.slotKeys.Remove(key)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// CLUSTER MEET ip port [cport]
+func (s *Server) clusterMeet(c *Context, args [][]byte) {
+	if len(args) != 2 && len(args) != 3 {
+		c.ErrInvalidArgs()
+		return
+	}
+	port, err := strconv.Atoi(string(args[1]))
+	if err != nil || port <= 0 || port > 65535 {
+		c.AppendError("ERR Invalid TCP base port specified: " + string(args[1]))
+		return
+	}
+	busPort := port + 10000
+	if len(args) == 3 {
+		busPort, err = strconv.Atoi(string(args[2]))
+		if err != nil || busPort <= 0 || busPort > 65535 {
+			c.AppendError("ERR Invalid TCP bus port specified: " + string(args[2]))
+			return
+		}
+	}
+	s.clusterReply(c, s.cluster.Meet(string(args[0]), port, busPort))
+}
+
+// CLUSTER ADDSLOTS|DELSLOTS slot [slot ...]
+// CLUSTER ADDSLOTSRANGE|DELSLOTSRANGE start end [start end ...]
+func (s *Server) clusterSlotsChange(c *Context, sub string, args [][]byte) {
+	ranged := strings.HasSuffix(sub, "RANGE")
+	if len(args) == 0 || (ranged && len(args)%2 != 0) {
+		c.ErrInvalidArgs()
+		return
+	}
+
+	var slots []int
+	seen := make(map[int]bool)
+	add := func(slot int) bool {
+		if seen[slot] {
+			c.AppendError(fmt.Sprintf("ERR Slot %d specified multiple times", slot))
+			return false
+		}
+		seen[slot] = true
+		slots = append(slots, slot)
+		return true
+	}
+	for i := 0; i < len(args); i++ {
+		start, ok := parseSlot(c, args[i])
+		if !ok {
+			return
+		}
+		end := start
+		if ranged {
+			i++
+			if end, ok = parseSlot(c, args[i]); !ok {
+				return
+			}
+			if start > end {
+				c.AppendError(fmt.Sprintf("ERR start slot number %d is greater than end slot number %d", start, end))
+				return
+			}
+		}
+		for slot := start; slot <= end; slot++ {
+			if !add(slot) {
+				return
+			}
+		}
+	}
+
+	if strings.HasPrefix(sub, "ADD") {
+		s.clusterReply(c, s.cluster.AddSlots(slots))
+	} else {
+		s.clusterReply(c, s.cluster.DelSlots(slots))
+	}
+}
+
+// CLUSTER SETSLOT slot IMPORTING|MIGRATING|NODE node-id | STABLE
+func (s *Server) clusterSetSlot(c *Context, args [][]byte) {
+	if len(args) < 2 {
+		c.ErrInvalidArgs()
+		return
+	}
+	slot, ok := parseSlot(c, args[0])
+	if !ok {
+		return
+	}
+	state := strings.ToUpper(string(args[1]))
+	var id string
+	switch {
+	case state == cluster.SlotStable && len(args) == 2:
+	case state != cluster.SlotStable && len(args) == 3:
+		id = string(args[2])
+	default:
+		c.AppendError("ERR Invalid CLUSTER SETSLOT action or number of arguments")
+		return
+	}
+
+	if state == cluster.SlotNode && id != s.cluster.MyID() {
+		// The keys would be lost for the clients.
+		keys, err := s.keysInSlot(slot, 1)
+		if err != nil {
+			s.logUnknownError("store.ForEach", err)
+			c.ErrUnknown(err)
+			return
+		}
+		if len(keys) > 0 && s.cluster.Route(slot).Mine {
+			c.AppendError(fmt.Sprintf("ERR Can't assign hashslot %d to a different node while I still hold keys for this hash slot.", slot))
+			return
+		}
+	}
+	s.clusterReply(c, s.cluster.SetSlot(slot, state, id))
+}
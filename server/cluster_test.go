@@ -0,0 +1,203 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.chensl.me/redix/server/internal/client"
+)
+
+func TestKeySpec(t *testing.T) {
+	srv, _ := newTestServer(t, nil)
+	defer srv.Cleanup()
+	keys := func(args [][]byte) [][]byte {
+		return srv.lookup(args[0]).keys.keys(args)
+	}
+	args := func(ss ...string) [][]byte {
+		var bs [][]byte
+		for _, s := range ss {
+			bs = append(bs, []byte(s))
+		}
+		return bs
+	}
+
+	assert.Equal(t, args("k"), keys(args("SET", "k", "v", "EX", "10")))
+	assert.Equal(t, args("a", "b"), keys(args("RENAME", "a", "b")))
+	assert.Equal(t, args("a", "b", "c"), keys(args("DEL", "a", "b", "c")))
+	assert.Equal(t, args("a", "b"), keys(args("MSET", "a", "1", "b", "2")))
+	assert.Empty(t, keys(args("GET")))
+	assert.Empty(t, keys(args("KEYS", "*")))
+}
+
+func TestClusterDisabled(t *testing.T) {
+	srv, c := newTestServer(t, nil)
+	defer srv.Cleanup()
+
+	for _, cmd := range []string{"CLUSTER", "ASKING", "READONLY"} {
+		assert.Equal(t, "-ERR This instance has cluster support disabled\r\n", c.do(cmd))
+	}
+}
+
+type clusterNode struct {
+	conn *client.Conn
+	addr string
+	id   string
+	bus  int
+}
+
+// startClusterNode runs a cluster node on free ports until the end of the
+// test.
+func startClusterNode(t *testing.T) *clusterNode {
+	port := freePort(t)
+	bus := freePort(t)
+	srv, _ := newTestServer(t, map[string]interface{}{
+		"host":                 "127.0.0.1",
+		"port":                 port,
+		"cluster.enabled":      true,
+		"cluster.config_file":  filepath.Join(t.TempDir(), "nodes.json"),
+		"cluster.bus_port":     bus,
+		"cluster.node_timeout": time.Second,
+	})
+	n := &clusterNode{
+		conn: serveAt(t, srv, port),
+		addr: "127.0.0.1:" + strconv.Itoa(port),
+		bus:  bus,
+	}
+	n.id = string(do(t, n.conn, "CLUSTER", "MYID").([]byte))
+	return n
+}
+
+// clusterInfo returns the fields of CLUSTER INFO.
+func clusterInfo(t *testing.T, c *client.Conn) map[string]string {
+	info := map[string]string{}
+	for _, line := range strings.Split(string(do(t, c, "CLUSTER", "INFO").([]byte)), "\r\n") {
+		if kv := strings.SplitN(line, ":", 2); len(kv) == 2 {
+			info[kv[0]] = kv[1]
+		}
+	}
+	return info
+}
+
+func errString(v interface{}) string {
+	if err, ok := v.(client.Error); ok {
+		return string(err)
+	}
+	return ""
+}
+
+func TestCluster(t *testing.T) {
+	n1 := startClusterNode(t)
+	n2 := startClusterNode(t)
+
+	assert.Equal(t, "fail", clusterInfo(t, n1.conn)["cluster_state"])
+	assert.Equal(t, "CLUSTERDOWN The cluster is down", errString(do(t, n1.conn, "GET", "foo")))
+	assert.Equal(t, "OK", do(t, n1.conn, "CLUSTER", "ADDSLOTSRANGE", "0", "8191"))
+	assert.Equal(t, "OK", do(t, n2.conn, "CLUSTER", "ADDSLOTSRANGE", "8192", "16383"))
+	assert.Equal(t, "ERR Slot 0 is already busy", errString(do(t, n1.conn, "CLUSTER", "ADDSLOTS", "0")))
+	assert.Equal(t, "ERR Invalid or out of range slot", errString(do(t, n1.conn, "CLUSTER", "ADDSLOTS", "16384")))
+	assert.Equal(t, "OK", do(t, n1.conn, "CLUSTER", "MEET", "127.0.0.1", strconv.Itoa(n2.port()), strconv.Itoa(n2.bus)))
+	for _, n := range []*clusterNode{n1, n2} {
+		c := n.conn
+		require.Eventually(t, func() bool {
+			info := clusterInfo(t, c)
+			return info["cluster_state"] == "ok" && info["cluster_known_nodes"] == "2"
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	// foo is in slot 12182, bar in slot 5061.
+	assert.Equal(t, int64(12182), do(t, n1.conn, "CLUSTER", "KEYSLOT", "foo"))
+	assert.Equal(t, "MOVED 12182 "+n2.addr, errString(do(t, n1.conn, "SET", "foo", "bar")))
+	assert.Equal(t, "MOVED 5061 "+n1.addr, errString(do(t, n2.conn, "GET", "bar")))
+	assert.Equal(t, "OK", do(t, n2.conn, "SET", "foo", "bar"))
+	assert.Equal(t, "CROSSSLOT Keys in request don't hash to the same slot",
+		errString(do(t, n2.conn, "MSET", "foo", "1", "bar", "2")))
+	assert.Equal(t, "OK", do(t, n2.conn, "SET", "{foo}x", "1"))
+	assert.Equal(t, int64(2), do(t, n2.conn, "EXISTS", "foo", "{foo}x"))
+	assert.Equal(t, int64(2), do(t, n2.conn, "CLUSTER", "COUNTKEYSINSLOT", "12182"))
+	assert.Len(t, do(t, n2.conn, "CLUSTER", "GETKEYSINSLOT", "12182", "1"), 1)
+	// The index of the keys by slot follows the renames and the expiration.
+	assert.Equal(t, "OK", do(t, n2.conn, "SET", "{foo}y", "1", "PX", "1"))
+	assert.Equal(t, "OK", do(t, n2.conn, "RENAME", "{foo}x", "{foo}z"))
+	time.Sleep(10 * time.Millisecond)
+	assert.ElementsMatch(t, []interface{}{[]byte("foo"), []byte("{foo}z")},
+		do(t, n2.conn, "CLUSTER", "GETKEYSINSLOT", "12182", "10"))
+	assert.Equal(t, "OK", do(t, n2.conn, "RENAME", "{foo}z", "{foo}x"))
+	assert.Equal(t, int64(2), do(t, n2.conn, "CLUSTER", "COUNTKEYSINSLOT", "12182"))
+
+	slots := do(t, n1.conn, "CLUSTER", "SLOTS").([]interface{})
+	require.Len(t, slots, 2)
+	assert.Equal(t, []interface{}{int64(8192), int64(16383),
+		[]interface{}{[]byte("127.0.0.1"), int64(n2.port()), []byte(n2.id)}}, slots[1])
+	nodes := string(do(t, n2.conn, "CLUSTER", "NODES").([]byte))
+	assert.Contains(t, nodes, n2.id+" "+n2.addr+"@"+strconv.Itoa(n2.bus)+" myself,master - 0 0 ")
+	assert.Contains(t, nodes, " connected 0-8191\n")
+	assert.Len(t, do(t, n1.conn, "CLUSTER", "SHARDS"), 2)
+
+	// Slot 12182 is migrated from n2 to n1.
+	assert.Equal(t, "OK", do(t, n1.conn, "CLUSTER", "SETSLOT", "12182", "IMPORTING", n2.id))
+	assert.Equal(t, "OK", do(t, n2.conn, "CLUSTER", "SETSLOT", "12182", "MIGRATING", n1.id))
+	assert.Contains(t, string(do(t, n2.conn, "CLUSTER", "NODES").([]byte)), " [12182->-"+n1.id+"]")
+	assert.Equal(t, "ASK 12182 "+n1.addr, errString(do(t, n2.conn, "GET", "{foo}y")))
+	assert.Equal(t, "MOVED 12182 "+n2.addr, errString(do(t, n1.conn, "GET", "{foo}y")))
+	assert.Equal(t, "OK", do(t, n1.conn, "ASKING"))
+	assert.Nil(t, do(t, n1.conn, "GET", "{foo}y"))
+	assert.Equal(t, "MOVED 12182 "+n2.addr, errString(do(t, n1.conn, "GET", "{foo}y")))
+	assert.Equal(t, "ERR Can't assign hashslot 12182 to a different node while I still hold keys for this hash slot.",
+		errString(do(t, n2.conn, "CLUSTER", "SETSLOT", "12182", "NODE", n1.id)))
+
+	port1 := strconv.Itoa(n1.port())
+	assert.Equal(t, "OK", do(t, n2.conn, "MIGRATE", "127.0.0.1", port1, "foo", "0", "5000"))
+	assert.Equal(t, "ASK 12182 "+n1.addr, errString(do(t, n2.conn, "GET", "foo")))
+	assert.Equal(t, "TRYAGAIN Multiple keys request during rehashing of slot",
+		errString(do(t, n2.conn, "MGET", "foo", "{foo}x")))
+	assert.Equal(t, "1", string(do(t, n2.conn, "GET", "{foo}x").([]byte)))
+	assert.Equal(t, "OK", do(t, n2.conn, "MIGRATE", "127.0.0.1", port1, "", "0", "5000", "KEYS", "{foo}x"))
+
+	assert.Equal(t, "OK", do(t, n1.conn, "CLUSTER", "SETSLOT", "12182", "NODE", n1.id))
+	assert.Equal(t, "OK", do(t, n2.conn, "CLUSTER", "SETSLOT", "12182", "NODE", n1.id))
+	assert.Equal(t, "MOVED 12182 "+n1.addr, errString(do(t, n2.conn, "GET", "foo")))
+	assert.Equal(t, "bar", string(do(t, n1.conn, "GET", "foo").([]byte)))
+	assert.Equal(t, "1", string(do(t, n1.conn, "GET", "{foo}x").([]byte)))
+	for _, n := range []*clusterNode{n1, n2} {
+		c := n.conn
+		require.Eventually(t, func() bool {
+			return len(do(t, c, "CLUSTER", "SLOTS").([]interface{})) == 4
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+}
+
+func TestClusterKeysInSlotReopen(t *testing.T) {
+	cfg := map[string]interface{}{
+		"driver":              "boltdb",
+		"data_dir":            t.TempDir(),
+		"cluster.enabled":     true,
+		"cluster.config_file": filepath.Join(t.TempDir(), "nodes.json"),
+		"cluster.bus_port":    freePort(t),
+	}
+	srv, c := newTestServer(t, cfg)
+	assert.Equal(t, "+OK\r\n", c.do("CLUSTER", "ADDSLOTSRANGE", "0", "16383"))
+	assert.Equal(t, "+OK\r\n", c.do("MSET", "foo", "1", "{foo}x", "2"))
+	assert.Equal(t, "+OK\r\n", c.do("SET", "bar", "3"))
+	assert.NoError(t, srv.Cleanup())
+
+	// The index is rebuilt from the store.
+	srv, c = newTestServer(t, cfg)
+	defer srv.Cleanup()
+	assert.Equal(t, ":2\r\n", c.do("CLUSTER", "COUNTKEYSINSLOT", "12182"))
+	assert.Equal(t, "*1\r\n$3\r\nbar\r\n", c.do("CLUSTER", "GETKEYSINSLOT", "5061", "10"))
+	assert.Equal(t, ":0\r\n", c.do("CLUSTER", "COUNTKEYSINSLOT", "0"))
+}
+
+func (n *clusterNode) port() int {
+	port, _ := strconv.Atoi(strings.Split(n.addr, ":")[1])
+	return port
+}
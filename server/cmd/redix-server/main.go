@@ -8,6 +8,8 @@ import (
 	_ "embed"
 	"fmt"
 	"log"
+	"os"
+	"path/filepath"
 
 	_ "go.chensl.me/gogctuner"
 	"go.chensl.me/redix/server"
@@ -20,15 +22,42 @@ var banner string
 
 var commit string
 
+var subcommands = map[string]func(args []string) error{
+	"import-rdb": importRDB,
+	"export-rdb": exportRDB,
+	"migrate":    migrateData,
+	"sentinel":   runSentinel,
+}
+
 func main() {
 	fmt.Printf("%s  commit=%s\n\n", banner, commit)
 	config.MustInit()
+	if filepath.Base(os.Args[0]) == "redix-sentinel" {
+		if err := runSentinel(os.Args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 {
+		fn, ok := subcommands[os.Args[1]]
+		if !ok {
+			log.Fatalf("unknown command %q", os.Args[1])
+		}
+		if err := fn(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	srv, err := server.New()
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer srv.Cleanup() //nolint:errcheck
-	if err := srv.Run(); err != nil {
+	// Run returns once the server is shut down, by SHUTDOWN or a signal.
+	err = srv.Run()
+	if cerr := srv.Cleanup(); cerr != nil {
+		log.Printf("failed to clean up: %v", cerr)
+	}
+	if err != nil {
 		log.Fatal(err)
 	}
 }
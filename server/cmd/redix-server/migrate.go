@@ -0,0 +1,113 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.chensl.me/redix/server"
+	"go.chensl.me/redix/server/internal/migrate"
+	"go.uber.org/zap"
+)
+
+// migrateData copies every key from a storage to another one, the server
+// must not be running on either of them:
+//
+//	redix-server migrate --from bitcask:./data --to badger:./data2
+//
+// A storage is given as DRIVER:DIR, where DIR is the data directory of the
+// driver. The drivers which don't store files, e.g. mysql, take their
+// options from the configuration and the directory can be omitted. An
+// interrupted migration is continued with --resume.
+func migrateData(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	from := fs.String("from", "", "source storage, as DRIVER:DIR")
+	to := fs.String("to", "", "destination storage, as DRIVER:DIR")
+	resume := fs.Bool("resume", false, "continue an interrupted migration into a non-empty destination")
+	verify := fs.Bool("verify", true, "compare the checksums of both storages once done")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *from == "" || *to == "" || fs.NArg() > 0 {
+		return errors.New("usage: redix-server migrate --from DRIVER:DIR --to DRIVER:DIR [--resume] [--verify=false]")
+	}
+
+	srcDriver, srcDir, err := parseStorage(*from)
+	if err != nil {
+		return err
+	}
+	dstDriver, dstDir, err := parseStorage(*to)
+	if err != nil {
+		return err
+	}
+	if srcDriver == dstDriver && srcDir == dstDir {
+		return errors.New("migrate: source and destination are the same storage")
+	}
+
+	logger, err := zap.NewProduction()
+	if err != nil {
+		return err
+	}
+	src, err := server.OpenStorage(srcDriver, srcDir, logger)
+	if err != nil {
+		return fmt.Errorf("migrate: open %s: %w", *from, err)
+	}
+	defer src.Close() //nolint:errcheck
+	dst, err := server.OpenStorage(dstDriver, dstDir, logger)
+	if err != nil {
+		return fmt.Errorf("migrate: open %s: %w", *to, err)
+	}
+	defer dst.Close() //nolint:errcheck
+
+	start := time.Now()
+	stats, err := migrate.Copy(src, dst, migrate.Options{
+		Resume: *resume,
+		Progress: func(s migrate.Stats) {
+			log.Printf("migrated %d/%d keys (copied %d, skipped %d, expired %d)",
+				s.Done(), s.Total, s.Copied, s.Skipped, s.Expired)
+		},
+		ProgressInterval: 5 * time.Second,
+	})
+	if errors.Is(err, migrate.ErrNotEmpty) {
+		return fmt.Errorf("%w, use --resume to continue an interrupted migration", err)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("copied %d keys in %v", stats.Copied, time.Since(start).Round(time.Millisecond))
+
+	if *verify {
+		sum, err := migrate.Verify(src, dst)
+		if err != nil {
+			return err
+		}
+		log.Printf("verified checksum: %v", sum)
+	}
+	return nil
+}
+
+// parseStorage splits DRIVER:DIR, the directory is made absolute so that
+// both storages can be compared.
+func parseStorage(s string) (driver, dir string, err error) {
+	driver, dir = s, ""
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		driver, dir = s[:i], s[i+1:]
+	}
+	if driver == "" {
+		return "", "", fmt.Errorf("migrate: missing driver in %q", s)
+	}
+	if dir != "" {
+		if dir, err = filepath.Abs(dir); err != nil {
+			return "", "", err
+		}
+	}
+	return driver, dir, nil
+}
@@ -0,0 +1,47 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+
+	"go.chensl.me/redix/server"
+)
+
+// importRDB loads an RDB file into the configured driver:
+//
+//	redix-server import-rdb dump.rdb
+func importRDB(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: redix-server import-rdb FILE")
+	}
+	srv, err := server.New()
+	if err != nil {
+		return err
+	}
+	if err := srv.LoadRDB(args[0]); err != nil {
+		_ = srv.Cleanup()
+		return err
+	}
+	return srv.Cleanup()
+}
+
+// exportRDB writes the data of the configured driver to an RDB file:
+//
+//	redix-server export-rdb dump.rdb
+func exportRDB(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: redix-server export-rdb FILE")
+	}
+	srv, err := server.New()
+	if err != nil {
+		return err
+	}
+	if err := srv.SaveRDB(args[0]); err != nil {
+		_ = srv.Cleanup()
+		return err
+	}
+	return srv.Cleanup()
+}
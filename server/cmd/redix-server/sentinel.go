@@ -0,0 +1,62 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/spf13/viper"
+	"go.chensl.me/redix/server/internal/sentinel"
+	"go.uber.org/zap"
+)
+
+// runSentinel runs a sentinel instead of a server, with the sentinel.*
+// configuration:
+//
+//	redix-server sentinel
+//
+// The binary behaves the same when it is named redix-sentinel, e.g. through
+// a symbolic link.
+func runSentinel(args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: redix-server sentinel")
+	}
+	masters, err := sentinel.ParseMasters(viper.GetString("sentinel.monitor"))
+	if err != nil {
+		return err
+	}
+	var peers []string
+	for _, peer := range strings.Split(viper.GetString("sentinel.peers"), ",") {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			peers = append(peers, peer)
+		}
+	}
+
+	logger, err := zap.NewProduction()
+	if err != nil {
+		return err
+	}
+	s, err := sentinel.New(sentinel.Config{
+		File:            viper.GetString("sentinel.config_file"),
+		Masters:         masters,
+		Peers:           peers,
+		DownAfter:       viper.GetDuration("sentinel.down_after"),
+		FailoverTimeout: viper.GetDuration("sentinel.failover_timeout"),
+		AuthPass:        viper.GetString("sentinel.auth_pass"),
+	}, logger)
+	if err != nil {
+		return err
+	}
+	defer s.Close() //nolint:errcheck
+
+	ln, err := net.Listen("tcp", net.JoinHostPort(viper.GetString("host"), viper.GetString("sentinel.port")))
+	if err != nil {
+		return err
+	}
+	logger.Info("redix sentinel started", zap.String("addr", ln.Addr().String()))
+	return s.Serve(ln)
+}
@@ -0,0 +1,91 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"strings"
+
+	"go.chensl.me/redix/server/pkg/bytesconv"
+)
+
+// The commands are registered in initCommands along with their flags and
+// the positions of their keys, from which the replication, the cluster,
+// the batches, the eviction, the offloading and the tracking decide how to
+// run them.
+
+// commandFlags describe what a command does.
+type commandFlags uint16
+
+const (
+	// flagWrite commands modify the store. They are rejected on read-only
+	// replicas and proposed to Raft.
+	flagWrite commandFlags = 1 << iota
+	// flagRead commands only read the store.
+	flagRead
+	// flagGrow write commands may grow the store, keys are evicted before
+	// they run.
+	flagGrow
+	// flagBatch write commands only use the operations of storage.Batch.
+	flagBatch
+	// flagSlow commands scan the store, or wait for the disk or the
+	// network.
+	flagSlow
+	// flagSnapshot commands copy the store, the write commands don't run
+	// meanwhile.
+	flagSnapshot
+	// flagPubSub commands can be run by a RESP2 client once subscribed to
+	// a channel, as PING and QUIT.
+	flagPubSub
+)
+
+// command is a command of the table.
+type command struct {
+	// name is in upper case.
+	name  string
+	fn    CommandFunc
+	flags commandFlags
+	keys  keySpec
+}
+
+// keySpec gives the positions of the keys in the arguments of a command,
+// the name of the command being the argument 0. A negative last counts
+// from the end. The zero value is for the commands without keys.
+type keySpec struct {
+	first, last, step int
+}
+
+// noKeys is the keySpec of the commands without keys.
+var noKeys = keySpec{}
+
+// keys returns the keys in args, the command included.
+func (spec keySpec) keys(args [][]byte) [][]byte {
+	if spec.first == 0 {
+		return nil
+	}
+	last := spec.last
+	if last < 0 {
+		last += len(args)
+	}
+	var keys [][]byte
+	for i := spec.first; i <= last && i < len(args); i += spec.step {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
+
+// is reports whether cmd has one of flags. A nil cmd has none.
+func (cmd *command) is(flags commandFlags) bool {
+	return cmd != nil && cmd.flags&flags != 0
+}
+
+func (s *Server) register(name string, fn CommandFunc, flags commandFlags, keys keySpec) {
+	name = strings.ToUpper(name)
+	s.commands[name] = &command{name: name, fn: fn, flags: flags, keys: keys}
+}
+
+// lookup returns the command named name, in any case, or nil.
+func (s *Server) lookup(name []byte) *command {
+	return s.commands[strings.ToUpper(bytesconv.BytesToString(name))]
+}
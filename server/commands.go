@@ -5,6 +5,8 @@
 package server
 
 import (
+	"bytes"
+	"math"
 	"strconv"
 	"strings"
 	"time"
@@ -16,23 +18,67 @@ import (
 )
 
 func (s *Server) initCommands() {
-	s.register("keys", s.cmdKEYS)
-	s.register("ttl", s.cmdTTL)
-	s.register("expire", s.cmdEXPIRE)
-	s.register("del", s.cmdDEL)
-	s.register("flushall", s.cmdFLUSHALL)
-	s.register("flushdb", s.cmdFLUSHALL)
-
-	s.register("set", s.cmdSET)
-	s.register("setex", s.cmdSETEX)
-	s.register("setnx", s.cmdSETNX)
-	s.register("get", s.cmdGET)
-	s.register("incr", s.cmdAdd(1))
-	s.register("decr", s.cmdAdd(-1))
-	s.register("incrby", s.cmdAddBy(true))
-	s.register("decrby", s.cmdAddBy(false))
-	s.register("mget", s.cmdMGET)
-	s.register("mset", s.cmdMSET)
+	var (
+		key     = keySpec{1, 1, 1}
+		twoKeys = keySpec{1, 2, 1}
+		allKeys = keySpec{1, -1, 1}
+	)
+	s.register("keys", s.cmdKEYS, flagRead|flagSlow, noKeys)
+	s.register("ttl", s.cmdTTL, flagRead, key)
+	s.register("expire", s.cmdEXPIRE, flagWrite, key)
+	s.register("pexpireat", s.cmdPEXPIREAT, flagWrite, key)
+	s.register("del", s.cmdDEL, flagWrite|flagBatch, allKeys)
+	s.register("unlink", s.cmdDEL, flagWrite|flagBatch, allKeys)
+	s.register("exists", s.cmdEXISTS, flagRead, allKeys)
+	s.register("touch", s.cmdEXISTS, flagRead, allKeys)
+	s.register("type", s.cmdTYPE, flagRead, key)
+	s.register("rename", s.cmdRENAME, flagWrite, twoKeys)
+	s.register("renamenx", s.cmdRENAMENX, flagWrite, twoKeys)
+	s.register("copy", s.cmdCOPY, flagWrite|flagGrow, twoKeys)
+	s.register("randomkey", s.cmdRANDOMKEY, flagRead, noKeys)
+	s.register("dbsize", s.cmdDBSIZE, flagRead|flagSlow, noKeys)
+	s.register("dump", s.cmdDUMP, flagRead, key)
+	s.register("restore", s.cmdRESTORE, flagWrite|flagGrow, key)
+	s.register("restore-asking", s.cmdRESTORE, flagWrite|flagGrow, key)
+	s.register("migrate", s.cmdMIGRATE, flagWrite|flagSlow, noKeys)
+	s.register("save", s.cmdSAVE, flagSlow, noKeys)
+	s.register("bgsave", s.cmdBGSAVE, 0, noKeys)
+	s.register("lastsave", s.cmdLASTSAVE, 0, noKeys)
+	s.register("backup", s.cmdBACKUP, flagSlow, noKeys)
+	s.register("bgrewriteaof", s.cmdBGREWRITEAOF, flagSnapshot|flagSlow, noKeys)
+	s.register("flushall", s.cmdFLUSHALL, flagWrite|flagSlow, noKeys)
+	s.register("flushdb", s.cmdFLUSHALL, flagWrite|flagSlow, noKeys)
+	s.register("replicaof", s.cmdREPLICAOF, 0, noKeys)
+	s.register("slaveof", s.cmdREPLICAOF, 0, noKeys)
+	s.register("replconf", s.cmdREPLCONF, 0, noKeys)
+	s.register("psync", s.cmdPSYNC, flagSnapshot, noKeys)
+	s.register("role", s.cmdROLE, 0, noKeys)
+	s.register("wait", s.cmdWAIT, 0, noKeys)
+	s.register("raft.node", s.cmdRAFTNODE, 0, noKeys)
+	s.register("raft.info", s.cmdRAFTINFO, 0, noKeys)
+	s.register("cluster", s.cmdCLUSTER, 0, noKeys)
+	s.register("asking", s.cmdASKING, 0, noKeys)
+	s.register("readonly", s.cmdREADONLY, 0, noKeys)
+	s.register("readwrite", s.cmdREADONLY, 0, noKeys)
+	s.register("shutdown", s.cmdSHUTDOWN, 0, noKeys)
+	s.register("info", s.cmdINFO, flagSlow, noKeys)
+	s.register("hello", s.cmdHELLO, 0, noKeys)
+	s.register("client", s.cmdCLIENT, 0, noKeys)
+	s.register("subscribe", s.cmdSUBSCRIBE, flagPubSub, noKeys)
+	s.register("unsubscribe", s.cmdUNSUBSCRIBE, flagPubSub, noKeys)
+	s.register("publish", s.cmdPUBLISH, 0, noKeys)
+
+	s.register("set", s.cmdSET, flagWrite|flagGrow|flagBatch, key)
+	s.register("setex", s.cmdSETEX, flagWrite|flagGrow|flagBatch, key)
+	s.register("setnx", s.cmdSETNX, flagWrite|flagGrow|flagBatch, key)
+	s.register("get", s.cmdGET, flagRead, key)
+	s.register("incr", s.cmdAdd(1), flagWrite|flagGrow|flagBatch, key)
+	s.register("decr", s.cmdAdd(-1), flagWrite|flagGrow|flagBatch, key)
+	s.register("incrby", s.cmdAddBy(true), flagWrite|flagGrow|flagBatch, key)
+	s.register("decrby", s.cmdAddBy(false), flagWrite|flagGrow|flagBatch, key)
+	s.register("incrbyfloat", s.cmdINCRBYFLOAT, flagWrite|flagGrow|flagBatch, key)
+	s.register("mget", s.cmdMGET, flagRead, allKeys)
+	s.register("mset", s.cmdMSET, flagWrite|flagGrow|flagBatch, keySpec{1, -1, 2})
 }
 
 func (s *Server) cmdSET(c *Context) {
@@ -42,30 +88,24 @@ func (s *Server) cmdSET(c *Context) {
 	}
 
 	var (
-		key    = c.Args[0]
-		val    = c.Args[1]
-		nx     bool
-		xx     bool
-		ttlSet bool
-		ttl    time.Duration
+		key     = c.Args[0]
+		val     = c.Args[1]
+		nx      bool
+		xx      bool
+		keepTTL bool
+		ttlSet  bool
+		ttl     time.Duration
 	)
 	args := c.Args[2:]
 	for len(args) > 0 {
-		timeUnit := time.Second
-		switch strings.ToUpper(bytesconv.BytesToString(args[0])) {
-		case "PX":
-			timeUnit = time.Microsecond
-			fallthrough
-		case "EX":
-			if len(args) < 2 {
+		opt := strings.ToUpper(bytesconv.BytesToString(args[0]))
+		switch opt {
+		case "EX", "PX", "EXAT", "PXAT":
+			if len(args) < 2 || ttlSet || keepTTL {
 				c.ErrSyntax()
 				return
 			}
-			if ttlSet {
-				c.ErrSyntax()
-				return
-			}
-			exp, err := strconv.Atoi(bytesconv.BytesToString(args[1]))
+			exp, err := storage.ParseInt(args[1])
 			if err != nil {
 				c.ErrInvalidInt()
 				return
@@ -74,9 +114,25 @@ func (s *Server) cmdSET(c *Context) {
 				c.ErrInvalidExp()
 				return
 			}
-			ttl = time.Duration(exp) * timeUnit
+			switch opt {
+			case "EX":
+				ttl = time.Duration(exp) * time.Second
+			case "PX":
+				ttl = time.Duration(exp) * time.Millisecond
+			case "EXAT":
+				ttl = time.Until(time.Unix(exp, 0))
+			case "PXAT":
+				ttl = time.Until(time.UnixMilli(exp))
+			}
 			ttlSet = true
 			args = args[2:]
+		case "KEEPTTL":
+			if ttlSet {
+				c.ErrSyntax()
+				return
+			}
+			keepTTL = true
+			args = args[1:]
 		case "NX":
 			nx = true
 			args = args[1:]
@@ -94,10 +150,18 @@ func (s *Server) cmdSET(c *Context) {
 		return
 	}
 
-	err := s.store.Set(key, val, storage.SetOptions{
-		TTL: ttl,
-		NX:  nx,
-		XX:  xx,
+	if ttlSet && ttl <= 0 {
+		// An absolute time in the past: the key is set and expires right
+		// away.
+		s.setExpired(c, key, nx, xx)
+		return
+	}
+
+	err := s.storeOf(c).Set(key, val, storage.SetOptions{
+		TTL:     ttl,
+		NX:      nx,
+		XX:      xx,
+		KeepTTL: keepTTL,
 	})
 	if err == storage.ErrExist || err == storage.ErrNotExist {
 		c.AppendNull()
@@ -109,6 +173,39 @@ func (s *Server) cmdSET(c *Context) {
 		return
 	}
 
+	s.touch(key)
+	switch {
+	case ttlSet:
+		s.propagateOf(c, []byte("SET"), key, val, []byte("PXAT"), pxat(ttl))
+	case keepTTL:
+		s.propagateOf(c, []byte("SET"), key, val, []byte("KEEPTTL"))
+	default:
+		s.propagateOf(c, []byte("SET"), key, val)
+	}
+	c.AppendOK()
+}
+
+func (s *Server) setExpired(c *Context, key []byte, nx, xx bool) {
+	ttl, err := s.storeOf(c).TTL(key)
+	if err != nil {
+		s.logUnknownError("store.TTL", err)
+		c.ErrUnknown(err)
+		return
+	}
+	ok := ttl != -2
+	if (ok && nx) || (!ok && xx) {
+		c.AppendNull()
+		return
+	}
+	if ok {
+		if _, err := s.storeOf(c).Del(key); err != nil {
+			s.logUnknownError("store.Del", err)
+			c.ErrUnknown(err)
+			return
+		}
+		s.forget(key)
+		s.propagateOf(c, []byte("DEL"), key)
+	}
 	c.AppendOK()
 }
 
@@ -129,6 +226,7 @@ func (s *Server) cmdGET(c *Context) {
 		return
 	}
 
+	s.touch(c.Args[0])
 	c.AppendBulk(v)
 }
 
@@ -164,7 +262,8 @@ func (s *Server) cmdEXPIRE(c *Context) {
 		return
 	}
 
-	err = s.store.Expire(c.Args[0], time.Duration(exp)*time.Second)
+	ttl := time.Duration(exp) * time.Second
+	err = s.store.Expire(c.Args[0], ttl)
 	if err == storage.ErrNotExist {
 		c.AppendInt(0)
 		return
@@ -175,6 +274,51 @@ func (s *Server) cmdEXPIRE(c *Context) {
 		return
 	}
 
+	s.propagate([]byte("PEXPIREAT"), c.Args[0], pxat(ttl))
+	c.AppendInt(1)
+}
+
+func (s *Server) cmdPEXPIREAT(c *Context) {
+	if len(c.Args) != 2 {
+		c.ErrInvalidArgs()
+		return
+	}
+
+	ms, err := storage.ParseInt(c.Args[1])
+	if err != nil {
+		c.ErrInvalidInt()
+		return
+	}
+
+	ttl := time.Until(time.UnixMilli(ms))
+	if ttl <= 0 {
+		// Already expired, the key is deleted right away.
+		n, err := s.store.Del(c.Args[0])
+		if err != nil {
+			s.logUnknownError("store.Del", err)
+			c.ErrUnknown(err)
+			return
+		}
+		if n > 0 {
+			s.forget(c.Args[0])
+			s.propagate([]byte("DEL"), c.Args[0])
+		}
+		c.AppendInt(int64(n))
+		return
+	}
+
+	err = s.store.Expire(c.Args[0], ttl)
+	if err == storage.ErrNotExist {
+		c.AppendInt(0)
+		return
+	}
+	if err != nil {
+		s.logUnknownError("store.Expire", err)
+		c.ErrUnknown(err)
+		return
+	}
+
+	s.propagate([]byte("PEXPIREAT"), c.Args[0], c.Args[1])
 	c.AppendInt(1)
 }
 
@@ -184,16 +328,202 @@ func (s *Server) cmdDEL(c *Context) {
 		return
 	}
 
-	n, err := s.store.Del(c.Args...)
+	n, err := s.storeOf(c).Del(c.Args...)
 	if err != nil {
 		s.logUnknownError("store.Del", err)
 		c.ErrUnknown(err)
 		return
 	}
 
+	if n > 0 {
+		s.forget(c.Args...)
+		s.propagateOf(c, append([][]byte{[]byte("DEL")}, c.Args...)...)
+	}
 	c.AppendInt(int64(n))
 }
 
+func (s *Server) cmdEXISTS(c *Context) {
+	if len(c.Args) == 0 {
+		c.ErrInvalidArgs()
+		return
+	}
+
+	var n int64
+	for _, k := range c.Args {
+		ok, err := s.exists(k)
+		if err != nil {
+			s.logUnknownError("store.TTL", err)
+			c.ErrUnknown(err)
+			return
+		}
+		if ok {
+			s.touch(k)
+			n++
+		}
+	}
+
+	c.AppendInt(n)
+}
+
+func (s *Server) cmdTYPE(c *Context) {
+	if len(c.Args) != 1 {
+		c.ErrInvalidArgs()
+		return
+	}
+
+	ok, err := s.exists(c.Args[0])
+	if err != nil {
+		s.logUnknownError("store.TTL", err)
+		c.ErrUnknown(err)
+		return
+	}
+
+	if !ok {
+		c.AppendString("none")
+		return
+	}
+	c.AppendString("string")
+}
+
+func (s *Server) cmdRENAME(c *Context) {
+	if len(c.Args) != 2 {
+		c.ErrInvalidArgs()
+		return
+	}
+
+	err := s.store.Rename(c.Args[0], c.Args[1], false)
+	if err == storage.ErrNotExist {
+		c.ErrNoSuchKey()
+		return
+	}
+	if err != nil {
+		s.logUnknownError("store.Rename", err)
+		c.ErrUnknown(err)
+		return
+	}
+
+	s.renamed(c.Args[0], c.Args[1])
+	s.propagate([]byte("RENAME"), c.Args[0], c.Args[1])
+	c.AppendOK()
+}
+
+func (s *Server) cmdRENAMENX(c *Context) {
+	if len(c.Args) != 2 {
+		c.ErrInvalidArgs()
+		return
+	}
+
+	err := s.store.Rename(c.Args[0], c.Args[1], true)
+	if err == storage.ErrNotExist {
+		c.ErrNoSuchKey()
+		return
+	}
+	if err == storage.ErrExist {
+		c.AppendInt(0)
+		return
+	}
+	if err != nil {
+		s.logUnknownError("store.Rename", err)
+		c.ErrUnknown(err)
+		return
+	}
+
+	s.renamed(c.Args[0], c.Args[1])
+	s.propagate([]byte("RENAME"), c.Args[0], c.Args[1])
+	c.AppendInt(1)
+}
+
+func (s *Server) cmdCOPY(c *Context) {
+	if len(c.Args) < 2 {
+		c.ErrInvalidArgs()
+		return
+	}
+
+	var replace bool
+	args := c.Args[2:]
+	for len(args) > 0 {
+		switch strings.ToUpper(bytesconv.BytesToString(args[0])) {
+		case "REPLACE":
+			replace = true
+			args = args[1:]
+		case "DB":
+			if len(args) < 2 {
+				c.ErrSyntax()
+				return
+			}
+			db, err := storage.ParseInt(args[1])
+			if err != nil {
+				c.ErrInvalidInt()
+				return
+			}
+			if db != 0 {
+				c.AppendError("ERR DB index is out of range")
+				return
+			}
+			args = args[2:]
+		default:
+			c.ErrSyntax()
+			return
+		}
+	}
+
+	if bytes.Equal(c.Args[0], c.Args[1]) {
+		c.AppendError("ERR source and destination objects are the same")
+		return
+	}
+
+	err := s.store.Copy(c.Args[0], c.Args[1], replace)
+	if err == storage.ErrNotExist || err == storage.ErrExist {
+		c.AppendInt(0)
+		return
+	}
+	if err != nil {
+		s.logUnknownError("store.Copy", err)
+		c.ErrUnknown(err)
+		return
+	}
+
+	s.touch(c.Args[1])
+	s.propagate([]byte("COPY"), c.Args[0], c.Args[1], []byte("REPLACE"))
+	c.AppendInt(1)
+}
+
+func (s *Server) cmdRANDOMKEY(c *Context) {
+	if len(c.Args) != 0 {
+		c.ErrInvalidArgs()
+		return
+	}
+
+	key, err := s.store.RandomKey()
+	if err == storage.ErrNotExist {
+		c.AppendNull()
+		return
+	}
+	if err != nil {
+		s.logUnknownError("store.RandomKey", err)
+		c.ErrUnknown(err)
+		return
+	}
+
+	c.AppendBulk(key)
+}
+
+func (s *Server) cmdDBSIZE(c *Context) {
+	if len(c.Args) != 0 {
+		c.ErrInvalidArgs()
+		return
+	}
+
+	n, err := s.store.DBSize()
+	if err != nil {
+		s.logUnknownError("store.DBSize", err)
+		c.ErrUnknown(err)
+		return
+	}
+
+	c.AppendInt(n)
+}
+
 func (s *Server) cmdFLUSHALL(c *Context) {
 	if len(c.Args) != 0 {
 		c.ErrInvalidArgs()
@@ -207,6 +537,8 @@ func (s *Server) cmdFLUSHALL(c *Context) {
 		return
 	}
 
+	s.forgetAll()
+	s.propagate([]byte("FLUSHALL"))
 	c.AppendOK()
 }
 
@@ -238,19 +570,26 @@ func (s *Server) cmdSETEX(c *Context) {
 		return
 	}
 
-	ttl, err := strconv.Atoi(bytesconv.BytesToString(c.Args[1]))
+	exp, err := strconv.Atoi(bytesconv.BytesToString(c.Args[1]))
 	if err != nil {
 		c.ErrInvalidInt()
 		return
 	}
+	if exp <= 0 {
+		c.AppendError("ERR invalid expire time in 'setex' command")
+		return
+	}
 
-	err = s.store.Set(c.Args[0], c.Args[1], storage.SetOptions{TTL: time.Duration(ttl) * time.Second})
+	ttl := time.Duration(exp) * time.Second
+	err = s.storeOf(c).Set(c.Args[0], c.Args[2], storage.SetOptions{TTL: ttl})
 	if err != nil {
 		s.logUnknownError("store.Set", err)
 		c.ErrUnknown(err)
 		return
 	}
 
+	s.touch(c.Args[0])
+	s.propagateOf(c, []byte("SET"), c.Args[0], c.Args[2], []byte("PXAT"), pxat(ttl))
 	c.AppendOK()
 }
 
@@ -260,7 +599,7 @@ func (s *Server) cmdSETNX(c *Context) {
 		return
 	}
 
-	err := s.store.Set(c.Args[0], c.Args[1], storage.SetOptions{NX: true})
+	err := s.storeOf(c).Set(c.Args[0], c.Args[1], storage.SetOptions{NX: true})
 	if err == storage.ErrExist {
 		c.AppendInt(0)
 		return
@@ -271,29 +610,19 @@ func (s *Server) cmdSETNX(c *Context) {
 		return
 	}
 
+	s.touch(c.Args[0])
+	s.propagateOf(c, []byte("SET"), c.Args[0], c.Args[1])
 	c.AppendInt(1)
 }
 
-func (s *Server) cmdAdd(delta int) CommandFunc {
+func (s *Server) cmdAdd(delta int64) CommandFunc {
 	return func(c *Context) {
 		if len(c.Args) != 1 {
 			c.ErrInvalidArgs()
 			return
 		}
 
-		i, err := s.store.Add(c.Args[0], delta)
-		if err == storage.ErrInvalidInt {
-			c.ErrInvalidInt()
-			return
-		}
-		if err != nil {
-			s.logUnknownError("store.Add", err)
-			c.ErrUnknown(err)
-			return
-		}
-
-		c.AppendInt(int64(i))
-
+		s.add(c, c.Args[0], delta)
 	}
 }
 
@@ -304,29 +633,76 @@ func (s *Server) cmdAddBy(incr bool) CommandFunc {
 			return
 		}
 
-		delta, err := strconv.Atoi(bytesconv.BytesToString(c.Args[1]))
+		delta, err := storage.ParseInt(c.Args[1])
 		if err != nil {
 			c.ErrInvalidInt()
 			return
 		}
 
 		if !incr {
+			if delta == math.MinInt64 {
+				c.AppendError("ERR decrement would overflow")
+				return
+			}
 			delta = -delta
 		}
 
-		i, err := s.store.Add(c.Args[0], delta)
-		if err == storage.ErrInvalidInt {
-			c.ErrInvalidInt()
-			return
-		}
-		if err != nil {
-			s.logUnknownError("store.Add", err)
-			c.ErrUnknown(err)
-			return
-		}
+		s.add(c, c.Args[0], delta)
+	}
+}
 
-		c.AppendInt(int64(i))
+func (s *Server) add(c *Context, key []byte, delta int64) {
+	i, err := s.storeOf(c).Add(key, delta)
+	if err == storage.ErrInvalidInt {
+		c.ErrInvalidInt()
+		return
 	}
+	if err == storage.ErrOverflow {
+		c.ErrOverflow()
+		return
+	}
+	if err != nil {
+		s.logUnknownError("store.Add", err)
+		c.ErrUnknown(err)
+		return
+	}
+
+	s.touch(key)
+	s.propagateOf(c, []byte("SET"), key, storage.FormatInt(i), []byte("KEEPTTL"))
+	c.AppendInt(i)
+}
+
+func (s *Server) cmdINCRBYFLOAT(c *Context) {
+	if len(c.Args) != 2 {
+		c.ErrInvalidArgs()
+		return
+	}
+
+	delta, err := storage.ParseFloat(c.Args[1])
+	if err != nil {
+		c.ErrInvalidFloat()
+		return
+	}
+
+	f, err := s.storeOf(c).AddFloat(c.Args[0], delta)
+	if err == storage.ErrInvalidFloat {
+		c.ErrInvalidFloat()
+		return
+	}
+	if err == storage.ErrNaNOrInf {
+		c.ErrNaNOrInf()
+		return
+	}
+	if err != nil {
+		s.logUnknownError("store.AddFloat", err)
+		c.ErrUnknown(err)
+		return
+	}
+
+	v := storage.FormatFloat(f)
+	s.touch(c.Args[0])
+	s.propagateOf(c, []byte("SET"), c.Args[0], v, []byte("KEEPTTL"))
+	c.AppendBulk(v)
 }
 
 func (s *Server) cmdMGET(c *Context) {
@@ -345,6 +721,7 @@ func (s *Server) cmdMGET(c *Context) {
 			c.ErrUnknown(err)
 			return
 		} else {
+			s.touch(k)
 			vals = append(vals, v)
 		}
 	}
@@ -360,17 +737,36 @@ func (s *Server) cmdMSET(c *Context) {
 	}
 
 	for i := 0; i+1 < n; i += 2 {
-		if err := s.store.Set(c.Args[i], c.Args[i+1], storage.SetOptions{}); err != nil {
+		if err := s.storeOf(c).Set(c.Args[i], c.Args[i+1], storage.SetOptions{}); err != nil {
 			s.logUnknownError("store.Set", err)
 			c.ErrUnknown(err)
 			return
 		}
+		s.touch(c.Args[i])
 	}
 
+	s.propagateOf(c, append([][]byte{[]byte("MSET")}, c.Args...)...)
 	c.AppendOK()
 }
 
+func (s *Server) exists(key []byte) (bool, error) {
+	ttl, err := s.store.TTL(key)
+	if err != nil {
+		return false, err
+	}
+	return ttl != -2, nil
+}
+
+// pxat returns the unix time in milliseconds at which ttl elapses.
+func pxat(ttl time.Duration) []byte {
+	return storage.FormatInt(time.Now().Add(ttl).UnixMilli())
+}
+
 func (s *Server) logUnknownError(method string, err error) {
+	if err == storage.ErrBatchFull {
+		// The command is run again, see runBatch.
+		return
+	}
 	s.logger.Error("unknown error",
 		zap.String("method", method),
 		zap.Error(err),
@@ -0,0 +1,118 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStringCommands(t *testing.T) {
+	srv, c := newTestServer(t, nil)
+	defer srv.Cleanup()
+
+	assert.Equal(t, "$-1\r\n", c.do("GET", "a"))
+	assert.Equal(t, "+OK\r\n", c.do("SET", "a", "1"))
+	assert.Equal(t, "$1\r\n1\r\n", c.do("GET", "a"))
+	assert.Equal(t, "$-1\r\n", c.do("SET", "a", "2", "NX"))
+	assert.Equal(t, "$-1\r\n", c.do("SET", "b", "2", "XX"))
+	assert.Equal(t, "-ERR syntax error\r\n", c.do("SET", "a", "2", "NX", "XX"))
+	assert.Equal(t, "-ERR syntax error\r\n", c.do("SET", "a", "2", "EX", "10", "KEEPTTL"))
+	assert.Equal(t, "-ERR invalid expire time in set\r\n", c.do("SET", "a", "2", "PX", "0"))
+
+	assert.Equal(t, "+OK\r\n", c.do("SET", "a", "2", "PX", "100000"))
+	assert.Equal(t, ":99\r\n", c.do("TTL", "a"))
+	assert.Equal(t, "+OK\r\n", c.do("SET", "a", "3", "KEEPTTL"))
+	assert.Equal(t, ":99\r\n", c.do("TTL", "a"))
+	assert.Equal(t, "+OK\r\n", c.do("SET", "a", "4"))
+	assert.Equal(t, ":-1\r\n", c.do("TTL", "a"))
+
+	at := time.Now().Add(time.Minute).Unix()
+	assert.Equal(t, "+OK\r\n", c.do("SET", "a", "5", "EXAT", strconv.FormatInt(at, 10)))
+	assert.Contains(t, []string{":59\r\n", ":58\r\n"}, c.do("TTL", "a"))
+	// A time in the past deletes the key.
+	assert.Equal(t, "+OK\r\n", c.do("SET", "a", "6", "PXAT", "1"))
+	assert.Equal(t, "$-1\r\n", c.do("GET", "a"))
+
+	assert.Equal(t, "+OK\r\n", c.do("SETEX", "s", "100", "value"))
+	assert.Equal(t, "$5\r\nvalue\r\n", c.do("GET", "s"))
+	assert.Equal(t, ":99\r\n", c.do("TTL", "s"))
+	assert.Equal(t, "-ERR invalid expire time in 'setex' command\r\n", c.do("SETEX", "s", "0", "value"))
+
+	assert.Equal(t, ":1\r\n", c.do("SETNX", "n", "1"))
+	assert.Equal(t, ":0\r\n", c.do("SETNX", "n", "2"))
+
+	assert.Equal(t, ":2\r\n", c.do("INCR", "n"))
+	assert.Equal(t, ":12\r\n", c.do("INCRBY", "n", "10"))
+	assert.Equal(t, ":11\r\n", c.do("DECR", "n"))
+	assert.Equal(t, ":1\r\n", c.do("DECRBY", "n", "10"))
+	assert.Equal(t, "$3\r\n1.5\r\n", c.do("INCRBYFLOAT", "n", "0.5"))
+	assert.Equal(t, "-ERR value is not an integer or out of range\r\n", c.do("INCR", "n"))
+	assert.Equal(t, "-ERR value is not an integer or out of range\r\n", c.do("INCR", "s"))
+
+	assert.Equal(t, "+OK\r\n", c.do("MSET", "m1", "1", "m2", "2"))
+	assert.Equal(t, "*3\r\n$1\r\n1\r\n$-1\r\n$1\r\n2\r\n", c.do("MGET", "m1", "x", "m2"))
+}
+
+func TestKeyCommands(t *testing.T) {
+	srv, c := newTestServer(t, nil)
+	defer srv.Cleanup()
+
+	assert.Equal(t, ":0\r\n", c.do("DBSIZE"))
+	assert.Equal(t, "$-1\r\n", c.do("RANDOMKEY"))
+	assert.Equal(t, "+OK\r\n", c.do("MSET", "a", "1", "b", "2"))
+	assert.Equal(t, ":2\r\n", c.do("EXISTS", "a", "b", "c"))
+	assert.Equal(t, "+string\r\n", c.do("TYPE", "a"))
+	assert.Equal(t, "+none\r\n", c.do("TYPE", "c"))
+
+	assert.Equal(t, ":1\r\n", c.do("EXPIRE", "a", "100"))
+	assert.Equal(t, ":99\r\n", c.do("TTL", "a"))
+	assert.Equal(t, ":0\r\n", c.do("EXPIRE", "c", "100"))
+	at := time.Now().Add(time.Minute).UnixMilli()
+	assert.Equal(t, ":1\r\n", c.do("PEXPIREAT", "b", strconv.FormatInt(at, 10)))
+	assert.Equal(t, ":59\r\n", c.do("TTL", "b"))
+
+	assert.Equal(t, "-ERR no such key\r\n", c.do("RENAME", "c", "d"))
+	assert.Equal(t, ":0\r\n", c.do("RENAMENX", "a", "b"))
+	assert.Equal(t, "+OK\r\n", c.do("RENAME", "a", "c"))
+	assert.Equal(t, ":99\r\n", c.do("TTL", "c"))
+	assert.Equal(t, ":0\r\n", c.do("COPY", "c", "b"))
+	assert.Equal(t, ":1\r\n", c.do("COPY", "c", "b", "REPLACE"))
+	assert.Equal(t, "$1\r\n1\r\n", c.do("GET", "b"))
+	assert.Contains(t, []string{
+		"*2\r\n$1\r\nb\r\n$1\r\nc\r\n",
+		"*2\r\n$1\r\nc\r\n$1\r\nb\r\n",
+	}, c.do("KEYS", "*"))
+
+	assert.Equal(t, ":1\r\n", c.do("PEXPIREAT", "b", "1"))
+	assert.Equal(t, ":0\r\n", c.do("EXISTS", "b"))
+	assert.Equal(t, ":1\r\n", c.do("DEL", "b", "c"))
+	assert.Equal(t, ":0\r\n", c.do("DBSIZE"))
+
+	assert.Equal(t, "+OK\r\n", c.do("SET", "a", "1"))
+	assert.Equal(t, "+OK\r\n", c.do("FLUSHALL"))
+	assert.Equal(t, ":0\r\n", c.do("DBSIZE"))
+}
+
+func TestDumpRestore(t *testing.T) {
+	srv, c := newTestServer(t, nil)
+	defer srv.Cleanup()
+
+	assert.Equal(t, "$-1\r\n", c.do("DUMP", "a"))
+	assert.Equal(t, "+OK\r\n", c.do("SET", "a", "hello"))
+	dump := c.do("DUMP", "a")
+	// Payload of "hello" as produced by Redis.
+	payload := "\x00\x05hello\t\x00\xb3\x80\x8e\xba1\xb2C\xbb"
+	assert.Equal(t, "$17\r\n"+payload+"\r\n", dump)
+
+	assert.Equal(t, "-BUSYKEY Target key name already exists.\r\n", c.do("RESTORE", "a", "0", payload))
+	assert.Equal(t, "+OK\r\n", c.do("RESTORE", "b", "100000", payload))
+	assert.Equal(t, "$5\r\nhello\r\n", c.do("GET", "b"))
+	assert.Equal(t, ":99\r\n", c.do("TTL", "b"))
+	assert.Equal(t, "-ERR DUMP payload version or checksum are wrong\r\n", c.do("RESTORE", "c", "0", payload[:16]+"x"))
+}
@@ -6,6 +6,7 @@ package server
 
 import (
 	"fmt"
+	"sync"
 
 	"github.com/tidwall/evio"
 	"github.com/tidwall/redcon"
@@ -17,12 +18,81 @@ type Context struct {
 	cmd  []byte
 	auth bool
 	Args [][]byte
+
+	conn evio.Conn
+	// action is set by the commands which take over the connection.
+	action evio.Action
+	// blocked receives the reply of a blocking command, see block.
+	blocked chan []byte
+	// closed is closed with the connection, if a command blocked.
+	closed chan struct{}
+	// link is the replica served on this connection after PSYNC.
+	link *replicaLink
+	// replPort is the port given by REPLCONF listening-port.
+	replPort int
+	// asking is set by ASKING for the next command.
+	asking bool
+	// batch is the batch the command runs in, see runBatch.
+	batch *writeBatch
+	// inflight is set while the blocked command is counted in
+	// Server.inflight.
+	inflight bool
+	// resumed is set while the commands queued behind a blocked command
+	// run.
+	resumed bool
+
+	// id is the id of the client, see CLIENT ID.
+	id int64
+	// pushMu guards resp3, set by HELLO, and pushed, the messages queued by
+	// the other clients, see push.
+	pushMu sync.Mutex
+	resp3  bool
+	pushed []byte
+	// channels are the channels subscribed to, see SUBSCRIBE.
+	channels map[string]bool
+	// tracking is set by CLIENT TRACKING ON.
+	tracking bool
+	// caching is set by CLIENT CACHING for the next command, 1 for YES and
+	// -1 for NO.
+	caching int8
+}
+
+// block suspends the connection until fn, which runs in the background,
+// returns the reply of the command. The following commands of the client
+// wait meanwhile. fn should return early once closed is closed.
+func (c *Context) block(fn func(closed <-chan struct{}) []byte) {
+	c.blockOn(func(f func()) bool {
+		go f()
+		return true
+	}, fn)
+}
+
+// blockOn is block with fn started by spawn, e.g. on a pool of workers. It
+// reports false, and doesn't block, if spawn couldn't start fn.
+func (c *Context) blockOn(spawn func(func()) bool, fn func(closed <-chan struct{}) []byte) bool {
+	if c.closed == nil {
+		c.closed = make(chan struct{})
+	}
+	blocked := make(chan []byte, 1)
+	conn, closed := c.conn, c.closed
+	started := spawn(func() {
+		blocked <- fn(closed)
+		conn.Wake()
+	})
+	if started {
+		c.blocked = blocked
+	}
+	return started
 }
 
 func (c *Context) AppendError(s string) {
 	*c.out = redcon.AppendError(*c.out, s)
 }
 
+func (c *Context) AppendArray(n int) {
+	*c.out = redcon.AppendArray(*c.out, n)
+}
+
 func (c *Context) AppendBulkArray(bs [][]byte) {
 	*c.out = redcon.AppendArray(*c.out, len(bs))
 	for _, b := range bs {
@@ -42,6 +112,10 @@ func (c *Context) AppendOK() {
 	*c.out = redcon.AppendOK(*c.out)
 }
 
+func (c *Context) AppendString(s string) {
+	*c.out = redcon.AppendString(*c.out, s)
+}
+
 func (c *Context) AppendNull() {
 	*c.out = redcon.AppendNull(*c.out)
 }
@@ -62,10 +136,26 @@ func (c *Context) ErrInvalidInt() {
 	c.AppendError("ERR value is not an integer or out of range")
 }
 
+func (c *Context) ErrInvalidFloat() {
+	c.AppendError("ERR value is not a valid float")
+}
+
+func (c *Context) ErrOverflow() {
+	c.AppendError("ERR increment or decrement would overflow")
+}
+
+func (c *Context) ErrNaNOrInf() {
+	c.AppendError("ERR increment would produce NaN or Infinity")
+}
+
 func (c *Context) ErrInvalidExp() {
 	c.AppendError("ERR invalid expire time in set")
 }
 
+func (c *Context) ErrNoSuchKey() {
+	c.AppendError("ERR no such key")
+}
+
 func (c *Context) ErrUnknown(err error) {
 	c.AppendError(fmt.Sprintf("ERR unknown %q", err.Error()))
 }
@@ -0,0 +1,93 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"strings"
+
+	"github.com/spf13/viper"
+	"go.chensl.me/redix/server/internal/storage"
+	"go.uber.org/zap"
+
+	// The built-in drivers register themselves.
+	_ "go.chensl.me/redix/server/internal/storage/badger"
+	_ "go.chensl.me/redix/server/internal/storage/bitcask"
+	_ "go.chensl.me/redix/server/internal/storage/boltdb"
+	_ "go.chensl.me/redix/server/internal/storage/memory"
+	_ "go.chensl.me/redix/server/internal/storage/mysql"
+	_ "go.chensl.me/redix/server/internal/storage/pebble"
+	_ "go.chensl.me/redix/server/internal/storage/postgres"
+	_ "go.chensl.me/redix/server/internal/storage/sqlite"
+)
+
+// The storage types are re-exported so that applications embedding the
+// server can implement their own driver.
+type (
+	// Storage is the interface implemented by the drivers.
+	Storage = storage.Interface
+	// SetOptions are the options of Storage.Set.
+	SetOptions = storage.SetOptions
+	// DriverOptions are passed to a DriverFactory.
+	DriverOptions = storage.Options
+	// DriverFactory opens the Storage of a driver.
+	DriverFactory = storage.Factory
+	// Batcher is implemented by the Storage which can commit the pipelined
+	// writes at once.
+	Batcher = storage.Batcher
+	// StorageBatch is the view of a Storage given to Batcher.Batch.
+	StorageBatch = storage.Batch
+	// DiskSizer is implemented by the Storage whose disk usage can bound it
+	// with maxdisk.
+	DiskSizer = storage.DiskSizer
+)
+
+// The errors returned by a Storage, the commands translate them into the
+// replies Redis would send.
+var (
+	ErrInvalidOpts  = storage.ErrInvalidOpts
+	ErrExist        = storage.ErrExist
+	ErrNotExist     = storage.ErrNotExist
+	ErrInvalidInt   = storage.ErrInvalidInt
+	ErrInvalidFloat = storage.ErrInvalidFloat
+	ErrOverflow     = storage.ErrOverflow
+	ErrNaNOrInf     = storage.ErrNaNOrInf
+)
+
+// RegisterDriver makes a driver available by the provided name, it can then
+// be selected with the driver option. The options under the section of the
+// same name in the configuration are passed to factory. It panics if the
+// name is already registered.
+func RegisterDriver(name string, factory DriverFactory) {
+	storage.Register(name, factory)
+}
+
+// Drivers returns a sorted list of the names of the registered drivers.
+func Drivers() []string {
+	return storage.Drivers()
+}
+
+// OpenStorage opens the storage of driver, with the options of its section
+// in the configuration and dir as the data directory.
+func OpenStorage(driver, dir string, logger *zap.Logger) (Storage, error) {
+	return storage.Open(driver, storage.Options{
+		DataDir: dir,
+		Config:  driverConfig(driver),
+		Logger:  logger,
+	})
+}
+
+// driverConfig returns the configuration section of driver. The keys are
+// copied one by one rather than using viper.Sub, so that environment
+// variables such as REDIX_MYSQL_HOST override the configuration file.
+func driverConfig(driver string) *viper.Viper {
+	sub := viper.New()
+	prefix := driver + "."
+	for _, key := range viper.AllKeys() {
+		if strings.HasPrefix(key, prefix) {
+			sub.Set(strings.TrimPrefix(key, prefix), viper.Get(key))
+		}
+	}
+	return sub
+}
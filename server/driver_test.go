@@ -0,0 +1,74 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.chensl.me/redix/server/internal/storage/memory"
+)
+
+var (
+	registerTestDriver sync.Once
+	testDriverOpts     DriverOptions
+)
+
+func TestRegisterDriver(t *testing.T) {
+	registerTestDriver.Do(func() {
+		RegisterDriver("test", func(opts DriverOptions) (Storage, error) {
+			testDriverOpts = opts
+			return memory.NewStorage(opts.Logger)
+		})
+	})
+	assert.Contains(t, Drivers(), "test")
+	assert.Panics(t, func() {
+		RegisterDriver("memory", func(opts DriverOptions) (Storage, error) { return nil, nil })
+	})
+
+	srv, c := newTestServer(t, map[string]interface{}{
+		"driver":    "test",
+		"data_dir":  "/tmp/redix-test",
+		"test.name": "redix",
+		"test.size": 42,
+	})
+	defer srv.Cleanup()
+
+	assert.Equal(t, "/tmp/redix-test", testDriverOpts.DataDir)
+	assert.Equal(t, "redix", testDriverOpts.Config.GetString("name"))
+	assert.Equal(t, 42, testDriverOpts.Config.GetInt("size"))
+	assert.Equal(t, "+OK\r\n", c.do("SET", "k", "v"))
+	assert.Equal(t, "$1\r\nv\r\n", c.do("GET", "k"))
+}
+
+func TestUnknownDriver(t *testing.T) {
+	viper.Reset()
+	viper.Set("driver", "nope")
+	t.Cleanup(viper.Reset)
+
+	_, err := New()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `unknown driver "nope"`)
+}
+
+func TestDriverConfigEnv(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	viper.SetEnvPrefix("redix")
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	viper.AutomaticEnv()
+	viper.SetDefault("mysql.host", "127.0.0.1")
+	viper.SetDefault("mysql.port", 3306)
+	t.Setenv("REDIX_MYSQL_HOST", "db.example.com")
+
+	cfg := driverConfig("mysql")
+	assert.Equal(t, "db.example.com", cfg.GetString("host"))
+	assert.Equal(t, 3306, cfg.GetInt("port"))
+	assert.False(t, cfg.IsSet("driver"))
+}
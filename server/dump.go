@@ -0,0 +1,375 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.chensl.me/redix/server/internal/client"
+	"go.chensl.me/redix/server/internal/rdb"
+	"go.chensl.me/redix/server/internal/storage"
+	"go.chensl.me/redix/server/pkg/bytesconv"
+)
+
+func (s *Server) cmdDUMP(c *Context) {
+	if len(c.Args) != 1 {
+		c.ErrInvalidArgs()
+		return
+	}
+
+	v, err := s.store.Get(c.Args[0])
+	if err == storage.ErrNotExist {
+		c.AppendNull()
+		return
+	}
+	if err != nil {
+		s.logUnknownError("store.Get", err)
+		c.ErrUnknown(err)
+		return
+	}
+
+	c.AppendBulk(rdb.Dump(v))
+}
+
+func (s *Server) cmdRESTORE(c *Context) {
+	if len(c.Args) < 3 {
+		c.ErrInvalidArgs()
+		return
+	}
+
+	var (
+		key     = c.Args[0]
+		payload = c.Args[2]
+		replace bool
+		absTTL  bool
+		idle    bool
+		freq    bool
+	)
+	args := c.Args[3:]
+	for len(args) > 0 {
+		switch strings.ToUpper(bytesconv.BytesToString(args[0])) {
+		case "REPLACE":
+			replace = true
+			args = args[1:]
+		case "ABSTTL":
+			absTTL = true
+			args = args[1:]
+		case "IDLETIME":
+			if len(args) < 2 || freq {
+				c.ErrSyntax()
+				return
+			}
+			// Access times aren't tracked, the value is only validated.
+			v, err := storage.ParseInt(args[1])
+			if err != nil {
+				c.ErrInvalidInt()
+				return
+			}
+			if v < 0 {
+				c.AppendError("ERR Invalid IDLETIME value, must be >= 0")
+				return
+			}
+			idle = true
+			args = args[2:]
+		case "FREQ":
+			if len(args) < 2 || idle {
+				c.ErrSyntax()
+				return
+			}
+			v, err := storage.ParseInt(args[1])
+			if err != nil {
+				c.ErrInvalidInt()
+				return
+			}
+			if v < 0 || v > 255 {
+				c.AppendError("ERR Invalid FREQ value, must be >= 0 and <= 255")
+				return
+			}
+			freq = true
+			args = args[2:]
+		default:
+			c.ErrSyntax()
+			return
+		}
+	}
+
+	ms, err := storage.ParseInt(c.Args[1])
+	if err != nil {
+		c.ErrInvalidInt()
+		return
+	}
+	if ms < 0 {
+		c.AppendError("ERR Invalid TTL value, must be >= 0")
+		return
+	}
+
+	val, err := rdb.ParseDump(payload)
+	if err == rdb.ErrChecksum {
+		c.AppendError("ERR DUMP payload version or checksum are wrong")
+		return
+	}
+	if err != nil {
+		c.AppendError("ERR Bad data format")
+		return
+	}
+
+	var ttl time.Duration
+	if ms > 0 {
+		if absTTL {
+			ttl = time.Until(time.UnixMilli(ms))
+		} else {
+			ttl = time.Duration(ms) * time.Millisecond
+		}
+		if ttl <= 0 {
+			// Already expired: behave as if it was restored and then
+			// expired right away.
+			s.restoreExpired(c, key, replace)
+			return
+		}
+	}
+
+	err = s.store.Set(key, val, storage.SetOptions{
+		TTL: ttl,
+		NX:  !replace,
+	})
+	if err == storage.ErrExist {
+		c.AppendError("BUSYKEY Target key name already exists.")
+		return
+	}
+	if err != nil {
+		s.logUnknownError("store.Set", err)
+		c.ErrUnknown(err)
+		return
+	}
+
+	at := []byte("0")
+	if ttl > 0 {
+		at = pxat(ttl)
+	}
+	s.touch(key)
+	s.propagate([]byte("RESTORE"), key, at, payload, []byte("ABSTTL"), []byte("REPLACE"))
+	c.AppendOK()
+}
+
+func (s *Server) restoreExpired(c *Context, key []byte, replace bool) {
+	ok, err := s.exists(key)
+	if err != nil {
+		s.logUnknownError("store.TTL", err)
+		c.ErrUnknown(err)
+		return
+	}
+	if ok && !replace {
+		c.AppendError("BUSYKEY Target key name already exists.")
+		return
+	}
+	if ok {
+		if _, err := s.store.Del(key); err != nil {
+			s.logUnknownError("store.Del", err)
+			c.ErrUnknown(err)
+			return
+		}
+		s.forget(key)
+		s.propagate([]byte("DEL"), key)
+	}
+	c.AppendOK()
+}
+
+// MIGRATE host port key|"" destination-db timeout [COPY] [REPLACE]
+// [AUTH password | AUTH2 username password] [KEYS key [key ...]]
+func (s *Server) cmdMIGRATE(c *Context) {
+	if len(c.Args) < 5 {
+		c.ErrInvalidArgs()
+		return
+	}
+
+	var (
+		copyKey bool
+		replace bool
+		auth    [][]byte
+		keys    = c.Args[2:3]
+	)
+	args := c.Args[5:]
+	for len(args) > 0 {
+		switch strings.ToUpper(bytesconv.BytesToString(args[0])) {
+		case "COPY":
+			copyKey = true
+			args = args[1:]
+		case "REPLACE":
+			replace = true
+			args = args[1:]
+		case "AUTH":
+			if len(args) < 2 {
+				c.ErrSyntax()
+				return
+			}
+			auth = args[1:2]
+			args = args[2:]
+		case "AUTH2":
+			if len(args) < 3 {
+				c.ErrSyntax()
+				return
+			}
+			auth = args[1:3]
+			args = args[3:]
+		case "KEYS":
+			if len(c.Args[2]) != 0 {
+				c.AppendError("ERR When using MIGRATE KEYS option, the key argument must be set to the empty string")
+				return
+			}
+			keys = args[1:]
+			args = nil
+		default:
+			c.ErrSyntax()
+			return
+		}
+	}
+
+	db, err := storage.ParseInt(c.Args[3])
+	if err != nil {
+		c.ErrInvalidInt()
+		return
+	}
+	timeout, err := storage.ParseInt(c.Args[4])
+	if err != nil {
+		c.ErrInvalidInt()
+		return
+	}
+	if timeout <= 0 {
+		timeout = 1000
+	}
+
+	type item struct {
+		key     []byte
+		payload []byte
+		ttl     int64
+	}
+	var items []item
+	for _, k := range keys {
+		v, err := s.store.Get(k)
+		if err == storage.ErrNotExist {
+			continue
+		}
+		if err != nil {
+			s.logUnknownError("store.Get", err)
+			c.ErrUnknown(err)
+			return
+		}
+		ttl, err := s.store.TTL(k)
+		if err != nil {
+			s.logUnknownError("store.TTL", err)
+			c.ErrUnknown(err)
+			return
+		}
+		switch {
+		case ttl == -1:
+			ttl = 0
+		case ttl == 0:
+			// Less than a second left.
+			ttl = 1
+		default:
+			ttl *= 1000
+		}
+		items = append(items, item{key: k, payload: rdb.Dump(v), ttl: ttl})
+	}
+	if len(items) == 0 {
+		c.AppendString("NOKEY")
+		return
+	}
+
+	addr := net.JoinHostPort(string(c.Args[0]), string(c.Args[1]))
+	conn, err := client.Dial(addr, time.Duration(timeout)*time.Millisecond)
+	if err != nil {
+		c.AppendError("IOERR error or timeout connecting to the client")
+		return
+	}
+	defer conn.Close()
+
+	var pre int
+	if len(auth) > 0 {
+		_ = conn.Send(append([]interface{}{"AUTH"}, bytesArgs(auth)...)...)
+		pre++
+	}
+	if db != 0 {
+		_ = conn.Send("SELECT", strconv.FormatInt(db, 10))
+		pre++
+	}
+	// In cluster mode the target is importing the slot of the keys.
+	restore := "RESTORE"
+	if s.cluster != nil {
+		restore = "RESTORE-ASKING"
+	}
+	for _, it := range items {
+		args := []interface{}{restore, it.key, it.ttl, it.payload}
+		if replace {
+			args = append(args, "REPLACE")
+		}
+		_ = conn.Send(args...)
+	}
+	if err := conn.Flush(); err != nil {
+		c.AppendError("IOERR error or timeout writing to target instance")
+		return
+	}
+
+	for i := 0; i < pre; i++ {
+		if _, err := conn.Receive(); err != nil {
+			s.migrateError(c, err)
+			return
+		}
+	}
+
+	var (
+		firstErr error
+		migrated [][]byte
+	)
+	for _, it := range items {
+		_, err := conn.Receive()
+		if _, ok := err.(client.Error); ok {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if err != nil {
+			s.migrateError(c, err)
+			return
+		}
+		migrated = append(migrated, it.key)
+	}
+
+	if !copyKey && len(migrated) > 0 {
+		if _, err := s.store.Del(migrated...); err != nil {
+			s.logUnknownError("store.Del", err)
+			c.ErrUnknown(err)
+			return
+		}
+		s.forget(migrated...)
+		s.propagate(append([][]byte{[]byte("DEL")}, migrated...)...)
+	}
+
+	if firstErr != nil {
+		s.migrateError(c, firstErr)
+		return
+	}
+	c.AppendOK()
+}
+
+func (*Server) migrateError(c *Context, err error) {
+	if e, ok := err.(client.Error); ok {
+		c.AppendError("ERR Target instance replied with error: " + string(e))
+		return
+	}
+	c.AppendError("IOERR error or timeout reading to target instance")
+}
+
+func bytesArgs(bs [][]byte) []interface{} {
+	args := make([]interface{}, len(bs))
+	for i, b := range bs {
+		args[i] = b
+	}
+	return args
+}
@@ -0,0 +1,245 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/spf13/viper"
+	"go.chensl.me/redix/server/internal/evict"
+	"go.chensl.me/redix/server/internal/storage"
+)
+
+// With maxkeys or maxdisk set, the store is bounded as a cache. Before a
+// write which may grow it, keys are evicted while it is over a limit: the
+// one chosen by eviction_policy among a sample of about eviction_samples
+// keys, as Redis does for maxmemory. The evictions are propagated as
+// DEL. With noeviction, or when there is nothing to evict, the write fails
+// with an OOM error instead. The accesses to the keys are recorded by the
+// commands in an index kept in memory.
+
+// maxEvictions bounds the keys evicted before a write.
+const maxEvictions = 64
+
+var (
+	errOOMKeys = errors.New("OOM command not allowed when keys >= 'maxkeys'.")
+	errOOMDisk = errors.New("OOM command not allowed when used disk > 'maxdisk'.")
+)
+
+type evictState struct {
+	policy  evict.Policy
+	samples int
+	maxKeys int64
+	maxDisk int64
+	sizer   storage.DiskSizer
+	// index is nil unless a limit is set.
+	index *evict.Index
+	// evicted counts the keys evicted, for INFO.
+	evicted int64
+}
+
+// loadEviction loads the options of the eviction.
+func (s *Server) loadEviction() error {
+	e := &s.evict
+	var err error
+	if e.policy, err = evict.ParsePolicy(viper.GetString("eviction_policy")); err != nil {
+		return err
+	}
+	if e.samples = viper.GetInt("eviction_samples"); e.samples <= 0 {
+		return errors.New("eviction_samples must be positive")
+	}
+	e.maxKeys = viper.GetInt64("maxkeys")
+	e.maxDisk = int64(viper.GetSizeInBytes("maxdisk"))
+	if e.maxKeys <= 0 && e.maxDisk <= 0 {
+		return nil
+	}
+	if s.raftConf.addr != "" {
+		return errors.New("maxkeys and maxdisk can't be used in raft mode")
+	}
+	if e.maxDisk > 0 {
+		sizer, ok := storage.Unwrap(s.store).(storage.DiskSizer)
+		if !ok {
+			return fmt.Errorf("maxdisk isn't supported by the %s driver", s.driver)
+		}
+		e.sizer = sizer
+	}
+	e.index = evict.NewIndex()
+	return nil
+}
+
+// evictIfNeeded evicts keys while the store is over a limit, and fails if
+// it can't. The store is over maxkeys once it has maxkeys keys, leaving room
+// for the key written. execMu must be held.
+func (s *Server) evictIfNeeded() error {
+	if s.evict.index == nil {
+		return nil
+	}
+	if n, err := s.store.DBSize(); err == nil && s.evict.index.Len() > int(n) {
+		s.pruneIndex()
+	}
+	for n := 0; ; n++ {
+		limit, err := s.overLimit()
+		if err != nil {
+			s.logUnknownError("overLimit", err)
+			return nil
+		}
+		if limit == "" {
+			return nil
+		}
+		// The disk size lags behind the deletes, a key is evicted per
+		// write while over maxdisk.
+		if n == maxEvictions || (n > 0 && limit == "maxdisk") {
+			return nil
+		}
+		ok := false
+		if s.evict.policy != evict.NoEviction {
+			if ok, err = s.evictKey(); err != nil {
+				s.logUnknownError("evictKey", err)
+				return nil
+			}
+		}
+		if !ok {
+			if limit == "maxdisk" {
+				return errOOMDisk
+			}
+			return errOOMKeys
+		}
+	}
+}
+
+// overLimit returns the limit the store is over, if any.
+func (s *Server) overLimit() (string, error) {
+	e := &s.evict
+	if e.maxKeys > 0 {
+		n, err := s.store.DBSize()
+		if err != nil {
+			return "", err
+		}
+		if n >= e.maxKeys {
+			return "maxkeys", nil
+		}
+	}
+	if e.maxDisk > 0 {
+		size, err := e.sizer.DiskSize()
+		if err != nil {
+			return "", err
+		}
+		if size > e.maxDisk {
+			return "maxdisk", nil
+		}
+	}
+	return "", nil
+}
+
+// pruneIndex forgets some of the keys of the index which expired, the
+// index knowing more keys than the store.
+func (s *Server) pruneIndex() {
+	for _, key := range s.evict.index.Sample(s.evict.samples) {
+		if ttl, err := s.store.TTL(key); err == nil && ttl == -2 {
+			s.evict.index.Remove(key)
+		}
+	}
+}
+
+// evictKey evicts the best of a sample of the keys, and reports whether
+// there was one. The sample is drawn from the index and from RandomKey, which
+// alone may favor some keys, e.g. by the shards of the memory driver, and
+// the keys the index doesn't know yet.
+func (s *Server) evictKey() (bool, error) {
+	e := &s.evict
+	// The volatile keys may be few, they are looked for longer.
+	tries := e.samples
+	if e.policy.Volatile() {
+		tries *= 10
+	}
+	keys := e.index.Sample(tries)
+	for i := 0; i < tries; i++ {
+		key, err := s.store.RandomKey()
+		if err == storage.ErrNotExist {
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+		keys = append(keys, key)
+	}
+
+	var (
+		best      []byte
+		bestScore float64
+	)
+	for _, key := range keys {
+		ttl, err := s.store.TTL(key)
+		if err != nil {
+			return false, err
+		}
+		if ttl == -2 {
+			e.index.Remove(key)
+			continue
+		}
+		var score float64
+		switch e.policy {
+		case evict.AllKeysLRU:
+			score = float64(e.index.Idle(key))
+		case evict.AllKeysLFU:
+			score = float64(255-int(e.index.Freq(key)))*1e18 + float64(e.index.Idle(key))
+		case evict.VolatileLRU, evict.VolatileTTL:
+			if ttl < 0 {
+				continue
+			}
+			if e.policy == evict.VolatileTTL {
+				score = -float64(ttl)
+			} else {
+				score = float64(e.index.Idle(key))
+			}
+		}
+		if best == nil || score > bestScore {
+			best, bestScore = key, score
+		}
+	}
+	if best == nil {
+		return false, nil
+	}
+	if _, err := s.store.Del(best); err != nil {
+		return false, err
+	}
+	e.index.Remove(best)
+	atomic.AddInt64(&e.evicted, 1)
+	s.propagate([]byte("DEL"), best)
+	return true, nil
+}
+
+// touch records an access to keys for the eviction.
+func (s *Server) touch(keys ...[]byte) {
+	if s.evict.index == nil {
+		return
+	}
+	for _, key := range keys {
+		s.evict.index.Touch(key)
+	}
+}
+
+// forget removes keys deleted from the index of the eviction.
+func (s *Server) forget(keys ...[]byte) {
+	if s.evict.index != nil {
+		s.evict.index.Remove(keys...)
+	}
+}
+
+// renamed moves the accesses of key to newKey in the index of the eviction.
+func (s *Server) renamed(key, newKey []byte) {
+	if s.evict.index != nil {
+		s.evict.index.Rename(key, newKey)
+	}
+}
+
+// forgetAll clears the index of the eviction once the store is flushed.
+func (s *Server) forgetAll() {
+	if s.evict.index != nil {
+		s.evict.index.Clear()
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.chensl.me/redix/server/internal/config"
+)
+
+func TestEvictionConfig(t *testing.T) {
+	for _, tt := range []struct {
+		cfg map[string]interface{}
+		err string
+	}{
+		{map[string]interface{}{"eviction_policy": "allkeys-random"}, `invalid eviction policy "allkeys-random"`},
+		{map[string]interface{}{"eviction_samples": 0}, "eviction_samples must be positive"},
+		{map[string]interface{}{"maxdisk": "1gb"}, "maxdisk isn't supported by the memory driver"},
+	} {
+		viper.Reset()
+		config.SetDefaults()
+		viper.Set("driver", "memory")
+		for k, v := range tt.cfg {
+			viper.Set(k, v)
+		}
+		_, err := New()
+		assert.EqualError(t, err, tt.err)
+	}
+	viper.Reset()
+}
+
+func TestEvictionLRU(t *testing.T) {
+	srv, c := newTestServer(t, map[string]interface{}{
+		"maxkeys":          3,
+		"eviction_policy":  "allkeys-lru",
+		"eviction_samples": 100,
+	})
+	defer srv.Cleanup()
+
+	assert.Equal(t, "+OK\r\n", c.do("SET", "a", "1"))
+	assert.Equal(t, "+OK\r\n", c.do("SET", "b", "2"))
+	assert.Equal(t, "+OK\r\n", c.do("SET", "c", "3"))
+	assert.Equal(t, "$1\r\n1\r\n", c.do("GET", "a"))
+	assert.Equal(t, "+OK\r\n", c.do("SET", "d", "4"))
+	assert.Equal(t, ":3\r\n", c.do("DBSIZE"))
+	assert.Equal(t, ":0\r\n", c.do("EXISTS", "b"))
+
+	// Renamed, c keeps its last access.
+	assert.Equal(t, "+OK\r\n", c.do("RENAME", "c", "e"))
+	assert.Equal(t, "+OK\r\n", c.do("SET", "f", "6"))
+	assert.Equal(t, ":0\r\n", c.do("EXISTS", "e"))
+	assert.Equal(t, ":3\r\n", c.do("EXISTS", "a", "d", "f"))
+}
+
+func TestEvictionLFU(t *testing.T) {
+	srv, c := newTestServer(t, map[string]interface{}{
+		"maxkeys":          3,
+		"eviction_policy":  "allkeys-lfu",
+		"eviction_samples": 100,
+	})
+	defer srv.Cleanup()
+
+	assert.Equal(t, "+OK\r\n", c.do("SET", "a", "1"))
+	for i := 0; i < 200; i++ {
+		c.do("GET", "a")
+	}
+	assert.Equal(t, "+OK\r\n", c.do("SET", "b", "2"))
+	assert.Equal(t, "+OK\r\n", c.do("SET", "c", "3"))
+	// a is the least recently used, but the most frequently.
+	assert.Equal(t, "+OK\r\n", c.do("SET", "d", "4"))
+	assert.Equal(t, ":0\r\n", c.do("EXISTS", "b"))
+	assert.Equal(t, ":3\r\n", c.do("EXISTS", "a", "c", "d"))
+}
+
+func TestEvictionVolatileTTL(t *testing.T) {
+	srv, c := newTestServer(t, map[string]interface{}{
+		"maxkeys":          3,
+		"eviction_policy":  "volatile-ttl",
+		"eviction_samples": 100,
+	})
+	defer srv.Cleanup()
+
+	assert.Equal(t, "+OK\r\n", c.do("SET", "a", "1"))
+	assert.Equal(t, "+OK\r\n", c.do("SET", "b", "2", "EX", "100"))
+	assert.Equal(t, "+OK\r\n", c.do("SET", "c", "3", "EX", "10"))
+	assert.Equal(t, "+OK\r\n", c.do("SET", "d", "4"))
+	assert.Equal(t, ":0\r\n", c.do("EXISTS", "c"))
+	assert.Equal(t, "+OK\r\n", c.do("SET", "e", "5"))
+	assert.Equal(t, ":0\r\n", c.do("EXISTS", "b"))
+
+	// There is no key with an expire left.
+	assert.Equal(t, "-OOM command not allowed when keys >= 'maxkeys'.\r\n", c.do("SET", "f", "6"))
+	assert.Equal(t, ":3\r\n", c.do("EXISTS", "a", "d", "e"))
+}
+
+func TestNoEviction(t *testing.T) {
+	srv, c := newTestServer(t, map[string]interface{}{
+		"maxkeys": 2,
+	})
+	defer srv.Cleanup()
+
+	assert.Equal(t, "+OK\r\n", c.do("SET", "a", "1"))
+	assert.Equal(t, ":1\r\n", c.do("INCR", "b"))
+	assert.Equal(t, "-OOM command not allowed when keys >= 'maxkeys'.\r\n", c.do("SET", "c", "3"))
+	assert.Equal(t, "-OOM command not allowed when keys >= 'maxkeys'.\r\n", c.do("MSET", "c", "3", "d", "4"))
+	// The reads and the deletes are still allowed.
+	assert.Equal(t, "$1\r\n1\r\n", c.do("GET", "a"))
+	assert.Equal(t, ":1\r\n", c.do("DEL", "a"))
+	assert.Equal(t, "+OK\r\n", c.do("SET", "c", "3"))
+	assert.Equal(t, ":2\r\n", c.do("DBSIZE"))
+}
+
+func TestEvictionMaxDisk(t *testing.T) {
+	srv, c := newTestServer(t, map[string]interface{}{
+		"driver":   "boltdb",
+		"data_dir": t.TempDir(),
+		"maxdisk":  "1",
+	})
+	defer srv.Cleanup()
+	require.NotNil(t, srv.evict.sizer)
+
+	assert.Equal(t, "-OOM command not allowed when used disk > 'maxdisk'.\r\n", c.do("SET", "a", "1"))
+	assert.Equal(t, ":0\r\n", c.do("DBSIZE"))
+}
@@ -0,0 +1,81 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.chensl.me/redix/server/pkg/bytesconv"
+)
+
+// infoSections are the sections of INFO, in order.
+var infoSections = []string{"server", "stats", "cache", "keyspace"}
+
+// INFO [section ...]
+func (s *Server) cmdINFO(c *Context) {
+	sections := make(map[string]bool)
+	for _, arg := range c.Args {
+		sections[strings.ToLower(bytesconv.BytesToString(arg))] = true
+	}
+	all := len(sections) == 0 || sections["all"] || sections["default"] || sections["everything"]
+
+	var b strings.Builder
+	for _, name := range infoSections {
+		if !all && !sections[name] {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		if err := s.writeInfo(&b, name); err != nil {
+			s.logUnknownError("info", err)
+			c.ErrUnknown(err)
+			return
+		}
+	}
+	c.AppendBulk([]byte(b.String()))
+}
+
+// writeInfo writes the section name of INFO to b.
+func (s *Server) writeInfo(b *strings.Builder, name string) error {
+	field := func(k, v string) {
+		b.WriteString(k + ":" + v + "\r\n")
+	}
+	switch name {
+	case "server":
+		b.WriteString("# Server\r\n")
+		field("process_id", strconv.Itoa(os.Getpid()))
+		field("driver", s.driver)
+		field("uptime_in_seconds", strconv.FormatInt(int64(time.Since(s.started).Seconds()), 10))
+	case "stats":
+		b.WriteString("# Stats\r\n")
+		field("evicted_keys", strconv.FormatInt(atomic.LoadInt64(&s.evict.evicted), 10))
+	case "cache":
+		b.WriteString("# Cache\r\n")
+		if s.cache == nil {
+			field("cache_enabled", "0")
+			break
+		}
+		stats := s.cache.Stats()
+		field("cache_enabled", "1")
+		field("cache_size", strconv.FormatInt(s.cacheSize, 10))
+		field("cache_hits", strconv.FormatUint(stats.Hits, 10))
+		field("cache_misses", strconv.FormatUint(stats.Misses, 10))
+	case "keyspace":
+		b.WriteString("# Keyspace\r\n")
+		n, err := s.store.DBSize()
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			field("db0", "keys="+strconv.FormatInt(n, 10))
+		}
+	}
+	return nil
+}
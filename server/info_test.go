@@ -0,0 +1,55 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInfo(t *testing.T) {
+	srv, c := newTestServer(t, nil)
+	defer srv.Cleanup()
+
+	assert.Equal(t, "+OK\r\n", c.do("SET", "a", "1"))
+	info := c.do("INFO")
+	for _, s := range []string{"# Server\r\n", "driver:memory\r\n", "evicted_keys:0\r\n", "cache_enabled:0\r\n", "db0:keys=1\r\n"} {
+		assert.Contains(t, info, s)
+	}
+	assert.Equal(t, "$24\r\n# Keyspace\r\ndb0:keys=1\r\n\r\n", c.do("INFO", "KEYSPACE"))
+	assert.Equal(t, "$0\r\n\r\n", c.do("INFO", "unknown"))
+}
+
+func TestCache(t *testing.T) {
+	srv, c := newTestServer(t, map[string]interface{}{
+		"driver":     "boltdb",
+		"data_dir":   t.TempDir(),
+		"cache_size": "1mb",
+	})
+	defer srv.Cleanup()
+	require.NotNil(t, srv.cache)
+	require.NotNil(t, srv.batcher)
+
+	assert.Equal(t, "+OK\r\n", c.do("SET", "a", "1"))
+	require.Eventually(t, func() bool {
+		return c.do("GET", "a") == "$1\r\n1\r\n" &&
+			strings.Contains(c.do("INFO", "cache"), "cache_hits:1\r\n")
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Contains(t, c.do("INFO", "cache"), "cache_size:1048576\r\n")
+
+	// The cached values are invalidated by the batches too.
+	out, _ := srv.dataHandler(c, pipeline(
+		[]string{"SET", "a", "2"},
+		[]string{"INCR", "a"},
+	))
+	assert.Equal(t, "+OK\r\n:3\r\n", string(out))
+	assert.Equal(t, "$1\r\n3\r\n", c.do("GET", "a"))
+	assert.Equal(t, "+OK\r\n", c.do("FLUSHALL"))
+	assert.Equal(t, "$-1\r\n", c.do("GET", "a"))
+}
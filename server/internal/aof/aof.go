@@ -0,0 +1,337 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package aof
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/ristretto/z"
+	"github.com/tidwall/redcon"
+	"go.uber.org/zap"
+)
+
+type FsyncPolicy int
+
+const (
+	// FsyncAlways fsyncs on every Flush, before replies are sent.
+	FsyncAlways FsyncPolicy = iota
+	// FsyncEverySec fsyncs once per second in the background.
+	FsyncEverySec
+	// FsyncNo leaves it to the operating system.
+	FsyncNo
+)
+
+var ErrRewriteInProgress = errors.New("aof: rewrite already in progress")
+
+func ParseFsyncPolicy(s string) (FsyncPolicy, error) {
+	switch strings.ToLower(s) {
+	case "always":
+		return FsyncAlways, nil
+	case "everysec":
+		return FsyncEverySec, nil
+	case "no":
+		return FsyncNo, nil
+	}
+	return 0, fmt.Errorf("aof: invalid fsync policy %q", s)
+}
+
+// AOF is an append-only journal of write commands in RESP format.
+type AOF struct {
+	mu     sync.Mutex
+	path   string
+	f      *os.File
+	policy FsyncPolicy
+	// buf holds the commands appended since the last Flush.
+	buf   []byte
+	dirty bool
+	// rewriteBuf holds the commands appended while a rewrite is running.
+	rewriting  bool
+	rewriteBuf []byte
+	rewriteWg  sync.WaitGroup
+
+	closer *z.Closer
+	logger *zap.Logger
+}
+
+// Open opens the journal at path for appending, creating it if needed.
+func Open(path string, policy FsyncPolicy, logger *zap.Logger) (*AOF, error) {
+	f, err := openFile(path)
+	if err != nil {
+		return nil, err
+	}
+	a := &AOF{
+		path:   path,
+		f:      f,
+		policy: policy,
+		closer: z.NewCloser(1),
+		logger: logger,
+	}
+	go a.fsyncLoop()
+	return a, nil
+}
+
+func openFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+}
+
+// Append adds a command to the journal. It isn't written until Flush.
+func (a *AOF) Append(args [][]byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	n := len(a.buf)
+	a.buf = appendCommand(a.buf, args)
+	if a.rewriting {
+		a.rewriteBuf = append(a.rewriteBuf, a.buf[n:]...)
+	}
+}
+
+// Flush writes the appended commands to the file, and fsyncs it with the
+// always policy.
+func (a *AOF) Flush() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.flush()
+}
+
+func (a *AOF) flush() error {
+	if len(a.buf) == 0 {
+		return nil
+	}
+	_, err := a.f.Write(a.buf)
+	a.buf = a.buf[:0]
+	if err != nil {
+		return err
+	}
+	if a.policy == FsyncAlways {
+		return a.f.Sync()
+	}
+	a.dirty = true
+	return nil
+}
+
+// StartRewrite marks the beginning of a rewrite: commands appended from
+// now on are also buffered and added to the new journal by Rewrite. The
+// snapshot given to Rewrite must reflect the dataset as of this call.
+func (a *AOF) StartRewrite() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.rewriting {
+		return ErrRewriteInProgress
+	}
+	a.rewriting = true
+	a.rewriteBuf = nil
+	a.rewriteWg.Add(1)
+	return nil
+}
+
+// Rewrite replaces the journal with a compact one made of the commands
+// emitted by snapshot followed by the commands appended since
+// StartRewrite. It must be called once after every successful
+// StartRewrite.
+func (a *AOF) Rewrite(snapshot func(emit func(args ...[]byte) error) error) error {
+	defer func() {
+		a.mu.Lock()
+		a.rewriting = false
+		a.rewriteBuf = nil
+		a.mu.Unlock()
+		a.rewriteWg.Done()
+	}()
+
+	tmp := filepath.Join(filepath.Dir(a.path), fmt.Sprintf("temp-rewriteaof-%d.aof", os.Getpid()))
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp) //nolint:errcheck
+
+	w := bufio.NewWriterSize(f, 1<<20)
+	var cmd []byte
+	err = snapshot(func(args ...[]byte) error {
+		cmd = appendCommand(cmd[:0], args)
+		_, err := w.Write(cmd)
+		return err
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// Everything appended until now is in rewriteBuf.
+	if err := a.flush(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if _, err := f.Write(a.rewriteBuf); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, a.path); err != nil {
+		return err
+	}
+
+	nf, err := openFile(a.path)
+	if err != nil {
+		return err
+	}
+	_ = a.f.Close()
+	a.f = nf
+	a.dirty = false
+	return nil
+}
+
+// Close waits for a running rewrite, then writes and fsyncs the pending
+// commands.
+func (a *AOF) Close() error {
+	a.rewriteWg.Wait()
+	a.closer.SignalAndWait()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.flush(); err != nil {
+		_ = a.f.Close()
+		return err
+	}
+	if err := a.f.Sync(); err != nil {
+		_ = a.f.Close()
+		return err
+	}
+	return a.f.Close()
+}
+
+func (a *AOF) fsyncLoop() {
+	defer a.closer.Done()
+	if a.policy != FsyncEverySec {
+		<-a.closer.HasBeenClosed()
+		return
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.closer.HasBeenClosed():
+			return
+		case <-ticker.C:
+		}
+		a.mu.Lock()
+		f, dirty := a.f, a.dirty
+		a.dirty = false
+		a.mu.Unlock()
+		if !dirty {
+			continue
+		}
+		// Sync outside the lock so the event loop isn't blocked, the file
+		// may have been replaced by a rewrite meanwhile.
+		if err := f.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+			a.logger.Error("failed to fsync AOF", zap.Error(err))
+		}
+	}
+}
+
+// Load replays the journal at path, calling fn for every command. A
+// missing file is not an error. An incomplete command at the end of the
+// file, left by a crash in the middle of a write, is truncated.
+func Load(path string, logger *zap.Logger, fn func(args [][]byte) error) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var (
+		buf    = make([]byte, 0, 64<<10)
+		args   [][]byte
+		offset int64
+		eof    bool
+	)
+	for !eof {
+		if len(buf) == cap(buf) {
+			nb := make([]byte, len(buf), 2*cap(buf))
+			copy(nb, buf)
+			buf = nb
+		}
+		n, err := f.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if err == io.EOF {
+			eof = true
+		} else if err != nil {
+			return err
+		}
+
+		data := buf
+		for len(data) > 0 {
+			pos := offset + int64(len(buf)-len(data))
+			var complete bool
+			complete, args, _, data, err = redcon.ReadNextCommand(data, args[:0])
+			if err != nil {
+				return fmt.Errorf("aof: bad format at offset %d: %w", pos, err)
+			}
+			if !complete {
+				break
+			}
+			if len(args) == 0 {
+				continue
+			}
+			if err := fn(args); err != nil {
+				return fmt.Errorf("aof: command at offset %d: %w", pos, err)
+			}
+		}
+		// offset is the end of the last complete command.
+		offset += int64(len(buf) - len(data))
+		buf = buf[:copy(buf, data)]
+	}
+
+	if len(buf) > 0 {
+		logger.Warn("AOF ends with an incomplete command, truncating",
+			zap.String("path", path),
+			zap.Int64("offset", offset),
+			zap.Int("bytes", len(buf)),
+		)
+		return os.Truncate(path, offset)
+	}
+	return nil
+}
+
+func appendCommand(b []byte, args [][]byte) []byte {
+	b = append(b, '*')
+	b = strconv.AppendInt(b, int64(len(args)), 10)
+	b = append(b, '\r', '\n')
+	for _, arg := range args {
+		b = redcon.AppendBulk(b, arg)
+	}
+	return b
+}
@@ -0,0 +1,85 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package aof
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func load(t *testing.T, path string) []string {
+	var cmds []string
+	err := Load(path, zap.NewNop(), func(args [][]byte) error {
+		parts := make([]string, len(args))
+		for i, arg := range args {
+			parts[i] = string(arg)
+		}
+		cmds = append(cmds, strings.Join(parts, " "))
+		return nil
+	})
+	require.NoError(t, err)
+	return cmds
+}
+
+func bs(args ...string) [][]byte {
+	b := make([][]byte, len(args))
+	for i, arg := range args {
+		b[i] = []byte(arg)
+	}
+	return b
+}
+
+func TestAppendLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	assert.Nil(t, load(t, path))
+
+	a, err := Open(path, FsyncAlways, zap.NewNop())
+	require.NoError(t, err)
+	a.Append(bs("SET", "a", "1"))
+	a.Append(bs("SET", "b", "hello\r\nworld"))
+	require.NoError(t, a.Flush())
+	a.Append(bs("DEL", "a"))
+	require.NoError(t, a.Close())
+
+	assert.Equal(t, []string{"SET a 1", "SET b hello\r\nworld", "DEL a"}, load(t, path))
+}
+
+func TestLoadTruncated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	full := "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n"
+	require.NoError(t, os.WriteFile(path, []byte(full+"*3\r\n$3\r\nSET\r\n$1\r\nb"), 0644))
+
+	assert.Equal(t, []string{"SET a 1"}, load(t, path))
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, full, string(b))
+}
+
+func TestRewrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	a, err := Open(path, FsyncNo, zap.NewNop())
+	require.NoError(t, err)
+	a.Append(bs("SET", "a", "1"))
+	a.Append(bs("SET", "a", "2"))
+	require.NoError(t, a.Flush())
+
+	require.NoError(t, a.StartRewrite())
+	assert.Equal(t, ErrRewriteInProgress, a.StartRewrite())
+	a.Append(bs("SET", "b", "3"))
+	err = a.Rewrite(func(emit func(args ...[]byte) error) error {
+		return emit(bs("SET", "a", "2")...)
+	})
+	require.NoError(t, err)
+	a.Append(bs("DEL", "a"))
+	require.NoError(t, a.Close())
+
+	assert.Equal(t, []string{"SET a 2", "SET b 3", "DEL a"}, load(t, path))
+}
@@ -0,0 +1,110 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package backlog implements the replication backlog, a fixed size window
+// over the end of the replication stream.
+package backlog
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrOutOfRange is returned when the requested part of the stream isn't
+// held anymore, or not yet.
+var ErrOutOfRange = errors.New("backlog: offset out of range")
+
+// Backlog keeps the last bytes of the replication stream. The bytes are
+// addressed by their offset in the stream, the first byte ever written
+// being at offset 1, as in Redis.
+type Backlog struct {
+	mu     sync.Mutex
+	buf    []byte
+	offset int64 // offset of the last byte written
+	n      int   // number of bytes held
+	notify chan struct{}
+}
+
+// New returns an empty backlog of size bytes whose next byte is at offset+1.
+func New(size int, offset int64) *Backlog {
+	return &Backlog{buf: make([]byte, size), offset: offset}
+}
+
+// Write appends p to the stream, discarding the oldest bytes.
+func (b *Backlog) Write(p []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.offset += int64(len(p))
+	if len(p) > len(b.buf) {
+		p = p[len(p)-len(b.buf):]
+	}
+	i := b.index(b.offset - int64(len(p)) + 1)
+	if n := copy(b.buf[i:], p); n < len(p) {
+		copy(b.buf, p[n:])
+	}
+	if b.n += len(p); b.n > len(b.buf) {
+		b.n = len(b.buf)
+	}
+
+	if b.notify != nil {
+		close(b.notify)
+		b.notify = nil
+	}
+}
+
+// Offset returns the offset of the last byte written.
+func (b *Backlog) Offset() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.offset
+}
+
+// Contains reports whether the stream can be read from offset, which may
+// be the offset of the next byte.
+func (b *Backlog) Contains(offset int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.contains(offset)
+}
+
+func (b *Backlog) contains(offset int64) bool {
+	return offset > b.offset-int64(b.n) && offset <= b.offset+1
+}
+
+// Read copies the stream from offset into p and returns the number of
+// bytes copied, zero when offset is the offset of the next byte.
+func (b *Backlog) Read(offset int64, p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.contains(offset) {
+		return 0, ErrOutOfRange
+	}
+	if avail := b.offset - offset + 1; int64(len(p)) > avail {
+		p = p[:avail]
+	}
+	i := b.index(offset)
+	n := copy(p, b.buf[i:])
+	if n < len(p) {
+		n += copy(p[n:], b.buf)
+	}
+	return n, nil
+}
+
+// Wait returns a channel which is closed on the next Write.
+func (b *Backlog) Wait() <-chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.notify == nil {
+		b.notify = make(chan struct{})
+	}
+	return b.notify
+}
+
+// index returns the position of the byte at offset in buf.
+func (b *Backlog) index(offset int64) int {
+	return int((offset - 1) % int64(len(b.buf)))
+}
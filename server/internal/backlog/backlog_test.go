@@ -0,0 +1,80 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package backlog
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func read(t *testing.T, b *Backlog, offset int64) string {
+	p := make([]byte, 64)
+	n, err := b.Read(offset, p)
+	require.NoError(t, err)
+	return string(p[:n])
+}
+
+func TestBacklog(t *testing.T) {
+	b := New(8, 0)
+	assert.True(t, b.Contains(1))
+	assert.False(t, b.Contains(0))
+	assert.False(t, b.Contains(2))
+	assert.Equal(t, "", read(t, b, 1))
+
+	b.Write([]byte("abcde"))
+	assert.Equal(t, int64(5), b.Offset())
+	assert.Equal(t, "abcde", read(t, b, 1))
+	assert.Equal(t, "de", read(t, b, 4))
+	assert.Equal(t, "", read(t, b, 6))
+
+	// Wraps around, "ab" is discarded.
+	b.Write([]byte("fghij"))
+	assert.Equal(t, int64(10), b.Offset())
+	assert.False(t, b.Contains(2))
+	assert.True(t, b.Contains(3))
+	assert.Equal(t, "cdefghij", read(t, b, 3))
+	assert.Equal(t, "hij", read(t, b, 8))
+	_, err := b.Read(2, make([]byte, 8))
+	assert.Equal(t, ErrOutOfRange, err)
+	_, err = b.Read(12, make([]byte, 8))
+	assert.Equal(t, ErrOutOfRange, err)
+
+	// Bounded by the size of p.
+	p := make([]byte, 3)
+	n, err := b.Read(5, p)
+	require.NoError(t, err)
+	assert.Equal(t, "efg", string(p[:n]))
+
+	// Larger than the backlog.
+	b.Write([]byte("0123456789"))
+	assert.Equal(t, int64(20), b.Offset())
+	assert.Equal(t, "23456789", read(t, b, 13))
+	assert.False(t, b.Contains(12))
+}
+
+func TestBacklogOffset(t *testing.T) {
+	b := New(4, 100)
+	assert.True(t, b.Contains(101))
+	assert.False(t, b.Contains(100))
+	b.Write([]byte("abcdef"))
+	assert.Equal(t, int64(106), b.Offset())
+	assert.Equal(t, "cdef", read(t, b, 103))
+}
+
+func TestBacklogWait(t *testing.T) {
+	b := New(8, 0)
+	ch := b.Wait()
+	assert.Equal(t, ch, b.Wait())
+	select {
+	case <-ch:
+		t.Fatal("closed before Write")
+	default:
+	}
+	b.Write([]byte("a"))
+	<-ch
+	assert.NotEqual(t, ch, b.Wait())
+}
@@ -0,0 +1,380 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package cluster
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// The nodes ping each other over the cluster bus, a TCP connection to the
+// bus port of the node. A message is a JSON document prefixed by its
+// length. Every message carries the state of the sender, the slots it
+// claims and the other nodes it knows about, a ping is answered by a pong.
+// An unknown node is only added on a MEET, sent by CLUSTER MEET, or from
+// the gossip of a known node.
+
+const (
+	msgMeet = "meet"
+	msgPing = "ping"
+	msgPong = "pong"
+
+	maxMessageSize = 1 << 20
+)
+
+var errMessageSize = errors.New("cluster: message too large")
+
+type nodeInfo struct {
+	ID      string `json:"id"`
+	IP      string `json:"ip"`
+	Port    int    `json:"port"`
+	BusPort int    `json:"bus_port"`
+	Epoch   uint64 `json:"epoch"`
+}
+
+type message struct {
+	Type         string   `json:"type"`
+	CurrentEpoch uint64   `json:"current_epoch"`
+	Sender       nodeInfo `json:"sender"`
+	// Slots is the bitmap of the slots claimed by the sender.
+	Slots  []byte     `json:"slots"`
+	Gossip []nodeInfo `json:"gossip"`
+}
+
+func writeMessage(w io.Writer, m *message) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 4, 4+len(b))
+	binary.BigEndian.PutUint32(buf, uint32(len(b)))
+	_, err = w.Write(append(buf, b...))
+	return err
+}
+
+func readMessage(r io.Reader) (*message, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n > maxMessageSize {
+		return nil, errMessageSize
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	var m message
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (c *Cluster) info(n *node) nodeInfo {
+	return nodeInfo{ID: n.id, IP: n.ip, Port: n.port, BusPort: n.busPort, Epoch: n.epoch}
+}
+
+func (c *Cluster) message(typ string) *message {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	m := &message{
+		Type:         typ,
+		CurrentEpoch: c.currentEpoch,
+		Sender:       c.info(c.myself),
+		Slots:        make([]byte, Slots/8),
+	}
+	for slot, n := range c.slots {
+		if n == c.myself {
+			m.Slots[slot/8] |= 1 << (slot % 8)
+		}
+	}
+	for _, n := range c.nodes {
+		if n != c.myself {
+			m.Gossip = append(m.Gossip, c.info(n))
+		}
+	}
+	return m
+}
+
+// pingInterval is the interval between the pings of a node, well within
+// the node timeout.
+func (c *Cluster) pingInterval() time.Duration {
+	d := c.conf.NodeTimeout / 10
+	if d > time.Second {
+		d = time.Second
+	}
+	return d
+}
+
+// track registers a bus connection, to be closed by Close. It returns false
+// once closed.
+func (c *Cluster) track(conn net.Conn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.closer.HasBeenClosed():
+		return false
+	default:
+	}
+	c.conns[conn] = struct{}{}
+	return true
+}
+
+func (c *Cluster) untrack(conn net.Conn) {
+	c.mu.Lock()
+	delete(c.conns, conn)
+	c.mu.Unlock()
+	_ = conn.Close()
+}
+
+func (c *Cluster) accept() {
+	defer c.closer.Done()
+	for {
+		conn, err := c.ln.Accept()
+		if err != nil {
+			select {
+			case <-c.closer.HasBeenClosed():
+			default:
+				c.logger.Error("cluster bus stopped", zap.Error(err))
+			}
+			return
+		}
+		if !c.track(conn) {
+			_ = conn.Close()
+			return
+		}
+		c.closer.AddRunning(1)
+		go c.serveConn(conn)
+	}
+}
+
+// serveConn answers the pings of another node.
+func (c *Cluster) serveConn(conn net.Conn) {
+	defer c.closer.Done()
+	defer c.untrack(conn)
+	r := bufio.NewReader(conn)
+	for {
+		// The node pings more often unless it's gone.
+		_ = conn.SetDeadline(time.Now().Add(c.conf.NodeTimeout))
+		m, err := readMessage(r)
+		if err != nil {
+			return
+		}
+		c.receive(m, conn, m.Type == msgMeet)
+		if err := writeMessage(conn, c.message(msgPong)); err != nil {
+			return
+		}
+	}
+}
+
+func (c *Cluster) startLink(n *node) {
+	c.closer.AddRunning(1)
+	go c.runLink(n)
+}
+
+// runLink pings n until it's forgotten, reconnecting as needed.
+func (c *Cluster) runLink(n *node) {
+	defer c.closer.Done()
+	var (
+		conn net.Conn
+		r    *bufio.Reader
+	)
+	defer func() {
+		if conn != nil {
+			c.untrack(conn)
+		}
+	}()
+	ticker := time.NewTicker(c.pingInterval())
+	defer ticker.Stop()
+	for {
+		if conn == nil {
+			c.mu.RLock()
+			addr := n.busAddr()
+			c.mu.RUnlock()
+			if nc, err := net.DialTimeout("tcp", addr, c.conf.NodeTimeout); err == nil {
+				if !c.track(nc) {
+					_ = nc.Close()
+					return
+				}
+				conn, r = nc, bufio.NewReader(nc)
+			}
+		}
+		if conn != nil {
+			err := c.ping(conn, r, msgPing)
+			if err != nil {
+				c.untrack(conn)
+				conn = nil
+			}
+			c.mu.Lock()
+			n.connected = err == nil
+			c.mu.Unlock()
+		}
+
+		select {
+		case <-c.closer.HasBeenClosed():
+			return
+		case <-n.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ping sends a message of type typ and processes the pong.
+func (c *Cluster) ping(conn net.Conn, r *bufio.Reader, typ string) error {
+	_ = conn.SetDeadline(time.Now().Add(c.conf.NodeTimeout))
+	if err := writeMessage(conn, c.message(typ)); err != nil {
+		return err
+	}
+	m, err := readMessage(r)
+	if err != nil {
+		return err
+	}
+	c.receive(m, conn, typ == msgMeet)
+	return nil
+}
+
+// meet sends a MEET to the bus at addr, the node is added from its pong.
+func (c *Cluster) meet(addr string) {
+	defer c.closer.Done()
+	conn, err := net.DialTimeout("tcp", addr, c.conf.NodeTimeout)
+	if err != nil {
+		c.logger.Warn("failed to meet cluster node", zap.String("addr", addr), zap.Error(err))
+		return
+	}
+	if !c.track(conn) {
+		_ = conn.Close()
+		return
+	}
+	defer c.untrack(conn)
+	if err := c.ping(conn, bufio.NewReader(conn), msgMeet); err != nil {
+		c.logger.Warn("failed to meet cluster node", zap.String("addr", addr), zap.Error(err))
+	}
+}
+
+// receive merges the state of the sender of m. trusted allows an unknown
+// sender to be added.
+func (c *Cluster) receive(m *message, conn net.Conn, trusted bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var changed bool
+	defer func() {
+		if !changed {
+			return
+		}
+		if err := c.save(); err != nil {
+			c.logger.Error("failed to save cluster config", zap.Error(err))
+		}
+	}()
+
+	if c.myself.ip == "" {
+		// This node is reached at the address the other node sees.
+		if ip := hostIP(conn.LocalAddr()); ip != "" {
+			c.myself.ip = ip
+			changed = true
+		}
+	}
+	info := m.Sender
+	if info.ID == "" || info.ID == c.myself.id {
+		return
+	}
+	if info.IP == "" {
+		info.IP = hostIP(conn.RemoteAddr())
+	}
+	if m.CurrentEpoch > c.currentEpoch {
+		c.currentEpoch = m.CurrentEpoch
+		changed = true
+	}
+
+	sender := c.nodes[info.ID]
+	if sender == nil {
+		if !trusted || c.isForgotten(info.ID) {
+			return
+		}
+		sender = c.addNode(info)
+		c.startLink(sender)
+		c.logger.Info("cluster node added", zap.String("id", info.ID), zap.String("addr", sender.addr()))
+		changed = true
+	}
+	sender.seen = time.Now()
+	if c.info(sender) != info {
+		sender.ip, sender.port, sender.busPort, sender.epoch = info.IP, info.Port, info.BusPort, info.Epoch
+		changed = true
+	}
+	if c.updateSlots(sender, m.Slots) {
+		changed = true
+	}
+	if sender.epoch == c.myself.epoch && c.myself.id < sender.id {
+		// Two nodes with the same epoch could claim the same slots, the
+		// one with the smaller ID moves on.
+		c.bumpEpoch()
+		changed = true
+	}
+
+	for _, g := range m.Gossip {
+		if g.ID == c.myself.id || g.IP == "" || c.nodes[g.ID] != nil || c.isForgotten(g.ID) {
+			continue
+		}
+		n := c.addNode(g)
+		c.startLink(n)
+		c.logger.Info("cluster node added from gossip", zap.String("id", g.ID), zap.String("addr", n.addr()))
+		changed = true
+	}
+}
+
+// updateSlots gives sender the slots it claims, unless they are owned by a
+// node with a greater epoch, or imported.
+func (c *Cluster) updateSlots(sender *node, claims []byte) bool {
+	if len(claims) != Slots/8 {
+		return false
+	}
+	var changed bool
+	for slot := 0; slot < Slots; slot++ {
+		if claims[slot/8]&(1<<(slot%8)) == 0 {
+			continue
+		}
+		owner := c.slots[slot]
+		if owner == sender || c.importing[slot] != nil {
+			continue
+		}
+		if owner != nil && owner.epoch >= sender.epoch {
+			continue
+		}
+		if owner == c.myself {
+			c.logger.Warn("hash slot taken over", zap.Int("slot", slot), zap.String("id", sender.id))
+			c.migrating[slot] = nil
+		}
+		c.assign(slot, sender)
+		changed = true
+	}
+	return changed
+}
+
+func (c *Cluster) isForgotten(id string) bool {
+	until, ok := c.forgotten[id]
+	if ok && time.Now().After(until) {
+		delete(c.forgotten, id)
+		return false
+	}
+	return ok
+}
+
+func hostIP(addr net.Addr) string {
+	if a, ok := addr.(*net.TCPAddr); ok {
+		return a.IP.String()
+	}
+	return ""
+}
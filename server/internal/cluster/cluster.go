@@ -0,0 +1,546 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package cluster keeps the state of a Redis Cluster node: the known
+// nodes and the owner of every hash slot. The nodes exchange their state
+// over the cluster bus, see bus.go, and the claim of the node with the
+// greatest config epoch wins when two nodes claim the same slot.
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/ristretto/z"
+	"go.chensl.me/redix/server/internal/runid"
+	"go.uber.org/zap"
+)
+
+type Config struct {
+	// File keeps the state of the node across restarts.
+	File string
+	// IP is announced to the other nodes, it's learned from them if empty.
+	IP          string
+	Port        int
+	BusPort     int
+	NodeTimeout time.Duration
+}
+
+// node is a member of the cluster, as seen by this node.
+type node struct {
+	id      string
+	ip      string
+	port    int
+	busPort int
+	// epoch is the config epoch of the node.
+	epoch uint64
+	// numSlots is the number of slots owned by the node.
+	numSlots int
+
+	// seen is the last time a message of the node was received.
+	seen      time.Time
+	connected bool
+	// done stops the link to the node once forgotten.
+	done chan struct{}
+}
+
+func (n *node) addr() string {
+	return net.JoinHostPort(n.ip, strconv.Itoa(n.port))
+}
+
+func (n *node) busAddr() string {
+	return net.JoinHostPort(n.ip, strconv.Itoa(n.busPort))
+}
+
+type Cluster struct {
+	conf   Config
+	logger *zap.Logger
+
+	mu           sync.RWMutex
+	myself       *node
+	nodes        map[string]*node
+	currentEpoch uint64
+	// slots is changed with assign.
+	slots     [Slots]*node
+	assigned  int
+	migrating [Slots]*node
+	importing [Slots]*node
+	// forgotten nodes aren't added back from gossip until the time.
+	forgotten map[string]time.Time
+
+	ln     net.Listener
+	conns  map[net.Conn]struct{}
+	closer *z.Closer
+}
+
+// Open loads the state of the node from the configuration file, or creates
+// a new node, then serves the cluster bus.
+func Open(conf Config, logger *zap.Logger) (*Cluster, error) {
+	c := &Cluster{
+		conf:      conf,
+		logger:    logger,
+		nodes:     make(map[string]*node),
+		forgotten: make(map[string]time.Time),
+		conns:     make(map[net.Conn]struct{}),
+		closer:    z.NewCloser(0),
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	if conf.IP != "" {
+		c.myself.ip = conf.IP
+	}
+	c.myself.port = conf.Port
+	c.myself.busPort = conf.BusPort
+	if err := c.save(); err != nil {
+		return nil, err
+	}
+
+	ln, err := net.Listen("tcp", net.JoinHostPort(conf.IP, strconv.Itoa(conf.BusPort)))
+	if err != nil {
+		return nil, err
+	}
+	c.ln = ln
+	c.closer.AddRunning(1)
+	go c.accept()
+	for _, n := range c.nodes {
+		if n != c.myself {
+			c.startLink(n)
+		}
+	}
+	return c, nil
+}
+
+// Close stops the cluster bus.
+func (c *Cluster) Close() error {
+	c.closer.Signal()
+	err := c.ln.Close()
+	c.mu.Lock()
+	for conn := range c.conns {
+		_ = conn.Close()
+	}
+	c.mu.Unlock()
+	c.closer.Wait()
+	return err
+}
+
+func (c *Cluster) addNode(info nodeInfo) *node {
+	n := &node{
+		id:      info.ID,
+		ip:      info.IP,
+		port:    info.Port,
+		busPort: info.BusPort,
+		epoch:   info.Epoch,
+		seen:    time.Now(),
+		done:    make(chan struct{}),
+	}
+	c.nodes[n.id] = n
+	return n
+}
+
+// failing reports whether n didn't send anything within the node timeout.
+func (c *Cluster) failing(n *node) bool {
+	return n != c.myself && time.Since(n.seen) > c.conf.NodeTimeout
+}
+
+// up reports whether every slot is served by a node which isn't failing.
+func (c *Cluster) up() bool {
+	if c.assigned != Slots {
+		return false
+	}
+	for _, n := range c.nodes {
+		if n.numSlots > 0 && c.failing(n) {
+			return false
+		}
+	}
+	return true
+}
+
+// assign gives slot to n, nil unassigns it.
+func (c *Cluster) assign(slot int, n *node) {
+	if old := c.slots[slot]; old != nil {
+		old.numSlots--
+		c.assigned--
+	}
+	if n != nil {
+		n.numSlots++
+		c.assigned++
+	}
+	c.slots[slot] = n
+}
+
+// bumpEpoch gives this node the greatest config epoch, without the
+// agreement of the other nodes.
+func (c *Cluster) bumpEpoch() {
+	c.currentEpoch++
+	c.myself.epoch = c.currentEpoch
+}
+
+func (c *Cluster) MyID() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.myself.id
+}
+
+// Route tells which nodes serve a slot, by client address.
+type Route struct {
+	// Up is false if a slot isn't served.
+	Up        bool
+	Mine      bool
+	Owner     string
+	Migrating string
+	Importing string
+}
+
+func (c *Cluster) Route(slot int) Route {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	r := Route{Up: c.up()}
+	if n := c.slots[slot]; n != nil {
+		r.Mine = n == c.myself
+		r.Owner = n.addr()
+	}
+	if n := c.migrating[slot]; n != nil {
+		r.Migrating = n.addr()
+	}
+	if n := c.importing[slot]; n != nil {
+		r.Importing = n.addr()
+	}
+	return r
+}
+
+// Info is the state reported by CLUSTER INFO.
+type Info struct {
+	Up            bool
+	SlotsAssigned int
+	SlotsFail     int
+	KnownNodes    int
+	// Size is the number of nodes serving slots.
+	Size         int
+	CurrentEpoch uint64
+	MyEpoch      uint64
+}
+
+func (c *Cluster) Info() Info {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	info := Info{
+		Up:            c.up(),
+		SlotsAssigned: c.assigned,
+		KnownNodes:    len(c.nodes),
+		CurrentEpoch:  c.currentEpoch,
+		MyEpoch:       c.myself.epoch,
+	}
+	for _, n := range c.nodes {
+		if n.numSlots == 0 {
+			continue
+		}
+		info.Size++
+		if c.failing(n) {
+			info.SlotsFail += n.numSlots
+		}
+	}
+	return info
+}
+
+// Node is a node as reported by CLUSTER NODES, SLOTS and SHARDS.
+type Node struct {
+	ID        string
+	IP        string
+	Port      int
+	BusPort   int
+	Epoch     uint64
+	Myself    bool
+	Fail      bool
+	Connected bool
+	// PongReceived is the last time a message of the node was received.
+	PongReceived time.Time
+	Slots        []Range
+	// Migrating and Importing map the slots to the other node, they are
+	// only known for this node.
+	Migrating map[int]string
+	Importing map[int]string
+}
+
+// Nodes returns the known nodes, sorted by ID.
+func (c *Cluster) Nodes() []Node {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	nodes := make([]Node, 0, len(c.nodes))
+	for _, n := range c.nodes {
+		v := Node{
+			ID:           n.id,
+			IP:           n.ip,
+			Port:         n.port,
+			BusPort:      n.busPort,
+			Epoch:        n.epoch,
+			Myself:       n == c.myself,
+			Fail:         c.failing(n),
+			Connected:    n == c.myself || n.connected,
+			PongReceived: n.seen,
+			Slots:        c.ranges(n),
+		}
+		if v.Myself {
+			v.Migrating = make(map[int]string)
+			v.Importing = make(map[int]string)
+			for slot := 0; slot < Slots; slot++ {
+				if m := c.migrating[slot]; m != nil {
+					v.Migrating[slot] = m.id
+				}
+				if m := c.importing[slot]; m != nil {
+					v.Importing[slot] = m.id
+				}
+			}
+		}
+		nodes = append(nodes, v)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes
+}
+
+func (c *Cluster) ranges(n *node) []Range {
+	return ranges(func(slot int) bool { return c.slots[slot] == n })
+}
+
+// Meet adds the node at ip and port to the cluster. The handshake is done
+// in the background.
+func (c *Cluster) Meet(ip string, port, busPort int) error {
+	if net.ParseIP(ip) == nil {
+		return fmt.Errorf("ERR Invalid node address specified: %s:%d", ip, port)
+	}
+	addr := net.JoinHostPort(ip, strconv.Itoa(busPort))
+	c.closer.AddRunning(1)
+	go c.meet(addr)
+	return nil
+}
+
+// AddSlots assigns the slots to this node, none of them must be assigned.
+func (c *Cluster) AddSlots(slots []int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, slot := range slots {
+		if c.slots[slot] != nil {
+			return fmt.Errorf("ERR Slot %d is already busy", slot)
+		}
+	}
+	for _, slot := range slots {
+		c.assign(slot, c.myself)
+		c.importing[slot] = nil
+	}
+	return c.save()
+}
+
+// DelSlots unassigns the slots, all of them must be assigned.
+func (c *Cluster) DelSlots(slots []int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, slot := range slots {
+		if c.slots[slot] == nil {
+			return fmt.Errorf("ERR Slot %d is already unassigned", slot)
+		}
+	}
+	for _, slot := range slots {
+		c.assign(slot, nil)
+		c.migrating[slot] = nil
+		c.importing[slot] = nil
+	}
+	return c.save()
+}
+
+// The states of CLUSTER SETSLOT.
+const (
+	SlotMigrating = "MIGRATING"
+	SlotImporting = "IMPORTING"
+	SlotStable    = "STABLE"
+	SlotNode      = "NODE"
+)
+
+// SetSlot changes the migration state or the owner of a slot. When this
+// node is given the slot it was importing, it bumps its epoch so that its
+// claim wins.
+func (c *Cluster) SetSlot(slot int, state, id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var n *node
+	if state != SlotStable {
+		if n = c.nodes[id]; n == nil {
+			return fmt.Errorf("ERR I don't know about node %s", id)
+		}
+	}
+	switch state {
+	case SlotMigrating:
+		if c.slots[slot] != c.myself {
+			return fmt.Errorf("ERR I'm not the owner of hash slot %d", slot)
+		}
+		if n == c.myself {
+			return errors.New("ERR Target node is myself")
+		}
+		c.migrating[slot] = n
+	case SlotImporting:
+		if c.slots[slot] == c.myself {
+			return fmt.Errorf("ERR I'm already the owner of hash slot %d", slot)
+		}
+		if n == c.myself {
+			return errors.New("ERR Source node is myself")
+		}
+		c.importing[slot] = n
+	case SlotStable:
+		c.migrating[slot] = nil
+		c.importing[slot] = nil
+	case SlotNode:
+		if n != c.myself {
+			c.migrating[slot] = nil
+		} else if c.importing[slot] != nil {
+			c.importing[slot] = nil
+			c.bumpEpoch()
+		}
+		c.assign(slot, n)
+	default:
+		return errors.New("ERR Invalid CLUSTER SETSLOT action or number of arguments")
+	}
+	return c.save()
+}
+
+// Forget removes a node, it isn't added back from gossip for a minute.
+func (c *Cluster) Forget(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := c.nodes[id]
+	if n == nil {
+		return fmt.Errorf("ERR Unknown node %s", id)
+	}
+	if n == c.myself {
+		return errors.New("ERR I tried hard but I can't forget myself...")
+	}
+	delete(c.nodes, id)
+	close(n.done)
+	c.forgotten[id] = time.Now().Add(time.Minute)
+	for slot := 0; slot < Slots; slot++ {
+		if c.slots[slot] == n {
+			c.assign(slot, nil)
+		}
+		if c.migrating[slot] == n {
+			c.migrating[slot] = nil
+		}
+		if c.importing[slot] == n {
+			c.importing[slot] = nil
+		}
+	}
+	return c.save()
+}
+
+// SaveConfig writes the state to the configuration file.
+func (c *Cluster) SaveConfig() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.save()
+}
+
+// fileState is the content of the configuration file.
+type fileState struct {
+	CurrentEpoch uint64         `json:"current_epoch"`
+	Myself       string         `json:"myself"`
+	Nodes        []fileNode     `json:"nodes"`
+	Migrating    map[int]string `json:"migrating,omitempty"`
+	Importing    map[int]string `json:"importing,omitempty"`
+}
+
+type fileNode struct {
+	nodeInfo
+	Slots string `json:"slots"`
+}
+
+func (c *Cluster) load() error {
+	b, err := os.ReadFile(c.conf.File)
+	if os.IsNotExist(err) {
+		c.myself = c.addNode(nodeInfo{ID: runid.New()})
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var st fileState
+	if err := json.Unmarshal(b, &st); err != nil {
+		return fmt.Errorf("cluster: %s: %w", c.conf.File, err)
+	}
+
+	c.currentEpoch = st.CurrentEpoch
+	for _, fn := range st.Nodes {
+		n := c.addNode(fn.nodeInfo)
+		rs, err := parseRanges(fn.Slots)
+		if err != nil {
+			return err
+		}
+		for _, r := range rs {
+			for slot := r.Start; slot <= r.End; slot++ {
+				c.assign(slot, n)
+			}
+		}
+	}
+	if c.myself = c.nodes[st.Myself]; c.myself == nil {
+		return fmt.Errorf("cluster: %s: myself isn't a node", c.conf.File)
+	}
+	for slot, id := range st.Migrating {
+		if slot >= 0 && slot < Slots {
+			c.migrating[slot] = c.nodes[id]
+		}
+	}
+	for slot, id := range st.Importing {
+		if slot >= 0 && slot < Slots {
+			c.importing[slot] = c.nodes[id]
+		}
+	}
+	return nil
+}
+
+// save writes the state to the configuration file, it's replaced
+// atomically.
+func (c *Cluster) save() error {
+	st := fileState{
+		CurrentEpoch: c.currentEpoch,
+		Myself:       c.myself.id,
+		Migrating:    make(map[int]string),
+		Importing:    make(map[int]string),
+	}
+	for _, n := range c.nodes {
+		st.Nodes = append(st.Nodes, fileNode{
+			nodeInfo: c.info(n),
+			Slots:    formatRanges(c.ranges(n)),
+		})
+	}
+	sort.Slice(st.Nodes, func(i, j int) bool { return st.Nodes[i].ID < st.Nodes[j].ID })
+	for slot := 0; slot < Slots; slot++ {
+		if n := c.migrating[slot]; n != nil {
+			st.Migrating[slot] = n.id
+		}
+		if n := c.importing[slot]; n != nil {
+			st.Importing[slot] = n.id
+		}
+	}
+	b, err := json.MarshalIndent(&st, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(filepath.Dir(c.conf.File), "."+filepath.Base(c.conf.File)+".tmp")
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.conf.File)
+}
@@ -0,0 +1,136 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package cluster
+
+import (
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func freePort(t *testing.T) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func testConfig(t *testing.T) Config {
+	return Config{
+		File:        filepath.Join(t.TempDir(), "nodes.json"),
+		IP:          "127.0.0.1",
+		Port:        freePort(t),
+		BusPort:     freePort(t),
+		NodeTimeout: time.Second,
+	}
+}
+
+func open(t *testing.T, conf Config) *Cluster {
+	c, err := Open(conf, zap.NewNop())
+	require.NoError(t, err)
+	return c
+}
+
+func TestPersistence(t *testing.T) {
+	conf := testConfig(t)
+	c := open(t, conf)
+	id := c.MyID()
+	assert.Len(t, id, 40)
+	assert.False(t, c.Info().Up)
+
+	require.NoError(t, c.AddSlots([]int{0, 1, 2, 100}))
+	assert.EqualError(t, c.AddSlots([]int{3, 2}), "ERR Slot 2 is already busy")
+	require.NoError(t, c.DelSlots([]int{100}))
+	assert.EqualError(t, c.DelSlots([]int{100}), "ERR Slot 100 is already unassigned")
+	require.NoError(t, c.Close())
+
+	c = open(t, conf)
+	defer c.Close()
+	assert.Equal(t, id, c.MyID())
+	nodes := c.Nodes()
+	require.Len(t, nodes, 1)
+	assert.True(t, nodes[0].Myself)
+	assert.Equal(t, []Range{{0, 2}}, nodes[0].Slots)
+	assert.Equal(t, 3, c.Info().SlotsAssigned)
+	assert.Equal(t, Route{Mine: true, Owner: nodes[0].IP + ":" + strconv.Itoa(conf.Port)}, c.Route(1))
+}
+
+func TestSetSlotErrors(t *testing.T) {
+	c := open(t, testConfig(t))
+	defer c.Close()
+	require.NoError(t, c.AddSlots([]int{0}))
+
+	assert.EqualError(t, c.SetSlot(0, SlotMigrating, "unknown"), "ERR I don't know about node unknown")
+	assert.EqualError(t, c.SetSlot(1, SlotMigrating, c.MyID()), "ERR I'm not the owner of hash slot 1")
+	assert.EqualError(t, c.SetSlot(0, SlotImporting, c.MyID()), "ERR I'm already the owner of hash slot 0")
+	assert.EqualError(t, c.Forget(c.MyID()), "ERR I tried hard but I can't forget myself...")
+	assert.EqualError(t, c.Meet("localhost", 1, 2), "ERR Invalid node address specified: localhost:1")
+}
+
+func TestGossip(t *testing.T) {
+	var cs []*Cluster
+	for i := 0; i < 3; i++ {
+		c := open(t, testConfig(t))
+		defer c.Close()
+		cs = append(cs, c)
+	}
+	require.NoError(t, cs[0].AddSlots(seq(0, 8191)))
+	require.NoError(t, cs[1].AddSlots(seq(8192, 16383)))
+
+	// The second and third nodes learn about each other from gossip.
+	require.NoError(t, cs[0].Meet("127.0.0.1", cs[1].conf.Port, cs[1].conf.BusPort))
+	require.NoError(t, cs[0].Meet("127.0.0.1", cs[2].conf.Port, cs[2].conf.BusPort))
+	for _, c := range cs {
+		c := c
+		require.Eventually(t, func() bool {
+			info := c.Info()
+			return info.Up && info.KnownNodes == 3 && info.Size == 2
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+	owner := cs[1].Route(10000).Owner
+	assert.Equal(t, owner, cs[2].Route(10000).Owner)
+
+	// Slot 10000 moves from the second node to the third one, which bumps
+	// its epoch so that its claim wins.
+	require.NoError(t, cs[2].SetSlot(10000, SlotImporting, cs[1].MyID()))
+	require.NoError(t, cs[1].SetSlot(10000, SlotMigrating, cs[2].MyID()))
+	r := cs[1].Route(10000)
+	assert.NotEmpty(t, cs[2].Route(10000).Importing)
+	assert.NotEmpty(t, r.Migrating)
+	require.NoError(t, cs[2].SetSlot(10000, SlotNode, cs[2].MyID()))
+	assert.True(t, cs[2].Route(10000).Mine)
+	for _, c := range cs {
+		c := c
+		require.Eventually(t, func() bool {
+			return c.Route(10000).Owner == r.Migrating
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+	assert.Empty(t, cs[1].Route(10000).Migrating)
+	assert.Equal(t, owner, cs[0].Route(10001).Owner)
+
+	// A node which stops answering fails the cluster.
+	require.NoError(t, cs[1].Close())
+	require.Eventually(t, func() bool {
+		return !cs[0].Info().Up && cs[0].Info().SlotsFail == 8191
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, cs[0].Forget(cs[1].MyID()))
+	assert.Equal(t, 2, cs[0].Info().KnownNodes)
+	assert.Equal(t, 8193, cs[0].Info().SlotsAssigned)
+}
+
+func seq(start, end int) []int {
+	var slots []int
+	for slot := start; slot <= end; slot++ {
+		slots = append(slots, slot)
+	}
+	return slots
+}
@@ -0,0 +1,63 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package cluster
+
+import "sync"
+
+// SlotKeys indexes keys by hash slot, so that the keys of a slot are listed
+// without scanning the store. It's safe for concurrent use.
+type SlotKeys struct {
+	mu    sync.Mutex
+	slots [Slots]map[string]struct{}
+}
+
+// NewSlotKeys returns an empty index.
+func NewSlotKeys() *SlotKeys {
+	return new(SlotKeys)
+}
+
+// Add indexes keys.
+func (x *SlotKeys) Add(keys ...[]byte) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for _, key := range keys {
+		slot := KeySlot(key)
+		if x.slots[slot] == nil {
+			x.slots[slot] = make(map[string]struct{})
+		}
+		x.slots[slot][string(key)] = struct{}{}
+	}
+}
+
+// Remove removes keys from the index.
+func (x *SlotKeys) Remove(keys ...[]byte) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for _, key := range keys {
+		slot := KeySlot(key)
+		delete(x.slots[slot], string(key))
+		if len(x.slots[slot]) == 0 {
+			x.slots[slot] = nil
+		}
+	}
+}
+
+// Clear removes every key.
+func (x *SlotKeys) Clear() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.slots = [Slots]map[string]struct{}{}
+}
+
+// Keys returns a copy of the keys of slot, in no particular order.
+func (x *SlotKeys) Keys(slot int) [][]byte {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	keys := make([][]byte, 0, len(x.slots[slot]))
+	for key := range x.slots[slot] {
+		keys = append(keys, []byte(key))
+	}
+	return keys
+}
@@ -0,0 +1,30 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package cluster
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlotKeys(t *testing.T) {
+	x := NewSlotKeys()
+	x.Add([]byte("{user1000}.following"), []byte("{user1000}.followers"), []byte("foo"))
+	x.Add([]byte("foo"))
+
+	assert.ElementsMatch(t, [][]byte{
+		[]byte("{user1000}.following"), []byte("{user1000}.followers"),
+	}, x.Keys(3443))
+	assert.Equal(t, [][]byte{[]byte("foo")}, x.Keys(12182))
+	assert.Empty(t, x.Keys(5061))
+
+	x.Remove([]byte("{user1000}.following"), []byte("bar"))
+	assert.Equal(t, [][]byte{[]byte("{user1000}.followers")}, x.Keys(3443))
+
+	x.Clear()
+	assert.Empty(t, x.Keys(3443))
+	assert.Empty(t, x.Keys(12182))
+}
@@ -0,0 +1,108 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package cluster
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Slots is the number of hash slots, the keys are sharded by slot.
+const Slots = 16384
+
+var crc16Table [256]uint16
+
+func init() {
+	// CRC16-CCITT (XMODEM), as in Redis.
+	for i := range crc16Table {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		crc16Table[i] = crc
+	}
+}
+
+func crc16(b []byte) uint16 {
+	var crc uint16
+	for _, c := range b {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^c]
+	}
+	return crc
+}
+
+// KeySlot returns the hash slot of key. Only the hash tag, the part between
+// the first { and the next }, is hashed if not empty, so that related keys
+// can be put in the same slot.
+func KeySlot(key []byte) int {
+	if i := bytes.IndexByte(key, '{'); i >= 0 {
+		if j := bytes.IndexByte(key[i+1:], '}'); j > 0 {
+			key = key[i+1 : i+1+j]
+		}
+	}
+	return int(crc16(key)) & (Slots - 1)
+}
+
+// Range is a range of slots, inclusive.
+type Range struct {
+	Start, End int
+}
+
+func (r Range) String() string {
+	if r.Start == r.End {
+		return strconv.Itoa(r.Start)
+	}
+	return strconv.Itoa(r.Start) + "-" + strconv.Itoa(r.End)
+}
+
+// ranges returns the ranges of the slots for which owned returns true.
+func ranges(owned func(slot int) bool) []Range {
+	var rs []Range
+	for slot := 0; slot < Slots; slot++ {
+		if !owned(slot) {
+			continue
+		}
+		if n := len(rs); n > 0 && rs[n-1].End == slot-1 {
+			rs[n-1].End = slot
+		} else {
+			rs = append(rs, Range{slot, slot})
+		}
+	}
+	return rs
+}
+
+// formatRanges returns the ranges separated by spaces, as in CLUSTER NODES.
+func formatRanges(rs []Range) string {
+	ss := make([]string, len(rs))
+	for i, r := range rs {
+		ss[i] = r.String()
+	}
+	return strings.Join(ss, " ")
+}
+
+func parseRanges(s string) ([]Range, error) {
+	var rs []Range
+	for _, f := range strings.Fields(s) {
+		start, end := f, f
+		if i := strings.IndexByte(f, '-'); i >= 0 {
+			start, end = f[:i], f[i+1:]
+		}
+		var r Range
+		var err1, err2 error
+		r.Start, err1 = strconv.Atoi(start)
+		r.End, err2 = strconv.Atoi(end)
+		if err1 != nil || err2 != nil || r.Start < 0 || r.End >= Slots || r.Start > r.End {
+			return nil, fmt.Errorf("cluster: invalid slot range %q", f)
+		}
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
@@ -0,0 +1,53 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package cluster
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeySlot(t *testing.T) {
+	assert.Equal(t, uint16(0x31c3), crc16([]byte("123456789")))
+
+	tests := []struct {
+		key  string
+		slot int
+	}{
+		{"", 0},
+		{"foo", 12182},
+		{"bar", 5061},
+		{"{user1000}.following", 3443},
+		{"{user1000}.followers", 3443},
+		{"user1000", 3443},
+		{"{bar}{foo}", 5061},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.slot, KeySlot([]byte(tt.key)), tt.key)
+	}
+
+	// Empty or unterminated tags hash the whole key.
+	for _, key := range []string{"foo{}{bar}", "foo{bar", "foo}bar{"} {
+		assert.Equal(t, int(crc16([]byte(key)))%Slots, KeySlot([]byte(key)), key)
+	}
+}
+
+func TestRanges(t *testing.T) {
+	rs := ranges(func(slot int) bool {
+		return slot <= 2 || slot == 5 || slot >= 16380
+	})
+	assert.Equal(t, []Range{{0, 2}, {5, 5}, {16380, 16383}}, rs)
+	assert.Equal(t, "0-2 5 16380-16383", formatRanges(rs))
+
+	parsed, err := parseRanges("0-2 5 16380-16383")
+	require.NoError(t, err)
+	assert.Equal(t, rs, parsed)
+	for _, s := range []string{"x", "2-1", "0-16384", "-1"} {
+		_, err := parseRanges(s)
+		assert.Error(t, err, s)
+	}
+}
@@ -6,6 +6,7 @@ package config
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/spf13/viper"
 )
@@ -17,13 +18,11 @@ func MustInit() {
 	viper.AddConfigPath("$HOME/.redix")
 	viper.AddConfigPath(".")
 	viper.SetEnvPrefix("redix")
+	// The options of the drivers are nested, e.g. REDIX_MYSQL_HOST sets
+	// mysql.host.
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	viper.AutomaticEnv()
-
-	viper.SetDefault("host", "0.0.0.0")
-	viper.SetDefault("port", 6380)
-	viper.SetDefault("password", "")
-	viper.SetDefault("data_dir", "./data")
-	viper.SetDefault("driver", "badger")
+	SetDefaults()
 
 	if err := viper.ReadInConfig(); err != nil {
 		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
@@ -31,3 +30,68 @@ func MustInit() {
 		}
 	}
 }
+
+// SetDefaults sets the default value of every option.
+func SetDefaults() {
+	viper.SetDefault("host", "0.0.0.0")
+	viper.SetDefault("port", 6380)
+	viper.SetDefault("num_loops", 1)
+	viper.SetDefault("load_balance", "random")
+	viper.SetDefault("offload", "")
+	viper.SetDefault("offload_workers", 0)
+	viper.SetDefault("batch_writes", true)
+	viper.SetDefault("shutdown_timeout", "10s")
+	viper.SetDefault("maxkeys", 0)
+	viper.SetDefault("maxdisk", "0")
+	viper.SetDefault("eviction_policy", "noeviction")
+	viper.SetDefault("eviction_samples", 5)
+	viper.SetDefault("cache_size", "0")
+	viper.SetDefault("tracking_table_max_keys", 1000000)
+	viper.SetDefault("password", "")
+	viper.SetDefault("data_dir", "./data")
+	viper.SetDefault("driver", "badger")
+	viper.SetDefault("rdb_file", "./dump.rdb")
+	viper.SetDefault("rdb_import", "")
+	viper.SetDefault("appendonly", false)
+	viper.SetDefault("appendfilename", "./appendonly.aof")
+	viper.SetDefault("appendfsync", "everysec")
+	viper.SetDefault("backup_dir", "./backups")
+	viper.SetDefault("backup_interval", 0)
+	viper.SetDefault("backup_retention", 7)
+	viper.SetDefault("backup_restore", "")
+	viper.SetDefault("admin_addr", "")
+	viper.SetDefault("replicaof", "")
+	viper.SetDefault("masterauth", "")
+	viper.SetDefault("replica_read_only", true)
+	viper.SetDefault("repl_backlog_size", "1mb")
+	viper.SetDefault("repl_timeout", "60s")
+	viper.SetDefault("repl_ping_replica_period", "10s")
+	viper.SetDefault("raft.addr", "")
+	viper.SetDefault("raft.node_id", "")
+	viper.SetDefault("raft.dir", "./raft")
+	viper.SetDefault("raft.bootstrap", false)
+	viper.SetDefault("raft.join", "")
+	viper.SetDefault("cluster.enabled", false)
+	viper.SetDefault("cluster.config_file", "./nodes.json")
+	viper.SetDefault("cluster.node_timeout", "15s")
+	viper.SetDefault("cluster.bus_port", 0)
+	viper.SetDefault("cluster.announce_ip", "")
+	viper.SetDefault("sentinel.port", 26379)
+	viper.SetDefault("sentinel.monitor", "")
+	viper.SetDefault("sentinel.peers", "")
+	viper.SetDefault("sentinel.down_after", "30s")
+	viper.SetDefault("sentinel.failover_timeout", "3m")
+	viper.SetDefault("sentinel.auth_pass", "")
+	viper.SetDefault("sentinel.config_file", "./sentinel.json")
+	viper.SetDefault("mysql.host", "127.0.0.1")
+	viper.SetDefault("mysql.port", 3306)
+	viper.SetDefault("mysql.username", "root")
+	viper.SetDefault("mysql.password", "")
+	viper.SetDefault("mysql.database", "redix")
+	viper.SetDefault("postgres.host", "127.0.0.1")
+	viper.SetDefault("postgres.port", 5432)
+	viper.SetDefault("postgres.username", "postgres")
+	viper.SetDefault("postgres.password", "")
+	viper.SetDefault("postgres.database", "redix")
+	viper.SetDefault("postgres.sslmode", "disable")
+}
@@ -0,0 +1,211 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package evict implements the eviction policies of a size-bounded store,
+// as the maxmemory-policy of Redis: the keys to evict are chosen among a
+// sample of the store by their last access time, their access frequency or
+// their TTL.
+package evict
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Policy chooses the keys evicted once the store is full.
+type Policy int
+
+const (
+	// NoEviction evicts nothing, the writes fail instead.
+	NoEviction Policy = iota
+	// AllKeysLRU evicts the least recently used keys.
+	AllKeysLRU
+	// AllKeysLFU evicts the least frequently used keys.
+	AllKeysLFU
+	// VolatileLRU evicts the least recently used keys among the keys with
+	// an expire.
+	VolatileLRU
+	// VolatileTTL evicts the keys with the shortest TTL.
+	VolatileTTL
+)
+
+var policyNames = []string{
+	NoEviction:  "noeviction",
+	AllKeysLRU:  "allkeys-lru",
+	AllKeysLFU:  "allkeys-lfu",
+	VolatileLRU: "volatile-lru",
+	VolatileTTL: "volatile-ttl",
+}
+
+// ParsePolicy parses the name of a policy, e.g. allkeys-lru.
+func ParsePolicy(s string) (Policy, error) {
+	for p, name := range policyNames {
+		if strings.EqualFold(s, name) {
+			return Policy(p), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid eviction policy %q", s)
+}
+
+func (p Policy) String() string {
+	return policyNames[p]
+}
+
+// Volatile reports whether p only evicts the keys with an expire.
+func (p Policy) Volatile() bool {
+	return p == VolatileLRU || p == VolatileTTL
+}
+
+// The access frequency is a logarithmic counter, as in Redis: it starts at
+// lfuInitVal, the more it grows the less likely an access increments it,
+// and it is decremented every minute without access.
+const (
+	lfuInitVal   = 5
+	lfuLogFactor = 10
+	lfuDecayTime = time.Minute
+)
+
+type access struct {
+	at   time.Time
+	freq uint8
+}
+
+// Index keeps the last access time and the access frequency of the keys.
+// The keys it doesn't know are taken as not accessed since it was created,
+// e.g. the keys of a store reopened. It is safe for concurrent use.
+type Index struct {
+	mu    sync.Mutex
+	keys  map[string]access
+	start time.Time
+	now   func() time.Time
+}
+
+// NewIndex returns an empty index.
+func NewIndex() *Index {
+	return &Index{
+		keys:  make(map[string]access),
+		start: time.Now(),
+		now:   time.Now,
+	}
+}
+
+// Touch records an access to key.
+func (x *Index) Touch(key []byte) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	now := x.now()
+	a, ok := x.keys[string(key)]
+	if !ok {
+		a = access{at: x.start, freq: lfuInitVal}
+	}
+	x.keys[string(key)] = access{at: now, freq: lfuIncr(decay(a, now))}
+}
+
+// Remove forgets keys, e.g. once deleted.
+func (x *Index) Remove(keys ...[]byte) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	for _, key := range keys {
+		delete(x.keys, string(key))
+	}
+}
+
+// Rename moves the accesses of key to newKey.
+func (x *Index) Rename(key, newKey []byte) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	a, ok := x.keys[string(key)]
+	if !ok {
+		delete(x.keys, string(newKey))
+		return
+	}
+	delete(x.keys, string(key))
+	x.keys[string(newKey)] = a
+}
+
+// Clear forgets every key, e.g. once the store is flushed.
+func (x *Index) Clear() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.keys = make(map[string]access)
+}
+
+// Len returns the number of keys known.
+func (x *Index) Len() int {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	return len(x.keys)
+}
+
+// Sample returns up to n of the keys known, at random.
+func (x *Index) Sample(n int) [][]byte {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	keys := make([][]byte, 0, n)
+	for key := range x.keys {
+		if len(keys) == n {
+			break
+		}
+		keys = append(keys, []byte(key))
+	}
+	return keys
+}
+
+// Idle returns the time since the last access to key.
+func (x *Index) Idle(key []byte) time.Duration {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	a, ok := x.keys[string(key)]
+	if !ok {
+		a.at = x.start
+	}
+	return x.now().Sub(a.at)
+}
+
+// Freq returns the access frequency of key, from 0 to 255.
+func (x *Index) Freq(key []byte) uint8 {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	a, ok := x.keys[string(key)]
+	if !ok {
+		a = access{at: x.start, freq: lfuInitVal}
+	}
+	return decay(a, x.now())
+}
+
+// decay returns the frequency of a at now.
+func decay(a access, now time.Time) uint8 {
+	periods := now.Sub(a.at) / lfuDecayTime
+	if periods >= time.Duration(a.freq) {
+		return 0
+	}
+	return a.freq - uint8(periods)
+}
+
+// lfuIncr increments the frequency freq, with a probability which falls
+// as it grows.
+func lfuIncr(freq uint8) uint8 {
+	if freq == 255 {
+		return freq
+	}
+	base := float64(freq) - lfuInitVal
+	if base < 0 {
+		base = 0
+	}
+	if rand.Float64() < 1/(base*lfuLogFactor+1) { //nolint:gosec
+		freq++
+	}
+	return freq
+}
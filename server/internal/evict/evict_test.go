@@ -0,0 +1,75 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package evict
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePolicy(t *testing.T) {
+	for _, name := range policyNames {
+		p, err := ParsePolicy(name)
+		require.NoError(t, err)
+		assert.Equal(t, name, p.String())
+	}
+	p, err := ParsePolicy("ALLKEYS-LFU")
+	require.NoError(t, err)
+	assert.Equal(t, AllKeysLFU, p)
+	assert.False(t, p.Volatile())
+	assert.True(t, VolatileTTL.Volatile())
+
+	_, err = ParsePolicy("allkeys-random")
+	assert.EqualError(t, err, `invalid eviction policy "allkeys-random"`)
+}
+
+func TestIndex(t *testing.T) {
+	x := NewIndex()
+	now := x.start
+	x.now = func() time.Time { return now }
+
+	now = now.Add(time.Second)
+	x.Touch([]byte("a"))
+	now = now.Add(time.Second)
+	x.Touch([]byte("b"))
+	now = now.Add(time.Second)
+	assert.Equal(t, 2*time.Second, x.Idle([]byte("a")))
+	assert.Equal(t, time.Second, x.Idle([]byte("b")))
+	assert.Equal(t, 3*time.Second, x.Idle([]byte("unknown")))
+
+	x.Rename([]byte("a"), []byte("c"))
+	assert.Equal(t, 2*time.Second, x.Idle([]byte("c")))
+	assert.Equal(t, 3*time.Second, x.Idle([]byte("a")))
+	assert.Len(t, x.Sample(1), 1)
+	assert.ElementsMatch(t, [][]byte{[]byte("b"), []byte("c")}, x.Sample(3))
+	x.Remove([]byte("b"))
+	assert.Equal(t, 1, x.Len())
+	x.Clear()
+	assert.Equal(t, 0, x.Len())
+}
+
+func TestIndexFreq(t *testing.T) {
+	x := NewIndex()
+	now := x.start
+	x.now = func() time.Time { return now }
+
+	assert.Equal(t, uint8(lfuInitVal), x.Freq([]byte("cold")))
+	for i := 0; i < 1000; i++ {
+		x.Touch([]byte("hot"))
+	}
+	hot := x.Freq([]byte("hot"))
+	assert.Greater(t, hot, uint8(lfuInitVal+5))
+	assert.Less(t, hot, uint8(50), "the counter is logarithmic")
+
+	// One less per minute without access.
+	now = now.Add(3 * time.Minute)
+	assert.Equal(t, hot-3, x.Freq([]byte("hot")))
+	assert.Equal(t, uint8(lfuInitVal-3), x.Freq([]byte("cold")))
+	now = now.Add(time.Hour)
+	assert.Equal(t, uint8(0), x.Freq([]byte("hot")))
+}
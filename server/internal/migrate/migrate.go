@@ -0,0 +1,208 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package migrate copies the data of a storage into another one, e.g. to
+// switch an existing installation to another driver.
+package migrate
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.chensl.me/redix/server/internal/storage"
+)
+
+// ErrNotEmpty is returned by Copy if the destination has keys and
+// Options.Resume is not set.
+var ErrNotEmpty = errors.New("migrate: destination is not empty")
+
+// verifyMargin is how long the keys must still live to be included in the
+// checksums, so that keys expiring while the storages are scanned don't
+// make them differ.
+const verifyMargin = time.Minute
+
+type Options struct {
+	// Resume continues an interrupted migration: the keys which are already
+	// in the destination with the same value are skipped instead of
+	// requiring an empty destination.
+	Resume bool
+	// Progress, if set, is called at most once per ProgressInterval while
+	// copying and once when done.
+	Progress         func(Stats)
+	ProgressInterval time.Duration
+}
+
+type Stats struct {
+	// Total is the number of keys of the source when the copy started, it
+	// may include expired keys.
+	Total int64
+	// Copied is the number of keys written to the destination.
+	Copied int64
+	// Skipped is the number of keys already in the destination when
+	// resuming.
+	Skipped int64
+	// Expired is the number of keys which expired before they were copied.
+	Expired int64
+}
+
+// Done returns the number of keys processed so far.
+func (s Stats) Done() int64 {
+	return s.Copied + s.Skipped + s.Expired
+}
+
+// Copy writes every live key of src, with its value and remaining time to
+// live, to dst. src must not be written to during the copy.
+func Copy(src, dst storage.Interface, opts Options) (Stats, error) {
+	var stats Stats
+
+	if !opts.Resume {
+		n, err := dst.DBSize()
+		if err != nil {
+			return stats, err
+		}
+		if n > 0 {
+			return stats, ErrNotEmpty
+		}
+	}
+
+	total, err := src.DBSize()
+	if err != nil {
+		return stats, err
+	}
+	stats.Total = total
+
+	interval := opts.ProgressInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	lastReport := time.Now()
+
+	err = src.ForEach(func(key, value []byte, expiresAt time.Time) error {
+		if opts.Progress != nil && time.Since(lastReport) >= interval {
+			opts.Progress(stats)
+			lastReport = time.Now()
+		}
+
+		var ttl time.Duration
+		if !expiresAt.IsZero() {
+			if ttl = time.Until(expiresAt); ttl <= 0 {
+				stats.Expired++
+				return nil
+			}
+		}
+
+		if opts.Resume {
+			done, err := copied(dst, key, value, ttl > 0)
+			if err != nil {
+				return err
+			}
+			if done {
+				stats.Skipped++
+				return nil
+			}
+		}
+
+		// key and value are only valid until the callback returns, but
+		// some drivers keep the slices given to Set.
+		key = append([]byte(nil), key...)
+		value = append([]byte(nil), value...)
+		if err := dst.Set(key, value, storage.SetOptions{TTL: ttl}); err != nil {
+			return fmt.Errorf("migrate: set %q: %w", key, err)
+		}
+		stats.Copied++
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	if opts.Progress != nil {
+		opts.Progress(stats)
+	}
+	return stats, nil
+}
+
+// copied reports whether dst already has key with value, and with an
+// expiration time if volatile is set.
+func copied(dst storage.Interface, key, value []byte, volatile bool) (bool, error) {
+	old, err := dst.Get(key)
+	if err == storage.ErrNotExist {
+		return false, nil
+	}
+	if err != nil || !bytes.Equal(old, value) {
+		return false, err
+	}
+	ttl, err := dst.TTL(key)
+	if err != nil {
+		return false, err
+	}
+	return (ttl != -1) == volatile, nil
+}
+
+// Checksum is an order-independent digest of the keys of a storage and
+// their values. Whether a key has an expiration time is included but not
+// the time itself, which the drivers store with different precisions.
+type Checksum struct {
+	Keys int64
+	Sum  [4]uint64
+}
+
+func (c Checksum) String() string {
+	return fmt.Sprintf("%d keys, %016x%016x%016x%016x", c.Keys, c.Sum[0], c.Sum[1], c.Sum[2], c.Sum[3])
+}
+
+// Sum computes the checksum of the keys of s which live at least until
+// cutoff.
+func Sum(s storage.Interface, cutoff time.Time) (Checksum, error) {
+	var (
+		c   Checksum
+		buf []byte
+		n   [binary.MaxVarintLen64]byte
+	)
+	err := s.ForEach(func(key, value []byte, expiresAt time.Time) error {
+		var volatile byte
+		if !expiresAt.IsZero() {
+			if expiresAt.Before(cutoff) {
+				return nil
+			}
+			volatile = 1
+		}
+
+		// The key is prefixed with its length so that key and value can't
+		// be shifted into each other.
+		buf = append(buf[:0], n[:binary.PutUvarint(n[:], uint64(len(key)))]...)
+		buf = append(buf, key...)
+		buf = append(buf, value...)
+		buf = append(buf, volatile)
+		h := sha256.Sum256(buf)
+		for i := range c.Sum {
+			c.Sum[i] += binary.LittleEndian.Uint64(h[i*8:])
+		}
+		c.Keys++
+		return nil
+	})
+	return c, err
+}
+
+// Verify compares the checksums of src and dst, which must not be written
+// to meanwhile. The keys expiring within a minute are ignored.
+func Verify(src, dst storage.Interface) (Checksum, error) {
+	cutoff := time.Now().Add(verifyMargin)
+	want, err := Sum(src, cutoff)
+	if err != nil {
+		return want, err
+	}
+	got, err := Sum(dst, cutoff)
+	if err != nil {
+		return want, err
+	}
+	if got != want {
+		return want, fmt.Errorf("migrate: checksum mismatch: source has %v, destination has %v", want, got)
+	}
+	return want, nil
+}
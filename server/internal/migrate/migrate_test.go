@@ -0,0 +1,155 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package migrate
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.chensl.me/redix/server/internal/storage"
+	"go.chensl.me/redix/server/internal/storage/badger"
+	"go.chensl.me/redix/server/internal/storage/bitcask"
+	"go.chensl.me/redix/server/internal/storage/memory"
+	"go.uber.org/zap"
+)
+
+func newMemory(t *testing.T) storage.Interface {
+	s, err := memory.NewStorage(zap.NewNop())
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func fill(t *testing.T, s storage.Interface, n int) {
+	for i := 0; i < n; i++ {
+		var ttl time.Duration
+		if i%10 == 0 {
+			ttl = time.Hour
+		}
+		k := []byte(fmt.Sprintf("key:%d", i))
+		require.NoError(t, s.Set(k, []byte(fmt.Sprintf("value:%d", i)), storage.SetOptions{TTL: ttl}))
+	}
+}
+
+func TestCopy(t *testing.T) {
+	src, dst := newMemory(t), newMemory(t)
+	fill(t, src, 100)
+	require.NoError(t, src.Set([]byte("expired"), []byte("v"), storage.SetOptions{TTL: time.Millisecond}))
+	time.Sleep(10 * time.Millisecond)
+
+	var reports int
+	stats, err := Copy(src, dst, Options{
+		Progress:         func(Stats) { reports++ },
+		ProgressInterval: time.Nanosecond,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(100), stats.Copied)
+	assert.Equal(t, int64(0), stats.Skipped)
+	assert.Equal(t, stats.Copied, stats.Done())
+	assert.Greater(t, reports, 1)
+
+	v, err := dst.Get([]byte("key:42"))
+	assert.Equal(t, []byte("value:42"), v)
+	assert.NoError(t, err)
+	ttl, err := dst.TTL([]byte("key:40"))
+	assert.InDelta(t, 3599, ttl, 1)
+	assert.NoError(t, err)
+	ttl, err = dst.TTL([]byte("key:41"))
+	assert.Equal(t, int64(-1), ttl)
+	assert.NoError(t, err)
+	ttl, err = dst.TTL([]byte("expired"))
+	assert.Equal(t, int64(-2), ttl)
+	assert.NoError(t, err)
+
+	sum, err := Verify(src, dst)
+	assert.Equal(t, int64(100), sum.Keys)
+	assert.NoError(t, err)
+
+	_, err = Copy(src, dst, Options{})
+	assert.ErrorIs(t, err, ErrNotEmpty)
+}
+
+func TestCopyResume(t *testing.T) {
+	src, dst := newMemory(t), newMemory(t)
+	fill(t, src, 100)
+
+	// An interrupted migration left some keys, one of them outdated. The
+	// volatile ones lost their expiration time.
+	for i := 0; i < 30; i++ {
+		k := []byte(fmt.Sprintf("key:%d", i))
+		require.NoError(t, dst.Set(k, []byte(fmt.Sprintf("value:%d", i)), storage.SetOptions{}))
+	}
+	require.NoError(t, dst.Set([]byte("key:5"), []byte("stale"), storage.SetOptions{}))
+
+	stats, err := Copy(src, dst, Options{Resume: true})
+	require.NoError(t, err)
+	assert.Equal(t, int64(26), stats.Skipped)
+	assert.Equal(t, int64(74), stats.Copied)
+
+	v, err := dst.Get([]byte("key:5"))
+	assert.Equal(t, []byte("value:5"), v)
+	assert.NoError(t, err)
+	_, err = Verify(src, dst)
+	assert.NoError(t, err)
+}
+
+func TestVerifyMismatch(t *testing.T) {
+	src, dst := newMemory(t), newMemory(t)
+	fill(t, src, 10)
+	_, err := Copy(src, dst, Options{})
+	require.NoError(t, err)
+
+	require.NoError(t, dst.Set([]byte("key:3"), []byte("changed"), storage.SetOptions{}))
+	_, err = Verify(src, dst)
+	assert.Error(t, err)
+
+	require.NoError(t, dst.Set([]byte("key:3"), []byte("value:3"), storage.SetOptions{}))
+	_, err = Verify(src, dst)
+	assert.NoError(t, err)
+
+	// A lost expiration time is detected too.
+	require.NoError(t, dst.Set([]byte("key:0"), []byte("value:0"), storage.SetOptions{}))
+	_, err = Verify(src, dst)
+	assert.Error(t, err)
+}
+
+func TestSum(t *testing.T) {
+	a, b := newMemory(t), newMemory(t)
+	require.NoError(t, a.Set([]byte("ab"), []byte("c"), storage.SetOptions{}))
+	require.NoError(t, b.Set([]byte("a"), []byte("bc"), storage.SetOptions{}))
+
+	sa, err := Sum(a, time.Now())
+	require.NoError(t, err)
+	sb, err := Sum(b, time.Now())
+	require.NoError(t, err)
+	assert.NotEqual(t, sa, sb)
+
+	// Keys expiring before the cutoff are ignored.
+	require.NoError(t, a.Set([]byte("soon"), []byte("v"), storage.SetOptions{TTL: time.Second}))
+	s, err := Sum(a, time.Now().Add(time.Minute))
+	assert.Equal(t, sa, s)
+	assert.NoError(t, err)
+}
+
+func TestCopyBetweenDrivers(t *testing.T) {
+	src, err := bitcask.NewStorage(t.TempDir(), zap.NewNop())
+	require.NoError(t, err)
+	defer src.Close()
+	dst, err := badger.NewStorage(t.TempDir(), zap.NewNop())
+	require.NoError(t, err)
+	defer dst.Close()
+
+	fill(t, src, 200)
+	stats, err := Copy(src, dst, Options{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(200), stats.Copied)
+
+	sum, err := Verify(src, dst)
+	assert.Equal(t, int64(200), sum.Keys)
+	assert.NoError(t, err)
+}
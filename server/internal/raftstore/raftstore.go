@@ -0,0 +1,209 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package raftstore implements the log and stable stores of Raft on bbolt.
+package raftstore
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"go.etcd.io/bbolt"
+)
+
+var (
+	bucketLogs   = []byte("logs")
+	bucketStable = []byte("stable")
+
+	// errNotFound is returned by Get, raft compares the message.
+	errNotFound = errors.New("not found")
+	errCorrupt  = errors.New("raftstore: corrupt log entry")
+)
+
+// Store is a raft.LogStore and a raft.StableStore. The logs are keyed by
+// their big-endian index, so that they sort by index.
+type Store struct {
+	db *bbolt.DB
+}
+
+var (
+	_ raft.LogStore    = (*Store)(nil)
+	_ raft.StableStore = (*Store)(nil)
+)
+
+// Open opens the store at path, creating it if needed.
+func Open(path string) (*Store, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(bucketLogs); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(bucketStable)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func (s *Store) FirstIndex() (uint64, error) {
+	var index uint64
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		if k, _ := tx.Bucket(bucketLogs).Cursor().First(); k != nil {
+			index = binary.BigEndian.Uint64(k)
+		}
+		return nil
+	})
+	return index, err
+}
+
+func (s *Store) LastIndex() (uint64, error) {
+	var index uint64
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		if k, _ := tx.Bucket(bucketLogs).Cursor().Last(); k != nil {
+			index = binary.BigEndian.Uint64(k)
+		}
+		return nil
+	})
+	return index, err
+}
+
+func (s *Store) GetLog(index uint64, log *raft.Log) error {
+	return s.db.View(func(tx *bbolt.Tx) error {
+		v := tx.Bucket(bucketLogs).Get(uint64Key(index))
+		if v == nil {
+			return raft.ErrLogNotFound
+		}
+		log.Index = index
+		return decodeLog(v, log)
+	})
+}
+
+func (s *Store) StoreLog(log *raft.Log) error {
+	return s.StoreLogs([]*raft.Log{log})
+}
+
+func (s *Store) StoreLogs(logs []*raft.Log) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(bucketLogs)
+		for _, log := range logs {
+			if err := b.Put(uint64Key(log.Index), encodeLog(log)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteRange deletes the logs from min to max, inclusive.
+func (s *Store) DeleteRange(min, max uint64) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(bucketLogs).Cursor()
+		for k, _ := c.Seek(uint64Key(min)); k != nil; k, _ = c.Next() {
+			if binary.BigEndian.Uint64(k) > max {
+				break
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *Store) Set(key, val []byte) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketStable).Put(key, val)
+	})
+}
+
+func (s *Store) Get(key []byte) ([]byte, error) {
+	var val []byte
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		v := tx.Bucket(bucketStable).Get(key)
+		if v == nil {
+			return errNotFound
+		}
+		val = append([]byte(nil), v...)
+		return nil
+	})
+	return val, err
+}
+
+func (s *Store) SetUint64(key []byte, val uint64) error {
+	return s.Set(key, uint64Key(val))
+}
+
+// GetUint64 returns zero if key isn't set, as raft expects.
+func (s *Store) GetUint64(key []byte) (uint64, error) {
+	val, err := s.Get(key)
+	if err == errNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(val) != 8 {
+		return 0, errCorrupt
+	}
+	return binary.BigEndian.Uint64(val), nil
+}
+
+func uint64Key(n uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, n)
+	return b
+}
+
+// A log entry is encoded as its term, type, append time in nanoseconds,
+// length of data, data and extensions. The index is the key.
+func encodeLog(log *raft.Log) []byte {
+	b := make([]byte, 17, 17+binary.MaxVarintLen64+len(log.Data)+len(log.Extensions))
+	binary.BigEndian.PutUint64(b, log.Term)
+	b[8] = byte(log.Type)
+	var appendedAt int64
+	if !log.AppendedAt.IsZero() {
+		appendedAt = log.AppendedAt.UnixNano()
+	}
+	binary.BigEndian.PutUint64(b[9:], uint64(appendedAt))
+	var n [binary.MaxVarintLen64]byte
+	b = append(b, n[:binary.PutUvarint(n[:], uint64(len(log.Data)))]...)
+	b = append(b, log.Data...)
+	return append(b, log.Extensions...)
+}
+
+func decodeLog(b []byte, log *raft.Log) error {
+	if len(b) < 17 {
+		return errCorrupt
+	}
+	log.Term = binary.BigEndian.Uint64(b)
+	log.Type = raft.LogType(b[8])
+	log.AppendedAt = time.Time{}
+	if ns := int64(binary.BigEndian.Uint64(b[9:])); ns != 0 {
+		log.AppendedAt = time.Unix(0, ns)
+	}
+	n, m := binary.Uvarint(b[17:])
+	if m <= 0 || uint64(len(b)-17-m) < n {
+		return errCorrupt
+	}
+	b = b[17+m:]
+	// The value is only valid during the transaction.
+	log.Data = append([]byte(nil), b[:n]...)
+	log.Extensions = nil
+	if len(b) > int(n) {
+		log.Extensions = append([]byte(nil), b[n:]...)
+	}
+	return nil
+}
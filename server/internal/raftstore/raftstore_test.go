@@ -0,0 +1,92 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package raftstore
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func open(t *testing.T, path string) *Store {
+	s, err := Open(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
+
+func TestLogs(t *testing.T) {
+	s := open(t, filepath.Join(t.TempDir(), "raft.db"))
+
+	first, err := s.FirstIndex()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), first)
+	var log raft.Log
+	assert.Equal(t, raft.ErrLogNotFound, s.GetLog(1, &log))
+
+	now := time.Now()
+	require.NoError(t, s.StoreLog(&raft.Log{Index: 1, Term: 1, Type: raft.LogConfiguration, Data: []byte("conf")}))
+	var logs []*raft.Log
+	for i := uint64(2); i <= 300; i++ {
+		logs = append(logs, &raft.Log{Index: i, Term: 2, Data: []byte("cmd"), Extensions: []byte("ext"), AppendedAt: now})
+	}
+	require.NoError(t, s.StoreLogs(logs))
+
+	first, err = s.FirstIndex()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), first)
+	last, err := s.LastIndex()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(300), last)
+
+	require.NoError(t, s.GetLog(1, &log))
+	assert.Equal(t, raft.Log{Index: 1, Term: 1, Type: raft.LogConfiguration, Data: []byte("conf")}, log)
+	require.NoError(t, s.GetLog(256, &log))
+	assert.Equal(t, uint64(256), log.Index)
+	assert.Equal(t, uint64(2), log.Term)
+	assert.Equal(t, raft.LogCommand, log.Type)
+	assert.Equal(t, []byte("cmd"), log.Data)
+	assert.Equal(t, []byte("ext"), log.Extensions)
+	assert.True(t, now.Equal(log.AppendedAt))
+
+	// Compaction removes a prefix, truncation a suffix.
+	require.NoError(t, s.DeleteRange(1, 10))
+	require.NoError(t, s.DeleteRange(291, 300))
+	first, err = s.FirstIndex()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(11), first)
+	last, err = s.LastIndex()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(290), last)
+	assert.Equal(t, raft.ErrLogNotFound, s.GetLog(10, &log))
+}
+
+func TestStable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "raft.db")
+	s := open(t, path)
+
+	_, err := s.Get([]byte("missing"))
+	assert.EqualError(t, err, "not found")
+	n, err := s.GetUint64([]byte("CurrentTerm"))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), n)
+
+	require.NoError(t, s.Set([]byte("LastVoteCand"), []byte("node1")))
+	require.NoError(t, s.SetUint64([]byte("CurrentTerm"), 42))
+	require.NoError(t, s.Close())
+
+	// Survives a reopen.
+	s = open(t, path)
+	v, err := s.Get([]byte("LastVoteCand"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("node1"), v)
+	n, err = s.GetUint64([]byte("CurrentTerm"))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(42), n)
+}
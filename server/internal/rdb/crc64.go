@@ -0,0 +1,36 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rdb
+
+// CRC-64/Jones as used by Redis: reflected, polynomial 0xad93d23594c935a9,
+// initial value 0 and no final xor. hash/crc64 always inverts the crc so it
+// can't be used here.
+const crc64Poly = 0x95ac9329ac4bc9b5 // reversed 0xad93d23594c935a9
+
+var crc64Table = makeCRC64Table()
+
+func makeCRC64Table() *[256]uint64 {
+	t := new([256]uint64)
+	for i := 0; i < 256; i++ {
+		crc := uint64(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 == 1 {
+				crc = crc>>1 ^ crc64Poly
+			} else {
+				crc >>= 1
+			}
+		}
+		t[i] = crc
+	}
+	return t
+}
+
+// CRC64 updates crc with the bytes of p.
+func CRC64(crc uint64, p []byte) uint64 {
+	for _, b := range p {
+		crc = crc64Table[byte(crc)^b] ^ crc>>8
+	}
+	return crc
+}
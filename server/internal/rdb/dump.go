@@ -0,0 +1,57 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Dump serializes a string value in the format of the Redis DUMP command:
+// the RDB encoded value followed by a 2 bytes RDB version and a CRC64 of
+// everything before it, both little endian.
+func Dump(value []byte) []byte {
+	b := make([]byte, 0, len(value)+16)
+	b = append(b, TypeString)
+	b = AppendString(b, value)
+	b = append(b, byte(Version), byte(Version>>8))
+	var crc [8]byte
+	binary.LittleEndian.PutUint64(crc[:], CRC64(0, b))
+	return append(b, crc[:]...)
+}
+
+// ParseDump verifies the footer of a DUMP payload and returns the string
+// value it holds. It returns ErrChecksum if the version or checksum are
+// wrong and ErrUnsupportedType for anything but strings.
+func ParseDump(payload []byte) ([]byte, error) {
+	if len(payload) < 10 {
+		return nil, ErrChecksum
+	}
+	footer := payload[len(payload)-10:]
+	if binary.LittleEndian.Uint16(footer) > MaxVersion {
+		return nil, ErrChecksum
+	}
+	if binary.LittleEndian.Uint64(footer[2:]) != CRC64(0, payload[:len(payload)-8]) {
+		return nil, ErrChecksum
+	}
+
+	d := NewDecoder(bytes.NewReader(payload[:len(payload)-10]))
+	typ, err := d.ReadByte()
+	if err != nil {
+		return nil, ErrBadFormat
+	}
+	if typ != TypeString {
+		return nil, ErrUnsupportedType
+	}
+	value, err := d.ReadString()
+	if err != nil {
+		return nil, ErrBadFormat
+	}
+	if _, err := d.ReadByte(); err == nil {
+		// Trailing garbage.
+		return nil, ErrBadFormat
+	}
+	return value, nil
+}
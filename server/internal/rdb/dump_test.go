@@ -0,0 +1,54 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rdb
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCRC64(t *testing.T) {
+	assert.Equal(t, uint64(0xe9c6d914c4b8d9ca), CRC64(0, []byte("123456789")))
+}
+
+func TestDump(t *testing.T) {
+	// redis> SET mykey 10
+	// redis> DUMP mykey
+	want := []byte("\x00\xc0\n\t\x00\xbem\x06\x89Z(\x00\n")
+	assert.Equal(t, want, Dump([]byte("10")))
+
+	for _, v := range []string{"", "hello", "-1", "010", "65536", "-2147483648", "2147483648", strings.Repeat("x", 20000)} {
+		got, err := ParseDump(Dump([]byte(v)))
+		assert.NoError(t, err)
+		assert.Equal(t, v, string(got))
+	}
+}
+
+func TestParseDump(t *testing.T) {
+	p := Dump([]byte("hello"))
+	p[1]++
+	_, err := ParseDump(p)
+	assert.ErrorIs(t, err, ErrChecksum)
+
+	_, err = ParseDump([]byte("short"))
+	assert.ErrorIs(t, err, ErrChecksum)
+
+	// A list dumped by Redis 7.
+	_, err = ParseDump([]byte("\x12\x01\x02\x0b\x0b\x00\x00\x00\x01\x00\x81a\x02\xff\x0b\x00\xaa\x8a\xa4\xc1\xde\x99\xc4\xc6"))
+	assert.Error(t, err)
+}
+
+func TestLZF(t *testing.T) {
+	// A literal "a" followed by an overlapping back reference of 61 bytes.
+	in := []byte{0x00, 'a', 0xe0, 0x34, 0x00}
+	out, err := lzfDecompress(in, 62)
+	assert.NoError(t, err)
+	assert.Equal(t, strings.Repeat("a", 62), string(out))
+
+	_, err = lzfDecompress(in, 61)
+	assert.ErrorIs(t, err, ErrBadFormat)
+}
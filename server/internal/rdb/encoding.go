@@ -0,0 +1,268 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"strconv"
+)
+
+// Version is the RDB version written by redix. Redis >= 5.0 accepts it.
+const Version = 9
+
+// MaxVersion is the newest RDB version redix can read.
+const MaxVersion = 11
+
+// Value types.
+const (
+	TypeString          = 0
+	TypeList            = 1
+	TypeSet             = 2
+	TypeZSet            = 3
+	TypeHash            = 4
+	TypeZSet2           = 5
+	TypeModule          = 6
+	TypeModule2         = 7
+	TypeHashZipmap      = 9
+	TypeListZiplist     = 10
+	TypeSetIntset       = 11
+	TypeZSetZiplist     = 12
+	TypeHashZiplist     = 13
+	TypeListQuicklist   = 14
+	TypeStreamListpacks = 15
+	TypeHashListpack    = 16
+	TypeZSetListpack    = 17
+	TypeListQuicklist2  = 18
+	TypeStreamListpack2 = 19
+	TypeSetListpack     = 20
+	TypeStreamListpack3 = 21
+)
+
+// Opcodes.
+const (
+	opFunction2    = 0xf5
+	opModuleAux    = 0xf7
+	opIdle         = 0xf8
+	opFreq         = 0xf9
+	opAux          = 0xfa
+	opResizeDB     = 0xfb
+	opExpireTimeMs = 0xfc
+	opExpireTime   = 0xfd
+	opSelectDB     = 0xfe
+	opEOF          = 0xff
+)
+
+// Length encodings, selected by the two most significant bits.
+const (
+	len6Bit  = 0
+	len14Bit = 1
+	len32Bit = 0x80
+	len64Bit = 0x81
+	lenEnc   = 3
+)
+
+// Special string encodings, used when the length type is lenEnc.
+const (
+	encInt8  = 0
+	encInt16 = 1
+	encInt32 = 2
+	encLZF   = 3
+)
+
+var (
+	ErrBadFormat       = errors.New("rdb: bad data format")
+	ErrChecksum        = errors.New("rdb: version or checksum are wrong")
+	ErrUnsupportedType = errors.New("rdb: unsupported value type")
+)
+
+// AppendLength appends the length-encoding of n to dst.
+func AppendLength(dst []byte, n uint64) []byte {
+	switch {
+	case n < 1<<6:
+		return append(dst, byte(n))
+	case n < 1<<14:
+		return append(dst, byte(n>>8)|len14Bit<<6, byte(n))
+	case n <= math.MaxUint32:
+		dst = append(dst, len32Bit)
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], uint32(n))
+		return append(dst, b[:]...)
+	default:
+		dst = append(dst, len64Bit)
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], n)
+		return append(dst, b[:]...)
+	}
+}
+
+// AppendString appends the string-encoding of s to dst, using the integer
+// encoding when s is the canonical representation of a 32-bit integer.
+func AppendString(dst []byte, s []byte) []byte {
+	if len(s) > 0 && len(s) <= 11 {
+		if v, err := strconv.ParseInt(string(s), 10, 32); err == nil && strconv.FormatInt(v, 10) == string(s) {
+			switch {
+			case v >= math.MinInt8 && v <= math.MaxInt8:
+				return append(dst, lenEnc<<6|encInt8, byte(v))
+			case v >= math.MinInt16 && v <= math.MaxInt16:
+				return append(dst, lenEnc<<6|encInt16, byte(v), byte(v>>8))
+			default:
+				return append(dst, lenEnc<<6|encInt32, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+			}
+		}
+	}
+	dst = AppendLength(dst, uint64(len(s)))
+	return append(dst, s...)
+}
+
+// Decoder reads RDB encoded data and keeps a running CRC64 of every byte
+// it has consumed.
+type Decoder struct {
+	r   *bufio.Reader
+	crc uint64
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Decoder{r: br}
+}
+
+// CRC64 returns the checksum of the bytes read so far.
+func (d *Decoder) CRC64() uint64 {
+	return d.crc
+}
+
+func (d *Decoder) ReadByte() (byte, error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	d.crc = CRC64(d.crc, []byte{b})
+	return b, nil
+}
+
+// ReadFull reads exactly n bytes.
+func (d *Decoder) ReadFull(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	d.crc = CRC64(d.crc, b)
+	return b, nil
+}
+
+// ReadLength reads a length-encoded integer.
+func (d *Decoder) ReadLength() (uint64, error) {
+	n, enc, err := d.readLength()
+	if err != nil {
+		return 0, err
+	}
+	if enc {
+		return 0, ErrBadFormat
+	}
+	return n, nil
+}
+
+// readLength reads a length. If enc is true, the length is actually one of
+// the special string encodings.
+func (d *Decoder) readLength() (n uint64, enc bool, err error) {
+	b, err := d.ReadByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b >> 6 {
+	case len6Bit:
+		return uint64(b & 0x3f), false, nil
+	case len14Bit:
+		next, err := d.ReadByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(b&0x3f)<<8 | uint64(next), false, nil
+	case lenEnc:
+		return uint64(b & 0x3f), true, nil
+	}
+	switch b {
+	case len32Bit:
+		p, err := d.ReadFull(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(p)), false, nil
+	case len64Bit:
+		p, err := d.ReadFull(8)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(p), false, nil
+	}
+	return 0, false, ErrBadFormat
+}
+
+// ReadString reads a string in any of its encodings.
+func (d *Decoder) ReadString() ([]byte, error) {
+	n, enc, err := d.readLength()
+	if err != nil {
+		return nil, err
+	}
+	if !enc {
+		if n > math.MaxInt32 {
+			return nil, ErrBadFormat
+		}
+		return d.ReadFull(int(n))
+	}
+
+	switch n {
+	case encInt8:
+		p, err := d.ReadFull(1)
+		if err != nil {
+			return nil, err
+		}
+		return strconv.AppendInt(nil, int64(int8(p[0])), 10), nil
+	case encInt16:
+		p, err := d.ReadFull(2)
+		if err != nil {
+			return nil, err
+		}
+		return strconv.AppendInt(nil, int64(int16(binary.LittleEndian.Uint16(p))), 10), nil
+	case encInt32:
+		p, err := d.ReadFull(4)
+		if err != nil {
+			return nil, err
+		}
+		return strconv.AppendInt(nil, int64(int32(binary.LittleEndian.Uint32(p))), 10), nil
+	case encLZF:
+		clen, err := d.ReadLength()
+		if err != nil {
+			return nil, err
+		}
+		ulen, err := d.ReadLength()
+		if err != nil {
+			return nil, err
+		}
+		if clen > math.MaxInt32 || ulen > math.MaxInt32 {
+			return nil, ErrBadFormat
+		}
+		p, err := d.ReadFull(int(clen))
+		if err != nil {
+			return nil, err
+		}
+		return lzfDecompress(p, int(ulen))
+	}
+	return nil, ErrBadFormat
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
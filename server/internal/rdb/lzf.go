@@ -0,0 +1,51 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rdb
+
+// lzfDecompress decompresses in, which must expand to exactly n bytes.
+func lzfDecompress(in []byte, n int) ([]byte, error) {
+	out := make([]byte, 0, n)
+	for ip := 0; ip < len(in); {
+		ctrl := int(in[ip])
+		ip++
+		if ctrl < 1<<5 {
+			// Literal run of ctrl+1 bytes.
+			ctrl++
+			if ip+ctrl > len(in) || len(out)+ctrl > n {
+				return nil, ErrBadFormat
+			}
+			out = append(out, in[ip:ip+ctrl]...)
+			ip += ctrl
+			continue
+		}
+
+		// Back reference.
+		length := ctrl >> 5
+		if length == 7 {
+			if ip >= len(in) {
+				return nil, ErrBadFormat
+			}
+			length += int(in[ip])
+			ip++
+		}
+		if ip >= len(in) {
+			return nil, ErrBadFormat
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[ip]) - 1
+		ip++
+		length += 2
+		if ref < 0 || len(out)+length > n {
+			return nil, ErrBadFormat
+		}
+		// The reference may overlap the bytes being written.
+		for i := 0; i < length; i++ {
+			out = append(out, out[ref+i])
+		}
+	}
+	if len(out) != n {
+		return nil, ErrBadFormat
+	}
+	return out, nil
+}
@@ -0,0 +1,371 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+var ErrBadMagic = errors.New("rdb: wrong signature")
+
+// Entry is a key read from an RDB file. Value is only set for strings,
+// values of other types are skipped.
+type Entry struct {
+	DB        int
+	Type      byte
+	Key       []byte
+	Value     []byte
+	ExpiresAt time.Time
+}
+
+// Parse reads an RDB file from r and calls fn for every key it contains,
+// including expired ones. The checksum is verified once the whole file has
+// been read, so fn may already have been called for every key when Parse
+// returns ErrChecksum.
+func Parse(r io.Reader, fn func(e *Entry) error) error {
+	d := NewDecoder(r)
+
+	magic, err := d.ReadFull(9)
+	if err != nil {
+		return err
+	}
+	if string(magic[:5]) != "REDIS" {
+		return ErrBadMagic
+	}
+	version, err := strconv.Atoi(string(magic[5:]))
+	if err != nil {
+		return ErrBadMagic
+	}
+	if version < 1 || version > MaxVersion {
+		return fmt.Errorf("rdb: can't handle RDB format version %d", version)
+	}
+
+	var (
+		db        int
+		expiresAt time.Time
+	)
+	for {
+		typ, err := d.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		switch typ {
+		case opExpireTimeMs:
+			p, err := d.ReadFull(8)
+			if err != nil {
+				return err
+			}
+			expiresAt = time.UnixMilli(int64(binary.LittleEndian.Uint64(p)))
+			continue
+		case opExpireTime:
+			p, err := d.ReadFull(4)
+			if err != nil {
+				return err
+			}
+			expiresAt = time.Unix(int64(binary.LittleEndian.Uint32(p)), 0)
+			continue
+		case opFreq:
+			if _, err := d.ReadByte(); err != nil {
+				return err
+			}
+			continue
+		case opIdle:
+			if _, err := d.ReadLength(); err != nil {
+				return err
+			}
+			continue
+		case opSelectDB:
+			n, err := d.ReadLength()
+			if err != nil {
+				return err
+			}
+			db = int(n)
+			continue
+		case opResizeDB:
+			if _, err := d.ReadLength(); err != nil {
+				return err
+			}
+			if _, err := d.ReadLength(); err != nil {
+				return err
+			}
+			continue
+		case opAux:
+			if _, err := d.ReadString(); err != nil {
+				return err
+			}
+			if _, err := d.ReadString(); err != nil {
+				return err
+			}
+			continue
+		case opModuleAux:
+			if _, err := d.ReadLength(); err != nil {
+				return err
+			}
+			if _, err := d.ReadLength(); err != nil {
+				return err
+			}
+			if err := d.skipModuleValue(); err != nil {
+				return err
+			}
+			continue
+		case opFunction2:
+			if _, err := d.ReadString(); err != nil {
+				return err
+			}
+			continue
+		case opEOF:
+			if version < 5 {
+				return nil
+			}
+			sum := d.CRC64()
+			p, err := d.ReadFull(8)
+			if err != nil {
+				return err
+			}
+			// A zero checksum means the file was saved without one.
+			if crc := binary.LittleEndian.Uint64(p); crc != 0 && crc != sum {
+				return ErrChecksum
+			}
+			return nil
+		}
+
+		key, err := d.ReadString()
+		if err != nil {
+			return err
+		}
+		e := &Entry{
+			DB:        db,
+			Type:      typ,
+			Key:       key,
+			ExpiresAt: expiresAt,
+		}
+		if typ == TypeString {
+			if e.Value, err = d.ReadString(); err != nil {
+				return err
+			}
+		} else if err := d.skipValue(typ); err != nil {
+			return err
+		}
+		expiresAt = time.Time{}
+
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+}
+
+// skipValue consumes a value of any type but strings.
+func (d *Decoder) skipValue(typ byte) error {
+	switch typ {
+	case TypeList, TypeSet, TypeListQuicklist:
+		return d.skipStrings(1)
+	case TypeHash:
+		return d.skipStrings(2)
+	case TypeZSet, TypeZSet2:
+		n, err := d.ReadLength()
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < n; i++ {
+			if _, err := d.ReadString(); err != nil {
+				return err
+			}
+			if typ == TypeZSet2 {
+				_, err = d.ReadFull(8)
+			} else {
+				err = d.skipDoubleString()
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case TypeHashZipmap, TypeListZiplist, TypeSetIntset, TypeZSetZiplist,
+		TypeHashZiplist, TypeHashListpack, TypeZSetListpack, TypeSetListpack:
+		_, err := d.ReadString()
+		return err
+	case TypeListQuicklist2:
+		n, err := d.ReadLength()
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < n; i++ {
+			if _, err := d.ReadLength(); err != nil {
+				return err
+			}
+			if _, err := d.ReadString(); err != nil {
+				return err
+			}
+		}
+		return nil
+	case TypeStreamListpacks, TypeStreamListpack2, TypeStreamListpack3:
+		return d.skipStream(typ)
+	case TypeModule2:
+		if _, err := d.ReadLength(); err != nil {
+			return err
+		}
+		return d.skipModuleValue()
+	}
+	return ErrUnsupportedType
+}
+
+// skipStrings consumes a length followed by length*per strings.
+func (d *Decoder) skipStrings(per int) error {
+	n, err := d.ReadLength()
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < n*uint64(per); i++ {
+		if _, err := d.ReadString(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// skipDoubleString consumes a double in the old string format: one length
+// byte, with 253, 254 and 255 standing for NaN, +Inf and -Inf.
+func (d *Decoder) skipDoubleString() error {
+	n, err := d.ReadByte()
+	if err != nil {
+		return err
+	}
+	if n >= 253 {
+		return nil
+	}
+	_, err = d.ReadFull(int(n))
+	return err
+}
+
+func (d *Decoder) skipLengths(n int) error {
+	for i := 0; i < n; i++ {
+		if _, err := d.ReadLength(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Decoder) skipStream(typ byte) error {
+	// Listpacks: master ID and listpack.
+	if err := d.skipStrings(2); err != nil {
+		return err
+	}
+	// Length and last ID.
+	if err := d.skipLengths(3); err != nil {
+		return err
+	}
+	if typ >= TypeStreamListpack2 {
+		// First ID, max deleted ID and entries added.
+		if err := d.skipLengths(5); err != nil {
+			return err
+		}
+	}
+
+	groups, err := d.ReadLength()
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < groups; i++ {
+		if _, err := d.ReadString(); err != nil {
+			return err
+		}
+		if err := d.skipLengths(2); err != nil {
+			return err
+		}
+		if typ >= TypeStreamListpack2 {
+			// Entries read.
+			if _, err := d.ReadLength(); err != nil {
+				return err
+			}
+		}
+
+		// Global PEL: raw ID, delivery time and delivery count.
+		pel, err := d.ReadLength()
+		if err != nil {
+			return err
+		}
+		for j := uint64(0); j < pel; j++ {
+			if _, err := d.ReadFull(16 + 8); err != nil {
+				return err
+			}
+			if _, err := d.ReadLength(); err != nil {
+				return err
+			}
+		}
+
+		consumers, err := d.ReadLength()
+		if err != nil {
+			return err
+		}
+		for j := uint64(0); j < consumers; j++ {
+			if _, err := d.ReadString(); err != nil {
+				return err
+			}
+			// Seen time, plus active time since Redis 7.2.
+			n := 8
+			if typ >= TypeStreamListpack3 {
+				n += 8
+			}
+			if _, err := d.ReadFull(n); err != nil {
+				return err
+			}
+			// Consumer PEL: raw IDs only.
+			cpel, err := d.ReadLength()
+			if err != nil {
+				return err
+			}
+			for k := uint64(0); k < cpel; k++ {
+				if _, err := d.ReadFull(16); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Module value opcodes.
+const (
+	moduleOpEOF = iota
+	moduleOpSInt
+	moduleOpUInt
+	moduleOpFloat
+	moduleOpDouble
+	moduleOpString
+)
+
+// skipModuleValue consumes the self describing payload of a module value.
+func (d *Decoder) skipModuleValue() error {
+	for {
+		op, err := d.ReadLength()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case moduleOpEOF:
+			return nil
+		case moduleOpSInt, moduleOpUInt:
+			_, err = d.ReadLength()
+		case moduleOpFloat:
+			_, err = d.ReadFull(4)
+		case moduleOpDouble:
+			_, err = d.ReadFull(8)
+		case moduleOpString:
+			_, err = d.ReadString()
+		default:
+			return ErrBadFormat
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncoderParse(t *testing.T) {
+	var buf bytes.Buffer
+	exp := time.UnixMilli(time.Now().Add(time.Hour).UnixMilli())
+
+	enc := NewEncoder(&buf)
+	assert.NoError(t, enc.WriteHeader())
+	assert.NoError(t, enc.WriteAux("redis-bits", "64"))
+	assert.NoError(t, enc.WriteSelectDB(0, 2, 1))
+	assert.NoError(t, enc.WriteString([]byte("a"), []byte("hello"), time.Time{}))
+	assert.NoError(t, enc.WriteString([]byte("b"), []byte("100"), exp))
+	assert.NoError(t, enc.Close())
+
+	var entries []Entry
+	err := Parse(bytes.NewReader(buf.Bytes()), func(e *Entry) error {
+		entries = append(entries, *e)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []Entry{
+		{Type: TypeString, Key: []byte("a"), Value: []byte("hello")},
+		{Type: TypeString, Key: []byte("b"), Value: []byte("100"), ExpiresAt: exp},
+	}, entries)
+
+	b := buf.Bytes()
+	b[len(b)-1]++
+	err = Parse(bytes.NewReader(b), func(e *Entry) error { return nil })
+	assert.ErrorIs(t, err, ErrChecksum)
+
+	err = Parse(bytes.NewReader([]byte("REDIX0009")), func(e *Entry) error { return nil })
+	assert.ErrorIs(t, err, ErrBadMagic)
+}
+
+func TestParseSkipsOtherTypes(t *testing.T) {
+	b := []byte("REDIS0009")
+	b = append(b, opSelectDB, 1)
+	// A list with two elements.
+	b = append(b, TypeList)
+	b = AppendString(b, []byte("list"))
+	b = AppendLength(b, 2)
+	b = AppendString(b, []byte("x"))
+	b = AppendString(b, []byte("y"))
+	// A sorted set with a binary double score.
+	b = append(b, TypeZSet2)
+	b = AppendString(b, []byte("zset"))
+	b = AppendLength(b, 1)
+	b = AppendString(b, []byte("m"))
+	b = append(b, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f)
+	// A hash encoded as a listpack blob.
+	b = append(b, TypeHashListpack)
+	b = AppendString(b, []byte("hash"))
+	b = AppendString(b, []byte("blob"))
+	b = append(b, TypeString)
+	b = AppendString(b, []byte("str"))
+	b = AppendString(b, []byte("v"))
+	b = append(b, opEOF)
+	var crc [8]byte
+	binary.LittleEndian.PutUint64(crc[:], CRC64(0, b))
+	b = append(b, crc[:]...)
+
+	var keys []string
+	var types []byte
+	err := Parse(bytes.NewReader(b), func(e *Entry) error {
+		assert.Equal(t, 1, e.DB)
+		keys = append(keys, string(e.Key))
+		types = append(types, e.Type)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"list", "zset", "hash", "str"}, keys)
+	assert.Equal(t, []byte{TypeList, TypeZSet2, TypeHashListpack, TypeString}, types)
+}
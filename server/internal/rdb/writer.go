@@ -0,0 +1,83 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Encoder writes an RDB file.
+type Encoder struct {
+	w   *bufio.Writer
+	crc uint64
+	buf []byte
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: bufio.NewWriter(w)}
+}
+
+func (e *Encoder) write(p []byte) error {
+	e.crc = CRC64(e.crc, p)
+	_, err := e.w.Write(p)
+	return err
+}
+
+// WriteHeader writes the magic string and version.
+func (e *Encoder) WriteHeader() error {
+	return e.write([]byte(fmt.Sprintf("REDIS%04d", Version)))
+}
+
+// WriteAux writes an auxiliary field.
+func (e *Encoder) WriteAux(key, value string) error {
+	e.buf = append(e.buf[:0], opAux)
+	e.buf = AppendString(e.buf, []byte(key))
+	e.buf = AppendString(e.buf, []byte(value))
+	return e.write(e.buf)
+}
+
+// WriteSelectDB starts the keys of database db. size and expires are hints
+// for the number of keys and of keys with an expire.
+func (e *Encoder) WriteSelectDB(db, size, expires uint64) error {
+	e.buf = append(e.buf[:0], opSelectDB)
+	e.buf = AppendLength(e.buf, db)
+	e.buf = append(e.buf, opResizeDB)
+	e.buf = AppendLength(e.buf, size)
+	e.buf = AppendLength(e.buf, expires)
+	return e.write(e.buf)
+}
+
+// WriteString writes a string key. A zero expiresAt means no expire.
+func (e *Encoder) WriteString(key, value []byte, expiresAt time.Time) error {
+	e.buf = e.buf[:0]
+	if !expiresAt.IsZero() {
+		e.buf = append(e.buf, opExpireTimeMs)
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], uint64(expiresAt.UnixMilli()))
+		e.buf = append(e.buf, b[:]...)
+	}
+	e.buf = append(e.buf, TypeString)
+	e.buf = AppendString(e.buf, key)
+	e.buf = AppendString(e.buf, value)
+	return e.write(e.buf)
+}
+
+// Close writes the EOF opcode and the checksum and flushes the file. It
+// doesn't close the underlying writer.
+func (e *Encoder) Close() error {
+	if err := e.write([]byte{opEOF}); err != nil {
+		return err
+	}
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], e.crc)
+	if _, err := e.w.Write(b[:]); err != nil {
+		return err
+	}
+	return e.w.Flush()
+}
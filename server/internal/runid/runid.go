@@ -0,0 +1,22 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package runid generates the 40 hex characters random IDs Redis uses for
+// replication IDs, cluster node IDs and Sentinel run IDs.
+package runid
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// New returns a new random ID. It panics if the system random source
+// fails.
+func New() string {
+	var b [20]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,20 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package runid
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	id := New()
+	assert.Len(t, id, 40)
+	_, err := hex.DecodeString(id)
+	assert.NoError(t, err)
+	assert.NotEqual(t, id, New())
+}
@@ -0,0 +1,372 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package sentinel
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/match"
+	"github.com/tidwall/redcon"
+)
+
+// The clients of Redis Sentinel ask for the address of the master with
+// SENTINEL GET-MASTER-ADDR-BY-NAME and subscribe to the events, e.g.
+// +switch-master, which are published on the channels named after them.
+
+func (s *Sentinel) handle(conn redcon.Conn, cmd redcon.Command) {
+	args := cmd.Args[1:]
+	switch name := strings.ToUpper(string(cmd.Args[0])); name {
+	case "PING":
+		conn.WriteString("PONG")
+	case "QUIT":
+		conn.WriteString("OK")
+		_ = conn.Close()
+	case "SUBSCRIBE", "PSUBSCRIBE":
+		if len(args) == 0 {
+			errInvalidArgs(conn, cmd)
+			return
+		}
+		for _, ch := range args {
+			if name == "SUBSCRIBE" {
+				s.ps.Subscribe(conn, string(ch))
+			} else {
+				s.ps.Psubscribe(conn, string(ch))
+			}
+		}
+	case "ROLE":
+		s.mu.Lock()
+		masters := s.sortedMasters()
+		s.mu.Unlock()
+		conn.WriteArray(2)
+		conn.WriteBulkString("sentinel")
+		conn.WriteArray(len(masters))
+		for _, m := range masters {
+			conn.WriteBulkString(m.name)
+		}
+	case "INFO":
+		s.cmdINFO(conn)
+	case "SENTINEL":
+		if len(args) == 0 {
+			errInvalidArgs(conn, cmd)
+			return
+		}
+		s.cmdSENTINEL(conn, cmd)
+	default:
+		conn.WriteError("ERR unknown command '" + string(cmd.Args[0]) + "'.")
+	}
+}
+
+func errInvalidArgs(conn redcon.Conn, cmd redcon.Command) {
+	conn.WriteError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", cmd.Args[0]))
+}
+
+func (s *Sentinel) cmdINFO(conn redcon.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Server\r\n")
+	fmt.Fprintf(&b, "redis_mode:sentinel\r\n")
+	fmt.Fprintf(&b, "run_id:%s\r\n", s.id)
+	fmt.Fprintf(&b, "\r\n# Sentinel\r\n")
+	fmt.Fprintf(&b, "sentinel_masters:%d\r\n", len(s.masters))
+	fmt.Fprintf(&b, "sentinel_tilt:0\r\n")
+	fmt.Fprintf(&b, "sentinel_running_scripts:0\r\n")
+	fmt.Fprintf(&b, "sentinel_scripts_queue_length:0\r\n")
+	for i, m := range s.sortedMasters() {
+		status := "ok"
+		switch {
+		case m.odown:
+			status = "odown"
+		case m.sdown:
+			status = "sdown"
+		}
+		fmt.Fprintf(&b, "master%d:name=%s,status=%s,address=%s,slaves=%d,sentinels=%d\r\n",
+			i, m.name, status, m.inst.addr, len(m.replicas), len(s.peers)+1)
+	}
+	conn.WriteBulkString(b.String())
+}
+
+// SENTINEL subcommand [argument ...]
+func (s *Sentinel) cmdSENTINEL(conn redcon.Conn, cmd redcon.Command) {
+	sub := strings.ToUpper(string(cmd.Args[1]))
+	args := cmd.Args[2:]
+	nargs := map[string]int{
+		"MASTERS":                 0,
+		"MYID":                    0,
+		"FLUSHCONFIG":             0,
+		"MASTER":                  1,
+		"REPLICAS":                1,
+		"SLAVES":                  1,
+		"SENTINELS":               1,
+		"GET-MASTER-ADDR-BY-NAME": 1,
+		"RESET":                   1,
+		"FAILOVER":                1,
+		"CKQUORUM":                1,
+		"REMOVE":                  1,
+		"IS-MASTER-DOWN-BY-ADDR":  4,
+		"MONITOR":                 4,
+	}
+	n, ok := nargs[sub]
+	if !ok {
+		conn.WriteError("ERR unknown subcommand '" + string(cmd.Args[1]) + "'.")
+		return
+	}
+	if len(args) != n {
+		errInvalidArgs(conn, cmd)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var m *master
+	switch sub {
+	case "MASTER", "REPLICAS", "SLAVES", "SENTINELS", "GET-MASTER-ADDR-BY-NAME", "FAILOVER", "CKQUORUM", "REMOVE":
+		if m = s.masters[string(args[0])]; m == nil {
+			if sub == "GET-MASTER-ADDR-BY-NAME" {
+				conn.WriteNull()
+			} else {
+				conn.WriteError(errNoMaster.Error())
+			}
+			return
+		}
+	}
+
+	switch sub {
+	case "MASTERS":
+		masters := s.sortedMasters()
+		conn.WriteArray(len(masters))
+		for _, m := range masters {
+			writeFields(conn, s.masterFields(m))
+		}
+	case "MASTER":
+		writeFields(conn, s.masterFields(m))
+	case "REPLICAS", "SLAVES":
+		replicas := make([]*instance, 0, len(m.replicas))
+		for _, r := range m.replicas {
+			replicas = append(replicas, r)
+		}
+		sort.Slice(replicas, func(i, j int) bool { return replicas[i].addr < replicas[j].addr })
+		conn.WriteArray(len(replicas))
+		for _, r := range replicas {
+			writeFields(conn, s.replicaFields(m, r))
+		}
+	case "SENTINELS":
+		conn.WriteArray(len(s.peers))
+		for _, p := range s.peers {
+			host, port, _ := net.SplitHostPort(p.addr)
+			flags := "sentinel"
+			if s.isDown(p.lastOK) {
+				flags = "s_down,sentinel"
+			}
+			writeFields(conn, []string{
+				"name", p.addr,
+				"ip", host,
+				"port", port,
+				"runid", p.id,
+				"flags", flags,
+				"last-ok-ping-reply", sinceMillis(p.lastOK),
+			})
+		}
+	case "GET-MASTER-ADDR-BY-NAME":
+		host, port, _ := net.SplitHostPort(m.inst.addr)
+		conn.WriteArray(2)
+		conn.WriteBulkString(host)
+		conn.WriteBulkString(port)
+	case "IS-MASTER-DOWN-BY-ADDR":
+		s.isMasterDownByAddr(conn, args)
+	case "MYID":
+		conn.WriteBulkString(s.id)
+	case "RESET":
+		var n int
+		for _, m := range s.masters {
+			if match.Match(m.name, string(args[0])) {
+				s.reset(m)
+				n++
+			}
+		}
+		s.saveOrLog()
+		conn.WriteInt(n)
+	case "FAILOVER":
+		if m.failingOver {
+			conn.WriteError("INPROG Failover already in progress")
+			return
+		}
+		if len(s.goodReplicas(m)) == 0 {
+			conn.WriteError("NOGOODSLAVE No suitable replica to promote")
+			return
+		}
+		m.forced = true
+		conn.WriteString("OK")
+	case "CKQUORUM":
+		usable := s.usablePeers() + 1
+		switch {
+		case usable < m.quorum:
+			conn.WriteError(fmt.Sprintf("NOQUORUM %d usable Sentinels. Not enough available Sentinels to reach the specified quorum for this master", usable))
+		case usable < s.majority(m):
+			conn.WriteError(fmt.Sprintf("NOQUORUM %d usable Sentinels. Not enough available Sentinels to reach the majority and authorize a failover", usable))
+		default:
+			conn.WriteString(fmt.Sprintf("OK %d usable Sentinels. Quorum and failover authorization can be reached", usable))
+		}
+	case "MONITOR":
+		s.monitorMaster(conn, args)
+	case "REMOVE":
+		delete(s.masters, m.name)
+		close(m.done)
+		s.saveOrLog()
+		conn.WriteString("OK")
+	case "FLUSHCONFIG":
+		if err := s.save(); err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+		conn.WriteString("OK")
+	}
+}
+
+// writeFields writes the fields as a flat array of names and values.
+func writeFields(conn redcon.Conn, fields []string) {
+	conn.WriteArray(len(fields))
+	for _, f := range fields {
+		conn.WriteBulkString(f)
+	}
+}
+
+func sinceMillis(t time.Time) string {
+	if t.IsZero() {
+		return "0"
+	}
+	return strconv.FormatInt(time.Since(t).Milliseconds(), 10)
+}
+
+func (s *Sentinel) masterFields(m *master) []string {
+	host, port, _ := net.SplitHostPort(m.inst.addr)
+	flags := "master"
+	if m.sdown {
+		flags = "s_down," + flags
+	}
+	if m.odown {
+		flags = "o_down," + flags
+	}
+	if m.failingOver {
+		flags += ",failover_in_progress"
+	}
+	return []string{
+		"name", m.name,
+		"ip", host,
+		"port", port,
+		"runid", "",
+		"flags", flags,
+		"last-ok-ping-reply", sinceMillis(m.inst.lastOK),
+		"down-after-milliseconds", strconv.FormatInt(s.conf.DownAfter.Milliseconds(), 10),
+		"role-reported", m.inst.role,
+		"num-slaves", strconv.Itoa(len(m.replicas)),
+		"num-other-sentinels", strconv.Itoa(len(s.peers)),
+		"quorum", strconv.Itoa(m.quorum),
+		"failover-timeout", strconv.FormatInt(s.conf.FailoverTimeout.Milliseconds(), 10),
+		"config-epoch", strconv.FormatUint(m.configEpoch, 10),
+	}
+}
+
+func (s *Sentinel) replicaFields(m *master, r *instance) []string {
+	host, port, _ := net.SplitHostPort(r.addr)
+	flags := "slave"
+	if s.isDown(r.lastOK) {
+		flags = "s_down,slave"
+	}
+	linkStatus := "err"
+	if r.linkUp {
+		linkStatus = "ok"
+	}
+	masterHost, masterPort, _ := net.SplitHostPort(r.master)
+	return []string{
+		"name", r.addr,
+		"ip", host,
+		"port", port,
+		"flags", flags,
+		"last-ok-ping-reply", sinceMillis(r.lastOK),
+		"role-reported", r.role,
+		"master-link-status", linkStatus,
+		"master-host", masterHost,
+		"master-port", masterPort,
+		"slave-repl-offset", strconv.FormatInt(r.offset, 10),
+	}
+}
+
+// SENTINEL IS-MASTER-DOWN-BY-ADDR ip port current-epoch runid
+//
+// The reply tells whether the master at ip:port is down for this sentinel
+// and, unless runid is *, the leader voted for in current-epoch.
+func (s *Sentinel) isMasterDownByAddr(conn redcon.Conn, args [][]byte) {
+	epoch, err := strconv.ParseUint(string(args[2]), 10, 64)
+	if err != nil {
+		conn.WriteError("ERR value is not an integer or out of range")
+		return
+	}
+	m := s.masterByAddr(net.JoinHostPort(string(args[0]), string(args[1])))
+	var down int
+	leader, leaderEpoch := "*", uint64(0)
+	if m != nil {
+		if m.sdown {
+			down = 1
+		}
+		if runID := string(args[3]); runID != "*" {
+			leader, leaderEpoch = s.vote(m, runID, epoch)
+		}
+	}
+	conn.WriteArray(3)
+	conn.WriteInt(down)
+	conn.WriteBulkString(leader)
+	conn.WriteInt64(int64(leaderEpoch))
+}
+
+// SENTINEL MONITOR name ip port quorum
+func (s *Sentinel) monitorMaster(conn redcon.Conn, args [][]byte) {
+	name := string(args[0])
+	port, err := strconv.Atoi(string(args[2]))
+	if err != nil || port <= 0 || port > 65535 {
+		conn.WriteError("ERR Invalid port")
+		return
+	}
+	quorum, err := strconv.Atoi(string(args[3]))
+	if err != nil || quorum <= 0 {
+		conn.WriteError("ERR Quorum must be 1 or greater.")
+		return
+	}
+	if s.masters[name] != nil {
+		conn.WriteError("ERR Duplicated master name.")
+		return
+	}
+	addr := net.JoinHostPort(string(args[1]), string(args[2]))
+	if s.masterByAddr(addr) != nil {
+		conn.WriteError("ERR Duplicated master address.")
+		return
+	}
+
+	m := s.addMaster(Master{Name: name, Addr: addr, Quorum: quorum})
+	s.event(m, m.inst, "+monitor", "quorum "+strconv.Itoa(quorum))
+	s.saveOrLog()
+	if s.serving {
+		s.startMonitor(m)
+	}
+	conn.WriteString("OK")
+}
+
+// reset forgets the replicas and the failover state of m, the replicas are
+// learned again from the master.
+func (s *Sentinel) reset(m *master) {
+	m.replicas = make(map[string]*instance)
+	m.inst.lastOK = time.Now()
+	m.sdown, m.odown = false, false
+	m.failoverAfter = time.Time{}
+	m.forced = false
+	s.event(m, m.inst, "+reset-master", "")
+}
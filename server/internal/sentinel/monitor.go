@@ -0,0 +1,432 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package sentinel
+
+import (
+	"math/rand"
+	"net"
+	"strconv"
+	"time"
+
+	"go.chensl.me/redix/server/internal/client"
+	"go.uber.org/zap"
+)
+
+// Every master is monitored by its own goroutine. On every tick, it sends
+// ROLE to the master and its replicas, learns the replicas from the master
+// and the configurations of the other sentinels, then checks whether the
+// master is down. The master is subjectively down (sdown) when it didn't
+// answer within the down-after time, and objectively down (odown) when
+// the quorum of the sentinels agree. The sentinel then asks the others to
+// vote for it in a new epoch, and fails the master over if elected by the
+// majority: the best replica is promoted with REPLICAOF NO ONE and the
+// other instances replicate it. The configuration of the leader, with the
+// greatest config epoch, is then adopted by the other sentinels.
+
+// period returns the interval between the ticks.
+func (s *Sentinel) period() time.Duration {
+	d := s.conf.DownAfter / 5
+	if d > time.Second {
+		d = time.Second
+	}
+	return d
+}
+
+func (s *Sentinel) startMonitor(m *master) {
+	s.closer.AddRunning(1)
+	go s.monitor(m)
+}
+
+func (s *Sentinel) monitor(m *master) {
+	defer s.closer.Done()
+	l := &links{s: s, conns: make(map[string]*client.Conn)}
+	defer l.close()
+
+	ticker := time.NewTicker(s.period())
+	defer ticker.Stop()
+	for {
+		s.refresh(m, l)
+		s.syncConfig(m, l)
+		s.checkDown(m, l)
+		s.fixReplicas(m, l)
+		s.maybeFailover(m, l)
+
+		select {
+		case <-s.closer.HasBeenClosed():
+			return
+		case <-m.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// links are the connections of a monitor to the instances and the other
+// sentinels.
+type links struct {
+	s     *Sentinel
+	conns map[string]*client.Conn
+}
+
+// do sends a command to addr, the instances are authenticated.
+func (l *links) do(addr string, inst bool, args ...interface{}) (interface{}, error) {
+	conn := l.conns[addr]
+	if conn == nil {
+		timeout := l.s.conf.DownAfter
+		if timeout > time.Second {
+			timeout = time.Second
+		}
+		var err error
+		if conn, err = client.Dial(addr, timeout); err != nil {
+			return nil, err
+		}
+		if inst && l.s.conf.AuthPass != "" {
+			if _, err := conn.Do("AUTH", l.s.conf.AuthPass); err != nil {
+				_ = conn.Close()
+				return nil, err
+			}
+		}
+		l.conns[addr] = conn
+	}
+	v, err := conn.Do(args...)
+	if _, ok := err.(client.Error); err != nil && !ok {
+		_ = conn.Close()
+		delete(l.conns, addr)
+	}
+	return v, err
+}
+
+func (l *links) close() {
+	for _, conn := range l.conns {
+		_ = conn.Close()
+	}
+}
+
+// refresh sends ROLE to the master and the replicas of m.
+func (s *Sentinel) refresh(m *master, l *links) {
+	s.mu.Lock()
+	addrs := []string{m.inst.addr}
+	for addr := range m.replicas {
+		addrs = append(addrs, addr)
+	}
+	s.mu.Unlock()
+
+	replies := make(map[string]interface{})
+	for _, addr := range addrs {
+		if v, err := l.do(addr, true, "ROLE"); err == nil {
+			replies[addr] = v
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for addr, v := range replies {
+		inst := m.replicas[addr]
+		if addr == m.inst.addr {
+			inst = m.inst
+		}
+		if inst == nil {
+			continue
+		}
+		for _, r := range inst.update(v) {
+			if r != m.inst.addr && m.replicas[r] == nil {
+				m.replicas[r] = &instance{addr: r, lastOK: time.Now()}
+				s.event(m, m.replicas[r], "+slave", "")
+				s.saveOrLog()
+			}
+		}
+	}
+}
+
+// roleName returns the role in a reply to ROLE.
+func roleName(v interface{}) string {
+	if role, ok := v.([]interface{}); ok && len(role) > 0 {
+		name, _ := role[0].([]byte)
+		return string(name)
+	}
+	return ""
+}
+
+// update updates inst from its reply to ROLE and returns the replicas
+// reported by a master.
+func (inst *instance) update(v interface{}) []string {
+	role, _ := v.([]interface{})
+	if len(role) < 3 {
+		return nil
+	}
+	inst.lastOK = time.Now()
+	inst.role = roleName(v)
+
+	var replicas []string
+	switch inst.role {
+	case "master":
+		inst.offset, _ = role[1].(int64)
+		inst.master, inst.linkUp = "", false
+		list, _ := role[2].([]interface{})
+		for _, r := range list {
+			if r, ok := r.([]interface{}); ok && len(r) >= 2 {
+				host, _ := r[0].([]byte)
+				port, _ := r[1].([]byte)
+				replicas = append(replicas, net.JoinHostPort(string(host), string(port)))
+			}
+		}
+	case "slave":
+		if len(role) < 5 {
+			return nil
+		}
+		host, _ := role[1].([]byte)
+		port, _ := role[2].(int64)
+		state, _ := role[3].([]byte)
+		inst.master = net.JoinHostPort(string(host), strconv.FormatInt(port, 10))
+		inst.linkUp = string(state) == "connected"
+		inst.offset, _ = role[4].(int64)
+	}
+	return replicas
+}
+
+// syncConfig asks the other sentinels for their configuration of m, the
+// one with the greatest config epoch is adopted.
+func (s *Sentinel) syncConfig(m *master, l *links) {
+	s.mu.Lock()
+	peers := make([]*peer, len(s.peers))
+	copy(peers, s.peers)
+	s.mu.Unlock()
+
+	for _, p := range peers {
+		v, err := l.do(p.addr, false, "SENTINEL", "MASTER", m.name)
+		if err != nil {
+			if _, ok := err.(client.Error); !ok {
+				continue
+			}
+		}
+		var id interface{}
+		s.mu.Lock()
+		p.lastOK = time.Now()
+		needID := p.id == ""
+		s.mu.Unlock()
+		if needID {
+			id, _ = l.do(p.addr, false, "SENTINEL", "MYID")
+		}
+
+		fields := make(map[string]string)
+		list, _ := v.([]interface{})
+		for i := 0; i+1 < len(list); i += 2 {
+			k, _ := list[i].([]byte)
+			v, _ := list[i+1].([]byte)
+			fields[string(k)] = string(v)
+		}
+		epoch, _ := strconv.ParseUint(fields["config-epoch"], 10, 64)
+		addr := net.JoinHostPort(fields["ip"], fields["port"])
+
+		s.mu.Lock()
+		if id, ok := id.([]byte); ok {
+			p.id = string(id)
+		}
+		if epoch > m.configEpoch && s.masters[m.name] == m {
+			if addr != m.inst.addr {
+				s.switchMaster(m, addr, epoch)
+			} else {
+				m.configEpoch = epoch
+				s.saveOrLog()
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// checkDown updates the sdown and odown states of the master of m.
+func (s *Sentinel) checkDown(m *master, l *links) {
+	s.mu.Lock()
+	sdown := s.isDown(m.inst.lastOK)
+	if sdown != m.sdown {
+		m.sdown = sdown
+		s.event(m, m.inst, map[bool]string{true: "+sdown", false: "-sdown"}[sdown], "")
+	}
+	host, port, _ := net.SplitHostPort(m.inst.addr)
+	epoch := s.currentEpoch
+	peers := make([]*peer, len(s.peers))
+	copy(peers, s.peers)
+	s.mu.Unlock()
+
+	votes := 1
+	if sdown {
+		for _, p := range peers {
+			v, err := l.do(p.addr, false, "SENTINEL", "IS-MASTER-DOWN-BY-ADDR", host, port, strconv.FormatUint(epoch, 10), "*")
+			if reply, ok := v.([]interface{}); err == nil && ok && len(reply) == 3 && reply[0] == int64(1) {
+				votes++
+			}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	odown := sdown && votes >= m.quorum
+	if odown == m.odown {
+		return
+	}
+	m.odown = odown
+	if odown {
+		s.event(m, m.inst, "+odown", "#quorum "+strconv.Itoa(votes)+"/"+strconv.Itoa(m.quorum))
+		// The sentinels which agree don't all try at once.
+		after := time.Now().Add(time.Duration(rand.Int63n(int64(3 * s.period()))))
+		if after.After(m.failoverAfter) {
+			m.failoverAfter = after
+		}
+	} else {
+		s.event(m, m.inst, "-odown", "")
+	}
+}
+
+// fixReplicas makes the replicas which don't replicate the master of m,
+// e.g. a previous master back online, replicate it. It waits for a few
+// ticks, so that a failover by another sentinel is learned first.
+func (s *Sentinel) fixReplicas(m *master, l *links) {
+	s.mu.Lock()
+	if m.sdown || m.failingOver {
+		s.mu.Unlock()
+		return
+	}
+	var fix []*instance
+	for _, r := range m.replicas {
+		if s.isDown(r.lastOK) || r.role == "" || (r.role == "slave" && r.master == m.inst.addr) {
+			r.wrongSince = time.Time{}
+			continue
+		}
+		if r.wrongSince.IsZero() {
+			r.wrongSince = time.Now()
+		} else if time.Since(r.wrongSince) > 3*s.period() {
+			fix = append(fix, r)
+		}
+	}
+	host, port, _ := net.SplitHostPort(m.inst.addr)
+	s.mu.Unlock()
+
+	for _, r := range fix {
+		_, err := l.do(r.addr, true, "REPLICAOF", host, port)
+		s.mu.Lock()
+		r.wrongSince = time.Time{}
+		if err != nil {
+			s.logger.Warn("failed to reconfigure replica", zap.String("addr", r.addr), zap.Error(err))
+		} else if r.role == "master" {
+			s.event(m, r, "+convert-to-slave", "")
+		} else {
+			s.event(m, r, "+fix-slave-config", "")
+		}
+		s.mu.Unlock()
+	}
+}
+
+// maybeFailover fails the master of m over if it's objectively down, or
+// the failover is forced, and this sentinel is elected.
+func (s *Sentinel) maybeFailover(m *master, l *links) {
+	s.mu.Lock()
+	forced := m.forced
+	if !forced && (!m.odown || time.Now().Before(m.failoverAfter)) {
+		s.mu.Unlock()
+		return
+	}
+	m.forced = false
+	m.failoverAfter = time.Now().Add(2 * s.conf.FailoverTimeout)
+	m.failingOver = true
+	s.currentEpoch++
+	epoch := s.currentEpoch
+	s.event(m, m.inst, "+new-epoch", strconv.FormatUint(epoch, 10))
+	s.event(m, m.inst, "+try-failover", "")
+	leader, _ := s.vote(m, s.id, epoch)
+	host, port, _ := net.SplitHostPort(m.inst.addr)
+	need := s.majority(m)
+	peers := make([]*peer, len(s.peers))
+	copy(peers, s.peers)
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		m.failingOver = false
+		s.mu.Unlock()
+	}()
+
+	if !forced {
+		var votes int
+		if leader == s.id {
+			votes++
+		}
+		for _, p := range peers {
+			v, err := l.do(p.addr, false, "SENTINEL", "IS-MASTER-DOWN-BY-ADDR", host, port, strconv.FormatUint(epoch, 10), s.id)
+			reply, ok := v.([]interface{})
+			if err != nil || !ok || len(reply) != 3 {
+				continue
+			}
+			if id, _ := reply[1].([]byte); string(id) == s.id && reply[2] == int64(epoch) {
+				votes++
+			}
+		}
+		s.mu.Lock()
+		if votes < need {
+			s.event(m, m.inst, "-failover-abort-not-elected", "")
+			s.mu.Unlock()
+			return
+		}
+		s.event(m, m.inst, "+elected-leader", "")
+		s.mu.Unlock()
+	}
+	s.failover(m, l, epoch)
+}
+
+// failover promotes the best replica of m and makes the other instances
+// replicate it.
+func (s *Sentinel) failover(m *master, l *links, epoch uint64) {
+	s.mu.Lock()
+	good := s.goodReplicas(m)
+	if len(good) == 0 {
+		s.event(m, m.inst, "-failover-abort-no-good-slave", "")
+		s.mu.Unlock()
+		return
+	}
+	promoted := good[0]
+	s.event(m, promoted, "+selected-slave", "")
+	s.mu.Unlock()
+
+	if _, err := l.do(promoted.addr, true, "REPLICAOF", "NO", "ONE"); err != nil {
+		s.logger.Warn("failed to promote replica", zap.String("addr", promoted.addr), zap.Error(err))
+		return
+	}
+	deadline := time.Now().Add(s.conf.FailoverTimeout)
+	for {
+		v, err := l.do(promoted.addr, true, "ROLE")
+		if err == nil && roleName(v) == "master" {
+			break
+		}
+		if time.Now().After(deadline) {
+			s.mu.Lock()
+			s.event(m, promoted, "-failover-abort-slave-timeout", "")
+			s.mu.Unlock()
+			return
+		}
+		time.Sleep(s.period())
+	}
+
+	s.mu.Lock()
+	s.event(m, promoted, "+promoted-slave", "")
+	s.switchMaster(m, promoted.addr, epoch)
+	var others []*instance
+	for _, r := range m.replicas {
+		others = append(others, r)
+	}
+	host, port, _ := net.SplitHostPort(promoted.addr)
+	s.mu.Unlock()
+
+	// The instances which can't be reached now, e.g. the previous master,
+	// are reconfigured once back, see fixReplicas.
+	for _, r := range others {
+		if _, err := l.do(r.addr, true, "REPLICAOF", host, port); err == nil {
+			s.mu.Lock()
+			s.event(m, r, "+slave-reconf-sent", "")
+			s.mu.Unlock()
+		}
+	}
+	s.mu.Lock()
+	s.event(m, m.inst, "+failover-end", "")
+	s.mu.Unlock()
+}
@@ -0,0 +1,449 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package sentinel monitors redix masters and their replicas like Redis
+// Sentinel. A master which doesn't answer is failed over to its best
+// replica once enough sentinels agree, and the clients ask the sentinels
+// for the address of the current master with the commands of Redis
+// Sentinel, see commands.go.
+package sentinel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/ristretto/z"
+	"github.com/tidwall/redcon"
+	"go.chensl.me/redix/server/internal/runid"
+	"go.uber.org/zap"
+)
+
+type Config struct {
+	// File keeps the state of the sentinel across restarts.
+	File string
+	// Masters are monitored unless already known from the file.
+	Masters []Master
+	// Peers are the client addresses of the other sentinels monitoring
+	// the same masters.
+	Peers []string
+	// DownAfter is the time after which an instance which doesn't answer
+	// is considered down.
+	DownAfter       time.Duration
+	FailoverTimeout time.Duration
+	// AuthPass is sent with AUTH to the monitored instances.
+	AuthPass string
+}
+
+// Master is a master to monitor, as given to SENTINEL MONITOR.
+type Master struct {
+	Name string
+	Addr string
+	// Quorum is the number of sentinels which must agree that the master
+	// is down to fail it over.
+	Quorum int
+}
+
+// ParseMasters parses a list of masters separated by commas, each master
+// being given as "name host port quorum".
+func ParseMasters(s string) ([]Master, error) {
+	var masters []Master
+	for _, f := range strings.Split(s, ",") {
+		if strings.TrimSpace(f) == "" {
+			continue
+		}
+		args := strings.Fields(f)
+		if len(args) != 4 {
+			return nil, fmt.Errorf("sentinel: invalid master %q, expected \"name host port quorum\"", f)
+		}
+		port, err := strconv.Atoi(args[2])
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("sentinel: invalid port %q", args[2])
+		}
+		quorum, err := strconv.Atoi(args[3])
+		if err != nil || quorum <= 0 {
+			return nil, fmt.Errorf("sentinel: invalid quorum %q", args[3])
+		}
+		masters = append(masters, Master{
+			Name:   args[0],
+			Addr:   net.JoinHostPort(args[1], args[2]),
+			Quorum: quorum,
+		})
+	}
+	return masters, nil
+}
+
+// instance is a monitored master or replica.
+type instance struct {
+	addr string
+	// lastOK is the last time the instance replied to ROLE.
+	lastOK time.Time
+	role   string
+	// master, linkUp and offset are reported by a replica.
+	master string
+	linkUp bool
+	offset int64
+	// wrongSince is the time since which the replica doesn't replicate
+	// the master, it's reconfigured if that lasts.
+	wrongSince time.Time
+}
+
+type master struct {
+	name   string
+	quorum int
+	// configEpoch is the epoch of the failover which promoted the master,
+	// the configuration with the greatest epoch wins across the sentinels.
+	configEpoch uint64
+	inst        *instance
+	replicas    map[string]*instance
+	sdown       bool
+	odown       bool
+
+	// leader is the sentinel voted for in leaderEpoch.
+	leader      string
+	leaderEpoch uint64
+	// failoverAfter is the earliest time of the next failover attempt.
+	failoverAfter time.Time
+	failingOver   bool
+	// forced is set by SENTINEL FAILOVER.
+	forced bool
+	// done stops the monitor of the master once removed.
+	done chan struct{}
+}
+
+// peer is another sentinel.
+type peer struct {
+	addr   string
+	id     string
+	lastOK time.Time
+}
+
+type Sentinel struct {
+	conf   Config
+	logger *zap.Logger
+
+	mu           sync.Mutex
+	id           string
+	currentEpoch uint64
+	masters      map[string]*master
+	peers        []*peer
+	serving      bool
+
+	ps  redcon.PubSub
+	srv *redcon.Server
+	// conns are the client connections, they are closed before the
+	// server by Close.
+	conns   map[redcon.Conn]struct{}
+	connsWG sync.WaitGroup
+	closing bool
+	closer  *z.Closer
+}
+
+// New loads the state of the sentinel from its file, or creates a new
+// sentinel.
+func New(conf Config, logger *zap.Logger) (*Sentinel, error) {
+	s := &Sentinel{
+		conf:    conf,
+		logger:  logger,
+		masters: make(map[string]*master),
+		conns:   make(map[redcon.Conn]struct{}),
+		closer:  z.NewCloser(0),
+	}
+	for _, addr := range conf.Peers {
+		s.peers = append(s.peers, &peer{addr: addr})
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	for _, m := range conf.Masters {
+		if s.masters[m.Name] == nil {
+			s.addMaster(m)
+		}
+	}
+	if err := s.save(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Serve answers the clients on ln and monitors the masters until Close.
+func (s *Sentinel) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	s.srv = redcon.NewServer(ln.Addr().String(), s.handle, s.accept, s.closed)
+	s.serving = true
+	for _, m := range s.masters {
+		s.startMonitor(m)
+	}
+	s.mu.Unlock()
+	return s.srv.Serve(ln)
+}
+
+// Close stops serving and monitoring.
+func (s *Sentinel) Close() error {
+	// The connections are closed and their handlers return first, redcon
+	// would close them while still in use.
+	s.mu.Lock()
+	srv := s.srv
+	s.closing = true
+	for conn := range s.conns {
+		_ = conn.NetConn().Close()
+	}
+	s.mu.Unlock()
+	s.connsWG.Wait()
+
+	var err error
+	if srv != nil {
+		err = srv.Close()
+	}
+	s.closer.SignalAndWait()
+	return err
+}
+
+func (s *Sentinel) accept(conn redcon.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.connsWG.Add(1)
+	return true
+}
+
+func (s *Sentinel) closed(conn redcon.Conn, err error) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	s.connsWG.Done()
+}
+
+func (s *Sentinel) addMaster(conf Master) *master {
+	m := &master{
+		name:     conf.Name,
+		quorum:   conf.Quorum,
+		inst:     &instance{addr: conf.Addr, lastOK: time.Now()},
+		replicas: make(map[string]*instance),
+		done:     make(chan struct{}),
+	}
+	s.masters[m.name] = m
+	return m
+}
+
+// masterByAddr returns the master at addr.
+func (s *Sentinel) masterByAddr(addr string) *master {
+	for _, m := range s.masters {
+		if m.inst.addr == addr {
+			return m
+		}
+	}
+	return nil
+}
+
+func (s *Sentinel) sortedMasters() []*master {
+	masters := make([]*master, 0, len(s.masters))
+	for _, m := range s.masters {
+		masters = append(masters, m)
+	}
+	sort.Slice(masters, func(i, j int) bool { return masters[i].name < masters[j].name })
+	return masters
+}
+
+// isDown reports whether inst didn't answer within the down-after time.
+func (s *Sentinel) isDown(lastOK time.Time) bool {
+	return time.Since(lastOK) > s.conf.DownAfter
+}
+
+// goodReplicas returns the replicas which can be promoted, the best first:
+// the one with the greatest replication offset.
+func (s *Sentinel) goodReplicas(m *master) []*instance {
+	var good []*instance
+	for _, r := range m.replicas {
+		if r.role == "slave" && !s.isDown(r.lastOK) {
+			good = append(good, r)
+		}
+	}
+	sort.Slice(good, func(i, j int) bool {
+		if good[i].offset != good[j].offset {
+			return good[i].offset > good[j].offset
+		}
+		return good[i].addr < good[j].addr
+	})
+	return good
+}
+
+// usablePeers returns the number of the other sentinels which answer.
+func (s *Sentinel) usablePeers() int {
+	var n int
+	for _, p := range s.peers {
+		if !s.isDown(p.lastOK) {
+			n++
+		}
+	}
+	return n
+}
+
+// majority is the number of votes needed to fail m over.
+func (s *Sentinel) majority(m *master) int {
+	n := (len(s.peers)+1)/2 + 1
+	if m.quorum > n {
+		n = m.quorum
+	}
+	return n
+}
+
+// vote gives the vote of this sentinel for the failover of m in epoch, if
+// it didn't vote in that epoch yet, and returns the leader voted for.
+func (s *Sentinel) vote(m *master, leader string, epoch uint64) (string, uint64) {
+	if epoch > s.currentEpoch {
+		s.currentEpoch = epoch
+		s.event(m, m.inst, "+new-epoch", strconv.FormatUint(epoch, 10))
+		s.saveOrLog()
+	}
+	if m.leaderEpoch < epoch && s.currentEpoch <= epoch {
+		m.leader, m.leaderEpoch = leader, s.currentEpoch
+		s.event(m, m.inst, "+vote-for-leader", leader+" "+strconv.FormatUint(epoch, 10))
+		s.saveOrLog()
+		if leader != s.id {
+			// The leader has the time to fail the master over.
+			m.failoverAfter = time.Now().Add(2 * s.conf.FailoverTimeout)
+		}
+	}
+	return m.leader, m.leaderEpoch
+}
+
+// switchMaster makes the instance at addr the master of m. The other
+// instances, the previous master included, are its replicas.
+func (s *Sentinel) switchMaster(m *master, addr string, epoch uint64) {
+	old := m.inst
+	inst := m.replicas[addr]
+	if inst == nil {
+		inst = &instance{addr: addr, lastOK: time.Now()}
+	}
+	delete(m.replicas, addr)
+	m.replicas[old.addr] = old
+	old.wrongSince = time.Time{}
+	m.inst = inst
+	m.configEpoch = epoch
+	m.sdown, m.odown = false, false
+
+	oldHost, oldPort, _ := net.SplitHostPort(old.addr)
+	host, port, _ := net.SplitHostPort(addr)
+	s.publish("+switch-master", strings.Join([]string{m.name, oldHost, oldPort, host, port}, " "))
+	s.saveOrLog()
+}
+
+// event logs an event about inst, an instance of m, and publishes it on
+// the channel named after the event.
+func (s *Sentinel) event(m *master, inst *instance, typ, detail string) {
+	host, port, _ := net.SplitHostPort(inst.addr)
+	var msg string
+	if inst == m.inst {
+		msg = "master " + m.name + " " + host + " " + port
+	} else {
+		mhost, mport, _ := net.SplitHostPort(m.inst.addr)
+		msg = "slave " + inst.addr + " " + host + " " + port + " @ " + m.name + " " + mhost + " " + mport
+	}
+	if detail != "" {
+		msg += " " + detail
+	}
+	s.publish(typ, msg)
+}
+
+func (s *Sentinel) publish(channel, msg string) {
+	s.logger.Info("sentinel event", zap.String("type", channel), zap.String("msg", msg))
+	s.ps.Publish(channel, msg)
+}
+
+// fileState is the content of the state file.
+type fileState struct {
+	ID           string       `json:"id"`
+	CurrentEpoch uint64       `json:"current_epoch"`
+	Masters      []fileMaster `json:"masters"`
+}
+
+type fileMaster struct {
+	Name        string   `json:"name"`
+	Addr        string   `json:"addr"`
+	Quorum      int      `json:"quorum"`
+	ConfigEpoch uint64   `json:"config_epoch"`
+	Leader      string   `json:"leader,omitempty"`
+	LeaderEpoch uint64   `json:"leader_epoch"`
+	Replicas    []string `json:"replicas"`
+}
+
+func (s *Sentinel) load() error {
+	b, err := os.ReadFile(s.conf.File)
+	if os.IsNotExist(err) {
+		s.id = runid.New()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var st fileState
+	if err := json.Unmarshal(b, &st); err != nil {
+		return fmt.Errorf("sentinel: %s: %w", s.conf.File, err)
+	}
+	if st.ID == "" {
+		return fmt.Errorf("sentinel: %s: missing id", s.conf.File)
+	}
+	s.id = st.ID
+	s.currentEpoch = st.CurrentEpoch
+	for _, fm := range st.Masters {
+		m := s.addMaster(Master{Name: fm.Name, Addr: fm.Addr, Quorum: fm.Quorum})
+		m.configEpoch = fm.ConfigEpoch
+		m.leader, m.leaderEpoch = fm.Leader, fm.LeaderEpoch
+		for _, addr := range fm.Replicas {
+			m.replicas[addr] = &instance{addr: addr, lastOK: time.Now()}
+		}
+	}
+	return nil
+}
+
+// save writes the state to the state file, it's replaced atomically.
+func (s *Sentinel) save() error {
+	st := fileState{ID: s.id, CurrentEpoch: s.currentEpoch}
+	for _, m := range s.sortedMasters() {
+		fm := fileMaster{
+			Name:        m.name,
+			Addr:        m.inst.addr,
+			Quorum:      m.quorum,
+			ConfigEpoch: m.configEpoch,
+			Leader:      m.leader,
+			LeaderEpoch: m.leaderEpoch,
+			Replicas:    []string{},
+		}
+		for addr := range m.replicas {
+			fm.Replicas = append(fm.Replicas, addr)
+		}
+		sort.Strings(fm.Replicas)
+		st.Masters = append(st.Masters, fm)
+	}
+	b, err := json.MarshalIndent(&st, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(filepath.Dir(s.conf.File), "."+filepath.Base(s.conf.File)+".tmp")
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.conf.File)
+}
+
+func (s *Sentinel) saveOrLog() {
+	if err := s.save(); err != nil {
+		s.logger.Error("failed to save sentinel state", zap.Error(err))
+	}
+}
+
+var errNoMaster = errors.New("ERR No such master with that name")
@@ -0,0 +1,321 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package sentinel
+
+import (
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/redcon"
+	"go.chensl.me/redix/server/internal/client"
+	"go.uber.org/zap"
+)
+
+// fakeInstance answers ROLE and REPLICAOF like a redix server.
+type fakeInstance struct {
+	addr string
+	net  *fakeNet
+
+	// The fields are guarded by the mutex of net.
+	down   bool
+	master string
+	offset int64
+	// promoted counts the REPLICAOF NO ONE received.
+	promoted int
+}
+
+type fakeNet struct {
+	mu    sync.Mutex
+	insts []*fakeInstance
+}
+
+func (n *fakeNet) start(t *testing.T, master string, offset int64) *fakeInstance {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	inst := &fakeInstance{addr: ln.Addr().String(), net: n, master: master, offset: offset}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go inst.serveConn(conn)
+		}
+	}()
+	t.Cleanup(func() { _ = ln.Close() })
+	n.mu.Lock()
+	n.insts = append(n.insts, inst)
+	n.mu.Unlock()
+	return inst
+}
+
+func (inst *fakeInstance) serveConn(conn net.Conn) {
+	defer conn.Close()
+	rd := redcon.NewReader(conn)
+	wr := redcon.NewWriter(conn)
+	for {
+		cmd, err := rd.ReadCommand()
+		if err != nil || !inst.handle(wr, cmd) {
+			return
+		}
+		if err := wr.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// handle writes the reply to cmd, it returns false to drop the connection
+// while down.
+func (inst *fakeInstance) handle(conn *redcon.Writer, cmd redcon.Command) bool {
+	n := inst.net
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if inst.down {
+		return false
+	}
+	switch strings.ToUpper(string(cmd.Args[0])) {
+	case "ROLE":
+		if inst.master == "" {
+			var replicas []*fakeInstance
+			for _, r := range n.insts {
+				if r.master == inst.addr && !r.down {
+					replicas = append(replicas, r)
+				}
+			}
+			conn.WriteArray(3)
+			conn.WriteBulkString("master")
+			conn.WriteInt64(inst.offset)
+			conn.WriteArray(len(replicas))
+			for _, r := range replicas {
+				host, port, _ := net.SplitHostPort(r.addr)
+				conn.WriteArray(3)
+				conn.WriteBulkString(host)
+				conn.WriteBulkString(port)
+				conn.WriteBulkString(strconv.FormatInt(r.offset, 10))
+			}
+			return true
+		}
+		host, port, _ := net.SplitHostPort(inst.master)
+		p, _ := strconv.Atoi(port)
+		conn.WriteArray(5)
+		conn.WriteBulkString("slave")
+		conn.WriteBulkString(host)
+		conn.WriteInt(p)
+		conn.WriteBulkString("connected")
+		conn.WriteInt64(inst.offset)
+	case "REPLICAOF":
+		if strings.EqualFold(string(cmd.Args[1]), "NO") {
+			inst.master = ""
+			inst.promoted++
+		} else {
+			inst.master = net.JoinHostPort(string(cmd.Args[1]), string(cmd.Args[2]))
+		}
+		conn.WriteString("OK")
+	default:
+		conn.WriteError("ERR unknown command")
+	}
+	return true
+}
+
+func (inst *fakeInstance) get() (master string, promoted int) {
+	inst.net.mu.Lock()
+	defer inst.net.mu.Unlock()
+	return inst.master, inst.promoted
+}
+
+func (inst *fakeInstance) setDown(down bool) {
+	inst.net.mu.Lock()
+	inst.down = down
+	inst.net.mu.Unlock()
+}
+
+func listen(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	return ln
+}
+
+// serve runs a sentinel on ln until the end of the test and returns a
+// client connection.
+func serve(t *testing.T, conf Config, ln net.Listener) (*Sentinel, *client.Conn) {
+	s, err := New(conf, zap.NewNop())
+	require.NoError(t, err)
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(ln) }()
+	conn, err := client.Dial(ln.Addr().String(), 5*time.Second)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+		_ = s.Close()
+		<-done
+	})
+	return s, conn
+}
+
+func testConfig(t *testing.T, masters ...Master) Config {
+	return Config{
+		File:            filepath.Join(t.TempDir(), "sentinel.json"),
+		Masters:         masters,
+		DownAfter:       200 * time.Millisecond,
+		FailoverTimeout: 500 * time.Millisecond,
+	}
+}
+
+func do(t *testing.T, c *client.Conn, args ...interface{}) interface{} {
+	v, err := c.Do(args...)
+	if _, ok := err.(client.Error); !ok {
+		require.NoError(t, err)
+	}
+	if err != nil {
+		return err
+	}
+	return v
+}
+
+func masterAddr(t *testing.T, c *client.Conn) string {
+	v := do(t, c, "SENTINEL", "GET-MASTER-ADDR-BY-NAME", "mymaster").([]interface{})
+	return net.JoinHostPort(string(v[0].([]byte)), string(v[1].([]byte)))
+}
+
+func TestParseMasters(t *testing.T) {
+	masters, err := ParseMasters("m1 127.0.0.1 6380 2, m2 ::1 6390 1")
+	require.NoError(t, err)
+	assert.Equal(t, []Master{
+		{Name: "m1", Addr: "127.0.0.1:6380", Quorum: 2},
+		{Name: "m2", Addr: "[::1]:6390", Quorum: 1},
+	}, masters)
+	for _, s := range []string{"m1 127.0.0.1 6380", "m1 127.0.0.1 x 1", "m1 127.0.0.1 6380 0"} {
+		_, err := ParseMasters(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	conf := testConfig(t, Master{Name: "mymaster", Addr: "127.0.0.1:1", Quorum: 1})
+	_, c := serve(t, conf, listen(t))
+
+	assert.Equal(t, "PONG", do(t, c, "PING"))
+	assert.Equal(t, "127.0.0.1:1", masterAddr(t, c))
+	assert.Nil(t, do(t, c, "SENTINEL", "GET-MASTER-ADDR-BY-NAME", "unknown"))
+	assert.Equal(t, client.Error("ERR No such master with that name"), do(t, c, "SENTINEL", "MASTER", "unknown"))
+	assert.Equal(t, client.Error("ERR Duplicated master name."), do(t, c, "SENTINEL", "MONITOR", "mymaster", "127.0.0.1", "2", "1"))
+	assert.Equal(t, client.Error("ERR Quorum must be 1 or greater."), do(t, c, "SENTINEL", "MONITOR", "other", "127.0.0.1", "2", "0"))
+	assert.Equal(t, "OK", do(t, c, "SENTINEL", "MONITOR", "other", "127.0.0.1", "2", "2"))
+	assert.Equal(t, []interface{}{[]byte("sentinel"), []interface{}{[]byte("mymaster"), []byte("other")}}, do(t, c, "ROLE"))
+	assert.Equal(t, "OK 1 usable Sentinels. Quorum and failover authorization can be reached", do(t, c, "SENTINEL", "CKQUORUM", "mymaster"))
+	assert.Equal(t, client.Error("NOQUORUM 1 usable Sentinels. Not enough available Sentinels to reach the specified quorum for this master"),
+		do(t, c, "SENTINEL", "CKQUORUM", "other"))
+	assert.Equal(t, "OK", do(t, c, "SENTINEL", "REMOVE", "other"))
+	assert.Equal(t, client.Error("NOGOODSLAVE No suitable replica to promote"), do(t, c, "SENTINEL", "FAILOVER", "mymaster"))
+
+	// One vote per epoch.
+	vote := func(epoch int, id string) interface{} {
+		return do(t, c, "SENTINEL", "IS-MASTER-DOWN-BY-ADDR", "127.0.0.1", "1", epoch, id)
+	}
+	assert.Equal(t, []interface{}{int64(0), []byte("*"), int64(0)}, vote(1, "*"))
+	assert.Equal(t, []interface{}{int64(0), []byte("a"), int64(1)}, vote(1, "a"))
+	assert.Equal(t, []interface{}{int64(0), []byte("a"), int64(1)}, vote(1, "b"))
+	assert.Equal(t, []interface{}{int64(0), []byte("b"), int64(2)}, vote(2, "b"))
+	assert.Equal(t, []interface{}{int64(0), []byte("b"), int64(2)}, vote(1, "c"))
+
+	// The master at 127.0.0.1:1 never answers.
+	require.Eventually(t, func() bool {
+		return strings.Contains(string(do(t, c, "INFO").([]byte)), "status=odown")
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []interface{}{int64(1), []byte("*"), int64(0)}, vote(3, "*"))
+}
+
+func TestFailover(t *testing.T) {
+	var n fakeNet
+	m := n.start(t, "", 100)
+	r1 := n.start(t, m.addr, 10)
+	r2 := n.start(t, m.addr, 20)
+	conf := testConfig(t, Master{Name: "mymaster", Addr: m.addr, Quorum: 1})
+	ln := listen(t)
+	s, c := serve(t, conf, ln)
+
+	sub, err := client.Dial(ln.Addr().String(), 5*time.Second)
+	require.NoError(t, err)
+	defer sub.Close()
+	_, err = sub.Do("SUBSCRIBE", "+switch-master")
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return len(do(t, c, "SENTINEL", "REPLICAS", "mymaster").([]interface{})) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	m.setDown(true)
+	require.Eventually(t, func() bool {
+		return masterAddr(t, c) == r2.addr
+	}, 5*time.Second, 10*time.Millisecond)
+	master, promoted := r2.get()
+	assert.Equal(t, "", master)
+	assert.Equal(t, 1, promoted)
+	master, _ = r1.get()
+	assert.Equal(t, r2.addr, master)
+
+	msg, err := sub.Receive()
+	require.NoError(t, err)
+	host, port, _ := net.SplitHostPort(m.addr)
+	host2, port2, _ := net.SplitHostPort(r2.addr)
+	assert.Equal(t, []interface{}{[]byte("message"), []byte("+switch-master"),
+		[]byte("mymaster " + host + " " + port + " " + host2 + " " + port2)}, msg)
+
+	// The previous master replicates the new one once back.
+	m.setDown(false)
+	require.Eventually(t, func() bool {
+		master, _ := m.get()
+		return master == r2.addr
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, s.Close())
+	s, err = New(conf, zap.NewNop())
+	require.NoError(t, err)
+	assert.Equal(t, r2.addr, s.masters["mymaster"].inst.addr)
+	assert.Len(t, s.masters["mymaster"].replicas, 2)
+}
+
+func TestFailoverQuorum(t *testing.T) {
+	var n fakeNet
+	m := n.start(t, "", 100)
+	r1 := n.start(t, m.addr, 20)
+	r2 := n.start(t, m.addr, 10)
+
+	lns := []net.Listener{listen(t), listen(t), listen(t)}
+	var conns []*client.Conn
+	for i, ln := range lns {
+		conf := testConfig(t, Master{Name: "mymaster", Addr: m.addr, Quorum: 2})
+		for j, peer := range lns {
+			if j != i {
+				conf.Peers = append(conf.Peers, peer.Addr().String())
+			}
+		}
+		_, c := serve(t, conf, ln)
+		conns = append(conns, c)
+	}
+	require.Eventually(t, func() bool {
+		return len(do(t, conns[0], "SENTINEL", "SENTINELS", "mymaster").([]interface{})) == 2 &&
+			strings.Contains(string(do(t, conns[0], "INFO").([]byte)), "slaves=2")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	m.setDown(true)
+	for _, c := range conns {
+		c := c
+		require.Eventually(t, func() bool {
+			return masterAddr(t, c) == r1.addr
+		}, 10*time.Second, 10*time.Millisecond)
+	}
+	_, promoted := r1.get()
+	assert.Equal(t, 1, promoted)
+	master, _ := r2.get()
+	assert.Equal(t, r1.addr, master)
+}
@@ -0,0 +1,14 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+// Backuper is implemented by the drivers which can take a consistent
+// snapshot of their own files while serving requests. The other drivers are
+// backed up through ForEach.
+type Backuper interface {
+	// Backup writes a snapshot to dir, which exists and is empty, so that
+	// dir can then be opened as the data directory of the same driver.
+	Backup(dir string) error
+}
@@ -0,0 +1,39 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package badger
+
+import (
+	"io"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Backup streams a snapshot of the database, as of the start of the call,
+// into a new database in dir.
+func (s *badgerStorage) Backup(dir string) error {
+	db, err := badger.Open(badger.DefaultOptions(dir).WithLoggingLevel(badger.WARNING))
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.db.Backup(pw, 0)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+	err = db.Load(pr, 256)
+	// Unblocks the backup if Load failed.
+	pr.CloseWithError(err)
+	if berr := <-done; err == nil {
+		err = berr
+	}
+
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
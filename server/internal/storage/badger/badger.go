@@ -5,6 +5,9 @@
 package badger
 
 import (
+	"bytes"
+	"errors"
+	"sync"
 	"time"
 
 	"github.com/dgraph-io/badger/v3"
@@ -15,10 +18,27 @@ import (
 	"go.uber.org/zap"
 )
 
+// errNoop aborts a transaction which has nothing to write.
+var errNoop = errors.New("noop")
+
 type badgerStorage struct {
 	db     *badger.DB
 	closer *z.Closer
 	logger *zap.Logger
+
+	// mu serializes writers so that size and expires stay consistent with
+	// the database.
+	mu sync.Mutex
+	// size is the number of keys, including expired keys which have not
+	// been reaped from expires yet.
+	size    int64
+	expires *storage.ExpiryIndex
+}
+
+func init() {
+	storage.Register("badger", func(opts storage.Options) (storage.Interface, error) {
+		return NewStorage(opts.DataDir, opts.Logger)
+	})
 }
 
 func NewStorage(path string, logger *zap.Logger) (storage.Interface, error) {
@@ -27,18 +47,40 @@ func NewStorage(path string, logger *zap.Logger) (storage.Interface, error) {
 		return nil, err
 	}
 	s := &badgerStorage{
-		db:     db,
-		closer: z.NewCloser(1),
+		db:      db,
+		closer:  z.NewCloser(1),
+		expires: storage.NewExpiryIndex(),
 	}
 	if logger != nil {
 		s.logger = logger
 	} else {
 		s.logger, _ = zap.NewDevelopment()
 	}
+	if err := s.loadIndex(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
 	go s.runValueLogGC()
 	return s, nil
 }
 
+func (s *badgerStorage) loadIndex() error {
+	return s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			s.size++
+			if exp := item.ExpiresAt(); exp > 0 {
+				s.expires.Set(item.Key(), int64(exp))
+			}
+		}
+		return nil
+	})
+}
+
 func (s *badgerStorage) Keys(pattern string) ([][]byte, error) {
 	var keys [][]byte
 
@@ -64,29 +106,237 @@ func (s *badgerStorage) Del(keys ...[]byte) (int, error) {
 		return 0, nil
 	}
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var (
+		found []bool
+		cnt   int
+	)
+	err := s.db.Update(func(txn *badger.Txn) error {
+		var err error
+		found, cnt, err = s.del(txn, keys)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for i, k := range keys {
+		s.untrack(k, found[i])
+	}
+	return cnt, nil
+}
+
+// del is Del with w. It returns whether each key was found. The keys are
+// looked up first, so that an invalid key fails before any write.
+func (*badgerStorage) del(w writer, keys [][]byte) ([]bool, int, error) {
+	found := make([]bool, len(keys))
+	seen := make(map[string]bool, len(keys))
 	var cnt int
+	for i, k := range keys {
+		if seen[string(k)] {
+			continue
+		}
+		seen[string(k)] = true
+		_, err := w.Get(k)
+		if err == badger.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		cnt++
+		found[i] = true
+	}
+	for i, k := range keys {
+		if !found[i] {
+			continue
+		}
+		if err := w.Delete(k); err != nil {
+			return nil, 0, err
+		}
+	}
+	return found, cnt, nil
+}
+
+func (s *badgerStorage) Rename(key, newKey []byte, nx bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var (
+		found     bool
+		expiresAt uint64
+	)
 	err := s.db.Update(func(txn *badger.Txn) error {
-		for _, k := range keys {
-			_, err := txn.Get(k)
-			if err == badger.ErrKeyNotFound {
-				continue
+		item, err := txn.Get(key)
+		if err == badger.ErrKeyNotFound {
+			return storage.ErrNotExist
+		}
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(key, newKey) {
+			if nx {
+				return storage.ErrExist
 			}
-			if err != nil {
-				return err
+			return errNoop
+		}
+
+		found, err = s.exists(txn, newKey)
+		if err != nil {
+			return err
+		}
+		if found && nx {
+			return storage.ErrExist
+		}
+
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		expiresAt = item.ExpiresAt()
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+		e := badger.NewEntry(newKey, val)
+		e.ExpiresAt = expiresAt
+		return txn.SetEntry(e)
+	})
+	if err == errNoop {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	s.untrack(key, true)
+	s.track(newKey, found, expiresAt)
+	return nil
+}
+
+func (s *badgerStorage) Copy(src, dst []byte, replace bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var (
+		found     bool
+		expiresAt uint64
+	)
+	err := s.db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get(src)
+		if err == badger.ErrKeyNotFound {
+			return storage.ErrNotExist
+		}
+		if err != nil {
+			return err
+		}
+
+		found, err = s.exists(txn, dst)
+		if err != nil {
+			return err
+		}
+		if found && !replace {
+			return storage.ErrExist
+		}
+		if bytes.Equal(src, dst) {
+			return errNoop
+		}
+
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		expiresAt = item.ExpiresAt()
+		e := badger.NewEntry(dst, val)
+		e.ExpiresAt = expiresAt
+		return txn.SetEntry(e)
+	})
+	if err == errNoop {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	s.track(dst, found, expiresAt)
+	return nil
+}
+
+func (s *badgerStorage) RandomKey() ([]byte, error) {
+	var key []byte
+
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		it.Rewind()
+		if !it.Valid() {
+			return storage.ErrNotExist
+		}
+		first := it.Item().KeyCopy(nil)
+
+		opts.Reverse = true
+		rit := txn.NewIterator(opts)
+		defer rit.Close()
+		rit.Rewind()
+		if !rit.Valid() {
+			return storage.ErrNotExist
+		}
+		last := rit.Item().KeyCopy(nil)
+
+		it.Seek(storage.RandomSeekKey(first, last))
+		if !it.Valid() {
+			key = first
+			return nil
+		}
+		key = it.Item().KeyCopy(nil)
+		return nil
+	})
+
+	return key, err
+}
+
+func (s *badgerStorage) DBSize() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reap()
+	return s.size, nil
+}
+
+func (s *badgerStorage) ForEach(fn func(key, value []byte, expiresAt time.Time) error) error {
+	return s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			var expiresAt time.Time
+			if exp := item.ExpiresAt(); exp > 0 {
+				expiresAt = time.Unix(int64(exp), 0)
 			}
-			cnt++
-			if err := txn.Delete(k); err != nil {
+			err := item.Value(func(val []byte) error {
+				return fn(item.Key(), val, expiresAt)
+			})
+			if err != nil {
 				return err
 			}
 		}
 		return nil
 	})
-
-	return cnt, err
 }
 
 func (s *badgerStorage) DropAll() error {
-	return s.db.DropAll()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.db.DropAll(); err != nil {
+		return err
+	}
+	s.size = 0
+	s.expires.Reset()
+	return nil
 }
 
 func (s *badgerStorage) Expire(key []byte, dur time.Duration) error {
@@ -94,6 +344,10 @@ func (s *badgerStorage) Expire(key []byte, dur time.Duration) error {
 		return storage.ErrInvalidOpts
 	}
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var expiresAt uint64
 	err := s.db.Update(func(txn *badger.Txn) error {
 		item, err := txn.Get(key)
 		if err == badger.ErrKeyNotFound {
@@ -104,41 +358,87 @@ func (s *badgerStorage) Expire(key []byte, dur time.Duration) error {
 		}
 		return item.Value(func(val []byte) error {
 			e := badger.NewEntry(item.Key(), val).WithTTL(dur)
+			expiresAt = e.ExpiresAt
 			return txn.SetEntry(e)
 		})
 	})
+	if err != nil {
+		return err
+	}
 
-	return err
+	s.expires.Set(key, int64(expiresAt))
+	return nil
 }
 
 func (s *badgerStorage) TTL(key []byte) (int64, error) {
-	ttl := int64(-1)
+	var ttl int64
 
 	err := s.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(key)
-		if err == badger.ErrKeyNotFound {
-			ttl = -2
-			return nil
-		}
-		if err != nil {
-			return err
-		}
-		exp := int64(item.ExpiresAt())
-		if exp > 0 {
-			ttl = int64(time.Until(time.Unix(exp, 0)).Seconds())
-		}
-		return nil
+		var err error
+		ttl, err = s.ttl(txn, key)
+		return err
 	})
 
 	return ttl, err
 }
 
+// ttl is TTL with w.
+func (*badgerStorage) ttl(w writer, key []byte) (int64, error) {
+	item, err := w.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return -2, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if exp := int64(item.ExpiresAt()); exp > 0 {
+		return int64(time.Until(time.Unix(exp, 0)).Seconds()), nil
+	}
+	return -1, nil
+}
+
 func (s *badgerStorage) Close() error {
 	s.logger.Info("stopping value log GC")
 	s.closer.SignalAndWait()
 	return s.db.Close()
 }
 
+// exists reports whether key is visible in txn.
+func (*badgerStorage) exists(txn *badger.Txn, key []byte) (bool, error) {
+	_, err := txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// track updates size and expires after key has been written. found reports
+// whether the key was visible before the write. s.mu must be held.
+func (s *badgerStorage) track(key []byte, found bool, expiresAt uint64) {
+	// An expired key which is still in expires has been counted already.
+	if !s.expires.Remove(key) && !found {
+		s.size++
+	}
+	if expiresAt > 0 {
+		s.expires.Set(key, int64(expiresAt))
+	}
+}
+
+// untrack updates size and expires after key has been deleted. s.mu must be
+// held.
+func (s *badgerStorage) untrack(key []byte, found bool) {
+	if s.expires.Remove(key) || found {
+		s.size--
+	}
+}
+
+// reap forgets the keys which have expired since the last call. s.mu must be
+// held.
+func (s *badgerStorage) reap() {
+	keys := s.expires.PopExpired(time.Now().Unix())
+	s.size -= int64(len(keys))
+}
+
 func (s *badgerStorage) runValueLogGC() {
 	ticker := time.NewTicker(5 * time.Minute)
 	defer s.closer.Done()
@@ -149,6 +449,9 @@ func (s *badgerStorage) runValueLogGC() {
 			return
 		case <-ticker.C:
 		}
+		s.mu.Lock()
+		s.reap()
+		s.mu.Unlock()
 	again:
 		err := s.db.RunValueLogGC(0.7)
 		if err == nil {
@@ -7,6 +7,7 @@ package badger
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"go.chensl.me/redix/server/internal/storage"
@@ -33,4 +34,53 @@ func Test_badgerStorage_CommonCmd(t *testing.T) {
 
 	err = s.Expire([]byte("key"), -1)
 	assert.ErrorIs(t, err, storage.ErrInvalidOpts)
+
+	n, err := s.DBSize()
+	assert.Equal(t, int64(0), n)
+	assert.NoError(t, err)
+
+	_, err = s.RandomKey()
+	assert.ErrorIs(t, err, storage.ErrNotExist)
+
+	err = s.Rename([]byte("a"), []byte("b"), false)
+	assert.ErrorIs(t, err, storage.ErrNotExist)
+
+	assert.NoError(t, s.Set([]byte("a"), []byte("1"), storage.SetOptions{TTL: time.Minute}))
+	assert.NoError(t, s.Set([]byte("b"), []byte("2"), storage.SetOptions{}))
+
+	err = s.Rename([]byte("a"), []byte("b"), true)
+	assert.ErrorIs(t, err, storage.ErrExist)
+
+	err = s.Rename([]byte("a"), []byte("c"), true)
+	assert.NoError(t, err)
+
+	ttl, err = s.TTL([]byte("c"))
+	assert.Equal(t, int64(59), ttl)
+	assert.NoError(t, err)
+
+	err = s.Copy([]byte("c"), []byte("b"), false)
+	assert.ErrorIs(t, err, storage.ErrExist)
+
+	err = s.Copy([]byte("c"), []byte("b"), true)
+	assert.NoError(t, err)
+
+	v, err := s.Get([]byte("b"))
+	assert.Equal(t, []byte("1"), v)
+	assert.NoError(t, err)
+
+	n, err = s.DBSize()
+	assert.Equal(t, int64(2), n)
+	assert.NoError(t, err)
+
+	k, err := s.RandomKey()
+	assert.Contains(t, []string{"b", "c"}, string(k))
+	assert.NoError(t, err)
+
+	cnt, err := s.Del([]byte("b"), []byte("b"), []byte("x"))
+	assert.Equal(t, 1, cnt)
+	assert.NoError(t, err)
+
+	n, err = s.DBSize()
+	assert.Equal(t, int64(1), n)
+	assert.NoError(t, err)
 }
@@ -0,0 +1,179 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package badger
+
+import (
+	"github.com/dgraph-io/badger/v3"
+	"go.chensl.me/redix/server/internal/storage"
+)
+
+// writer is what the operations read and write through, a transaction or
+// a batch.
+type writer interface {
+	Get(key []byte) (*badger.Item, error)
+	SetEntry(e *badger.Entry) error
+	Delete(key []byte) error
+}
+
+// Batch runs the calls of next in a single transaction. The writes are
+// logged, so that those of the call which doesn't fit in the transaction
+// can be dropped by replaying the others in a new one.
+func (s *badgerStorage) Batch(next func(b storage.Batch) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := &badgerBatch{s: s, txn: s.db.NewTransaction(true)}
+	for {
+		writes, tracked := len(b.writes), len(b.tracked)
+		more := next((*batchView)(b))
+		if b.full {
+			b.writes, b.tracked = b.writes[:writes], b.tracked[:tracked]
+			if err := b.replay(); err != nil {
+				return err
+			}
+			if err := b.commit(); err != nil {
+				return err
+			}
+			return storage.ErrBatchFull
+		}
+		if !more {
+			return b.commit()
+		}
+	}
+}
+
+// badgerBatch runs the operations of a batch in its transaction. s.mu is
+// held meanwhile.
+type badgerBatch struct {
+	s   *badgerStorage
+	txn *badger.Txn
+	// writes are the writes of txn.
+	writes []func(txn *badger.Txn) error
+	// tracked updates size and expires once txn is committed.
+	tracked []func()
+	// full is set once txn can't hold a write.
+	full bool
+}
+
+// commit commits txn, which can't be used anymore.
+func (b *badgerBatch) commit() error {
+	if err := b.txn.Commit(); err != nil {
+		return err
+	}
+	for _, fn := range b.tracked {
+		fn()
+	}
+	return nil
+}
+
+// replay discards txn and runs the writes again in a new transaction.
+func (b *badgerBatch) replay() error {
+	b.txn.Discard()
+	b.txn = b.s.db.NewTransaction(true)
+	for _, fn := range b.writes {
+		if err := fn(b.txn); err != nil {
+			b.txn.Discard()
+			return err
+		}
+	}
+	return nil
+}
+
+// write runs a write in txn, the batch is full if it can't hold it.
+func (b *badgerBatch) write(fn func(txn *badger.Txn) error) error {
+	if b.full {
+		return storage.ErrBatchFull
+	}
+	err := fn(b.txn)
+	if err == badger.ErrTxnTooBig {
+		b.full = true
+		return storage.ErrBatchFull
+	}
+	if err != nil {
+		return err
+	}
+	b.writes = append(b.writes, fn)
+	return nil
+}
+
+func (b *badgerBatch) Get(key []byte) (*badger.Item, error) {
+	if b.full {
+		return nil, storage.ErrBatchFull
+	}
+	return b.txn.Get(key)
+}
+
+func (b *badgerBatch) SetEntry(e *badger.Entry) error {
+	return b.write(func(txn *badger.Txn) error { return txn.SetEntry(e) })
+}
+
+func (b *badgerBatch) Delete(key []byte) error {
+	return b.write(func(txn *badger.Txn) error { return txn.Delete(key) })
+}
+
+// batchView is the storage.Batch of a badgerBatch, whose own Get returns
+// items.
+type batchView badgerBatch
+
+func (v *batchView) batch() *badgerBatch {
+	return (*badgerBatch)(v)
+}
+
+func (v *batchView) Set(key, value []byte, opts storage.SetOptions) error {
+	if (opts.NX && opts.XX) || (opts.KeepTTL && opts.TTL > 0) {
+		return storage.ErrInvalidOpts
+	}
+	b := v.batch()
+	found, expiresAt, err := b.s.set(b, key, value, opts)
+	if err != nil {
+		return err
+	}
+	b.tracked = append(b.tracked, func() { b.s.track(key, found, expiresAt) })
+	return nil
+}
+
+func (v *batchView) Get(key []byte) ([]byte, error) {
+	return v.s.get(v.batch(), key)
+}
+
+func (v *batchView) Add(key []byte, delta int64) (int64, error) {
+	var i int64
+	err := v.update(key, addInt(&i, delta))
+	return i, err
+}
+
+func (v *batchView) AddFloat(key []byte, delta float64) (float64, error) {
+	var f float64
+	err := v.update(key, addFloat(&f, delta))
+	return f, err
+}
+
+func (v *batchView) update(key []byte, fn func(val []byte) ([]byte, error)) error {
+	b := v.batch()
+	found, expiresAt, err := b.s.updateWith(b, key, fn)
+	if err != nil {
+		return err
+	}
+	b.tracked = append(b.tracked, func() { b.s.track(key, found, expiresAt) })
+	return nil
+}
+
+func (v *batchView) Del(keys ...[]byte) (int, error) {
+	b := v.batch()
+	found, cnt, err := b.s.del(b, keys)
+	if err != nil {
+		return 0, err
+	}
+	b.tracked = append(b.tracked, func() {
+		for i, k := range keys {
+			b.s.untrack(k, found[i])
+		}
+	})
+	return cnt, nil
+}
+
+func (v *batchView) TTL(key []byte) (int64, error) {
+	return v.s.ttl(v.batch(), key)
+}
@@ -0,0 +1,12 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package badger
+
+// DiskSize returns the size of the LSM tree and the value log, which badger
+// updates every minute.
+func (s *badgerStorage) DiskSize() (int64, error) {
+	lsm, vlog := s.db.Size()
+	return lsm + vlog, nil
+}
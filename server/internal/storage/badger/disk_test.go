@@ -0,0 +1,23 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package badger
+
+import (
+	"testing"
+
+	"go.chensl.me/redix/server/internal/storage"
+	"go.chensl.me/redix/server/internal/storage/storagetest"
+	"go.uber.org/zap"
+)
+
+func Test_badgerStorage_DiskSize(t *testing.T) {
+	storagetest.RunDiskSize(t, func(t *testing.T) storage.Interface {
+		s, err := NewStorage(t.TempDir(), zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}, true)
+}
@@ -5,89 +5,177 @@
 package badger
 
 import (
-	"strconv"
-	"time"
-
 	"github.com/dgraph-io/badger/v3"
 	"go.chensl.me/redix/server/internal/storage"
-	"go.chensl.me/redix/server/pkg/bytesconv"
 )
 
 func (s *badgerStorage) Set(key, value []byte, opts storage.SetOptions) error {
-	if opts.NX && opts.XX {
+	if (opts.NX && opts.XX) || (opts.KeepTTL && opts.TTL > 0) {
 		return storage.ErrInvalidOpts
 	}
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var (
+		found     bool
+		expiresAt uint64
+	)
 	err := s.db.Update(func(txn *badger.Txn) error {
-		if opts.NX || opts.XX {
-			_, err := txn.Get(key)
-			if err == badger.ErrKeyNotFound {
-				if opts.XX {
-					return storage.ErrNotExist
-				}
-			} else if err == nil {
-				if opts.NX {
-					return storage.ErrExist
-				}
-			} else {
-				return err
-			}
-		}
+		var err error
+		found, expiresAt, err = s.set(txn, key, value, opts)
+		return err
+	})
+	if err != nil {
+		return err
+	}
 
-		e := badger.NewEntry(key, value)
-		if opts.TTL > 0 {
-			e = e.WithTTL(opts.TTL)
-		}
+	s.track(key, found, expiresAt)
+	return nil
+}
 
-		return txn.SetEntry(e)
-	})
+// set is Set with w, the options are valid. It returns whether the key was
+// found and its new expiration time.
+func (*badgerStorage) set(w writer, key, value []byte, opts storage.SetOptions) (bool, uint64, error) {
+	var (
+		found bool
+		old   uint64
+	)
+	item, err := w.Get(key)
+	if err == nil {
+		found = true
+		old = item.ExpiresAt()
+	} else if err != badger.ErrKeyNotFound {
+		return false, 0, err
+	}
+	if !found && opts.XX {
+		return false, 0, storage.ErrNotExist
+	}
+	if found && opts.NX {
+		return false, 0, storage.ErrExist
+	}
 
-	return err
+	e := badger.NewEntry(key, value)
+	if opts.TTL > 0 {
+		e = e.WithTTL(opts.TTL)
+	} else if opts.KeepTTL {
+		e.ExpiresAt = old
+	}
+	return found, e.ExpiresAt, w.SetEntry(e)
 }
 
 func (s *badgerStorage) Get(key []byte) ([]byte, error) {
 	var val []byte
 
 	err := s.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(key)
-		if err == badger.ErrKeyNotFound {
-			return storage.ErrNotExist
-		}
-		if err != nil {
-			return err
-		}
-		val, _ = item.ValueCopy(nil)
-		return nil
+		var err error
+		val, err = s.get(txn, key)
+		return err
 	})
 
 	return val, err
 }
 
-func (s *badgerStorage) Add(key []byte, delta int) (int, error) {
-	var i int
+// get is Get with w.
+func (*badgerStorage) get(w writer, key []byte) ([]byte, error) {
+	item, err := w.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return nil, storage.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item.ValueCopy(nil)
+}
 
-	err := s.db.Update(func(txn *badger.Txn) error {
-		item, err := txn.Get(key)
-		if err == badger.ErrKeyNotFound {
-			i = delta
-			return txn.Set(key, bytesconv.StringToBytes(strconv.Itoa(delta)))
+func (s *badgerStorage) Add(key []byte, delta int64) (int64, error) {
+	var i int64
+
+	err := s.update(key, addInt(&i, delta))
+
+	return i, err
+}
+
+func (s *badgerStorage) AddFloat(key []byte, delta float64) (float64, error) {
+	var f float64
+
+	err := s.update(key, addFloat(&f, delta))
+
+	return f, err
+}
+
+// addInt returns the update of Add, which stores the result in i.
+func addInt(i *int64, delta int64) func(val []byte) ([]byte, error) {
+	return func(val []byte) ([]byte, error) {
+		var err error
+		*i, err = storage.IncrInt(val, delta)
+		if err != nil {
+			return nil, err
 		}
+		return storage.FormatInt(*i), nil
+	}
+}
+
+// addFloat returns the update of AddFloat, which stores the result in f.
+func addFloat(f *float64, delta float64) func(val []byte) ([]byte, error) {
+	return func(val []byte) ([]byte, error) {
+		var err error
+		*f, err = storage.IncrFloat(val, delta)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		return item.Value(func(val []byte) error {
-			i, err = strconv.Atoi(bytesconv.BytesToString(val))
-			if err != nil {
-				return storage.ErrInvalidInt
-			}
-			i += delta
-			e := badger.NewEntry(key, bytesconv.StringToBytes(strconv.Itoa(i)))
-			if exp := item.ExpiresAt(); exp > 0 {
-				e = e.WithTTL(time.Until(time.Unix(int64(exp), 0)))
-			}
-			return txn.SetEntry(e)
-		})
+		return storage.FormatFloat(*f), nil
+	}
+}
+
+// update replaces the value of key with the result of fn, keeping the
+// original expiration time. fn receives nil if the key does not exist.
+func (s *badgerStorage) update(key []byte, fn func(val []byte) ([]byte, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var (
+		found     bool
+		expiresAt uint64
+	)
+	err := s.db.Update(func(txn *badger.Txn) error {
+		var err error
+		found, expiresAt, err = s.updateWith(txn, key, fn)
+		return err
 	})
+	if err != nil {
+		return err
+	}
 
-	return i, err
+	s.track(key, found, expiresAt)
+	return nil
+}
+
+// updateWith is update with w. It returns whether the key was found and its
+// expiration time.
+func (*badgerStorage) updateWith(w writer, key []byte, fn func(val []byte) ([]byte, error)) (bool, uint64, error) {
+	var (
+		val       []byte
+		found     bool
+		expiresAt uint64
+	)
+	item, err := w.Get(key)
+	if err == nil {
+		found = true
+		if val, err = item.ValueCopy([]byte{}); err != nil {
+			return false, 0, err
+		}
+		expiresAt = item.ExpiresAt()
+	} else if err != badger.ErrKeyNotFound {
+		return false, 0, err
+	}
+
+	val, err = fn(val)
+	if err != nil {
+		return false, 0, err
+	}
+
+	e := badger.NewEntry(key, val)
+	e.ExpiresAt = expiresAt
+	return found, expiresAt, w.SetEntry(e)
 }
@@ -5,6 +5,7 @@
 package badger
 
 import (
+	"math"
 	"os"
 	"testing"
 	"time"
@@ -88,4 +89,35 @@ func Test_badgerStorage_StringCmd(t *testing.T) {
 	v, err = s.Get(key)
 	assert.Nil(t, v)
 	assert.ErrorIs(t, err, storage.ErrNotExist)
+
+	i, err := s.Add(key, 10)
+	assert.Equal(t, int64(10), i)
+	assert.NoError(t, err)
+
+	err = s.Expire(key, time.Minute)
+	assert.NoError(t, err)
+
+	i, err = s.Add(key, math.MaxInt64)
+	assert.Equal(t, int64(0), i)
+	assert.ErrorIs(t, err, storage.ErrOverflow)
+
+	i, err = s.Add(key, -20)
+	assert.Equal(t, int64(-10), i)
+	assert.NoError(t, err)
+
+	f, err := s.AddFloat(key, 0.5)
+	assert.Equal(t, -9.5, f)
+	assert.NoError(t, err)
+
+	v, err = s.Get(key)
+	assert.Equal(t, []byte("-9.5"), v)
+	assert.NoError(t, err)
+
+	ttl, err = s.TTL(key)
+	assert.Equal(t, int64(59), ttl)
+	assert.NoError(t, err)
+
+	i, err = s.Add(key, 1)
+	assert.Equal(t, int64(0), i)
+	assert.ErrorIs(t, err, storage.ErrInvalidInt)
 }
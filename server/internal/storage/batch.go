@@ -0,0 +1,29 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+// Batch is the view of a storage given to the function of Batcher.Batch.
+type Batch interface {
+	StringCmd
+
+	Del(keys ...[]byte) (int, error)
+	TTL(key []byte) (int64, error)
+}
+
+// Batcher is implemented by the drivers which can commit several writes at
+// once, e.g. in a single transaction rather than one per write. The writes
+// of the other drivers are run one at a time.
+type Batcher interface {
+	// Batch calls next with a view of the storage until it returns false,
+	// and commits the writes of the calls at once. An operation of b which
+	// fails leaves the batch as it was: the other operations are still
+	// committed, and each operation sees the writes of the ones before it.
+	//
+	// A batch is never split. Once it can't hold a write, the operation
+	// fails with ErrBatchFull, as do the operations after it, next isn't
+	// called anymore and the writes of its last call are dropped: the
+	// calls before it are committed and Batch returns ErrBatchFull.
+	Batch(next func(b Batch) bool) error
+}
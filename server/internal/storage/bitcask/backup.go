@@ -0,0 +1,86 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package bitcask
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Backup copies the data files to dir. They are first hard-linked while the
+// writers are blocked, which is cheap, then the bytes they had at that
+// point are copied from the links: the data files are append-only, so the
+// copies are consistent even though the active file keeps growing and
+// reclaimed files are deleted meanwhile.
+func (s *bitcaskStorage) Backup(dir string) error {
+	links := filepath.Join(dir, ".links")
+	if err := os.Mkdir(links, 0700); err != nil {
+		return err
+	}
+	defer os.RemoveAll(links) //nolint:errcheck
+
+	sizes, err := s.linkFiles(links)
+	if err != nil {
+		return err
+	}
+	for name, size := range sizes {
+		if err := copyFile(filepath.Join(dir, name), filepath.Join(links, name), size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// linkFiles hard-links the files of the database into dir and returns their
+// sizes.
+func (s *bitcaskStorage) linkFiles(dir string) (map[string]int64, error) {
+	s.filesMu.Lock()
+	defer s.filesMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := os.ReadDir(s.path)
+	if err != nil {
+		return nil, err
+	}
+	sizes := make(map[string]int64, len(entries))
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Link(filepath.Join(s.path, e.Name()), filepath.Join(dir, e.Name())); err != nil {
+			return nil, err
+		}
+		sizes[e.Name()] = info.Size()
+	}
+	return sizes, nil
+}
+
+// copyFile copies the first n bytes of src to dst.
+func copyFile(dst, src string, n int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(out, in, n)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
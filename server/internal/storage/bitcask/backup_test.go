@@ -0,0 +1,41 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package bitcask
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func Test_bitcaskStorage_Backup(t *testing.T) {
+	path := t.TempDir()
+	s, err := NewStorage(path, zap.NewNop())
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Stand-ins for the append-only data files.
+	data := filepath.Join(path, "backup-test.data")
+	require.NoError(t, os.WriteFile(data, []byte("first"), 0600))
+
+	dir := t.TempDir()
+	require.NoError(t, s.(*bitcaskStorage).Backup(dir))
+
+	f, err := os.OpenFile(data, os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = f.WriteString(" second")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	b, err := os.ReadFile(filepath.Join(dir, "backup-test.data"))
+	assert.Equal(t, "first", string(b))
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dir, ".links"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -5,20 +5,46 @@
 package bitcask
 
 import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"sync"
 	"time"
 
 	"github.com/dgraph-io/ristretto/z"
 	"github.com/tidwall/match"
 	"go.chensl.me/bitcask"
 	"go.chensl.me/redix/server/internal/storage"
+	"go.chensl.me/redix/server/internal/storage/entrypb"
 	"go.chensl.me/redix/server/pkg/bytesconv"
 	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
 )
 
+// errStop stops a ForEach iteration early.
+var errStop = errors.New("stop")
+
 type bitcaskStorage struct {
 	db     *bitcask.DB
+	path   string
 	closer *z.Closer
 	logger *zap.Logger
+
+	// mu makes multi-step operations atomic, bitcask itself only
+	// guarantees it for single Put/Get/Delete calls.
+	mu sync.Mutex
+	// size is the number of keys, including expired keys which have not
+	// been deleted yet.
+	size int64
+	// filesMu is held while the data files are reclaimed or linked by
+	// Backup.
+	filesMu sync.Mutex
+}
+
+func init() {
+	storage.Register("bitcask", func(opts storage.Options) (storage.Interface, error) {
+		return NewStorage(opts.DataDir, opts.Logger)
+	})
 }
 
 func NewStorage(path string, logger *zap.Logger) (storage.Interface, error) {
@@ -28,14 +54,26 @@ func NewStorage(path string, logger *zap.Logger) (storage.Interface, error) {
 	}
 	s := &bitcaskStorage{
 		db:     db,
+		path:   path,
 		closer: z.NewCloser(1),
 		logger: logger,
 	}
+	err = db.ForEach(func(_, _ []byte) error {
+		s.size++
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
 	go s.gc()
 	return s, nil
 }
 
 func (s *bitcaskStorage) Keys(pattern string) ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	var keys [][]byte
 	err := s.db.ForEach(func(key, _ []byte) error {
 		keys = append(keys, key)
@@ -64,23 +102,172 @@ func (s *bitcaskStorage) Del(keys ...[]byte) (int, error) {
 		return 0, nil
 	}
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	var cnt int
 	for _, k := range keys {
-		err := s.db.Delete(k)
-		if err == bitcask.ErrNotExist {
+		_, err := s.getEntry(k)
+		if err == storage.ErrNotExist {
 			continue
 		}
 		if err != nil {
 			return cnt, err
 		}
+		if err := s.deleteEntry(k); err != nil {
+			return cnt, err
+		}
 		cnt++
 	}
 
 	return cnt, nil
 }
 
+func (s *bitcaskStorage) Rename(key, newKey []byte, nx bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, err := s.getEntry(key)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(key, newKey) {
+		if nx {
+			return storage.ErrExist
+		}
+		return nil
+	}
+
+	_, err = s.getEntry(newKey)
+	if err != nil && err != storage.ErrNotExist {
+		return err
+	}
+	exist := err == nil
+	if exist && nx {
+		return storage.ErrExist
+	}
+
+	if err := s.putEntry(newKey, entry); err != nil {
+		return err
+	}
+	if !exist {
+		s.size++
+	}
+	return s.deleteEntry(key)
+}
+
+func (s *bitcaskStorage) Copy(src, dst []byte, replace bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, err := s.getEntry(src)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.getEntry(dst)
+	if err != nil && err != storage.ErrNotExist {
+		return err
+	}
+	exist := err == nil
+	if exist && !replace {
+		return storage.ErrExist
+	}
+	if bytes.Equal(src, dst) {
+		return nil
+	}
+
+	if err := s.putEntry(dst, entry); err != nil {
+		return err
+	}
+	if !exist {
+		s.size++
+	}
+	return nil
+}
+
+func (s *bitcaskStorage) RandomKey() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.size <= 0 {
+		return nil, storage.ErrNotExist
+	}
+
+	// bitcask has no ordered access, so walk to a random position and
+	// return the first live key from there, falling back to the first live
+	// key seen before it.
+	var (
+		i        int64
+		n        = rand.Int63n(s.size)
+		key      []byte
+		fallback []byte
+	)
+	err := s.db.ForEach(func(k, v []byte) error {
+		if expired(v) {
+			i++
+			return nil
+		}
+		if i >= n {
+			key = cloneBytes(k)
+			return errStop
+		}
+		if fallback == nil {
+			fallback = cloneBytes(k)
+		}
+		i++
+		return nil
+	})
+	if err != nil && err != errStop {
+		return nil, err
+	}
+	if key == nil {
+		key = fallback
+	}
+	if key == nil {
+		return nil, storage.ErrNotExist
+	}
+	return key, nil
+}
+
+func (s *bitcaskStorage) DBSize() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.size, nil
+}
+
+// ForEach holds the lock during the whole iteration since bitcask has no
+// snapshots, so writers are blocked until it returns.
+func (s *bitcaskStorage) ForEach(fn func(key, value []byte, expiresAt time.Time) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.db.ForEach(func(k, v []byte) error {
+		var entry entrypb.Entry
+		if err := proto.Unmarshal(v, &entry); err != nil {
+			return err
+		}
+		var expiresAt time.Time
+		if entry.ExpiresAt > 0 {
+			if time.Now().Unix() >= entry.ExpiresAt {
+				return nil
+			}
+			expiresAt = time.Unix(entry.ExpiresAt, 0)
+		}
+		return fn(k, entry.Value, expiresAt)
+	})
+}
+
 func (s *bitcaskStorage) DropAll() error {
-	return s.db.DropAll()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.db.DropAll(); err != nil {
+		return err
+	}
+	s.size = 0
+	return nil
 }
 
 func (s *bitcaskStorage) Expire(key []byte, dur time.Duration) error {
@@ -88,6 +275,9 @@ func (s *bitcaskStorage) Expire(key []byte, dur time.Duration) error {
 		return storage.ErrInvalidOpts
 	}
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	entry, err := s.getEntry(key)
 	if err != nil {
 		return err
@@ -99,6 +289,9 @@ func (s *bitcaskStorage) Expire(key []byte, dur time.Duration) error {
 }
 
 func (s *bitcaskStorage) TTL(key []byte) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	entry, err := s.getEntry(key)
 	if err == storage.ErrNotExist {
 		return -2, nil
@@ -120,6 +313,12 @@ func (s *bitcaskStorage) Close() error {
 	return s.db.Close()
 }
 
+func cloneBytes(b []byte) []byte {
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
+
 func (s *bitcaskStorage) gc() {
 	defer s.closer.Done()
 	ticker := time.NewTicker(5 * time.Minute)
@@ -130,8 +329,10 @@ func (s *bitcaskStorage) gc() {
 			return
 		case <-ticker.C:
 		}
+		s.filesMu.Lock()
 		if err := s.db.Reclaim(); err != nil {
 			s.logger.Error("failed to reclaim", zap.Error(err))
 		}
+		s.filesMu.Unlock()
 	}
 }
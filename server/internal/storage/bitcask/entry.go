@@ -34,8 +34,29 @@ func (s *bitcaskStorage) getEntry(key []byte) (*entrypb.Entry, error) {
 		return nil, err
 	}
 	if entry.ExpiresAt > 0 && time.Now().Unix() >= entry.ExpiresAt {
-		_ = s.db.Delete(key)
+		_ = s.deleteEntry(key)
 		return nil, storage.ErrNotExist
 	}
 	return &entry, nil
 }
+
+func (s *bitcaskStorage) deleteEntry(key []byte) error {
+	err := s.db.Delete(key)
+	if err == bitcask.ErrNotExist {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.size--
+	return nil
+}
+
+// expired reports whether the encoded entry b has expired.
+func expired(b []byte) bool {
+	var entry entrypb.Entry
+	if err := proto.Unmarshal(b, &entry); err != nil {
+		return false
+	}
+	return entry.ExpiresAt > 0 && time.Now().Unix() >= entry.ExpiresAt
+}
@@ -5,43 +5,54 @@
 package bitcask
 
 import (
-	"strconv"
 	"time"
 
 	"go.chensl.me/redix/server/internal/storage"
 	"go.chensl.me/redix/server/internal/storage/entrypb"
-	"go.chensl.me/redix/server/pkg/bytesconv"
 )
 
 func (s *bitcaskStorage) Set(key, value []byte, opts storage.SetOptions) error {
-	if opts.NX && opts.XX {
+	if (opts.NX && opts.XX) || (opts.KeepTTL && opts.TTL > 0) {
 		return storage.ErrInvalidOpts
 	}
 
-	_, err := s.getEntry(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, err := s.getEntry(key)
 	if err != nil && err != storage.ErrNotExist {
 		return err
 	}
 
-	if err == storage.ErrNotExist {
-		if opts.XX {
-			return storage.ErrNotExist
-		}
-	} else {
-		if opts.NX {
-			return storage.ErrExist
-		}
+	exist := err == nil
+
+	if !exist && opts.XX {
+		return storage.ErrNotExist
+	}
+	if exist && opts.NX {
+		return storage.ErrExist
 	}
 
 	entry := &entrypb.Entry{Value: value}
 	if opts.TTL > 0 {
 		entry.ExpiresAt = time.Now().Add(opts.TTL).Unix()
+	} else if opts.KeepTTL && exist {
+		entry.ExpiresAt = old.ExpiresAt
 	}
 
-	return s.putEntry(key, entry)
+	if err := s.putEntry(key, entry); err != nil {
+		return err
+	}
+	if !exist {
+		s.size++
+	}
+	return nil
 }
 
 func (s *bitcaskStorage) Get(key []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	entry, err := s.getEntry(key)
 	if err != nil {
 		return nil, err
@@ -50,21 +61,61 @@ func (s *bitcaskStorage) Get(key []byte) ([]byte, error) {
 	return entry.Value, nil
 }
 
-func (s *bitcaskStorage) Add(key []byte, delta int) (int, error) {
+func (s *bitcaskStorage) Add(key []byte, delta int64) (int64, error) {
+	var i int64
+
+	err := s.update(key, func(val []byte) ([]byte, error) {
+		var err error
+		i, err = storage.IncrInt(val, delta)
+		if err != nil {
+			return nil, err
+		}
+		return storage.FormatInt(i), nil
+	})
+
+	return i, err
+}
+
+func (s *bitcaskStorage) AddFloat(key []byte, delta float64) (float64, error) {
+	var f float64
+
+	err := s.update(key, func(val []byte) ([]byte, error) {
+		var err error
+		f, err = storage.IncrFloat(val, delta)
+		if err != nil {
+			return nil, err
+		}
+		return storage.FormatFloat(f), nil
+	})
+
+	return f, err
+}
+
+// update replaces the value of key with the result of fn, keeping the
+// original expiration time. fn receives nil if the key does not exist.
+func (s *bitcaskStorage) update(key []byte, fn func(val []byte) ([]byte, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	entry, err := s.getEntry(key)
+	exist := err == nil
 	if err == storage.ErrNotExist {
-		return delta, s.putEntry(key, &entrypb.Entry{Value: bytesconv.StringToBytes(strconv.Itoa(delta))})
-	}
-	if err != nil {
-		return 0, err
+		entry = &entrypb.Entry{}
+	} else if err != nil {
+		return err
+	} else if entry.Value == nil {
+		entry.Value = []byte{}
 	}
 
-	i, err := strconv.Atoi(bytesconv.BytesToString(entry.Value))
+	entry.Value, err = fn(entry.Value)
 	if err != nil {
-		return 0, storage.ErrInvalidInt
+		return err
 	}
-
-	i += delta
-	entry.Value = bytesconv.StringToBytes(strconv.Itoa(i))
-	return i, s.putEntry(key, entry)
+	if err := s.putEntry(key, entry); err != nil {
+		return err
+	}
+	if !exist {
+		s.size++
+	}
+	return nil
 }
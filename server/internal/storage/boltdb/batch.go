@@ -0,0 +1,58 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package boltdb
+
+import (
+	"go.chensl.me/redix/server/internal/storage"
+	"go.etcd.io/bbolt"
+)
+
+// Batch runs the calls of next in a single read-write transaction, so that
+// their writes share one commit and one fsync. The transaction is never
+// full.
+func (s *boltDBStorage) Batch(next func(b storage.Batch) bool) error {
+	return s.updateTx(func(tx *bbolt.Tx, delta *int64) error {
+		// The failed operations wrote nothing, the transaction is
+		// committed whatever they return.
+		b := &boltBatch{s: s, tx: tx, delta: delta}
+		for next(b) {
+		}
+		return nil
+	})
+}
+
+// boltBatch runs the operations of a batch in its transaction.
+type boltBatch struct {
+	s     *boltDBStorage
+	tx    *bbolt.Tx
+	delta *int64
+}
+
+func (b *boltBatch) Set(key, value []byte, opts storage.SetOptions) error {
+	if (opts.NX && opts.XX) || (opts.KeepTTL && opts.TTL > 0) {
+		return storage.ErrInvalidOpts
+	}
+	return b.s.set(b.tx, b.delta, key, value, opts)
+}
+
+func (b *boltBatch) Get(key []byte) ([]byte, error) {
+	return b.s.get(b.tx, key)
+}
+
+func (b *boltBatch) Add(key []byte, delta int64) (int64, error) {
+	return b.s.add(b.tx, b.delta, key, delta)
+}
+
+func (b *boltBatch) AddFloat(key []byte, delta float64) (float64, error) {
+	return b.s.addFloat(b.tx, b.delta, key, delta)
+}
+
+func (b *boltBatch) Del(keys ...[]byte) (int, error) {
+	return b.s.del(b.tx, b.delta, keys)
+}
+
+func (b *boltBatch) TTL(key []byte) (int64, error) {
+	return b.s.ttl(b.tx, key)
+}
@@ -0,0 +1,24 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package boltdb
+
+import (
+	"path/filepath"
+	"testing"
+
+	"go.chensl.me/redix/server/internal/storage"
+	"go.chensl.me/redix/server/internal/storage/storagetest"
+	"go.uber.org/zap"
+)
+
+func Test_boltDBStorage_Batch(t *testing.T) {
+	storagetest.RunBatch(t, func(t *testing.T) storage.Interface {
+		s, err := NewStorage(filepath.Join(t.TempDir(), "redix.db"), zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
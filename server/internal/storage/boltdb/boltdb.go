@@ -5,8 +5,10 @@
 package boltdb
 
 import (
+	"bytes"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"time"
 
 	"github.com/dgraph-io/ristretto/z"
@@ -26,6 +28,15 @@ type boltDBStorage struct {
 	expiresCh chan []byte
 	closer    *z.Closer
 	logger    *zap.Logger
+	// size is the number of keys in the bucket, including expired keys
+	// which have not been deleted yet.
+	size int64
+}
+
+func init() {
+	storage.Register("boltdb", func(opts storage.Options) (storage.Interface, error) {
+		return NewStorage(filepath.Join(opts.DataDir, "redix.db"), opts.Logger)
+	})
 }
 
 func NewStorage(path string, logger *zap.Logger) (storage.Interface, error) {
@@ -48,6 +59,16 @@ func NewStorage(path string, logger *zap.Logger) (storage.Interface, error) {
 		closer:    z.NewCloser(1),
 		logger:    logger,
 	}
+	err = db.View(func(tx *bbolt.Tx) error {
+		if b := tx.Bucket(_defaultBucket); b != nil {
+			s.size = int64(b.Stats().KeyN)
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
 	go s.asyncDeleter()
 	return s, nil
 }
@@ -61,13 +82,13 @@ func (s *boltDBStorage) Keys(pattern string) ([][]byte, error) {
 			return nil
 		}
 		return b.ForEach(func(k, v []byte) error {
-			entry, err := s.getEntry(b, k)
+			_, err := s.getEntry(b, k)
+			if err == storage.ErrNotExist {
+				return nil
+			}
 			if err != nil {
 				return err
 			}
-			if entry == nil {
-				return nil
-			}
 			if match.Match(bytesconv.BytesToString(k), pattern) {
 				keys = append(keys, cloneBytes(k))
 			}
@@ -84,34 +105,191 @@ func (s *boltDBStorage) Del(keys ...[]byte) (int, error) {
 	}
 
 	var cnt int
-	err := s.db.Update(func(tx *bbolt.Tx) error {
+	err := s.updateTx(func(tx *bbolt.Tx, delta *int64) error {
+		var err error
+		cnt, err = s.del(tx, delta, keys)
+		return err
+	})
+
+	return cnt, err
+}
+
+// del is Del in tx.
+func (s *boltDBStorage) del(tx *bbolt.Tx, delta *int64, keys [][]byte) (int, error) {
+	b := tx.Bucket(_defaultBucket)
+	if b == nil {
+		return 0, nil
+	}
+
+	var cnt int
+	for _, k := range keys {
+		if b.Get(k) == nil {
+			continue
+		}
+		_, err := s.getEntry(b, k)
+		if err == nil {
+			cnt++
+		} else if err != storage.ErrNotExist {
+			return cnt, err
+		}
+		if err := b.Delete(k); err != nil {
+			return cnt, err
+		}
+		*delta--
+	}
+	return cnt, nil
+}
+
+func (s *boltDBStorage) Rename(key, newKey []byte, nx bool) error {
+	return s.updateTx(func(tx *bbolt.Tx, delta *int64) error {
+		b := tx.Bucket(_defaultBucket)
+		if b == nil {
+			return storage.ErrNotExist
+		}
+
+		ent, err := s.getEntry(b, key)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(key, newKey) {
+			if nx {
+				return storage.ErrExist
+			}
+			return nil
+		}
+
+		_, err = s.getEntry(b, newKey)
+		if err == nil && nx {
+			return storage.ErrExist
+		}
+		if err != nil && err != storage.ErrNotExist {
+			return err
+		}
+
+		if err := b.Delete(key); err != nil {
+			return err
+		}
+		*delta--
+		if b.Get(newKey) == nil {
+			*delta++
+		}
+		return s.putEntry(b, newKey, ent)
+	})
+}
+
+func (s *boltDBStorage) Copy(src, dst []byte, replace bool) error {
+	return s.updateTx(func(tx *bbolt.Tx, delta *int64) error {
 		b := tx.Bucket(_defaultBucket)
 		if b == nil {
+			return storage.ErrNotExist
+		}
+
+		ent, err := s.getEntry(b, src)
+		if err != nil {
+			return err
+		}
+
+		_, err = s.getEntry(b, dst)
+		if err == nil && !replace {
+			return storage.ErrExist
+		}
+		if err != nil && err != storage.ErrNotExist {
+			return err
+		}
+		if bytes.Equal(src, dst) {
 			return nil
 		}
 
-		for _, k := range keys {
-			if b.Get(k) == nil {
+		if b.Get(dst) == nil {
+			*delta++
+		}
+		return s.putEntry(b, dst, ent)
+	})
+}
+
+func (s *boltDBStorage) RandomKey() ([]byte, error) {
+	var key []byte
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(_defaultBucket)
+		if b == nil {
+			return storage.ErrNotExist
+		}
+
+		c := b.Cursor()
+		first, _ := c.First()
+		if first == nil {
+			return storage.ErrNotExist
+		}
+		last, _ := c.Last()
+
+		// Skip forward over expired keys, wrapping around at most once.
+		k, _ := c.Seek(storage.RandomSeekKey(first, last))
+		for wrapped := false; ; k, _ = c.Next() {
+			if k == nil {
+				if wrapped {
+					return storage.ErrNotExist
+				}
+				wrapped = true
+				if k, _ = c.First(); k == nil {
+					return storage.ErrNotExist
+				}
+			}
+			_, err := s.getEntry(b, k)
+			if err == storage.ErrNotExist {
 				continue
 			}
-			cnt++
-			if err := b.Delete(k); err != nil {
+			if err != nil {
 				return err
 			}
+			key = cloneBytes(k)
+			return nil
 		}
-		return nil
 	})
 
-	return cnt, err
+	return key, err
+}
+
+func (s *boltDBStorage) DBSize() (int64, error) {
+	return atomic.LoadInt64(&s.size), nil
+}
+
+func (s *boltDBStorage) ForEach(fn func(key, value []byte, expiresAt time.Time) error) error {
+	return s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(_defaultBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, _ []byte) error {
+			ent, err := s.getEntry(b, k)
+			if err == storage.ErrNotExist {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			var expiresAt time.Time
+			if ent.ExpiresAt > 0 {
+				expiresAt = time.Unix(ent.ExpiresAt, 0)
+			}
+			return fn(k, ent.Value, expiresAt)
+		})
+	})
 }
 
 func (s *boltDBStorage) DropAll() error {
-	return s.db.Update(func(tx *bbolt.Tx) error {
+	err := s.db.Update(func(tx *bbolt.Tx) error {
 		if err := tx.DeleteBucket(_defaultBucket); err != nil && err != bbolt.ErrBucketNotFound {
 			return err
 		}
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+
+	atomic.StoreInt64(&s.size, 0)
+	return nil
 }
 
 func (s *boltDBStorage) Expire(key []byte, dur time.Duration) error {
@@ -129,9 +307,6 @@ func (s *boltDBStorage) Expire(key []byte, dur time.Duration) error {
 		if err != nil {
 			return err
 		}
-		if ent == nil {
-			return storage.ErrNotExist
-		}
 
 		ent.ExpiresAt = time.Now().Add(dur).Unix()
 		return s.putEntry(b, key, ent)
@@ -141,33 +316,38 @@ func (s *boltDBStorage) Expire(key []byte, dur time.Duration) error {
 }
 
 func (s *boltDBStorage) TTL(key []byte) (int64, error) {
-	ttl := int64(-1)
+	var ttl int64
 
 	err := s.db.View(func(tx *bbolt.Tx) error {
-		b := tx.Bucket(_defaultBucket)
-		if b == nil {
-			ttl = -2
-			return nil
-		}
-
-		ent, err := s.getEntry(b, key)
-		if err != nil {
-			return err
-		}
-		if ent == nil {
-			ttl = -2
-			return nil
-		}
-
-		if ent.ExpiresAt > 0 {
-			ttl = int64(time.Until(time.Unix(ent.ExpiresAt, 0)).Seconds())
-		}
-		return nil
+		var err error
+		ttl, err = s.ttl(tx, key)
+		return err
 	})
 
 	return ttl, err
 }
 
+// ttl is TTL in tx.
+func (s *boltDBStorage) ttl(tx *bbolt.Tx, key []byte) (int64, error) {
+	b := tx.Bucket(_defaultBucket)
+	if b == nil {
+		return -2, nil
+	}
+
+	ent, err := s.getEntry(b, key)
+	if err == storage.ErrNotExist {
+		return -2, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if ent.ExpiresAt > 0 {
+		return int64(time.Until(time.Unix(ent.ExpiresAt, 0)).Seconds()), nil
+	}
+	return -1, nil
+}
+
 func (s *boltDBStorage) Close() error {
 	s.logger.Info("stopping asyncDeleter")
 	s.closer.SignalAndWait()
@@ -181,11 +361,16 @@ func (s *boltDBStorage) asyncDeleter() {
 		case <-s.closer.HasBeenClosed():
 			return
 		case key := <-s.expiresCh:
-			err := s.db.Update(func(tx *bbolt.Tx) error {
+			err := s.updateTx(func(tx *bbolt.Tx, delta *int64) error {
 				b := tx.Bucket(_defaultBucket)
 				if b == nil {
 					return nil
 				}
+				// The key may have been overwritten in the meantime.
+				if v := b.Get(key); v == nil || !expired(v) {
+					return nil
+				}
+				*delta--
 				return b.Delete(key)
 			})
 			if err != nil {
@@ -198,6 +383,22 @@ func (s *boltDBStorage) asyncDeleter() {
 	}
 }
 
+// updateTx runs fn in a read-write transaction and adds the change in the
+// number of keys reported by fn to s.size once the transaction is committed.
+func (s *boltDBStorage) updateTx(fn func(tx *bbolt.Tx, delta *int64) error) error {
+	var delta int64
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		delta = 0
+		return fn(tx, &delta)
+	})
+	if err != nil {
+		return err
+	}
+
+	atomic.AddInt64(&s.size, delta)
+	return nil
+}
+
 func cloneBytes(b []byte) []byte {
 	c := make([]byte, len(b))
 	copy(c, b)
@@ -0,0 +1,22 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package boltdb
+
+import "go.etcd.io/bbolt"
+
+// DiskSize returns the size of the pages in use: the file never shrinks,
+// the pages freed are reused.
+func (s *boltDBStorage) DiskSize() (int64, error) {
+	var size int64
+	if err := s.db.View(func(tx *bbolt.Tx) error {
+		size = tx.Size()
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	stats := s.db.Stats()
+	free := int64(stats.FreePageN+stats.PendingPageN) * int64(s.db.Info().PageSize)
+	return size - free, nil
+}
@@ -7,6 +7,7 @@ package boltdb
 import (
 	"time"
 
+	"go.chensl.me/redix/server/internal/storage"
 	"go.chensl.me/redix/server/internal/storage/entrypb"
 	"go.etcd.io/bbolt"
 	"google.golang.org/protobuf/proto"
@@ -20,20 +21,34 @@ func (*boltDBStorage) putEntry(bucket *bbolt.Bucket, key []byte, ent *entrypb.En
 	return bucket.Put(key, v)
 }
 
+// getEntry returns the entry of key, or storage.ErrNotExist if the key does
+// not exist or has expired.
 func (s *boltDBStorage) getEntry(bucket *bbolt.Bucket, key []byte) (*entrypb.Entry, error) {
-	// TODO: return not exists error
-
 	v := bucket.Get(key)
 	if v == nil {
-		return nil, nil
+		return nil, storage.ErrNotExist
 	}
 	var ent entrypb.Entry
 	if err := proto.Unmarshal(v, &ent); err != nil {
 		return nil, err
 	}
 	if ent.ExpiresAt > 0 && time.Now().Unix() >= ent.ExpiresAt {
-		s.expiresCh <- key
-		return nil, nil
+		// Don't block: the key is deleted lazily again on the next access
+		// if the deleter is busy.
+		select {
+		case s.expiresCh <- cloneBytes(key):
+		default:
+		}
+		return nil, storage.ErrNotExist
 	}
 	return &ent, nil
 }
+
+// expired reports whether the encoded entry v has expired.
+func expired(v []byte) bool {
+	var ent entrypb.Entry
+	if err := proto.Unmarshal(v, &ent); err != nil {
+		return false
+	}
+	return ent.ExpiresAt > 0 && time.Now().Unix() >= ent.ExpiresAt
+}
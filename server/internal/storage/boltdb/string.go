@@ -5,105 +5,160 @@
 package boltdb
 
 import (
-	"strconv"
 	"time"
 
 	"go.chensl.me/redix/server/internal/storage"
 	"go.chensl.me/redix/server/internal/storage/entrypb"
-	"go.chensl.me/redix/server/pkg/bytesconv"
 	"go.etcd.io/bbolt"
 )
 
 func (s *boltDBStorage) Set(key, value []byte, opts storage.SetOptions) error {
-	if opts.NX && opts.XX {
+	if (opts.NX && opts.XX) || (opts.KeepTTL && opts.TTL > 0) {
 		return storage.ErrInvalidOpts
 	}
 
-	err := s.db.Update(func(tx *bbolt.Tx) error {
-		b, err := tx.CreateBucketIfNotExists(_defaultBucket)
-		if err != nil {
-			return err
-		}
+	return s.updateTx(func(tx *bbolt.Tx, delta *int64) error {
+		return s.set(tx, delta, key, value, opts)
+	})
+}
 
-		if opts.NX || opts.XX {
-			ent, err := s.getEntry(b, key)
-			if err != nil {
-				return err
-			}
-
-			if ent == nil {
-				if opts.XX {
-					return storage.ErrNotExist
-				}
-			} else {
-				if opts.NX {
-					return storage.ErrExist
-				}
-			}
-		}
+// set is Set in tx, the options are valid.
+func (s *boltDBStorage) set(tx *bbolt.Tx, delta *int64, key, value []byte, opts storage.SetOptions) error {
+	b, err := tx.CreateBucketIfNotExists(_defaultBucket)
+	if err != nil {
+		return err
+	}
 
-		ent := &entrypb.Entry{Value: value}
-		if opts.TTL > 0 {
-			ent.ExpiresAt = time.Now().Add(opts.TTL).Unix()
-		}
+	old, err := s.getEntry(b, key)
+	if err != nil && err != storage.ErrNotExist {
+		return err
+	}
+	exist := err == nil
+	if !exist && opts.XX {
+		return storage.ErrNotExist
+	}
+	if exist && opts.NX {
+		return storage.ErrExist
+	}
 
-		return s.putEntry(b, key, ent)
-	})
+	ent := &entrypb.Entry{Value: value}
+	if opts.TTL > 0 {
+		ent.ExpiresAt = time.Now().Add(opts.TTL).Unix()
+	} else if opts.KeepTTL && exist {
+		ent.ExpiresAt = old.ExpiresAt
+	}
 
-	return err
+	if b.Get(key) == nil {
+		*delta++
+	}
+	return s.putEntry(b, key, ent)
 }
 
 func (s *boltDBStorage) Get(key []byte) ([]byte, error) {
 	var val []byte
 
 	err := s.db.View(func(tx *bbolt.Tx) error {
-		b := tx.Bucket(_defaultBucket)
-		if b == nil {
-			return storage.ErrNotExist
-		}
+		var err error
+		val, err = s.get(tx, key)
+		return err
+	})
 
-		ent, err := s.getEntry(b, key)
-		if err != nil {
-			return err
-		}
-		if ent == nil {
-			return storage.ErrNotExist
-		}
+	return val, err
+}
+
+// get is Get in tx.
+func (s *boltDBStorage) get(tx *bbolt.Tx, key []byte) ([]byte, error) {
+	b := tx.Bucket(_defaultBucket)
+	if b == nil {
+		return nil, storage.ErrNotExist
+	}
+
+	ent, err := s.getEntry(b, key)
+	if err != nil {
+		return nil, err
+	}
+	return ent.Value, nil
+}
+
+func (s *boltDBStorage) Add(key []byte, delta int64) (int64, error) {
+	var i int64
 
-		val = ent.Value
-		return nil
+	err := s.updateTx(func(tx *bbolt.Tx, size *int64) error {
+		var err error
+		i, err = s.add(tx, size, key, delta)
+		return err
 	})
 
-	return val, err
+	return i, err
 }
 
-func (s *boltDBStorage) Add(key []byte, delta int) (int, error) {
-	var i int
+// add is Add in tx.
+func (s *boltDBStorage) add(tx *bbolt.Tx, size *int64, key []byte, delta int64) (int64, error) {
+	var i int64
 
-	err := s.db.Update(func(tx *bbolt.Tx) error {
-		b, err := tx.CreateBucketIfNotExists(_defaultBucket)
+	err := s.update(tx, size, key, func(val []byte) ([]byte, error) {
+		var err error
+		i, err = storage.IncrInt(val, delta)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		return storage.FormatInt(i), nil
+	})
 
-		ent, err := s.getEntry(b, key)
-		if err != nil {
-			return err
-		}
+	return i, err
+}
 
-		if ent == nil {
-			i = delta
-			return s.putEntry(b, key, &entrypb.Entry{Value: bytesconv.StringToBytes(strconv.Itoa(delta))})
-		}
+func (s *boltDBStorage) AddFloat(key []byte, delta float64) (float64, error) {
+	var f float64
+
+	err := s.updateTx(func(tx *bbolt.Tx, size *int64) error {
+		var err error
+		f, err = s.addFloat(tx, size, key, delta)
+		return err
+	})
 
-		i, err = strconv.Atoi(bytesconv.BytesToString(ent.Value))
+	return f, err
+}
+
+// addFloat is AddFloat in tx.
+func (s *boltDBStorage) addFloat(tx *bbolt.Tx, size *int64, key []byte, delta float64) (float64, error) {
+	var f float64
+
+	err := s.update(tx, size, key, func(val []byte) ([]byte, error) {
+		var err error
+		f, err = storage.IncrFloat(val, delta)
 		if err != nil {
-			return storage.ErrInvalidInt
+			return nil, err
 		}
-		i += delta
-		ent.Value = bytesconv.StringToBytes(strconv.Itoa(i))
-		return s.putEntry(b, key, ent)
+		return storage.FormatFloat(f), nil
 	})
 
-	return i, err
+	return f, err
+}
+
+// update replaces the value of key with the result of fn in tx, keeping the
+// original expiration time. fn receives nil if the key does not exist.
+func (s *boltDBStorage) update(tx *bbolt.Tx, delta *int64, key []byte, fn func(val []byte) ([]byte, error)) error {
+	b, err := tx.CreateBucketIfNotExists(_defaultBucket)
+	if err != nil {
+		return err
+	}
+
+	ent, err := s.getEntry(b, key)
+	if err == storage.ErrNotExist {
+		ent = &entrypb.Entry{}
+	} else if err != nil {
+		return err
+	} else if ent.Value == nil {
+		ent.Value = []byte{}
+	}
+
+	ent.Value, err = fn(ent.Value)
+	if err != nil {
+		return err
+	}
+	if b.Get(key) == nil {
+		*delta++
+	}
+	return s.putEntry(b, key, ent)
 }
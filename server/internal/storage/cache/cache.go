@@ -0,0 +1,240 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package cache implements a read-through cache of the values of a storage,
+// bounded in bytes, for the drivers which read and decode an entry from disk
+// on every Get. The values are cached by Get, until their expire, and
+// dropped by the writes of their keys and by DropAll.
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/ristretto"
+	"github.com/dgraph-io/ristretto/z"
+	"go.chensl.me/redix/server/internal/storage"
+)
+
+// numGens is the number of generations the keys are spread over.
+const numGens = 1024
+
+// Stats are the statistics of a cache.
+type Stats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+// Storage caches the values of the storage it wraps. The values returned by
+// Get are shared and must not be modified. It implements storage.Batcher,
+// with the batches of the storage if it has them, see storage.Unwrap.
+type Storage struct {
+	storage.Interface
+	cache *ristretto.Cache
+
+	// A value read from the storage is only cached if no write invalidated
+	// its key in the meantime, which the generation of the key tells. mu
+	// orders the fills with the invalidations.
+	mu   sync.Mutex
+	gens [numGens]uint64
+
+	hits   uint64
+	misses uint64
+}
+
+// New returns a cache of at most maxBytes of keys and values in front of s.
+func New(s storage.Interface, maxBytes int64) (*Storage, error) {
+	// About 10 counters per value, for values of about 100 bytes.
+	counters := maxBytes / 10
+	if counters < 10000 {
+		counters = 10000
+	}
+	cache, err := ristretto.NewCache(&ristretto.Config{
+		NumCounters: counters,
+		MaxCost:     maxBytes,
+		BufferItems: 64,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Storage{Interface: s, cache: cache}, nil
+}
+
+// Unwrap returns the storage s caches.
+func (s *Storage) Unwrap() storage.Interface {
+	return s.Interface
+}
+
+// Stats returns the statistics of the cache.
+func (s *Storage) Stats() Stats {
+	return Stats{
+		Hits:   atomic.LoadUint64(&s.hits),
+		Misses: atomic.LoadUint64(&s.misses),
+	}
+}
+
+func (s *Storage) Get(key []byte) ([]byte, error) {
+	if v, ok := s.cache.Get(key); ok {
+		atomic.AddUint64(&s.hits, 1)
+		return v.([]byte), nil
+	}
+	atomic.AddUint64(&s.misses, 1)
+
+	gen := s.gen(key)
+	v, err := s.Interface.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	ttl, err := s.Interface.TTL(key)
+	if err != nil {
+		return v, nil
+	}
+	s.fill(key, v, gen, ttl)
+	return v, nil
+}
+
+func (s *Storage) Set(key, value []byte, opts storage.SetOptions) error {
+	defer s.invalidate(key)
+	return s.Interface.Set(key, value, opts)
+}
+
+func (s *Storage) Add(key []byte, delta int64) (int64, error) {
+	defer s.invalidate(key)
+	return s.Interface.Add(key, delta)
+}
+
+func (s *Storage) AddFloat(key []byte, delta float64) (float64, error) {
+	defer s.invalidate(key)
+	return s.Interface.AddFloat(key, delta)
+}
+
+func (s *Storage) Del(keys ...[]byte) (int, error) {
+	defer s.invalidate(keys...)
+	return s.Interface.Del(keys...)
+}
+
+func (s *Storage) Rename(key, newKey []byte, nx bool) error {
+	defer s.invalidate(key, newKey)
+	return s.Interface.Rename(key, newKey, nx)
+}
+
+func (s *Storage) Copy(src, dst []byte, replace bool) error {
+	defer s.invalidate(dst)
+	return s.Interface.Copy(src, dst, replace)
+}
+
+func (s *Storage) Expire(key []byte, dur time.Duration) error {
+	defer s.invalidate(key)
+	return s.Interface.Expire(key, dur)
+}
+
+func (s *Storage) DropAll() error {
+	defer s.clear()
+	return s.Interface.DropAll()
+}
+
+func (s *Storage) Close() error {
+	s.cache.Close()
+	return s.Interface.Close()
+}
+
+// Batch runs the calls of next in a batch of the storage, or on s if the
+// storage has no batches, and invalidates the keys written once the batch
+// is committed.
+func (s *Storage) Batch(next func(b storage.Batch) bool) error {
+	b, ok := s.Interface.(storage.Batcher)
+	if !ok {
+		for next(s) {
+		}
+		return nil
+	}
+	var keys [][]byte
+	defer func() {
+		s.invalidate(keys...)
+	}()
+	return b.Batch(func(b storage.Batch) bool {
+		return next(&batch{Batch: b, keys: &keys})
+	})
+}
+
+// batch records the keys written in a batch of the storage.
+type batch struct {
+	storage.Batch
+	keys *[][]byte
+}
+
+func (b *batch) Set(key, value []byte, opts storage.SetOptions) error {
+	*b.keys = append(*b.keys, key)
+	return b.Batch.Set(key, value, opts)
+}
+
+func (b *batch) Add(key []byte, delta int64) (int64, error) {
+	*b.keys = append(*b.keys, key)
+	return b.Batch.Add(key, delta)
+}
+
+func (b *batch) AddFloat(key []byte, delta float64) (float64, error) {
+	*b.keys = append(*b.keys, key)
+	return b.Batch.AddFloat(key, delta)
+}
+
+func (b *batch) Del(keys ...[]byte) (int, error) {
+	*b.keys = append(*b.keys, keys...)
+	return b.Batch.Del(keys...)
+}
+
+func genOf(key []byte) int {
+	return int(z.MemHash(key) % numGens)
+}
+
+// gen returns the generation of key.
+func (s *Storage) gen(key []byte) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gens[genOf(key)]
+}
+
+// fill caches the value of key read at generation gen, which expires in ttl
+// seconds. The keys which expire in less than a second aren't cached, as
+// ttl is rounded down.
+func (s *Storage) fill(key, value []byte, gen uint64, ttl int64) {
+	if ttl == 0 || ttl < -1 {
+		return
+	}
+	var d time.Duration
+	if ttl > 0 {
+		d = time.Duration(ttl) * time.Second
+	}
+	// The value is returned to several callers, it is copied from the one
+	// the storage returned.
+	value = append([]byte(nil), value...)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.gens[genOf(key)] == gen {
+		s.cache.SetWithTTL(key, value, int64(len(key)+len(value)), d)
+	}
+}
+
+// invalidate drops keys from the cache, along with the values of keys read
+// before and not cached yet.
+func (s *Storage) invalidate(keys ...[]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		s.gens[genOf(key)]++
+		s.cache.Del(key)
+	}
+}
+
+// clear drops every key from the cache.
+func (s *Storage) clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.gens {
+		s.gens[i]++
+	}
+	s.cache.Clear()
+}
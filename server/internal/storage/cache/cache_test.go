@@ -0,0 +1,119 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package cache
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.chensl.me/redix/server/internal/storage"
+	"go.chensl.me/redix/server/internal/storage/boltdb"
+	"go.chensl.me/redix/server/internal/storage/memory"
+	"go.chensl.me/redix/server/internal/storage/storagetest"
+	"go.uber.org/zap"
+)
+
+func newBoltDB(t *testing.T) *Storage {
+	db, err := boltdb.NewStorage(filepath.Join(t.TempDir(), "redix.db"), zap.NewNop())
+	require.NoError(t, err)
+	s, err := New(db, 1<<20)
+	require.NoError(t, err)
+	return s
+}
+
+func Test_Storage_Conformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Interface {
+		return newBoltDB(t)
+	})
+}
+
+func Test_Storage_Batch(t *testing.T) {
+	storagetest.RunBatch(t, func(t *testing.T) storage.Interface {
+		return newBoltDB(t)
+	})
+}
+
+// get reads key twice from s, the second time from the cache once filled.
+func get(t *testing.T, s *Storage, key string) string {
+	v, err := s.Get([]byte(key))
+	if err == storage.ErrNotExist {
+		return ""
+	}
+	require.NoError(t, err)
+	s.cache.Wait()
+	return string(v)
+}
+
+func TestStorage(t *testing.T) {
+	s := newBoltDB(t)
+	defer func() {
+		assert.NoError(t, s.Close())
+	}()
+	_, ok := storage.Unwrap(s).(storage.Backuper)
+	assert.True(t, ok)
+
+	require.NoError(t, s.Set([]byte("a"), []byte("1"), storage.SetOptions{}))
+	assert.Equal(t, "1", get(t, s, "a"))
+	assert.Equal(t, "1", get(t, s, "a"))
+	assert.Equal(t, Stats{Hits: 1, Misses: 1}, s.Stats())
+
+	// The writes invalidate the keys.
+	_, err := s.Add([]byte("a"), 1)
+	require.NoError(t, err)
+	assert.Equal(t, "2", get(t, s, "a"))
+	require.NoError(t, s.Rename([]byte("a"), []byte("b"), false))
+	assert.Equal(t, "", get(t, s, "a"))
+	assert.Equal(t, "2", get(t, s, "b"))
+	require.NoError(t, s.Copy([]byte("b"), []byte("c"), false))
+	assert.Equal(t, "2", get(t, s, "c"))
+	err = s.Batch(func(b storage.Batch) bool {
+		require.NoError(t, b.Set([]byte("c"), []byte("3"), storage.SetOptions{}))
+		return false
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "3", get(t, s, "c"))
+	_, err = s.Del([]byte("c"))
+	require.NoError(t, err)
+	assert.Equal(t, "", get(t, s, "c"))
+	require.NoError(t, s.DropAll())
+	assert.Equal(t, "", get(t, s, "b"))
+}
+
+func TestStorageFill(t *testing.T) {
+	mem, err := memory.NewStorage(zap.NewNop())
+	require.NoError(t, err)
+	s, err := New(mem, 1<<20)
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, s.Close())
+	}()
+
+	// A value read before a write of its key isn't cached.
+	key := []byte("k")
+	require.NoError(t, s.Set(key, []byte("old"), storage.SetOptions{}))
+	gen := s.gen(key)
+	require.NoError(t, s.Set(key, []byte("new"), storage.SetOptions{}))
+	s.fill(key, []byte("old"), gen, -1)
+	s.cache.Wait()
+	assert.Equal(t, "new", get(t, s, "k"))
+
+	// Nor the keys which expire in less than a second.
+	require.NoError(t, s.Set(key, []byte("v"), storage.SetOptions{TTL: 500 * time.Millisecond}))
+	assert.Equal(t, "v", get(t, s, "k"))
+	_, ok := s.cache.Get(key)
+	assert.False(t, ok)
+
+	// The values expire from the cache with their keys.
+	require.NoError(t, s.Set(key, []byte("w"), storage.SetOptions{TTL: 1100 * time.Millisecond}))
+	assert.Equal(t, "w", get(t, s, "k"))
+	hits := s.Stats().Hits
+	assert.Equal(t, "w", get(t, s, "k"))
+	assert.Equal(t, hits+1, s.Stats().Hits)
+	time.Sleep(1200 * time.Millisecond)
+	assert.Equal(t, "", get(t, s, "k"))
+}
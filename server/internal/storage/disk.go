@@ -0,0 +1,13 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+// DiskSizer is implemented by the drivers which can tell the disk space
+// their data takes, which the maxdisk option limits.
+type DiskSizer interface {
+	// DiskSize returns the bytes taken on disk. It must be cheap, and may
+	// lag behind the writes and the deletes, e.g. until a compaction.
+	DiskSize() (int64, error)
+}
@@ -7,8 +7,12 @@ package storage
 import "errors"
 
 var (
-	ErrInvalidOpts = errors.New("invalid options")
-	ErrExist       = errors.New("key already exists")
-	ErrNotExist    = errors.New("key does not exist")
-	ErrInvalidInt  = errors.New("invalid int")
+	ErrInvalidOpts  = errors.New("invalid options")
+	ErrExist        = errors.New("key already exists")
+	ErrNotExist     = errors.New("key does not exist")
+	ErrInvalidInt   = errors.New("invalid int")
+	ErrInvalidFloat = errors.New("invalid float")
+	ErrOverflow     = errors.New("increment or decrement would overflow")
+	ErrNaNOrInf     = errors.New("increment would produce NaN or Infinity")
+	ErrBatchFull    = errors.New("batch is full")
 )
@@ -0,0 +1,117 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// ExpiryIndex keeps track of the expiration time of volatile keys, as unix
+// timestamps in whatever unit the caller consistently uses, so that drivers
+// can find expired keys without scanning. Stale heap entries are skipped
+// lazily.
+type ExpiryIndex struct {
+	mu    sync.Mutex
+	items map[string]int64
+	heap  expiryHeap
+}
+
+func NewExpiryIndex() *ExpiryIndex {
+	return &ExpiryIndex{items: make(map[string]int64)}
+}
+
+// Set records that key expires at the given time.
+func (x *ExpiryIndex) Set(key []byte, at int64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	k := string(key)
+	x.items[k] = at
+	heap.Push(&x.heap, expiryItem{key: k, at: at})
+	x.compact()
+}
+
+// Remove forgets key and reports whether it was present.
+func (x *ExpiryIndex) Remove(key []byte) bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	k := string(key)
+	if _, ok := x.items[k]; !ok {
+		return false
+	}
+	delete(x.items, k)
+	return true
+}
+
+// Get returns the expiration time of key, if any.
+func (x *ExpiryIndex) Get(key []byte) (int64, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	at, ok := x.items[string(key)]
+	return at, ok
+}
+
+// PopExpired removes every key expiring at or before now and returns them.
+func (x *ExpiryIndex) PopExpired(now int64) []string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	var keys []string
+	for x.heap.Len() > 0 && x.heap[0].at <= now {
+		it := heap.Pop(&x.heap).(expiryItem)
+		if at, ok := x.items[it.key]; ok && at == it.at {
+			delete(x.items, it.key)
+			keys = append(keys, it.key)
+		}
+	}
+	x.compact()
+	return keys
+}
+
+// Len returns the number of volatile keys.
+func (x *ExpiryIndex) Len() int {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return len(x.items)
+}
+
+// Reset forgets every key.
+func (x *ExpiryIndex) Reset() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.items = make(map[string]int64)
+	x.heap = nil
+}
+
+// compact rebuilds the heap when most of its entries are stale.
+func (x *ExpiryIndex) compact() {
+	if x.heap.Len() <= 64 || x.heap.Len() <= 4*len(x.items) {
+		return
+	}
+	x.heap = x.heap[:0]
+	for k, at := range x.items {
+		x.heap = append(x.heap, expiryItem{key: k, at: at})
+	}
+	heap.Init(&x.heap)
+}
+
+type expiryItem struct {
+	key string
+	at  int64
+}
+
+type expiryHeap []expiryItem
+
+func (h expiryHeap) Len() int            { return len(h) }
+func (h expiryHeap) Less(i, j int) bool  { return h[i].at < h[j].at }
+func (h expiryHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x interface{}) { *h = append(*h, x.(expiryItem)) }
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	it := old[n-1]
+	*h = old[:n-1]
+	return it
+}
@@ -0,0 +1,346 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package memory
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/ristretto/z"
+	"github.com/tidwall/match"
+	"go.chensl.me/redix/server/internal/storage"
+	"go.uber.org/zap"
+)
+
+// shardCount must be a power of two.
+const shardCount = 256
+
+type entry struct {
+	value []byte
+	// expiresAt is a unix timestamp in nanoseconds, 0 means no expire.
+	expiresAt int64
+}
+
+func (e *entry) expired(now int64) bool {
+	return e.expiresAt > 0 && now >= e.expiresAt
+}
+
+type shard struct {
+	mu      sync.RWMutex
+	data    map[string]*entry
+	expires *storage.ExpiryIndex
+}
+
+// get returns the live entry of key. sh.mu must be held.
+func (sh *shard) get(key []byte, now int64) *entry {
+	e, ok := sh.data[string(key)]
+	if !ok || e.expired(now) {
+		return nil
+	}
+	return e
+}
+
+// put stores e under key, replacing any existing entry. sh.mu must be held.
+func (sh *shard) put(key []byte, e *entry) {
+	sh.data[string(key)] = e
+	if e.expiresAt > 0 {
+		sh.expires.Set(key, e.expiresAt)
+	} else {
+		sh.expires.Remove(key)
+	}
+}
+
+// del removes key. sh.mu must be held.
+func (sh *shard) del(key []byte) {
+	delete(sh.data, string(key))
+	sh.expires.Remove(key)
+}
+
+// memoryStorage spreads the keys over shards, each one with its own lock
+// and expiry index, so that commands on different keys rarely contend.
+type memoryStorage struct {
+	shards [shardCount]shard
+	closer *z.Closer
+	logger *zap.Logger
+}
+
+func init() {
+	storage.Register("memory", func(opts storage.Options) (storage.Interface, error) {
+		return NewStorage(opts.Logger)
+	})
+}
+
+// NewStorage returns a storage which keeps everything in memory, it's
+// meant to be used together with the AOF or as an ephemeral cache.
+func NewStorage(logger *zap.Logger) (storage.Interface, error) {
+	s := &memoryStorage{
+		closer: z.NewCloser(1),
+		logger: logger,
+	}
+	for i := range s.shards {
+		s.shards[i].data = make(map[string]*entry)
+		s.shards[i].expires = storage.NewExpiryIndex()
+	}
+	go s.activeExpire()
+	return s, nil
+}
+
+// shardIndex returns the shard of key using FNV-1a.
+func shardIndex(key []byte) int {
+	h := uint32(2166136261)
+	for _, c := range key {
+		h ^= uint32(c)
+		h *= 16777619
+	}
+	return int(h & (shardCount - 1))
+}
+
+func (s *memoryStorage) shard(key []byte) *shard {
+	return &s.shards[shardIndex(key)]
+}
+
+// lockPair locks the shards of two keys in a fixed order and returns them
+// along with a function releasing the locks.
+func (s *memoryStorage) lockPair(a, b []byte) (*shard, *shard, func()) {
+	i, j := shardIndex(a), shardIndex(b)
+	if i == j {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		return sh, sh, sh.mu.Unlock
+	}
+	first, second := i, j
+	if first > second {
+		first, second = second, first
+	}
+	s.shards[first].mu.Lock()
+	s.shards[second].mu.Lock()
+	return &s.shards[i], &s.shards[j], func() {
+		s.shards[second].mu.Unlock()
+		s.shards[first].mu.Unlock()
+	}
+}
+
+func (s *memoryStorage) Keys(pattern string) ([][]byte, error) {
+	var keys [][]byte
+	now := time.Now().UnixNano()
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.RLock()
+		for k, e := range sh.data {
+			if !e.expired(now) && match.Match(k, pattern) {
+				keys = append(keys, []byte(k))
+			}
+		}
+		sh.mu.RUnlock()
+	}
+
+	return keys, nil
+}
+
+func (s *memoryStorage) Del(keys ...[]byte) (int, error) {
+	var cnt int
+	now := time.Now().UnixNano()
+	for _, k := range keys {
+		sh := s.shard(k)
+		sh.mu.Lock()
+		if sh.get(k, now) != nil {
+			cnt++
+		}
+		sh.del(k)
+		sh.mu.Unlock()
+	}
+
+	return cnt, nil
+}
+
+func (s *memoryStorage) Rename(key, newKey []byte, nx bool) error {
+	src, dst, unlock := s.lockPair(key, newKey)
+	defer unlock()
+
+	now := time.Now().UnixNano()
+	e := src.get(key, now)
+	if e == nil {
+		return storage.ErrNotExist
+	}
+	if string(key) == string(newKey) {
+		if nx {
+			return storage.ErrExist
+		}
+		return nil
+	}
+	if nx && dst.get(newKey, now) != nil {
+		return storage.ErrExist
+	}
+
+	src.del(key)
+	dst.put(newKey, e)
+	return nil
+}
+
+func (s *memoryStorage) Copy(src, dst []byte, replace bool) error {
+	from, to, unlock := s.lockPair(src, dst)
+	defer unlock()
+
+	now := time.Now().UnixNano()
+	e := from.get(src, now)
+	if e == nil {
+		return storage.ErrNotExist
+	}
+	if !replace && to.get(dst, now) != nil {
+		return storage.ErrExist
+	}
+	if string(src) == string(dst) {
+		return nil
+	}
+
+	// Values are never modified in place, so they can be shared.
+	to.put(dst, &entry{value: e.value, expiresAt: e.expiresAt})
+	return nil
+}
+
+func (s *memoryStorage) RandomKey() ([]byte, error) {
+	// Start from a random shard, map iteration starts at a random position
+	// too.
+	now := time.Now().UnixNano()
+	start := rand.Intn(shardCount) //nolint:gosec
+	for i := 0; i < shardCount; i++ {
+		sh := &s.shards[(start+i)&(shardCount-1)]
+		sh.mu.RLock()
+		for k, e := range sh.data {
+			if !e.expired(now) {
+				sh.mu.RUnlock()
+				return []byte(k), nil
+			}
+		}
+		sh.mu.RUnlock()
+	}
+
+	return nil, storage.ErrNotExist
+}
+
+func (s *memoryStorage) DBSize() (int64, error) {
+	var n int64
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.RLock()
+		n += int64(len(sh.data))
+		sh.mu.RUnlock()
+	}
+
+	return n, nil
+}
+
+func (s *memoryStorage) ForEach(fn func(key, value []byte, expiresAt time.Time) error) error {
+	// Hold every shard for a consistent view.
+	for i := range s.shards {
+		s.shards[i].mu.RLock()
+	}
+	defer func() {
+		for i := range s.shards {
+			s.shards[i].mu.RUnlock()
+		}
+	}()
+
+	now := time.Now().UnixNano()
+	for i := range s.shards {
+		for k, e := range s.shards[i].data {
+			if e.expired(now) {
+				continue
+			}
+			var expiresAt time.Time
+			if e.expiresAt > 0 {
+				expiresAt = time.Unix(0, e.expiresAt)
+			}
+			if err := fn([]byte(k), e.value, expiresAt); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryStorage) Expire(key []byte, dur time.Duration) error {
+	if dur <= 0 {
+		return storage.ErrInvalidOpts
+	}
+
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	e := sh.get(key, time.Now().UnixNano())
+	if e == nil {
+		return storage.ErrNotExist
+	}
+
+	sh.put(key, &entry{value: e.value, expiresAt: time.Now().Add(dur).UnixNano()})
+	return nil
+}
+
+func (s *memoryStorage) TTL(key []byte) (int64, error) {
+	sh := s.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	now := time.Now().UnixNano()
+	e := sh.get(key, now)
+	if e == nil {
+		return -2, nil
+	}
+	if e.expiresAt == 0 {
+		return -1, nil
+	}
+
+	return int64(time.Duration(e.expiresAt - now).Seconds()), nil
+}
+
+func (s *memoryStorage) DropAll() error {
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		sh.data = make(map[string]*entry)
+		sh.expires.Reset()
+		sh.mu.Unlock()
+	}
+	return nil
+}
+
+func (s *memoryStorage) Close() error {
+	s.logger.Info("stopping active expire")
+	s.closer.SignalAndWait()
+	return nil
+}
+
+// activeExpire deletes expired keys in the background so that keys which
+// are never accessed again don't stay in memory forever.
+func (s *memoryStorage) activeExpire() {
+	defer s.closer.Done()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closer.HasBeenClosed():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now().UnixNano()
+		for i := range s.shards {
+			sh := &s.shards[i]
+			keys := sh.expires.PopExpired(now)
+			if len(keys) == 0 {
+				continue
+			}
+			sh.mu.Lock()
+			for _, k := range keys {
+				if e, ok := sh.data[k]; ok && e.expired(now) {
+					delete(sh.data, k)
+				}
+			}
+			sh.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package memory
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.chensl.me/redix/server/internal/storage"
+	"go.uber.org/zap"
+)
+
+func Test_memoryStorage_CommonCmd(t *testing.T) {
+	s, err := NewStorage(zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ttl, err := s.TTL([]byte("key"))
+	assert.Equal(t, int64(-2), ttl)
+	assert.NoError(t, err)
+
+	err = s.Expire([]byte("key"), -1)
+	assert.ErrorIs(t, err, storage.ErrInvalidOpts)
+
+	n, err := s.DBSize()
+	assert.Equal(t, int64(0), n)
+	assert.NoError(t, err)
+
+	_, err = s.RandomKey()
+	assert.ErrorIs(t, err, storage.ErrNotExist)
+
+	err = s.Rename([]byte("a"), []byte("b"), false)
+	assert.ErrorIs(t, err, storage.ErrNotExist)
+
+	assert.NoError(t, s.Set([]byte("a"), []byte("1"), storage.SetOptions{TTL: time.Minute}))
+	assert.NoError(t, s.Set([]byte("b"), []byte("2"), storage.SetOptions{}))
+
+	err = s.Rename([]byte("a"), []byte("b"), true)
+	assert.ErrorIs(t, err, storage.ErrExist)
+
+	err = s.Rename([]byte("a"), []byte("c"), true)
+	assert.NoError(t, err)
+
+	ttl, err = s.TTL([]byte("c"))
+	assert.Equal(t, int64(59), ttl)
+	assert.NoError(t, err)
+
+	err = s.Copy([]byte("c"), []byte("b"), false)
+	assert.ErrorIs(t, err, storage.ErrExist)
+
+	err = s.Copy([]byte("c"), []byte("b"), true)
+	assert.NoError(t, err)
+
+	v, err := s.Get([]byte("b"))
+	assert.Equal(t, []byte("1"), v)
+	assert.NoError(t, err)
+
+	n, err = s.DBSize()
+	assert.Equal(t, int64(2), n)
+	assert.NoError(t, err)
+
+	k, err := s.RandomKey()
+	assert.Contains(t, []string{"b", "c"}, string(k))
+	assert.NoError(t, err)
+
+	cnt, err := s.Del([]byte("b"), []byte("b"), []byte("x"))
+	assert.Equal(t, 1, cnt)
+	assert.NoError(t, err)
+
+	n, err = s.DBSize()
+	assert.Equal(t, int64(1), n)
+	assert.NoError(t, err)
+}
+
+func Test_memoryStorage_ActiveExpire(t *testing.T) {
+	s, err := NewStorage(zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for i := 0; i < 100; i++ {
+		key := []byte{'k', byte(i)}
+		assert.NoError(t, s.Set(key, key, storage.SetOptions{TTL: 100 * time.Millisecond}))
+	}
+	assert.NoError(t, s.Set([]byte("persist"), []byte("1"), storage.SetOptions{}))
+
+	n, err := s.DBSize()
+	assert.Equal(t, int64(101), n)
+	assert.NoError(t, err)
+
+	// Expired keys are removed without being accessed.
+	time.Sleep(300 * time.Millisecond)
+	n, err = s.DBSize()
+	assert.Equal(t, int64(1), n)
+	assert.NoError(t, err)
+
+	var keys []string
+	err = s.ForEach(func(key, value []byte, expiresAt time.Time) error {
+		keys = append(keys, string(key))
+		assert.True(t, expiresAt.IsZero())
+		return nil
+	})
+	assert.Equal(t, []string{"persist"}, keys)
+	assert.NoError(t, err)
+}
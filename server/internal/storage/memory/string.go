@@ -0,0 +1,115 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package memory
+
+import (
+	"time"
+
+	"go.chensl.me/redix/server/internal/storage"
+)
+
+func (s *memoryStorage) Set(key, value []byte, opts storage.SetOptions) error {
+	if (opts.NX && opts.XX) || (opts.KeepTTL && opts.TTL > 0) {
+		return storage.ErrInvalidOpts
+	}
+
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	old := sh.get(key, time.Now().UnixNano())
+	if old == nil && opts.XX {
+		return storage.ErrNotExist
+	}
+	if old != nil && opts.NX {
+		return storage.ErrExist
+	}
+
+	e := &entry{value: cloneBytes(value)}
+	if opts.TTL > 0 {
+		e.expiresAt = time.Now().Add(opts.TTL).UnixNano()
+	} else if opts.KeepTTL && old != nil {
+		e.expiresAt = old.expiresAt
+	}
+
+	sh.put(key, e)
+	return nil
+}
+
+func (s *memoryStorage) Get(key []byte) ([]byte, error) {
+	sh := s.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	e := sh.get(key, time.Now().UnixNano())
+	if e == nil {
+		return nil, storage.ErrNotExist
+	}
+
+	return e.value, nil
+}
+
+func (s *memoryStorage) Add(key []byte, delta int64) (int64, error) {
+	var i int64
+
+	err := s.update(key, func(val []byte) ([]byte, error) {
+		var err error
+		i, err = storage.IncrInt(val, delta)
+		if err != nil {
+			return nil, err
+		}
+		return storage.FormatInt(i), nil
+	})
+
+	return i, err
+}
+
+func (s *memoryStorage) AddFloat(key []byte, delta float64) (float64, error) {
+	var f float64
+
+	err := s.update(key, func(val []byte) ([]byte, error) {
+		var err error
+		f, err = storage.IncrFloat(val, delta)
+		if err != nil {
+			return nil, err
+		}
+		return storage.FormatFloat(f), nil
+	})
+
+	return f, err
+}
+
+// update replaces the value of key with the result of fn, keeping the
+// original expiration time. fn receives nil if the key does not exist.
+func (s *memoryStorage) update(key []byte, fn func(val []byte) ([]byte, error)) error {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	var (
+		val       []byte
+		expiresAt int64
+	)
+	if e := sh.get(key, time.Now().UnixNano()); e != nil {
+		val, expiresAt = e.value, e.expiresAt
+		if val == nil {
+			val = []byte{}
+		}
+	}
+
+	val, err := fn(val)
+	if err != nil {
+		return err
+	}
+
+	sh.put(key, &entry{value: val, expiresAt: expiresAt})
+	return nil
+}
+
+func cloneBytes(b []byte) []byte {
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
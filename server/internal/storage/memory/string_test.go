@@ -0,0 +1,115 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package memory
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.chensl.me/redix/server/internal/storage"
+	"go.uber.org/zap"
+)
+
+func Test_memoryStorage_StringCmd(t *testing.T) {
+	s, err := NewStorage(zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	key, value := []byte("key"), []byte("value")
+
+	v, err := s.Get(key)
+	assert.Nil(t, v)
+	assert.ErrorIs(t, err, storage.ErrNotExist)
+
+	err = s.Expire(key, time.Minute)
+	assert.ErrorIs(t, err, storage.ErrNotExist)
+
+	err = s.Set(key, value, storage.SetOptions{
+		NX: true,
+		XX: true,
+	})
+	assert.ErrorIs(t, err, storage.ErrInvalidOpts)
+
+	err = s.Set(key, value, storage.SetOptions{
+		XX: true,
+	})
+	assert.ErrorIs(t, err, storage.ErrNotExist)
+
+	err = s.Set(key, value, storage.SetOptions{})
+	assert.NoError(t, err)
+
+	ttl, err := s.TTL(key)
+	assert.Equal(t, int64(-1), ttl)
+	assert.NoError(t, err)
+
+	err = s.Expire(key, time.Minute)
+	assert.NoError(t, err)
+
+	ttl, err = s.TTL(key)
+	assert.Equal(t, int64(59), ttl)
+	assert.NoError(t, err)
+
+	v, err = s.Get(key)
+	assert.Equal(t, value, v)
+	assert.NoError(t, err)
+
+	err = s.Set(key, value, storage.SetOptions{
+		NX: true,
+	})
+	assert.ErrorIs(t, err, storage.ErrExist)
+
+	err = s.Set(key, value, storage.SetOptions{
+		TTL: 2 * time.Second,
+	})
+	assert.NoError(t, err)
+
+	v, err = s.Get(key)
+	assert.Equal(t, value, v)
+	assert.NoError(t, err)
+
+	ttl, err = s.TTL(key)
+	assert.Equal(t, int64(1), ttl)
+	assert.NoError(t, err)
+
+	time.Sleep(2 * time.Second)
+	v, err = s.Get(key)
+	assert.Nil(t, v)
+	assert.ErrorIs(t, err, storage.ErrNotExist)
+
+	i, err := s.Add(key, 10)
+	assert.Equal(t, int64(10), i)
+	assert.NoError(t, err)
+
+	err = s.Expire(key, time.Minute)
+	assert.NoError(t, err)
+
+	i, err = s.Add(key, math.MaxInt64)
+	assert.Equal(t, int64(0), i)
+	assert.ErrorIs(t, err, storage.ErrOverflow)
+
+	i, err = s.Add(key, -20)
+	assert.Equal(t, int64(-10), i)
+	assert.NoError(t, err)
+
+	f, err := s.AddFloat(key, 0.5)
+	assert.Equal(t, -9.5, f)
+	assert.NoError(t, err)
+
+	v, err = s.Get(key)
+	assert.Equal(t, []byte("-9.5"), v)
+	assert.NoError(t, err)
+
+	ttl, err = s.TTL(key)
+	assert.Equal(t, int64(59), ttl)
+	assert.NoError(t, err)
+
+	i, err = s.Add(key, 1)
+	assert.Equal(t, int64(0), i)
+	assert.ErrorIs(t, err, storage.ErrInvalidInt)
+}
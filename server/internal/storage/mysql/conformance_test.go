@@ -0,0 +1,36 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mysql
+
+import (
+	"os"
+	"testing"
+
+	"go.chensl.me/redix/server/internal/storage"
+	"go.chensl.me/redix/server/internal/storage/storagetest"
+	"go.uber.org/zap"
+)
+
+// The tests run against the database of REDIX_TEST_MYSQL_DSN, which must
+// set clientFoundRows=true and parseTime=true like NewStorage, e.g.
+// root@tcp(127.0.0.1:3306)/redix_test?clientFoundRows=true&parseTime=true.
+// They are skipped if it's unset.
+func Test_mysqlStorage_Conformance(t *testing.T) {
+	dsn := os.Getenv("REDIX_TEST_MYSQL_DSN")
+	if dsn == "" {
+		t.Skip("REDIX_TEST_MYSQL_DSN is not set")
+	}
+	storagetest.Run(t, func(t *testing.T) storage.Interface {
+		s, err := newStorage(dsn, zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.DropAll(); err != nil {
+			s.Close()
+			t.Fatal(err)
+		}
+		return s
+	})
+}
@@ -1,6 +1,7 @@
 package mysql
 
 import (
+	"context"
 	"database/sql"
 	"embed"
 
@@ -12,18 +13,33 @@ import (
 //go:embed migrations/*.sql
 var fs embed.FS
 
+// migrationsTable keeps the schema version apart from the default
+// schema_migrations table, which the database may already use for
+// something else.
+const migrationsTable = "redix_schema_migrations"
+
+// autoMigrate applies the pending migrations. The migrations only ever add
+// to the schema, existing data is never dropped.
 func autoMigrate(db *sql.DB) error {
 	s, err := iofs.New(fs, "migrations")
 	if err != nil {
-		return nil
+		return err
+	}
+	// Use a dedicated connection, which is given back to the pool once
+	// done.
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
 	}
-	d, err := mysql.WithInstance(db, &mysql.Config{})
+	defer conn.Close()
+	d, err := mysql.WithConnection(ctx, conn, &mysql.Config{MigrationsTable: migrationsTable})
 	if err != nil {
 		return err
 	}
 	m, err := migrate.NewWithInstance("iofs", s, "mysql", d)
 	if err != nil {
-		return nil
+		return err
 	}
 	err = m.Up()
 	if err == migrate.ErrNoChange {
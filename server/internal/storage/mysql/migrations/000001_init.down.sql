@@ -1 +1,3 @@
-DROP TABLE IF EXISTS `entries`;
+-- Keep the data around, the table can be dropped by hand once it's no
+-- longer needed.
+RENAME TABLE `entries` TO `entries_backup`;
@@ -0,0 +1,2 @@
+-- The columns are left as is, shrinking them could truncate data.
+ALTER TABLE `entries` DROP INDEX `entries_expire_at_IDX`;
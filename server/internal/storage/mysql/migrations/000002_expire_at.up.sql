@@ -0,0 +1,4 @@
+ALTER TABLE `entries`
+  MODIFY `_value` longblob NOT NULL,
+  MODIFY `_expire_at` datetime(3) NULL DEFAULT NULL,
+  ADD INDEX `entries_expire_at_IDX` (`_expire_at`) USING BTREE;
@@ -1,25 +1,45 @@
 package mysql
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"math/rand"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/dgraph-io/ristretto/z"
+	mysqldriver "github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
+	"github.com/tidwall/match"
 	"go.chensl.me/redix/server/internal/storage"
+	"go.uber.org/zap"
 )
 
+// live is the condition selecting the entries which haven't expired, it
+// takes the current time as argument.
+const live = "(_expire_at IS NULL OR _expire_at > ?)"
+
+// maxTxRetries is the number of times a transaction aborted by a deadlock
+// is retried.
+const maxTxRetries = 3
+
+// sweepBatch is the maximum number of expired entries deleted by a single
+// statement of the expiry sweep.
+const sweepBatch = 1000
+
 type Config struct {
-	Username string
-	Password string
-	Host     string
-	Port     int
-	Database string
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	Host     string `mapstructure:"host"`
+	Port     int    `mapstructure:"port"`
+	Database string `mapstructure:"database"`
 }
 
 type mysqlStorage struct {
-	db *sqlx.DB
+	db     *sqlx.DB
+	closer *z.Closer
+	logger *zap.Logger
 }
 
 type entry struct {
@@ -29,177 +49,429 @@ type entry struct {
 	ExpireAt sql.NullTime `db:"_expire_at"`
 }
 
-func NewStorage(cfg *Config) (storage.Interface, error) {
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?charset=utf8mb4&parseTime=True&loc=Local",
+func (e *entry) expired(now time.Time) bool {
+	return e.ExpireAt.Valid && !now.Before(e.ExpireAt.Time)
+}
+
+func init() {
+	storage.Register("mysql", func(opts storage.Options) (storage.Interface, error) {
+		var cfg Config
+		if err := opts.Config.Unmarshal(&cfg); err != nil {
+			return nil, err
+		}
+		return NewStorage(&cfg, opts.Logger)
+	})
+}
+
+func NewStorage(cfg *Config, logger *zap.Logger) (storage.Interface, error) {
+	// clientFoundRows makes UPDATE report the matched rows rather than the
+	// changed ones.
+	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?charset=utf8mb4&parseTime=True&loc=Local&clientFoundRows=true",
 		cfg.Username, cfg.Password, cfg.Host, cfg.Port, cfg.Database)
+	return newStorage(dsn, logger)
+}
 
+func newStorage(dsn string, logger *zap.Logger) (storage.Interface, error) {
 	db, err := sqlx.Connect("mysql", dsn)
 	if err != nil {
 		return nil, err
 	}
 
 	if err := autoMigrate(db.DB); err != nil {
+		_ = db.Close()
 		return nil, err
 	}
 
-	return &mysqlStorage{
-		db: db,
-	}, nil
+	s := &mysqlStorage{
+		db:     db,
+		closer: z.NewCloser(1),
+		logger: logger,
+	}
+	go s.sweepExpired()
+	return s, nil
 }
 
 func (s *mysqlStorage) Close() error {
+	s.logger.Info("stopping expiry sweep")
+	s.closer.SignalAndWait()
 	return s.db.Close()
 }
 
-func (s *mysqlStorage) Set(key []byte, value []byte, opts storage.SetOptions) error {
-	if opts.NX && opts.XX {
-		return storage.ErrInvalidOpts
-	}
-
-	tx, err := s.db.Beginx()
+func (s *mysqlStorage) Keys(pattern string) ([][]byte, error) {
+	rows, err := s.db.Queryx(`
+		SELECT
+			_key
+		FROM
+			entries
+		WHERE
+			_key LIKE ? AND `+live,
+		storage.LikePattern(pattern), time.Now())
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer func() { _ = tx.Rollback() }()
+	defer rows.Close()
 
-	_, err = getEntryWithTx(tx, key)
-	if err != nil && err != sql.ErrNoRows {
-		return err
+	var keys [][]byte
+	for rows.Next() {
+		var key []byte
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		if match.Match(string(key), pattern) {
+			keys = append(keys, key)
+		}
 	}
-	exist := err == nil
+	return keys, rows.Err()
+}
 
-	if !exist && opts.XX {
-		return storage.ErrNotExist
-	} else if exist && opts.NX {
-		return storage.ErrExist
-	}
+func (s *mysqlStorage) Del(keys ...[]byte) (int, error) {
+	var count int
+
+	err := s.withTx(func(tx *sqlx.Tx) error {
+		// Expired entries are deleted too but aren't counted.
+		query, args, err := sqlx.In(`
+			SELECT
+				COUNT(*)
+			FROM
+				entries
+			WHERE
+				_key IN (?) AND `+live+`
+			FOR UPDATE
+		`, keys, time.Now())
+		if err != nil {
+			return err
+		}
+		if err := tx.Get(&count, tx.Rebind(query), args...); err != nil {
+			return err
+		}
 
-	e := entry{
-		Key:   key,
-		Value: value,
-	}
-	if opts.TTL > 0 {
-		e.ExpireAt.Valid = true
-		e.ExpireAt.Time = time.Now().Add(opts.TTL)
-	}
+		query, args, err = sqlx.In(`
+			DELETE FROM
+				entries
+			WHERE
+				_key IN (?)
+		`, keys)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(tx.Rebind(query), args...)
+		return err
+	})
 
-	if exist {
-		if err := updateValueWithTx(tx, &e); err != nil {
+	return count, err
+}
+
+func (s *mysqlStorage) Rename(key, newKey []byte, nx bool) error {
+	return s.withTx(func(tx *sqlx.Tx) error {
+		now := time.Now()
+		e, err := getLiveEntryForUpdate(tx, key, now)
+		if err != nil {
+			return err
+		}
+		if string(key) == string(newKey) {
+			if nx {
+				return storage.ErrExist
+			}
+			return nil
+		}
+		_, err = getLiveEntryForUpdate(tx, newKey, now)
+		if err == nil && nx {
+			return storage.ErrExist
+		}
+		if err != nil && err != storage.ErrNotExist {
 			return err
 		}
-		return tx.Commit()
-	}
 
-	if err := insertEntryWithTx(tx, &e); err != nil {
+		if err := deleteEntryWithTx(tx, newKey); err != nil {
+			return err
+		}
+		_, err = tx.Exec(`
+			UPDATE
+				entries
+			SET
+				_key = ?
+			WHERE
+				_id = ?
+		`, newKey, e.ID)
 		return err
-	}
-	return tx.Commit()
+	})
 }
 
-func (s *mysqlStorage) Get(key []byte) ([]byte, error) {
-	tx, err := s.db.Beginx()
-	if err != nil {
+func (s *mysqlStorage) Copy(src, dst []byte, replace bool) error {
+	return s.withTx(func(tx *sqlx.Tx) error {
+		now := time.Now()
+		e, err := getLiveEntryForUpdate(tx, src, now)
+		if err != nil {
+			return err
+		}
+		_, err = getLiveEntryForUpdate(tx, dst, now)
+		if err == nil && !replace {
+			return storage.ErrExist
+		}
+		if err != nil && err != storage.ErrNotExist {
+			return err
+		}
+		if string(src) == string(dst) {
+			return nil
+		}
+
+		return upsertEntryWithTx(tx, &entry{Key: dst, Value: e.Value, ExpireAt: e.ExpireAt})
+	})
+}
+
+func (s *mysqlStorage) RandomKey() ([]byte, error) {
+	now := time.Now()
+	var bounds struct {
+		Min sql.NullInt64 `db:"min_id"`
+		Max sql.NullInt64 `db:"max_id"`
+	}
+	if err := s.db.Get(&bounds, `
+		SELECT
+			MIN(_id) AS min_id, MAX(_id) AS max_id
+		FROM
+			entries
+	`); err != nil {
 		return nil, err
 	}
-	defer func() { _ = tx.Rollback() }()
+	if !bounds.Min.Valid {
+		return nil, storage.ErrNotExist
+	}
 
-	e, err := getEntryWithTx(tx, key)
+	// Pick the first live key from a random id, wrapping around.
+	id := bounds.Min.Int64 + rand.Int63n(bounds.Max.Int64-bounds.Min.Int64+1) //nolint:gosec
+	var key []byte
+	err := s.db.Get(&key, `
+		SELECT
+			_key
+		FROM
+			entries
+		WHERE
+			_id >= ? AND `+live+`
+		ORDER BY
+			_id
+		LIMIT 1
+	`, id, now)
+	if err == sql.ErrNoRows {
+		err = s.db.Get(&key, `
+			SELECT
+				_key
+			FROM
+				entries
+			WHERE
+				_id < ? AND `+live+`
+			ORDER BY
+				_id
+			LIMIT 1
+		`, id, now)
+	}
 	if err == sql.ErrNoRows {
 		return nil, storage.ErrNotExist
 	}
 	if err != nil {
 		return nil, err
 	}
+	return key, nil
+}
 
-	if e.ExpireAt.Valid && time.Now().After(e.ExpireAt.Time) {
-		if err := deleteEntryWithTx(tx, e.Key); err != nil {
-			return nil, err
-		}
+func (s *mysqlStorage) DBSize() (int64, error) {
+	var n int64
+	err := s.db.Get(&n, `
+		SELECT
+			COUNT(*)
+		FROM
+			entries
+		WHERE
+			`+live,
+		time.Now())
+	return n, err
+}
+
+func (s *mysqlStorage) ForEach(fn func(key, value []byte, expiresAt time.Time) error) error {
+	// A repeatable read transaction reads from a single snapshot.
+	tx, err := s.db.BeginTxx(context.Background(), &sql.TxOptions{
+		Isolation: sql.LevelRepeatableRead,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return err
 	}
+	defer func() { _ = tx.Rollback() }()
 
-	_ = tx.Commit()
-	return e.Value, nil
-}
+	rows, err := tx.Queryx(`
+		SELECT
+			*
+		FROM
+			entries
+		WHERE
+			`+live,
+		time.Now())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
 
-func (s *mysqlStorage) Add(key []byte, delta int) (int, error) {
-	panic("not implemented") // TODO: Implement
+	for rows.Next() {
+		var e entry
+		if err := rows.StructScan(&e); err != nil {
+			return err
+		}
+		var expiresAt time.Time
+		if e.ExpireAt.Valid {
+			expiresAt = e.ExpireAt.Time
+		}
+		if err := fn(e.Key, e.Value, expiresAt); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
 }
 
-func (s *mysqlStorage) Keys(pattern string) ([][]byte, error) {
-	panic("not implemented") // TODO: Implement
-}
+func (s *mysqlStorage) Expire(key []byte, dur time.Duration) error {
+	if dur <= 0 {
+		return storage.ErrInvalidOpts
+	}
 
-func (s *mysqlStorage) Del(keys ...[]byte) (int, error) {
-	query, args, err := sqlx.In(`
-		DELETE FROM
+	now := time.Now()
+	res, err := s.db.Exec(`
+		UPDATE
 			entries
+		SET
+			_expire_at = ?
 		WHERE
-			_key IN (?)
-	`, keys)
+			_key = ? AND `+live,
+		now.Add(dur), key, now)
 	if err != nil {
-		return 0, err
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return storage.ErrNotExist
 	}
+	return nil
+}
 
-	query = s.db.Rebind(query)
-	res, err := s.db.Exec(query, args...)
+func (s *mysqlStorage) TTL(key []byte) (int64, error) {
+	now := time.Now()
+	var expireAt sql.NullTime
+	err := s.db.Get(&expireAt, `
+		SELECT
+			_expire_at
+		FROM
+			entries
+		WHERE
+			_key = ? AND `+live,
+		key, now)
+	if err == sql.ErrNoRows {
+		return -2, nil
+	}
 	if err != nil {
 		return 0, err
 	}
-	count, _ := res.RowsAffected()
-	return int(count), nil
+	if !expireAt.Valid {
+		return -1, nil
+	}
+	return int64(expireAt.Time.Sub(now).Seconds()), nil
 }
 
-func (s *mysqlStorage) Expire(key []byte, dur time.Duration) error {
-	panic("not implemented") // TODO: Implement
+func (s *mysqlStorage) DropAll() error {
+	_, err := s.db.Exec(`TRUNCATE TABLE entries`)
+	return err
 }
 
-func (s *mysqlStorage) TTL(key []byte) (int64, error) {
-	panic("not implemented") // TODO: Implement
+// sweepExpired deletes expired entries in the background, the reads
+// already ignore them.
+func (s *mysqlStorage) sweepExpired() {
+	defer s.closer.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closer.HasBeenClosed():
+			return
+		case <-ticker.C:
+		}
+		for {
+			res, err := s.db.Exec(`
+				DELETE FROM
+					entries
+				WHERE
+					_expire_at <= ?
+				LIMIT ?
+			`, time.Now(), sweepBatch)
+			if err != nil {
+				s.logger.Error("failed to delete expired entries", zap.Error(err))
+				break
+			}
+			if n, _ := res.RowsAffected(); n < sweepBatch {
+				break
+			}
+		}
+	}
 }
 
-func (s *mysqlStorage) DropAll() error {
-	panic("not implemented") // TODO: Implement
+// withTx runs fn in a transaction which is committed if fn returns nil.
+// Locking a missing key locks the gap around it in InnoDB, so concurrent
+// inserts can deadlock: the aborted transaction is retried.
+func (s *mysqlStorage) withTx(fn func(tx *sqlx.Tx) error) error {
+	for i := 0; ; i++ {
+		err := s.runTx(fn)
+		var myErr *mysqldriver.MySQLError
+		if i < maxTxRetries && errors.As(err, &myErr) && myErr.Number == 1213 {
+			continue
+		}
+		return err
+	}
+}
+
+func (s *mysqlStorage) runTx(fn func(tx *sqlx.Tx) error) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-func getEntryWithTx(tx *sqlx.Tx, key []byte) (*entry, error) {
+func getLiveEntryForUpdate(tx *sqlx.Tx, key []byte, now time.Time) (*entry, error) {
 	var e entry
-	if err := tx.Get(&e, `
+	err := tx.Get(&e, `
 		SELECT
 			*
 		FROM
 			entries
 		WHERE
 			_key = ?
-	`, key); err != nil {
+		FOR UPDATE
+	`, key)
+	if err == sql.ErrNoRows {
+		return nil, storage.ErrNotExist
+	}
+	if err != nil {
 		return nil, err
 	}
+	if e.expired(now) {
+		return nil, storage.ErrNotExist
+	}
 	return &e, nil
 }
 
-func updateValueWithTx(tx *sqlx.Tx, e *entry) error {
+func upsertEntryWithTx(tx *sqlx.Tx, e *entry) error {
 	_, err := tx.Exec(`
-		UPDATE
-			entries
-		SET
-			_value = ?, _expire_at = ?
-		WHERE
-			_key = ?
-	`, e.Value, e.ExpireAt, e.Key)
-	return err
-}
-
-func insertEntryWithTx(tx *sqlx.Tx, e *entry) error {
-	res, err := tx.Exec(`
 		INSERT INTO
 			entries (_key, _value, _expire_at)
 		VALUES
 			(?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+			_value = VALUES(_value), _expire_at = VALUES(_expire_at)
 	`, e.Key, e.Value, e.ExpireAt)
-	if err != nil {
-		return err
-	}
-	e.ID, _ = res.LastInsertId()
-	return nil
+	return err
 }
 
 func deleteEntryWithTx(tx *sqlx.Tx, key []byte) error {
@@ -0,0 +1,122 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mysql
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"go.chensl.me/redix/server/internal/storage"
+)
+
+func (s *mysqlStorage) Set(key []byte, value []byte, opts storage.SetOptions) error {
+	if (opts.NX && opts.XX) || (opts.KeepTTL && opts.TTL > 0) {
+		return storage.ErrInvalidOpts
+	}
+
+	return s.withTx(func(tx *sqlx.Tx) error {
+		now := time.Now()
+		old, err := getLiveEntryForUpdate(tx, key, now)
+		if err != nil && err != storage.ErrNotExist {
+			return err
+		}
+		exist := err == nil
+
+		if !exist && opts.XX {
+			return storage.ErrNotExist
+		} else if exist && opts.NX {
+			return storage.ErrExist
+		}
+
+		e := entry{
+			Key:   key,
+			Value: value,
+		}
+		if opts.TTL > 0 {
+			e.ExpireAt.Valid = true
+			e.ExpireAt.Time = now.Add(opts.TTL)
+		} else if opts.KeepTTL && exist {
+			e.ExpireAt = old.ExpireAt
+		}
+
+		return upsertEntryWithTx(tx, &e)
+	})
+}
+
+func (s *mysqlStorage) Get(key []byte) ([]byte, error) {
+	var value []byte
+	err := s.db.Get(&value, `
+		SELECT
+			_value
+		FROM
+			entries
+		WHERE
+			_key = ? AND `+live,
+		key, time.Now())
+	if err == sql.ErrNoRows {
+		return nil, storage.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	return value, nil
+}
+
+func (s *mysqlStorage) Add(key []byte, delta int64) (int64, error) {
+	var i int64
+
+	err := s.update(key, func(val []byte) ([]byte, error) {
+		var err error
+		i, err = storage.IncrInt(val, delta)
+		if err != nil {
+			return nil, err
+		}
+		return storage.FormatInt(i), nil
+	})
+
+	return i, err
+}
+
+func (s *mysqlStorage) AddFloat(key []byte, delta float64) (float64, error) {
+	var f float64
+
+	err := s.update(key, func(val []byte) ([]byte, error) {
+		var err error
+		f, err = storage.IncrFloat(val, delta)
+		if err != nil {
+			return nil, err
+		}
+		return storage.FormatFloat(f), nil
+	})
+
+	return f, err
+}
+
+// update replaces the value of key with the result of fn, keeping the
+// original expiration time. fn receives nil if the key does not exist. The
+// row is locked with SELECT ... FOR UPDATE so that concurrent updates are
+// serialized.
+func (s *mysqlStorage) update(key []byte, fn func(val []byte) ([]byte, error)) error {
+	return s.withTx(func(tx *sqlx.Tx) error {
+		e, err := getLiveEntryForUpdate(tx, key, time.Now())
+		if err == storage.ErrNotExist {
+			e, err = &entry{Key: key}, nil
+		} else if err == nil && e.Value == nil {
+			e.Value = []byte{}
+		}
+		if err != nil {
+			return err
+		}
+
+		if e.Value, err = fn(e.Value); err != nil {
+			return err
+		}
+		return upsertEntryWithTx(tx, e)
+	})
+}
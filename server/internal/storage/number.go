@@ -0,0 +1,138 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"bytes"
+	"math"
+	"math/big"
+	"strconv"
+
+	"go.chensl.me/redix/server/pkg/bytesconv"
+)
+
+// ParseInt parses b as a signed 64-bit integer with the same strictness as
+// Redis: no '+' sign, no leading zeros, no spaces and no "-0".
+func ParseInt(b []byte) (int64, error) {
+	if len(b) == 0 || len(b) > 20 {
+		return 0, ErrInvalidInt
+	}
+	if len(b) == 1 && b[0] == '0' {
+		return 0, nil
+	}
+	p := b
+	if p[0] == '-' {
+		p = p[1:]
+		if len(p) == 0 {
+			return 0, ErrInvalidInt
+		}
+	}
+	if p[0] < '1' || p[0] > '9' {
+		return 0, ErrInvalidInt
+	}
+	i, err := strconv.ParseInt(bytesconv.BytesToString(b), 10, 64)
+	if err != nil {
+		return 0, ErrInvalidInt
+	}
+	return i, nil
+}
+
+// ParseFloat parses b as a float, rejecting empty input, surrounding spaces
+// and NaN.
+func ParseFloat(b []byte) (float64, error) {
+	if len(b) == 0 || isSpace(b[0]) || isSpace(b[len(b)-1]) {
+		return 0, ErrInvalidFloat
+	}
+	f, err := strconv.ParseFloat(bytesconv.BytesToString(b), 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, ErrInvalidFloat
+	}
+	return f, nil
+}
+
+// FormatInt returns the decimal representation of i.
+func FormatInt(i int64) []byte {
+	return strconv.AppendInt(nil, i, 10)
+}
+
+// longDoublePrec is the mantissa precision of the x87 long double Redis
+// computes and formats INCRBYFLOAT with.
+const longDoublePrec = 64
+
+// FormatFloat returns the human friendly representation of f used by
+// INCRBYFLOAT: 17 digits after the decimal point, as Redis formats its long
+// doubles with %.17Lf, without the trailing zeros. f stands for the long
+// double nearest to its shortest decimal form, so that 0.3 isn't printed as
+// 0.29999999999999999.
+func FormatFloat(f float64) []byte {
+	x := longDouble(f)
+	b := x.Append(nil, 'f', 17)
+	if bytes.IndexByte(b, '.') >= 0 {
+		b = bytes.TrimRight(b, "0")
+		b = bytes.TrimSuffix(b, []byte("."))
+	}
+	if string(b) == "-0" {
+		return []byte("0")
+	}
+	return b
+}
+
+// longDouble returns the long double nearest to the shortest decimal form
+// of f.
+func longDouble(f float64) *big.Float {
+	x, _, err := big.ParseFloat(strconv.FormatFloat(f, 'g', -1, 64), 10, longDoublePrec, big.ToNearestEven)
+	if err != nil {
+		// Not reached, f is finite.
+		return new(big.Float).SetPrec(longDoublePrec).SetFloat64(f)
+	}
+	return x
+}
+
+// IncrInt adds delta to the integer stored in val. A nil val is treated as 0.
+func IncrInt(val []byte, delta int64) (int64, error) {
+	var i int64
+	if val != nil {
+		var err error
+		if i, err = ParseInt(val); err != nil {
+			return 0, err
+		}
+	}
+	if (delta < 0 && i < math.MinInt64-delta) || (delta > 0 && i > math.MaxInt64-delta) {
+		return 0, ErrOverflow
+	}
+	return i + delta, nil
+}
+
+// IncrFloat adds delta to the float stored in val. A nil val is treated as 0.
+// The sum is computed with the precision of a long double, as Redis does, so
+// that 0.1 plus 0.2 is 0.3.
+func IncrFloat(val []byte, delta float64) (float64, error) {
+	if math.IsNaN(delta) || math.IsInf(delta, 0) {
+		return 0, ErrNaNOrInf
+	}
+	x := new(big.Float).SetPrec(longDoublePrec)
+	if val != nil {
+		f, err := ParseFloat(val)
+		if err != nil {
+			return 0, err
+		}
+		if math.IsInf(f, 0) {
+			return 0, ErrNaNOrInf
+		}
+		if _, _, err := x.Parse(bytesconv.BytesToString(val), 10); err != nil {
+			x = longDouble(f)
+		}
+	}
+	x.Add(x, longDouble(delta))
+	f, _ := x.Float64()
+	if math.IsInf(f, 0) {
+		return 0, ErrNaNOrInf
+	}
+	return f, nil
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
@@ -0,0 +1,90 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseInt(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		err  error
+	}{
+		{"0", 0, nil},
+		{"1", 1, nil},
+		{"-1", -1, nil},
+		{"9223372036854775807", math.MaxInt64, nil},
+		{"-9223372036854775808", math.MinInt64, nil},
+		{"9223372036854775808", 0, ErrInvalidInt},
+		{"", 0, ErrInvalidInt},
+		{"-", 0, ErrInvalidInt},
+		{"-0", 0, ErrInvalidInt},
+		{"+1", 0, ErrInvalidInt},
+		{"01", 0, ErrInvalidInt},
+		{" 1", 0, ErrInvalidInt},
+		{"1.5", 0, ErrInvalidInt},
+	}
+	for _, tt := range tests {
+		got, err := ParseInt([]byte(tt.in))
+		assert.Equal(t, tt.want, got, tt.in)
+		assert.Equal(t, tt.err, err, tt.in)
+	}
+}
+
+func TestIncrInt(t *testing.T) {
+	i, err := IncrInt(nil, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), i)
+
+	i, err = IncrInt([]byte("10"), -15)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-5), i)
+
+	_, err = IncrInt([]byte("9223372036854775807"), 1)
+	assert.ErrorIs(t, err, ErrOverflow)
+
+	_, err = IncrInt([]byte("-9223372036854775808"), -1)
+	assert.ErrorIs(t, err, ErrOverflow)
+
+	_, err = IncrInt([]byte{}, 1)
+	assert.ErrorIs(t, err, ErrInvalidInt)
+}
+
+func TestIncrFloat(t *testing.T) {
+	f, err := IncrFloat([]byte("10.50"), 0.1)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.6", string(FormatFloat(f)))
+
+	f, err = IncrFloat([]byte("0.1"), 0.2)
+	assert.NoError(t, err)
+	assert.Equal(t, "0.3", string(FormatFloat(f)))
+
+	f, err = IncrFloat([]byte("5.0e3"), 2.0e3)
+	assert.NoError(t, err)
+	assert.Equal(t, "7000", string(FormatFloat(f)))
+	assert.Equal(t, "1.0000000000000002", string(FormatFloat(math.Nextafter(1, 2))))
+
+	f, err = IncrFloat(nil, 5.0e3)
+	assert.NoError(t, err)
+	assert.Equal(t, "5000", string(FormatFloat(f)))
+
+	f, err = IncrFloat([]byte("3"), -3)
+	assert.NoError(t, err)
+	assert.Equal(t, "0", string(FormatFloat(f)))
+
+	_, err = IncrFloat([]byte("abc"), 1)
+	assert.ErrorIs(t, err, ErrInvalidFloat)
+
+	_, err = IncrFloat([]byte(" 1"), 1)
+	assert.ErrorIs(t, err, ErrInvalidFloat)
+
+	_, err = IncrFloat([]byte("1.7976931348623157e308"), 1.7976931348623157e308)
+	assert.ErrorIs(t, err, ErrNaNOrInf)
+}
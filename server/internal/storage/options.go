@@ -10,4 +10,7 @@ type SetOptions struct {
 	TTL time.Duration
 	NX  bool
 	XX  bool
+	// KeepTTL retains the expiration time of an existing key, TTL must be
+	// zero.
+	KeepTTL bool
 }
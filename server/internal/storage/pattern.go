@@ -0,0 +1,74 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import "strings"
+
+// LikePattern returns a SQL LIKE pattern, escaped with backslashes, which
+// matches a superset of the keys matched by the glob-style pattern, so that
+// SQL drivers can leave most of the filtering to the database. Character
+// classes and '?', which matches a whole UTF-8 character, are widened to
+// '%'.
+func LikePattern(pattern string) string {
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*', '?':
+			b.WriteByte('%')
+		case '[':
+			b.WriteByte('%')
+			for i++; i < len(pattern) && pattern[i] != ']'; i++ {
+				if pattern[i] == '\\' {
+					i++
+				}
+			}
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				writeLikeLiteral(&b, pattern[i])
+			}
+		default:
+			writeLikeLiteral(&b, c)
+		}
+	}
+	return b.String()
+}
+
+// PrefixRange returns the range [from, to) of the keys starting with the
+// literal prefix of the glob-style pattern, to is nil if unbounded. Drivers
+// backed by ordered engines only need to scan this range.
+func PrefixRange(pattern string) (from, to []byte) {
+	from = []byte{}
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		if c == '*' || c == '?' || c == '[' {
+			break
+		}
+		if c == '\\' {
+			if i+1 == len(pattern) {
+				break
+			}
+			i++
+			c = pattern[i]
+		}
+		from = append(from, c)
+	}
+
+	to = append([]byte(nil), from...)
+	for i := len(to) - 1; i >= 0; i-- {
+		if to[i] < 0xff {
+			to[i]++
+			return from, to[:i+1]
+		}
+	}
+	return from, nil
+}
+
+func writeLikeLiteral(b *strings.Builder, c byte) {
+	if c == '%' || c == '_' || c == '\\' {
+		b.WriteByte('\\')
+	}
+	b.WriteByte(c)
+}
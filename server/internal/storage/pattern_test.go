@@ -0,0 +1,48 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLikePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    string
+	}{
+		{"*", "%"},
+		{"user:*", "user:%"},
+		{"h?llo", "h%llo"},
+		{"h[ae]llo", "h%llo"},
+		{"h[^\\]]llo", "h%llo"},
+		{"100%_\\*", "100\\%\\_*"},
+		{"a\\\\b", "a\\\\b"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, LikePattern(tt.pattern), tt.pattern)
+	}
+}
+
+func TestPrefixRange(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		from, to []byte
+	}{
+		{"*", []byte{}, nil},
+		{"user:*", []byte("user:"), []byte("user;")},
+		{"a\\*b?", []byte("a*b"), []byte("a*c")},
+		{"h[ae]llo", []byte("h"), []byte("i")},
+		{"a\xff\xff*", []byte("a\xff\xff"), []byte("b")},
+		{"\xff", []byte("\xff"), nil},
+	}
+	for _, tt := range tests {
+		from, to := PrefixRange(tt.pattern)
+		assert.Equal(t, tt.from, from, tt.pattern)
+		assert.Equal(t, tt.to, to, tt.pattern)
+	}
+}
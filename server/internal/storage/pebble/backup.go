@@ -0,0 +1,17 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package pebble
+
+import (
+	"path/filepath"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// Backup takes a checkpoint of the database in dir/pebble, the SSTables are
+// hard-linked when possible.
+func (s *pebbleStorage) Backup(dir string) error {
+	return s.db.Checkpoint(filepath.Join(dir, "pebble"), pebble.WithFlushedWAL())
+}
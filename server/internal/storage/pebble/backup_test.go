@@ -0,0 +1,27 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package pebble
+
+import (
+	"path/filepath"
+	"testing"
+
+	"go.chensl.me/redix/server/internal/storage"
+	"go.chensl.me/redix/server/internal/storage/storagetest"
+	"go.uber.org/zap"
+)
+
+func Test_pebbleStorage_Backup(t *testing.T) {
+	open := func(t *testing.T, dir string) storage.Interface {
+		s, err := NewStorage(filepath.Join(dir, "pebble"), zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	storagetest.RunBackup(t, func(t *testing.T) storage.Interface {
+		return open(t, t.TempDir())
+	}, open)
+}
@@ -0,0 +1,10 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package pebble
+
+// DiskSize returns the size of the files of pebble, the WAL included.
+func (s *pebbleStorage) DiskSize() (int64, error) {
+	return int64(s.db.Metrics().DiskSpaceUsage()), nil
+}
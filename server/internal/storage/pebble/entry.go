@@ -0,0 +1,61 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package pebble
+
+import (
+	"github.com/cockroachdb/pebble"
+	"go.chensl.me/redix/server/internal/storage"
+	"go.chensl.me/redix/server/internal/storage/entrypb"
+	"google.golang.org/protobuf/proto"
+)
+
+// getEntry returns the entry of key, expired or not, or nil if there is
+// none.
+func getEntry(r pebble.Reader, key []byte) (*entrypb.Entry, error) {
+	v, closer, err := r.Get(key)
+	if err == pebble.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+	return decodeEntry(v)
+}
+
+// getLiveEntry returns the entry of key, or storage.ErrNotExist if there is
+// none or it has expired.
+func getLiveEntry(r pebble.Reader, key []byte, now int64) (*entrypb.Entry, error) {
+	ent, err := getEntry(r, key)
+	if err != nil {
+		return nil, err
+	}
+	if ent == nil || expired(ent, now) {
+		return nil, storage.ErrNotExist
+	}
+	return ent, nil
+}
+
+func putEntry(w pebble.Writer, key []byte, ent *entrypb.Entry) error {
+	v, err := proto.Marshal(ent)
+	if err != nil {
+		return err
+	}
+	return w.Set(key, v, pebble.Sync)
+}
+
+// decodeEntry decodes v, the entry doesn't retain it.
+func decodeEntry(v []byte) (*entrypb.Entry, error) {
+	var ent entrypb.Entry
+	if err := proto.Unmarshal(v, &ent); err != nil {
+		return nil, err
+	}
+	return &ent, nil
+}
+
+// expired reports whether ent has expired at now, in unix seconds.
+func expired(ent *entrypb.Entry, now int64) bool {
+	return ent.ExpiresAt > 0 && now >= ent.ExpiresAt
+}
@@ -0,0 +1,76 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package pebble
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/stretchr/testify/assert"
+	"go.chensl.me/redix/server/internal/storage"
+	"go.uber.org/zap"
+)
+
+func Test_pebbleStorage_LoadIndex(t *testing.T) {
+	path, err := os.MkdirTemp(os.TempDir(), "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	s, err := NewStorage(path, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, s.Set([]byte("persist"), []byte("1"), storage.SetOptions{}))
+	assert.NoError(t, s.Set([]byte("volatile"), []byte("1"), storage.SetOptions{TTL: time.Minute}))
+	assert.NoError(t, s.Set([]byte("expired"), []byte("1"), storage.SetOptions{TTL: time.Second}))
+	// Overwriting a volatile key without a TTL makes it persistent.
+	assert.NoError(t, s.Set([]byte("overwritten"), []byte("1"), storage.SetOptions{TTL: time.Minute}))
+	assert.NoError(t, s.Set([]byte("overwritten"), []byte("2"), storage.SetOptions{}))
+	assert.NoError(t, s.Set([]byte("expire"), []byte("1"), storage.SetOptions{}))
+	assert.NoError(t, s.Expire([]byte("expire"), time.Minute))
+	assert.NoError(t, s.Set([]byte("deleted"), []byte("1"), storage.SetOptions{TTL: time.Minute}))
+	_, err = s.Del([]byte("deleted"))
+	assert.NoError(t, err)
+	assert.NoError(t, s.Close())
+
+	time.Sleep(1100 * time.Millisecond)
+
+	// Reopen without activeExpire, which would delete the expired key.
+	db, err := pebble.Open(path, &pebble.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ps := &pebbleStorage{
+		db:      db,
+		logger:  zap.NewNop(),
+		expires: storage.NewExpiryIndex(),
+	}
+	assert.NoError(t, ps.loadIndex())
+
+	// The expired key is still counted until activeExpire deletes it.
+	assert.Equal(t, int64(5), ps.size)
+	assert.Equal(t, 3, ps.expires.Len())
+
+	now := time.Now().Unix()
+	for _, key := range []string{"volatile", "expire"} {
+		at, ok := ps.expires.Get([]byte(key))
+		assert.True(t, ok, key)
+		assert.InDelta(t, now+59, at, 1, key)
+	}
+	at, ok := ps.expires.Get([]byte("expired"))
+	assert.True(t, ok)
+	assert.LessOrEqual(t, at, now)
+	for _, key := range []string{"persist", "overwritten", "deleted"} {
+		_, ok := ps.expires.Get([]byte(key))
+		assert.False(t, ok, key)
+	}
+
+	assert.Equal(t, []string{"expired"}, ps.expires.PopExpired(now))
+}
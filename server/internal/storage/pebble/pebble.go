@@ -0,0 +1,451 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package pebble implements a storage backed by Pebble, an LSM engine which
+// keeps the values in the SSTables rather than in a separate value log, so
+// there is no value log GC to run.
+//
+// The expiration time is kept in the value envelope. Pebble has no
+// compaction filter to drop expired entries while compacting, so they are
+// deleted by activeExpire instead, using an in-memory expiry index rebuilt
+// when opening the database.
+//
+// The writes are synced to the WAL before they return, as bbolt and badger
+// do by default, so an acknowledged write survives a crash.
+package pebble
+
+import (
+	"bytes"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/dgraph-io/ristretto/z"
+	"github.com/tidwall/match"
+	"go.chensl.me/redix/server/internal/storage"
+	"go.chensl.me/redix/server/pkg/bytesconv"
+	"go.uber.org/zap"
+)
+
+type pebbleStorage struct {
+	db     *pebble.DB
+	closer *z.Closer
+	logger *zap.Logger
+
+	// mu serializes writers. Pebble has no transactions: the commands
+	// which read before writing rely on it, as do size and expires.
+	mu sync.Mutex
+	// size is the number of keys, including expired keys which have not
+	// been deleted by activeExpire yet.
+	size int64
+	// expires holds the expiration time of the volatile keys, as unix
+	// timestamps in seconds like entrypb.Entry.ExpiresAt.
+	expires *storage.ExpiryIndex
+}
+
+func init() {
+	storage.Register("pebble", func(opts storage.Options) (storage.Interface, error) {
+		return NewStorage(filepath.Join(opts.DataDir, "pebble"), opts.Logger)
+	})
+}
+
+func NewStorage(path string, logger *zap.Logger) (storage.Interface, error) {
+	db, err := pebble.Open(path, &pebble.Options{Logger: logger.Sugar()})
+	if err != nil {
+		return nil, err
+	}
+	s := &pebbleStorage{
+		db:      db,
+		closer:  z.NewCloser(1),
+		logger:  logger,
+		expires: storage.NewExpiryIndex(),
+	}
+	if err := s.loadIndex(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	go s.activeExpire()
+	return s, nil
+}
+
+func (s *pebbleStorage) loadIndex() error {
+	it := s.db.NewIter(nil)
+	defer it.Close()
+	for it.First(); it.Valid(); it.Next() {
+		ent, err := decodeEntry(it.Value())
+		if err != nil {
+			return err
+		}
+		s.size++
+		if ent.ExpiresAt > 0 {
+			s.expires.Set(it.Key(), ent.ExpiresAt)
+		}
+	}
+	return it.Error()
+}
+
+func (s *pebbleStorage) Keys(pattern string) ([][]byte, error) {
+	var keys [][]byte
+
+	opts := &pebble.IterOptions{}
+	opts.LowerBound, opts.UpperBound = storage.PrefixRange(pattern)
+	it := s.db.NewIter(opts)
+	defer it.Close()
+	now := time.Now().Unix()
+	for it.First(); it.Valid(); it.Next() {
+		if !match.Match(bytesconv.BytesToString(it.Key()), pattern) {
+			continue
+		}
+		ent, err := decodeEntry(it.Value())
+		if err != nil {
+			return nil, err
+		}
+		if !expired(ent, now) {
+			keys = append(keys, cloneBytes(it.Key()))
+		}
+	}
+
+	return keys, it.Error()
+}
+
+func (s *pebbleStorage) Del(keys ...[]byte) (int, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The batch is indexed so that a key given twice is only counted once.
+	b := s.db.NewIndexedBatch()
+	defer b.Close()
+
+	found := make([]bool, len(keys))
+	var cnt int
+	now := time.Now().Unix()
+	for i, k := range keys {
+		ent, err := getEntry(b, k)
+		if err != nil {
+			return 0, err
+		}
+		if ent == nil {
+			continue
+		}
+		if !expired(ent, now) {
+			cnt++
+		}
+		found[i] = true
+		if err := b.Delete(k, nil); err != nil {
+			return 0, err
+		}
+	}
+	if err := b.Commit(pebble.Sync); err != nil {
+		return 0, err
+	}
+
+	for i, k := range keys {
+		s.untrack(k, found[i])
+	}
+	return cnt, nil
+}
+
+func (s *pebbleStorage) Rename(key, newKey []byte, nx bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().Unix()
+	ent, err := getLiveEntry(s.db, key, now)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(key, newKey) {
+		if nx {
+			return storage.ErrExist
+		}
+		return nil
+	}
+
+	old, err := getEntry(s.db, newKey)
+	if err != nil {
+		return err
+	}
+	if nx && old != nil && !expired(old, now) {
+		return storage.ErrExist
+	}
+
+	b := s.db.NewBatch()
+	defer b.Close()
+	if err := b.Delete(key, nil); err != nil {
+		return err
+	}
+	if err := putEntry(b, newKey, ent); err != nil {
+		return err
+	}
+	if err := b.Commit(pebble.Sync); err != nil {
+		return err
+	}
+
+	s.untrack(key, true)
+	s.track(newKey, old != nil, ent.ExpiresAt)
+	return nil
+}
+
+func (s *pebbleStorage) Copy(src, dst []byte, replace bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().Unix()
+	ent, err := getLiveEntry(s.db, src, now)
+	if err != nil {
+		return err
+	}
+
+	old, err := getEntry(s.db, dst)
+	if err != nil {
+		return err
+	}
+	if !replace && old != nil && !expired(old, now) {
+		return storage.ErrExist
+	}
+	if bytes.Equal(src, dst) {
+		return nil
+	}
+
+	if err := putEntry(s.db, dst, ent); err != nil {
+		return err
+	}
+
+	s.track(dst, old != nil, ent.ExpiresAt)
+	return nil
+}
+
+func (s *pebbleStorage) RandomKey() ([]byte, error) {
+	it := s.db.NewIter(nil)
+	defer it.Close()
+	if !it.First() {
+		return nil, storage.ErrNotExist
+	}
+	first := cloneBytes(it.Key())
+	if !it.Last() {
+		return nil, storage.ErrNotExist
+	}
+	last := cloneBytes(it.Key())
+
+	// Skip forward over expired keys, wrapping around at most once.
+	now := time.Now().Unix()
+	valid := it.SeekGE(storage.RandomSeekKey(first, last))
+	for wrapped := false; ; valid = it.Next() {
+		if !valid {
+			if err := it.Error(); err != nil {
+				return nil, err
+			}
+			if wrapped || !it.First() {
+				return nil, storage.ErrNotExist
+			}
+			wrapped = true
+		}
+		ent, err := decodeEntry(it.Value())
+		if err != nil {
+			return nil, err
+		}
+		if !expired(ent, now) {
+			return cloneBytes(it.Key()), nil
+		}
+	}
+}
+
+func (s *pebbleStorage) DBSize() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.size, nil
+}
+
+func (s *pebbleStorage) ForEach(fn func(key, value []byte, expiresAt time.Time) error) error {
+	snap := s.db.NewSnapshot()
+	defer snap.Close()
+
+	it := snap.NewIter(nil)
+	defer it.Close()
+	now := time.Now().Unix()
+	for it.First(); it.Valid(); it.Next() {
+		ent, err := decodeEntry(it.Value())
+		if err != nil {
+			return err
+		}
+		if expired(ent, now) {
+			continue
+		}
+		var expiresAt time.Time
+		if ent.ExpiresAt > 0 {
+			expiresAt = time.Unix(ent.ExpiresAt, 0)
+		}
+		if err := fn(it.Key(), ent.Value, expiresAt); err != nil {
+			return err
+		}
+	}
+
+	return it.Error()
+}
+
+func (s *pebbleStorage) DropAll() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	it := s.db.NewIter(nil)
+	if !it.First() {
+		return it.Close()
+	}
+	first := cloneBytes(it.Key())
+	it.Last()
+	last := cloneBytes(it.Key())
+	if err := it.Close(); err != nil {
+		return err
+	}
+
+	// The end of a range deletion is exclusive.
+	b := s.db.NewBatch()
+	defer b.Close()
+	if err := b.DeleteRange(first, last, nil); err != nil {
+		return err
+	}
+	if err := b.Delete(last, nil); err != nil {
+		return err
+	}
+	if err := b.Commit(pebble.Sync); err != nil {
+		return err
+	}
+
+	s.size = 0
+	s.expires.Reset()
+	return nil
+}
+
+func (s *pebbleStorage) Expire(key []byte, dur time.Duration) error {
+	if dur <= 0 {
+		return storage.ErrInvalidOpts
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	ent, err := getLiveEntry(s.db, key, now.Unix())
+	if err != nil {
+		return err
+	}
+	ent.ExpiresAt = now.Add(dur).Unix()
+	if err := putEntry(s.db, key, ent); err != nil {
+		return err
+	}
+
+	s.expires.Set(key, ent.ExpiresAt)
+	return nil
+}
+
+func (s *pebbleStorage) TTL(key []byte) (int64, error) {
+	now := time.Now().Unix()
+	ent, err := getLiveEntry(s.db, key, now)
+	if err == storage.ErrNotExist {
+		return -2, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if ent.ExpiresAt == 0 {
+		return -1, nil
+	}
+	return int64(time.Until(time.Unix(ent.ExpiresAt, 0)).Seconds()), nil
+}
+
+func (s *pebbleStorage) Close() error {
+	s.logger.Info("stopping active expire")
+	s.closer.SignalAndWait()
+	return s.db.Close()
+}
+
+// activeExpire deletes the expired keys in the background, the reads
+// already ignore them.
+func (s *pebbleStorage) activeExpire() {
+	defer s.closer.Done()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closer.HasBeenClosed():
+			return
+		case <-ticker.C:
+		}
+		if err := s.deleteExpired(); err != nil {
+			s.logger.Error("failed to delete expired keys", zap.Error(err))
+		}
+	}
+}
+
+func (s *pebbleStorage) deleteExpired() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().Unix()
+	keys := s.expires.PopExpired(now)
+	if len(keys) == 0 {
+		return nil
+	}
+
+	// The deletions aren't synced: the keys found expired again after a
+	// crash are deleted again.
+	b := s.db.NewBatch()
+	defer b.Close()
+	var n int64
+	for _, k := range keys {
+		// The key may have been deleted before it expired.
+		ent, err := getEntry(s.db, []byte(k))
+		if err != nil {
+			return err
+		}
+		if ent == nil || !expired(ent, now) {
+			continue
+		}
+		if err := b.Delete([]byte(k), nil); err != nil {
+			return err
+		}
+		n++
+	}
+	if err := b.Commit(pebble.NoSync); err != nil {
+		return err
+	}
+
+	s.size -= n
+	return nil
+}
+
+// track updates size and expires after key has been written. found reports
+// whether the key was stored before the write, expired or not. s.mu must be
+// held.
+func (s *pebbleStorage) track(key []byte, found bool, expiresAt int64) {
+	if !found {
+		s.size++
+	}
+	if expiresAt > 0 {
+		s.expires.Set(key, expiresAt)
+	} else {
+		s.expires.Remove(key)
+	}
+}
+
+// untrack updates size and expires after key has been deleted. s.mu must be
+// held.
+func (s *pebbleStorage) untrack(key []byte, found bool) {
+	if found {
+		s.size--
+	}
+	s.expires.Remove(key)
+}
+
+func cloneBytes(b []byte) []byte {
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
@@ -0,0 +1,135 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package pebble
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.chensl.me/redix/server/internal/storage"
+	"go.uber.org/zap"
+)
+
+func Test_pebbleStorage_CommonCmd(t *testing.T) {
+	path, err := os.MkdirTemp(os.TempDir(), "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewStorage(path, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		s.Close()
+		os.RemoveAll(path)
+	}()
+
+	ttl, err := s.TTL([]byte("key"))
+	assert.Equal(t, int64(-2), ttl)
+	assert.NoError(t, err)
+
+	err = s.Expire([]byte("key"), -1)
+	assert.ErrorIs(t, err, storage.ErrInvalidOpts)
+
+	n, err := s.DBSize()
+	assert.Equal(t, int64(0), n)
+	assert.NoError(t, err)
+
+	_, err = s.RandomKey()
+	assert.ErrorIs(t, err, storage.ErrNotExist)
+
+	err = s.Rename([]byte("a"), []byte("b"), false)
+	assert.ErrorIs(t, err, storage.ErrNotExist)
+
+	assert.NoError(t, s.Set([]byte("a"), []byte("1"), storage.SetOptions{TTL: time.Minute}))
+	assert.NoError(t, s.Set([]byte("b"), []byte("2"), storage.SetOptions{}))
+
+	err = s.Rename([]byte("a"), []byte("b"), true)
+	assert.ErrorIs(t, err, storage.ErrExist)
+
+	err = s.Rename([]byte("a"), []byte("c"), true)
+	assert.NoError(t, err)
+
+	ttl, err = s.TTL([]byte("c"))
+	assert.Equal(t, int64(59), ttl)
+	assert.NoError(t, err)
+
+	err = s.Copy([]byte("c"), []byte("b"), false)
+	assert.ErrorIs(t, err, storage.ErrExist)
+
+	err = s.Copy([]byte("c"), []byte("b"), true)
+	assert.NoError(t, err)
+
+	v, err := s.Get([]byte("b"))
+	assert.Equal(t, []byte("1"), v)
+	assert.NoError(t, err)
+
+	n, err = s.DBSize()
+	assert.Equal(t, int64(2), n)
+	assert.NoError(t, err)
+
+	k, err := s.RandomKey()
+	assert.Contains(t, []string{"b", "c"}, string(k))
+	assert.NoError(t, err)
+
+	cnt, err := s.Del([]byte("b"), []byte("b"), []byte("x"))
+	assert.Equal(t, 1, cnt)
+	assert.NoError(t, err)
+
+	n, err = s.DBSize()
+	assert.Equal(t, int64(1), n)
+	assert.NoError(t, err)
+}
+
+func Test_pebbleStorage_ActiveExpire(t *testing.T) {
+	path, err := os.MkdirTemp(os.TempDir(), "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	s, err := NewStorage(path, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		key := []byte{'k', byte(i)}
+		assert.NoError(t, s.Set(key, key, storage.SetOptions{TTL: time.Second}))
+	}
+	assert.NoError(t, s.Set([]byte("persist"), []byte("1"), storage.SetOptions{}))
+	assert.NoError(t, s.Close())
+
+	// The expiry index is rebuilt when reopening.
+	s, err = NewStorage(path, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	n, err := s.DBSize()
+	assert.Equal(t, int64(101), n)
+	assert.NoError(t, err)
+
+	// Expired keys are removed without being accessed.
+	time.Sleep(1300 * time.Millisecond)
+	n, err = s.DBSize()
+	assert.Equal(t, int64(1), n)
+	assert.NoError(t, err)
+
+	keys, err := s.Keys("*")
+	assert.Equal(t, [][]byte{[]byte("persist")}, keys)
+	assert.NoError(t, err)
+
+	assert.NoError(t, s.DropAll())
+	n, err = s.DBSize()
+	assert.Equal(t, int64(0), n)
+	assert.NoError(t, err)
+
+	_, err = s.Get([]byte("persist"))
+	assert.ErrorIs(t, err, storage.ErrNotExist)
+}
@@ -0,0 +1,117 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package pebble
+
+import (
+	"time"
+
+	"go.chensl.me/redix/server/internal/storage"
+	"go.chensl.me/redix/server/internal/storage/entrypb"
+)
+
+func (s *pebbleStorage) Set(key, value []byte, opts storage.SetOptions) error {
+	if (opts.NX && opts.XX) || (opts.KeepTTL && opts.TTL > 0) {
+		return storage.ErrInvalidOpts
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	old, err := getEntry(s.db, key)
+	if err != nil {
+		return err
+	}
+	exist := old != nil && !expired(old, now.Unix())
+	if !exist && opts.XX {
+		return storage.ErrNotExist
+	}
+	if exist && opts.NX {
+		return storage.ErrExist
+	}
+
+	ent := &entrypb.Entry{Value: value}
+	if opts.TTL > 0 {
+		ent.ExpiresAt = now.Add(opts.TTL).Unix()
+	} else if opts.KeepTTL && exist {
+		ent.ExpiresAt = old.ExpiresAt
+	}
+	if err := putEntry(s.db, key, ent); err != nil {
+		return err
+	}
+
+	s.track(key, old != nil, ent.ExpiresAt)
+	return nil
+}
+
+func (s *pebbleStorage) Get(key []byte) ([]byte, error) {
+	ent, err := getLiveEntry(s.db, key, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	if ent.Value == nil {
+		return []byte{}, nil
+	}
+	return ent.Value, nil
+}
+
+func (s *pebbleStorage) Add(key []byte, delta int64) (int64, error) {
+	var i int64
+
+	err := s.update(key, func(val []byte) ([]byte, error) {
+		var err error
+		i, err = storage.IncrInt(val, delta)
+		if err != nil {
+			return nil, err
+		}
+		return storage.FormatInt(i), nil
+	})
+
+	return i, err
+}
+
+func (s *pebbleStorage) AddFloat(key []byte, delta float64) (float64, error) {
+	var f float64
+
+	err := s.update(key, func(val []byte) ([]byte, error) {
+		var err error
+		f, err = storage.IncrFloat(val, delta)
+		if err != nil {
+			return nil, err
+		}
+		return storage.FormatFloat(f), nil
+	})
+
+	return f, err
+}
+
+// update replaces the value of key with the result of fn, keeping the
+// original expiration time. fn receives nil if the key does not exist.
+func (s *pebbleStorage) update(key []byte, fn func(val []byte) ([]byte, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, err := getEntry(s.db, key)
+	if err != nil {
+		return err
+	}
+	ent := &entrypb.Entry{}
+	if old != nil && !expired(old, time.Now().Unix()) {
+		ent = old
+		if ent.Value == nil {
+			ent.Value = []byte{}
+		}
+	}
+
+	if ent.Value, err = fn(ent.Value); err != nil {
+		return err
+	}
+	if err := putEntry(s.db, key, ent); err != nil {
+		return err
+	}
+
+	s.track(key, old != nil, ent.ExpiresAt)
+	return nil
+}
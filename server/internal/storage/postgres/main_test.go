@@ -0,0 +1,94 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package postgres
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"go.chensl.me/redix/server/internal/storage"
+	"go.uber.org/zap"
+)
+
+// testDSN is the connection string of the database used by the tests, it's
+// empty if no database is available.
+var testDSN string
+
+// TestMain runs the tests against the database of REDIX_TEST_POSTGRES_DSN
+// or, if unset, against a throwaway cluster started with the initdb and
+// pg_ctl found in PATH. The tests are skipped if neither is available.
+func TestMain(m *testing.M) {
+	testDSN = os.Getenv("REDIX_TEST_POSTGRES_DSN")
+	if testDSN != "" {
+		os.Exit(m.Run())
+	}
+
+	dir, err := os.MkdirTemp(os.TempDir(), "*")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	stop, err := startPostgres(dir)
+	if err == nil {
+		// The server only listens on a unix socket in dir.
+		testDSN = fmt.Sprintf("host=%s user=redix dbname=postgres sslmode=disable", quoteDSN(dir))
+	} else {
+		fmt.Fprintln(os.Stderr, "postgres unavailable, skipping tests:", err)
+	}
+
+	code := m.Run()
+	if stop != nil {
+		stop()
+	}
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// startPostgres initializes a cluster in dir and starts it, the returned
+// function stops it.
+func startPostgres(dir string) (func(), error) {
+	initdb, err := exec.LookPath("initdb")
+	if err != nil {
+		return nil, err
+	}
+	pgCtl, err := exec.LookPath("pg_ctl")
+	if err != nil {
+		return nil, err
+	}
+
+	data := filepath.Join(dir, "data")
+	out, err := exec.Command(initdb, "-D", data, "-U", "redix", "--auth=trust").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("initdb: %w: %s", err, out)
+	}
+	opts := fmt.Sprintf("-k %s -c listen_addresses=''", dir)
+	out, err = exec.Command(pgCtl, "-D", data, "-l", filepath.Join(dir, "log"), "-o", opts, "-w", "start").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("pg_ctl start: %w: %s", err, out)
+	}
+	return func() {
+		_ = exec.Command(pgCtl, "-D", data, "-m", "fast", "-w", "stop").Run()
+	}, nil
+}
+
+// newTestStorage returns an empty storage, or skips the test if there is no
+// database.
+func newTestStorage(t *testing.T) storage.Interface {
+	if testDSN == "" {
+		t.Skip("postgres unavailable")
+	}
+	s, err := newStorage(testDSN, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DropAll(); err != nil {
+		s.Close()
+		t.Fatal(err)
+	}
+	return s
+}
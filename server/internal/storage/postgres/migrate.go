@@ -0,0 +1,53 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+)
+
+//go:embed migrations/*.sql
+var fs embed.FS
+
+// migrationsTable keeps the schema version apart from the default
+// schema_migrations table, which the database may already use for
+// something else.
+const migrationsTable = "redix_schema_migrations"
+
+// autoMigrate applies the pending migrations. The migrations only ever add
+// to the schema, existing data is never dropped.
+func autoMigrate(db *sql.DB) error {
+	s, err := iofs.New(fs, "migrations")
+	if err != nil {
+		return err
+	}
+	// Use a dedicated connection, which is given back to the pool once
+	// done.
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	d, err := postgres.WithConnection(ctx, conn, &postgres.Config{MigrationsTable: migrationsTable})
+	if err != nil {
+		return err
+	}
+	m, err := migrate.NewWithInstance("iofs", s, "postgres", d)
+	if err != nil {
+		return err
+	}
+	err = m.Up()
+	if err == migrate.ErrNoChange {
+		return nil
+	}
+	return err
+}
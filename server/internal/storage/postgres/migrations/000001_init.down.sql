@@ -0,0 +1,4 @@
+-- Keep the data around, the table can be dropped by hand once it's no
+-- longer needed.
+ALTER INDEX entries_expire_at_idx RENAME TO entries_backup_expire_at_idx;
+ALTER TABLE entries RENAME TO entries_backup;
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS entries (
+  _key bytea PRIMARY KEY,
+  _value bytea NOT NULL,
+  _expire_at timestamptz NULL
+);
+
+CREATE INDEX IF NOT EXISTS entries_expire_at_idx ON entries (_expire_at);
@@ -0,0 +1,510 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/ristretto/z"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/tidwall/match"
+	"go.chensl.me/redix/server/internal/storage"
+	"go.uber.org/zap"
+)
+
+// maxTxRetries is the number of times a transaction aborted by a deadlock
+// or a serialization failure is retried.
+const maxTxRetries = 3
+
+// sweepBatch is the maximum number of expired entries deleted by a single
+// statement of the expiry sweep.
+const sweepBatch = 1000
+
+type Config struct {
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	// Host is either a host name or, if it starts with a slash, the
+	// directory of the unix socket.
+	Host     string `mapstructure:"host"`
+	Port     int    `mapstructure:"port"`
+	Database string `mapstructure:"database"`
+	SSLMode  string `mapstructure:"sslmode"`
+}
+
+type postgresStorage struct {
+	db     *sqlx.DB
+	closer *z.Closer
+	logger *zap.Logger
+}
+
+type entry struct {
+	Key      []byte       `db:"_key"`
+	Value    []byte       `db:"_value"`
+	ExpireAt sql.NullTime `db:"_expire_at"`
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return e.ExpireAt.Valid && !now.Before(e.ExpireAt.Time)
+}
+
+// live returns the condition selecting the entries which haven't expired,
+// the current time is the n-th argument of the statement.
+func live(n int) string {
+	return fmt.Sprintf("(_expire_at IS NULL OR _expire_at > $%d)", n)
+}
+
+func init() {
+	storage.Register("postgres", func(opts storage.Options) (storage.Interface, error) {
+		var cfg Config
+		if err := opts.Config.Unmarshal(&cfg); err != nil {
+			return nil, err
+		}
+		return NewStorage(&cfg, opts.Logger)
+	})
+}
+
+func NewStorage(cfg *Config, logger *zap.Logger) (storage.Interface, error) {
+	dsn := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		quoteDSN(cfg.Host), cfg.Port, quoteDSN(cfg.Username), quoteDSN(cfg.Password),
+		quoteDSN(cfg.Database), quoteDSN(cfg.SSLMode))
+	return newStorage(dsn, logger)
+}
+
+func newStorage(dsn string, logger *zap.Logger) (storage.Interface, error) {
+	db, err := sqlx.Connect("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := autoMigrate(db.DB); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	s := &postgresStorage{
+		db:     db,
+		closer: z.NewCloser(1),
+		logger: logger,
+	}
+	go s.sweepExpired()
+	return s, nil
+}
+
+// quoteDSN quotes a value of a key/value connection string.
+func quoteDSN(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `'`, `\'`)
+	return "'" + v + "'"
+}
+
+func (s *postgresStorage) Close() error {
+	s.logger.Info("stopping expiry sweep")
+	s.closer.SignalAndWait()
+	return s.db.Close()
+}
+
+func (s *postgresStorage) Keys(pattern string) ([][]byte, error) {
+	// The pattern is passed as bytes so that it's compared as bytea.
+	rows, err := s.db.Queryx(`
+		SELECT
+			_key
+		FROM
+			entries
+		WHERE
+			_key LIKE $1 AND `+live(2),
+		[]byte(storage.LikePattern(pattern)), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys [][]byte
+	for rows.Next() {
+		var key []byte
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		if match.Match(string(key), pattern) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, rows.Err()
+}
+
+func (s *postgresStorage) Del(keys ...[]byte) (int, error) {
+	rows, err := s.db.Query(`
+		DELETE FROM
+			entries
+		WHERE
+			_key = ANY($1)
+		RETURNING
+			_expire_at
+	`, pq.ByteaArray(keys))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	// Expired entries are deleted too but aren't counted.
+	now := time.Now()
+	var count int
+	for rows.Next() {
+		var e entry
+		if err := rows.Scan(&e.ExpireAt); err != nil {
+			return 0, err
+		}
+		if !e.expired(now) {
+			count++
+		}
+	}
+	return count, rows.Err()
+}
+
+func (s *postgresStorage) Rename(key, newKey []byte, nx bool) error {
+	return s.withTx(func(tx *sqlx.Tx) error {
+		now := time.Now()
+		if string(key) == string(newKey) {
+			if _, err := getLiveEntryForUpdate(tx, key, now); err != nil {
+				return err
+			}
+			if nx {
+				return storage.ErrExist
+			}
+			return nil
+		}
+
+		var e entry
+		err := tx.Get(&e, `
+			DELETE FROM
+				entries
+			WHERE
+				_key = $1
+			RETURNING
+				*
+		`, key)
+		if err == sql.ErrNoRows || (err == nil && e.expired(now)) {
+			return storage.ErrNotExist
+		}
+		if err != nil {
+			return err
+		}
+
+		e.Key = newKey
+		return insertEntryWithTx(tx, &e, !nx, now)
+	})
+}
+
+func (s *postgresStorage) Copy(src, dst []byte, replace bool) error {
+	return s.withTx(func(tx *sqlx.Tx) error {
+		now := time.Now()
+		e, err := getLiveEntryForUpdate(tx, src, now)
+		if err != nil {
+			return err
+		}
+		if string(src) == string(dst) {
+			if !replace {
+				return storage.ErrExist
+			}
+			return nil
+		}
+
+		e.Key = dst
+		return insertEntryWithTx(tx, e, replace, now)
+	})
+}
+
+func (s *postgresStorage) RandomKey() ([]byte, error) {
+	now := time.Now()
+	var bounds struct {
+		Min []byte `db:"min_key"`
+		Max []byte `db:"max_key"`
+	}
+	// There are no MIN and MAX aggregates for bytea.
+	if err := s.db.Get(&bounds, `
+		SELECT
+			(SELECT _key FROM entries ORDER BY _key LIMIT 1) AS min_key,
+			(SELECT _key FROM entries ORDER BY _key DESC LIMIT 1) AS max_key
+	`); err != nil {
+		return nil, err
+	}
+	if bounds.Min == nil {
+		return nil, storage.ErrNotExist
+	}
+
+	// Pick the first live key from a random key, wrapping around.
+	var key []byte
+	err := s.db.Get(&key, `
+		SELECT
+			_key
+		FROM
+			entries
+		WHERE
+			_key >= $1 AND `+live(2)+`
+		ORDER BY
+			_key
+		LIMIT 1
+	`, storage.RandomSeekKey(bounds.Min, bounds.Max), now)
+	if err == sql.ErrNoRows {
+		err = s.db.Get(&key, `
+			SELECT
+				_key
+			FROM
+				entries
+			WHERE
+				`+live(1)+`
+			ORDER BY
+				_key
+			LIMIT 1
+		`, now)
+	}
+	if err == sql.ErrNoRows {
+		return nil, storage.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (s *postgresStorage) DBSize() (int64, error) {
+	var n int64
+	err := s.db.Get(&n, `
+		SELECT
+			COUNT(*)
+		FROM
+			entries
+		WHERE
+			`+live(1),
+		time.Now())
+	return n, err
+}
+
+func (s *postgresStorage) ForEach(fn func(key, value []byte, expiresAt time.Time) error) error {
+	// A repeatable read transaction reads from a single snapshot.
+	tx, err := s.db.BeginTxx(context.Background(), &sql.TxOptions{
+		Isolation: sql.LevelRepeatableRead,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	rows, err := tx.Queryx(`
+		SELECT
+			*
+		FROM
+			entries
+		WHERE
+			`+live(1),
+		time.Now())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e entry
+		if err := rows.StructScan(&e); err != nil {
+			return err
+		}
+		var expiresAt time.Time
+		if e.ExpireAt.Valid {
+			expiresAt = e.ExpireAt.Time
+		}
+		if err := fn(e.Key, e.Value, expiresAt); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *postgresStorage) Expire(key []byte, dur time.Duration) error {
+	if dur <= 0 {
+		return storage.ErrInvalidOpts
+	}
+
+	now := time.Now()
+	res, err := s.db.Exec(`
+		UPDATE
+			entries
+		SET
+			_expire_at = $1
+		WHERE
+			_key = $2 AND `+live(3),
+		now.Add(dur), key, now)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return storage.ErrNotExist
+	}
+	return nil
+}
+
+func (s *postgresStorage) TTL(key []byte) (int64, error) {
+	now := time.Now()
+	var expireAt sql.NullTime
+	err := s.db.Get(&expireAt, `
+		SELECT
+			_expire_at
+		FROM
+			entries
+		WHERE
+			_key = $1 AND `+live(2),
+		key, now)
+	if err == sql.ErrNoRows {
+		return -2, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !expireAt.Valid {
+		return -1, nil
+	}
+	return int64(expireAt.Time.Sub(now).Seconds()), nil
+}
+
+func (s *postgresStorage) DropAll() error {
+	_, err := s.db.Exec(`TRUNCATE TABLE entries`)
+	return err
+}
+
+// sweepExpired deletes expired entries in the background, the reads
+// already ignore them.
+func (s *postgresStorage) sweepExpired() {
+	defer s.closer.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closer.HasBeenClosed():
+			return
+		case <-ticker.C:
+		}
+		for {
+			res, err := s.db.Exec(`
+				DELETE FROM
+					entries
+				WHERE
+					_key IN (
+						SELECT
+							_key
+						FROM
+							entries
+						WHERE
+							_expire_at <= $1
+						LIMIT $2
+					)
+			`, time.Now(), sweepBatch)
+			if err != nil {
+				s.logger.Error("failed to delete expired entries", zap.Error(err))
+				break
+			}
+			if n, _ := res.RowsAffected(); n < sweepBatch {
+				break
+			}
+		}
+	}
+}
+
+// withTx runs fn in a transaction which is committed if fn returns nil.
+// Transactions locking several keys can deadlock: the aborted transaction
+// is retried.
+func (s *postgresStorage) withTx(fn func(tx *sqlx.Tx) error) error {
+	for i := 0; ; i++ {
+		err := s.runTx(fn)
+		var pqErr *pq.Error
+		if i < maxTxRetries && errors.As(err, &pqErr) &&
+			(pqErr.Code == "40P01" || pqErr.Code == "40001") {
+			continue
+		}
+		return err
+	}
+}
+
+func (s *postgresStorage) runTx(fn func(tx *sqlx.Tx) error) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// getEntryForUpdate returns the entry of key, expired or not, and locks it
+// until the end of the transaction.
+func getEntryForUpdate(tx *sqlx.Tx, key []byte) (*entry, error) {
+	var e entry
+	err := tx.Get(&e, `
+		SELECT
+			*
+		FROM
+			entries
+		WHERE
+			_key = $1
+		FOR UPDATE
+	`, key)
+	if err == sql.ErrNoRows {
+		return nil, storage.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func getLiveEntryForUpdate(tx *sqlx.Tx, key []byte, now time.Time) (*entry, error) {
+	e, err := getEntryForUpdate(tx, key)
+	if err != nil {
+		return nil, err
+	}
+	if e.expired(now) {
+		return nil, storage.ErrNotExist
+	}
+	return e, nil
+}
+
+// insertEntryWithTx stores e. An existing entry is only replaced if replace
+// is true or if it has expired, otherwise ErrExist is returned. Unlike a
+// check with SELECT ... FOR UPDATE, this also holds when the key is
+// inserted concurrently, as there is no row to lock beforehand.
+func insertEntryWithTx(tx *sqlx.Tx, e *entry, replace bool, now time.Time) error {
+	res, err := tx.Exec(`
+		INSERT INTO
+			entries (_key, _value, _expire_at)
+		VALUES
+			($1, $2, $3)
+		ON CONFLICT (_key) DO UPDATE SET
+			_value = EXCLUDED._value, _expire_at = EXCLUDED._expire_at
+		WHERE
+			$4::boolean OR entries._expire_at <= $5
+	`, e.Key, e.Value, e.ExpireAt, replace, now)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return storage.ErrExist
+	}
+	return nil
+}
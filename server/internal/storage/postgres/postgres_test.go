@@ -0,0 +1,115 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package postgres
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.chensl.me/redix/server/internal/storage"
+)
+
+func Test_postgresStorage_CommonCmd(t *testing.T) {
+	s := newTestStorage(t)
+	defer s.Close()
+
+	ttl, err := s.TTL([]byte("key"))
+	assert.Equal(t, int64(-2), ttl)
+	assert.NoError(t, err)
+
+	err = s.Expire([]byte("key"), -1)
+	assert.ErrorIs(t, err, storage.ErrInvalidOpts)
+
+	n, err := s.DBSize()
+	assert.Equal(t, int64(0), n)
+	assert.NoError(t, err)
+
+	_, err = s.RandomKey()
+	assert.ErrorIs(t, err, storage.ErrNotExist)
+
+	err = s.Rename([]byte("a"), []byte("b"), false)
+	assert.ErrorIs(t, err, storage.ErrNotExist)
+
+	assert.NoError(t, s.Set([]byte("a"), []byte("1"), storage.SetOptions{TTL: time.Minute}))
+	assert.NoError(t, s.Set([]byte("b"), []byte("2"), storage.SetOptions{}))
+
+	err = s.Rename([]byte("a"), []byte("b"), true)
+	assert.ErrorIs(t, err, storage.ErrExist)
+
+	err = s.Rename([]byte("a"), []byte("c"), true)
+	assert.NoError(t, err)
+
+	ttl, err = s.TTL([]byte("c"))
+	assert.Equal(t, int64(59), ttl)
+	assert.NoError(t, err)
+
+	err = s.Copy([]byte("c"), []byte("b"), false)
+	assert.ErrorIs(t, err, storage.ErrExist)
+
+	err = s.Copy([]byte("c"), []byte("b"), true)
+	assert.NoError(t, err)
+
+	v, err := s.Get([]byte("b"))
+	assert.Equal(t, []byte("1"), v)
+	assert.NoError(t, err)
+
+	n, err = s.DBSize()
+	assert.Equal(t, int64(2), n)
+	assert.NoError(t, err)
+
+	k, err := s.RandomKey()
+	assert.Contains(t, []string{"b", "c"}, string(k))
+	assert.NoError(t, err)
+
+	cnt, err := s.Del([]byte("b"), []byte("b"), []byte("x"))
+	assert.Equal(t, 1, cnt)
+	assert.NoError(t, err)
+
+	n, err = s.DBSize()
+	assert.Equal(t, int64(1), n)
+	assert.NoError(t, err)
+}
+
+func Test_postgresStorage_KeysForEach(t *testing.T) {
+	s := newTestStorage(t)
+	defer s.Close()
+
+	for _, k := range []string{"a%b", "axb", "a_c", "abc", "\\xff"} {
+		assert.NoError(t, s.Set([]byte(k), []byte(k), storage.SetOptions{}))
+	}
+	assert.NoError(t, s.Set([]byte("aexp"), []byte("1"), storage.SetOptions{TTL: time.Millisecond}))
+	time.Sleep(10 * time.Millisecond)
+
+	// LIKE wildcards in the keys are matched literally.
+	keys, err := s.Keys("a%*")
+	assert.Equal(t, [][]byte{[]byte("a%b")}, keys)
+	assert.NoError(t, err)
+
+	keys, err = s.Keys("a_?")
+	assert.Equal(t, [][]byte{[]byte("a_c")}, keys)
+	assert.NoError(t, err)
+
+	keys, err = s.Keys("a[bx]?")
+	assert.ElementsMatch(t, [][]byte{[]byte("axb"), []byte("abc")}, keys)
+	assert.NoError(t, err)
+
+	keys, err = s.Keys("\\\\*")
+	assert.Equal(t, [][]byte{[]byte("\\xff")}, keys)
+	assert.NoError(t, err)
+
+	assert.NoError(t, s.Expire([]byte("abc"), time.Minute))
+	var got []string
+	err = s.ForEach(func(key, value []byte, expiresAt time.Time) error {
+		assert.Equal(t, key, value)
+		assert.Equal(t, string(key) == "abc", !expiresAt.IsZero())
+		got = append(got, string(key))
+		return nil
+	})
+	sort.Strings(got)
+	assert.Equal(t, []string{"\\xff", "a%b", "a_c", "abc", "axb"}, got)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,161 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package postgres
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"go.chensl.me/redix/server/internal/storage"
+)
+
+func (s *postgresStorage) Set(key []byte, value []byte, opts storage.SetOptions) error {
+	if (opts.NX && opts.XX) || (opts.KeepTTL && opts.TTL > 0) {
+		return storage.ErrInvalidOpts
+	}
+
+	now := time.Now()
+	var expireAt sql.NullTime
+	if opts.TTL > 0 {
+		expireAt.Valid = true
+		expireAt.Time = now.Add(opts.TTL)
+	}
+
+	// Each variant is a single statement, the conflict on the primary key
+	// takes care of the concurrent inserts.
+	var (
+		res sql.Result
+		err error
+	)
+	if opts.XX {
+		res, err = s.db.Exec(`
+			UPDATE
+				entries
+			SET
+				_value = $2,
+				_expire_at = CASE WHEN $4::boolean THEN _expire_at ELSE $3::timestamptz END
+			WHERE
+				_key = $1 AND `+live(5),
+			key, value, expireAt, opts.KeepTTL, now)
+	} else {
+		// An existing entry is only kept by NX if it hasn't expired.
+		res, err = s.db.Exec(`
+			INSERT INTO
+				entries (_key, _value, _expire_at)
+			VALUES
+				($1, $2, $3)
+			ON CONFLICT (_key) DO UPDATE SET
+				_value = EXCLUDED._value,
+				_expire_at = CASE
+					WHEN $4::boolean AND (entries._expire_at IS NULL OR entries._expire_at > $5)
+					THEN entries._expire_at
+					ELSE EXCLUDED._expire_at
+				END
+			WHERE
+				NOT $6::boolean OR entries._expire_at <= $5
+		`, key, value, expireAt, opts.KeepTTL, now, opts.NX)
+	}
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 && opts.XX {
+		return storage.ErrNotExist
+	} else if n == 0 {
+		return storage.ErrExist
+	}
+	return nil
+}
+
+func (s *postgresStorage) Get(key []byte) ([]byte, error) {
+	var value []byte
+	err := s.db.Get(&value, `
+		SELECT
+			_value
+		FROM
+			entries
+		WHERE
+			_key = $1 AND `+live(2),
+		key, time.Now())
+	if err == sql.ErrNoRows {
+		return nil, storage.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	return value, nil
+}
+
+func (s *postgresStorage) Add(key []byte, delta int64) (int64, error) {
+	var i int64
+
+	err := s.update(key, func(val []byte) ([]byte, error) {
+		var err error
+		i, err = storage.IncrInt(val, delta)
+		if err != nil {
+			return nil, err
+		}
+		return storage.FormatInt(i), nil
+	})
+
+	return i, err
+}
+
+func (s *postgresStorage) AddFloat(key []byte, delta float64) (float64, error) {
+	var f float64
+
+	err := s.update(key, func(val []byte) ([]byte, error) {
+		var err error
+		f, err = storage.IncrFloat(val, delta)
+		if err != nil {
+			return nil, err
+		}
+		return storage.FormatFloat(f), nil
+	})
+
+	return f, err
+}
+
+// update replaces the value of key with the result of fn, keeping the
+// original expiration time. fn receives nil if the key does not exist. The
+// row is locked with SELECT ... FOR UPDATE so that concurrent updates are
+// serialized. A missing key can't be locked: if it's inserted concurrently,
+// the insert fails and the update starts over with the new row.
+func (s *postgresStorage) update(key []byte, fn func(val []byte) ([]byte, error)) error {
+	return s.withTx(func(tx *sqlx.Tx) error {
+		for {
+			now := time.Now()
+			e, err := getEntryForUpdate(tx, key)
+			// An existing row, expired or not, is locked and can be replaced.
+			locked := err == nil
+			if err == storage.ErrNotExist {
+				e, err = &entry{Key: key}, nil
+			} else if err == nil && e.expired(now) {
+				e = &entry{Key: key}
+			} else if err == nil && e.Value == nil {
+				e.Value = []byte{}
+			}
+			if err != nil {
+				return err
+			}
+
+			if e.Value, err = fn(e.Value); err != nil {
+				return err
+			}
+			err = insertEntryWithTx(tx, e, locked, now)
+			if err == storage.ErrExist {
+				continue
+			}
+			return err
+		}
+	})
+}
@@ -0,0 +1,104 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package postgres
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.chensl.me/redix/server/internal/storage"
+)
+
+func Test_postgresStorage_ConcurrentUpdate(t *testing.T) {
+	s := newTestStorage(t)
+	defer s.Close()
+
+	const n = 16
+
+	// All the updates find the key missing, only one of the inserts can
+	// succeed and the others must start over with the inserted row.
+	for _, key := range [][]byte{[]byte("int"), []byte("float")} {
+		var wg sync.WaitGroup
+		wg.Add(n)
+		for i := 0; i < n; i++ {
+			go func(key []byte) {
+				defer wg.Done()
+				var err error
+				if string(key) == "int" {
+					_, err = s.Add(key, 1)
+				} else {
+					_, err = s.AddFloat(key, 0.5)
+				}
+				assert.NoError(t, err)
+			}(key)
+		}
+		wg.Wait()
+	}
+
+	v, err := s.Get([]byte("int"))
+	assert.Equal(t, []byte("16"), v)
+	assert.NoError(t, err)
+
+	v, err = s.Get([]byte("float"))
+	assert.Equal(t, []byte("8"), v)
+	assert.NoError(t, err)
+
+	// An expired row is replaced rather than updated.
+	assert.NoError(t, s.Set([]byte("int"), []byte("x"), storage.SetOptions{TTL: time.Millisecond}))
+	time.Sleep(10 * time.Millisecond)
+	i, err := s.Add([]byte("int"), 2)
+	assert.Equal(t, int64(2), i)
+	assert.NoError(t, err)
+
+	ttl, err := s.TTL([]byte("int"))
+	assert.Equal(t, int64(-1), ttl)
+	assert.NoError(t, err)
+}
+
+func Test_postgresStorage_SetOptions(t *testing.T) {
+	s := newTestStorage(t)
+	defer s.Close()
+
+	key := []byte("key")
+
+	// NX replaces an expired entry.
+	assert.NoError(t, s.Set(key, []byte("1"), storage.SetOptions{TTL: time.Millisecond}))
+	time.Sleep(10 * time.Millisecond)
+	err := s.Set(key, []byte("2"), storage.SetOptions{XX: true})
+	assert.ErrorIs(t, err, storage.ErrNotExist)
+	assert.NoError(t, s.Set(key, []byte("2"), storage.SetOptions{NX: true, TTL: time.Minute}))
+
+	err = s.Set(key, []byte("3"), storage.SetOptions{KeepTTL: true, TTL: time.Minute})
+	assert.ErrorIs(t, err, storage.ErrInvalidOpts)
+
+	assert.NoError(t, s.Set(key, []byte("3"), storage.SetOptions{XX: true, KeepTTL: true}))
+	ttl, err := s.TTL(key)
+	assert.Equal(t, int64(59), ttl)
+	assert.NoError(t, err)
+
+	assert.NoError(t, s.Set(key, []byte("4"), storage.SetOptions{KeepTTL: true}))
+	ttl, err = s.TTL(key)
+	assert.Equal(t, int64(59), ttl)
+	assert.NoError(t, err)
+
+	assert.NoError(t, s.Set(key, []byte("5"), storage.SetOptions{XX: true}))
+	ttl, err = s.TTL(key)
+	assert.Equal(t, int64(-1), ttl)
+	assert.NoError(t, err)
+
+	v, err := s.Get(key)
+	assert.Equal(t, []byte("5"), v)
+	assert.NoError(t, err)
+
+	// KEEPTTL doesn't keep the expiration time of an expired entry.
+	assert.NoError(t, s.Expire(key, time.Millisecond))
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, s.Set(key, []byte("6"), storage.SetOptions{KeepTTL: true}))
+	ttl, err = s.TTL(key)
+	assert.Equal(t, int64(-1), ttl)
+	assert.NoError(t, err)
+}
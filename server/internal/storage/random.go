@@ -0,0 +1,34 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import "math/rand"
+
+// RandomSeekKey returns a random key k with first <= k <= last. Drivers
+// backed by ordered engines seek to it to pick an approximately random key
+// without scanning the whole key space.
+func RandomSeekKey(first, last []byte) []byte {
+	p := 0
+	for p < len(first) && p < len(last) && first[p] == last[p] {
+		p++
+	}
+	if p == len(last) {
+		return append([]byte(nil), last...)
+	}
+
+	lo := 0
+	if p < len(first) {
+		lo = int(first[p])
+	}
+	hi := int(last[p])
+
+	k := make([]byte, p, p+5)
+	copy(k, last[:p])
+	k = append(k, byte(lo+rand.Intn(hi-lo+1)))
+	for i := 0; i < 4; i++ {
+		k = append(k, byte(rand.Intn(256)))
+	}
+	return k
+}
@@ -0,0 +1,78 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// Options are passed to a Factory when opening a driver.
+type Options struct {
+	// DataDir is the data directory of the server, drivers which store
+	// files keep them in it.
+	DataDir string
+	// Config is the configuration sub-tree of the driver, e.g. the mysql
+	// section for the mysql driver, which drivers usually Unmarshal into
+	// their own Config. It is never nil.
+	Config *viper.Viper
+	Logger *zap.Logger
+}
+
+// Factory opens a storage with the given options.
+type Factory func(opts Options) (Interface, error)
+
+var (
+	driversMu sync.RWMutex
+	drivers   = make(map[string]Factory)
+)
+
+// Register makes a driver available by the provided name. Drivers usually
+// register themselves in an init function. If Register is called twice
+// with the same name or if factory is nil, it panics.
+func Register(name string, factory Factory) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	if factory == nil {
+		panic("storage: Register factory is nil")
+	}
+	if _, dup := drivers[name]; dup {
+		panic("storage: Register called twice for driver " + name)
+	}
+	drivers[name] = factory
+}
+
+// Open opens the storage of the driver registered by the provided name.
+func Open(name string, opts Options) (Interface, error) {
+	driversMu.RLock()
+	factory, ok := drivers[name]
+	driversMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("storage: unknown driver %q (forgotten import?)", name)
+	}
+	if opts.Config == nil {
+		opts.Config = viper.New()
+	}
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+	return factory(opts)
+}
+
+// Drivers returns a sorted list of the names of the registered drivers.
+func Drivers() []string {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+	list := make([]string, 0, len(drivers))
+	for name := range drivers {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
@@ -0,0 +1,39 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	errOpened := errors.New("opened")
+	var got Options
+	Register("registry-test", func(opts Options) (Interface, error) {
+		got = opts
+		return nil, errOpened
+	})
+	t.Cleanup(func() {
+		driversMu.Lock()
+		delete(drivers, "registry-test")
+		driversMu.Unlock()
+	})
+
+	assert.Contains(t, Drivers(), "registry-test")
+	assert.Panics(t, func() { Register("registry-test", func(Options) (Interface, error) { return nil, nil }) })
+	assert.Panics(t, func() { Register("registry-nil", nil) })
+
+	_, err := Open("registry-test", Options{DataDir: "data"})
+	assert.Equal(t, errOpened, err)
+	assert.Equal(t, "data", got.DataDir)
+	assert.NotNil(t, got.Config)
+	assert.NotNil(t, got.Logger)
+
+	_, err = Open("registry-unknown", Options{})
+	assert.EqualError(t, err, `storage: unknown driver "registry-unknown" (forgotten import?)`)
+}
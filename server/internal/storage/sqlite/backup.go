@@ -0,0 +1,32 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package sqlite
+
+import (
+	"context"
+	"path/filepath"
+)
+
+// Backup writes a compacted copy of the database to dir/redix.sqlite. It
+// reads from a snapshot on a reader connection, so the writer isn't
+// blocked.
+func (s *sqliteStorage) Backup(dir string) error {
+	ctx := context.Background()
+	conn, err := s.rdb.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// query_only also forbids writing the target of VACUUM INTO.
+	if _, err := conn.ExecContext(ctx, `PRAGMA query_only(0)`); err != nil {
+		return err
+	}
+	_, err = conn.ExecContext(ctx, `VACUUM INTO ?`, filepath.Join(dir, "redix.sqlite"))
+	if _, rerr := conn.ExecContext(ctx, `PRAGMA query_only(1)`); err == nil {
+		err = rerr
+	}
+	return err
+}
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS entries (
+  _key BLOB PRIMARY KEY,
+  _value BLOB NOT NULL,
+  -- Unix time in nanoseconds, NULL means no expire.
+  _expire_at INTEGER NULL
+) WITHOUT ROWID;
+
+CREATE INDEX IF NOT EXISTS entries_expire_at_idx ON entries (_expire_at);
@@ -0,0 +1,464 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package sqlite
+
+import (
+	"database/sql"
+	_ "embed"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dgraph-io/ristretto/z"
+	_ "github.com/glebarez/go-sqlite"
+	"github.com/tidwall/match"
+	"go.chensl.me/redix/server/internal/storage"
+	"go.uber.org/zap"
+)
+
+// schema is applied on every start, it only creates what's missing.
+//
+//go:embed schema.sql
+var schema string
+
+// live is the condition selecting the entries which haven't expired, it
+// takes the current unix time in nanoseconds as argument.
+const live = "(_expire_at IS NULL OR _expire_at > ?)"
+
+// sweepBatch is the maximum number of expired entries deleted by a single
+// statement of the active expiry.
+const sweepBatch = 1000
+
+type sqliteStorage struct {
+	// db has a single connection used for the writes. SQLite only allows
+	// one writer at a time anyway, serializing the transactions here
+	// rather than in SQLite avoids SQLITE_BUSY errors.
+	db *sql.DB
+	// rdb is a pool of read-only connections. In WAL mode they read from
+	// a snapshot without blocking the writer.
+	rdb *sql.DB
+
+	// Read statements, prepared on rdb.
+	getStmt         *sql.Stmt
+	ttlStmt         *sql.Stmt
+	keysStmt        *sql.Stmt
+	countStmt       *sql.Stmt
+	boundsStmt      *sql.Stmt
+	randomFromStmt  *sql.Stmt
+	randomFirstStmt *sql.Stmt
+	forEachStmt     *sql.Stmt
+	// Write statements, prepared on db.
+	getEntryStmt *sql.Stmt
+	upsertStmt   *sql.Stmt
+	delStmt      *sql.Stmt
+	expireStmt   *sql.Stmt
+	sweepStmt    *sql.Stmt
+	prepared     []*sql.Stmt
+
+	closer *z.Closer
+	logger *zap.Logger
+}
+
+type entry struct {
+	value    []byte
+	expireAt sql.NullInt64
+}
+
+func (e *entry) expired(now int64) bool {
+	return e.expireAt.Valid && now >= e.expireAt.Int64
+}
+
+func init() {
+	storage.Register("sqlite", func(opts storage.Options) (storage.Interface, error) {
+		return NewStorage(filepath.Join(opts.DataDir, "redix.sqlite"), opts.Logger)
+	})
+}
+
+// NewStorage opens the database file at path, creating it if needed.
+func NewStorage(path string, logger *zap.Logger) (storage.Interface, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	q := url.Values{}
+	q.Add("_pragma", "busy_timeout(5000)")
+	q.Add("_pragma", "journal_mode(WAL)")
+	q.Add("_pragma", "synchronous(NORMAL)")
+	// Take the write lock when the transaction begins rather than when it
+	// first writes, a read-modify-write could fail half way otherwise.
+	q.Set("_txlock", "immediate")
+	db, err := sql.Open("sqlite", path+"?"+q.Encode())
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	q.Del("_txlock")
+	q.Add("_pragma", "query_only(1)")
+	rdb, err := sql.Open("sqlite", path+"?"+q.Encode())
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	s := &sqliteStorage{
+		db:     db,
+		rdb:    rdb,
+		closer: z.NewCloser(1),
+		logger: logger,
+	}
+	if err := s.prepare(); err != nil {
+		_ = s.closeDB()
+		return nil, err
+	}
+	go s.activeExpire()
+	return s, nil
+}
+
+func (s *sqliteStorage) prepare() error {
+	for _, p := range []struct {
+		stmt  **sql.Stmt
+		db    *sql.DB
+		query string
+	}{
+		{&s.getStmt, s.rdb, `SELECT _value FROM entries WHERE _key = ? AND ` + live},
+		{&s.ttlStmt, s.rdb, `SELECT _expire_at FROM entries WHERE _key = ? AND ` + live},
+		{&s.keysStmt, s.rdb, `
+			SELECT _key FROM entries
+			WHERE _key >= ? AND (? IS NULL OR _key < ?) AND ` + live},
+		{&s.countStmt, s.rdb, `SELECT COUNT(*) FROM entries WHERE ` + live},
+		{&s.boundsStmt, s.rdb, `SELECT MIN(_key), MAX(_key) FROM entries`},
+		{&s.randomFromStmt, s.rdb, `
+			SELECT _key FROM entries
+			WHERE _key >= ? AND ` + live + `
+			ORDER BY _key LIMIT 1`},
+		{&s.randomFirstStmt, s.rdb, `
+			SELECT _key FROM entries
+			WHERE ` + live + `
+			ORDER BY _key LIMIT 1`},
+		{&s.forEachStmt, s.rdb, `SELECT _key, _value, _expire_at FROM entries WHERE ` + live},
+		{&s.getEntryStmt, s.db, `SELECT _value, _expire_at FROM entries WHERE _key = ?`},
+		{&s.upsertStmt, s.db, `
+			INSERT INTO entries (_key, _value, _expire_at) VALUES (?, ?, ?)
+			ON CONFLICT (_key) DO UPDATE SET
+				_value = excluded._value, _expire_at = excluded._expire_at`},
+		{&s.delStmt, s.db, `DELETE FROM entries WHERE _key = ? RETURNING _expire_at`},
+		{&s.expireStmt, s.db, `UPDATE entries SET _expire_at = ? WHERE _key = ? AND ` + live},
+		{&s.sweepStmt, s.db, `
+			DELETE FROM entries WHERE _key IN (
+				SELECT _key FROM entries WHERE _expire_at <= ? LIMIT ?
+			)`},
+	} {
+		stmt, err := p.db.Prepare(p.query)
+		if err != nil {
+			return err
+		}
+		*p.stmt = stmt
+		s.prepared = append(s.prepared, stmt)
+	}
+	return nil
+}
+
+func (s *sqliteStorage) Close() error {
+	s.logger.Info("stopping active expire")
+	s.closer.SignalAndWait()
+	return s.closeDB()
+}
+
+func (s *sqliteStorage) closeDB() error {
+	for _, stmt := range s.prepared {
+		_ = stmt.Close()
+	}
+	rerr := s.rdb.Close()
+	if err := s.db.Close(); err != nil {
+		return err
+	}
+	return rerr
+}
+
+func (s *sqliteStorage) Keys(pattern string) ([][]byte, error) {
+	// Only scan the keys starting with the literal prefix of the pattern,
+	// the blobs are sorted bytewise.
+	from, to := storage.PrefixRange(pattern)
+	var upper interface{}
+	if to != nil {
+		upper = to
+	}
+	rows, err := s.keysStmt.Query(from, upper, upper, time.Now().UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys [][]byte
+	for rows.Next() {
+		var key []byte
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		if match.Match(string(key), pattern) {
+			keys = append(keys, blob(key))
+		}
+	}
+	return keys, rows.Err()
+}
+
+func (s *sqliteStorage) Del(keys ...[]byte) (int, error) {
+	var count int
+
+	err := s.withTx(func(tx *sql.Tx) error {
+		now := time.Now().UnixNano()
+		del := tx.Stmt(s.delStmt)
+		for _, key := range keys {
+			// Expired entries are deleted too but aren't counted.
+			var e entry
+			err := del.QueryRow(blob(key)).Scan(&e.expireAt)
+			if err == sql.ErrNoRows {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if !e.expired(now) {
+				count++
+			}
+		}
+		return nil
+	})
+
+	return count, err
+}
+
+func (s *sqliteStorage) Rename(key, newKey []byte, nx bool) error {
+	return s.withTx(func(tx *sql.Tx) error {
+		now := time.Now().UnixNano()
+		e, err := s.getLiveEntry(tx, key, now)
+		if err != nil {
+			return err
+		}
+		if string(key) == string(newKey) {
+			if nx {
+				return storage.ErrExist
+			}
+			return nil
+		}
+		_, err = s.getLiveEntry(tx, newKey, now)
+		if err == nil && nx {
+			return storage.ErrExist
+		}
+		if err != nil && err != storage.ErrNotExist {
+			return err
+		}
+
+		if _, err := tx.Stmt(s.delStmt).Exec(blob(key)); err != nil {
+			return err
+		}
+		return s.upsert(tx, newKey, e)
+	})
+}
+
+func (s *sqliteStorage) Copy(src, dst []byte, replace bool) error {
+	return s.withTx(func(tx *sql.Tx) error {
+		now := time.Now().UnixNano()
+		e, err := s.getLiveEntry(tx, src, now)
+		if err != nil {
+			return err
+		}
+		_, err = s.getLiveEntry(tx, dst, now)
+		if err == nil && !replace {
+			return storage.ErrExist
+		}
+		if err != nil && err != storage.ErrNotExist {
+			return err
+		}
+		if string(src) == string(dst) {
+			return nil
+		}
+
+		return s.upsert(tx, dst, e)
+	})
+}
+
+func (s *sqliteStorage) RandomKey() ([]byte, error) {
+	var first, last []byte
+	// An empty table is handled below like a table without live keys.
+	if err := s.boundsStmt.QueryRow().Scan(&first, &last); err != nil {
+		return nil, err
+	}
+
+	// Pick the first live key from a random key, wrapping around.
+	now := time.Now().UnixNano()
+	var key []byte
+	err := s.randomFromStmt.QueryRow(storage.RandomSeekKey(blob(first), blob(last)), now).Scan(&key)
+	if err == sql.ErrNoRows {
+		err = s.randomFirstStmt.QueryRow(now).Scan(&key)
+	}
+	if err == sql.ErrNoRows {
+		return nil, storage.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return blob(key), nil
+}
+
+func (s *sqliteStorage) DBSize() (int64, error) {
+	var n int64
+	err := s.countStmt.QueryRow(time.Now().UnixNano()).Scan(&n)
+	return n, err
+}
+
+func (s *sqliteStorage) ForEach(fn func(key, value []byte, expiresAt time.Time) error) error {
+	// The transaction reads from a single snapshot.
+	tx, err := s.rdb.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	rows, err := tx.Stmt(s.forEachStmt).Query(time.Now().UnixNano())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			key []byte
+			e   entry
+		)
+		if err := rows.Scan(&key, &e.value, &e.expireAt); err != nil {
+			return err
+		}
+		var expiresAt time.Time
+		if e.expireAt.Valid {
+			expiresAt = time.Unix(0, e.expireAt.Int64)
+		}
+		if err := fn(blob(key), blob(e.value), expiresAt); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *sqliteStorage) Expire(key []byte, dur time.Duration) error {
+	if dur <= 0 {
+		return storage.ErrInvalidOpts
+	}
+
+	return s.withTx(func(tx *sql.Tx) error {
+		now := time.Now()
+		res, err := tx.Stmt(s.expireStmt).Exec(now.Add(dur).UnixNano(), blob(key), now.UnixNano())
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return storage.ErrNotExist
+		}
+		return nil
+	})
+}
+
+func (s *sqliteStorage) TTL(key []byte) (int64, error) {
+	now := time.Now().UnixNano()
+	var expireAt sql.NullInt64
+	err := s.ttlStmt.QueryRow(blob(key), now).Scan(&expireAt)
+	if err == sql.ErrNoRows {
+		return -2, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !expireAt.Valid {
+		return -1, nil
+	}
+	return int64(time.Duration(expireAt.Int64 - now).Seconds()), nil
+}
+
+func (s *sqliteStorage) DropAll() error {
+	return s.withTx(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`DELETE FROM entries`)
+		return err
+	})
+}
+
+// activeExpire deletes expired entries in the background using the index
+// on the expiration time, the reads already ignore them.
+func (s *sqliteStorage) activeExpire() {
+	defer s.closer.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closer.HasBeenClosed():
+			return
+		case <-ticker.C:
+		}
+		for {
+			res, err := s.sweepStmt.Exec(time.Now().UnixNano(), sweepBatch)
+			if err != nil {
+				s.logger.Error("failed to delete expired entries", zap.Error(err))
+				break
+			}
+			if n, _ := res.RowsAffected(); n < sweepBatch {
+				break
+			}
+		}
+	}
+}
+
+// withTx runs fn in a write transaction which is committed if fn returns
+// nil. fn must only use tx, the connection of db is held until it returns.
+func (s *sqliteStorage) withTx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStorage) getLiveEntry(tx *sql.Tx, key []byte, now int64) (*entry, error) {
+	var e entry
+	err := tx.Stmt(s.getEntryStmt).QueryRow(blob(key)).Scan(&e.value, &e.expireAt)
+	if err == sql.ErrNoRows {
+		return nil, storage.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	if e.expired(now) {
+		return nil, storage.ErrNotExist
+	}
+	e.value = blob(e.value)
+	return &e, nil
+}
+
+func (s *sqliteStorage) upsert(tx *sql.Tx, key []byte, e *entry) error {
+	_, err := tx.Stmt(s.upsertStmt).Exec(blob(key), blob(e.value), e.expireAt)
+	return err
+}
+
+// blob returns b as a non-nil slice. The driver binds nil as NULL and scans
+// an empty blob as nil, but keys and values are never NULL.
+func blob(b []byte) []byte {
+	if b == nil {
+		return []byte{}
+	}
+	return b
+}
@@ -0,0 +1,183 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package sqlite
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.chensl.me/redix/server/internal/storage"
+	"go.uber.org/zap"
+)
+
+func Test_sqliteStorage_CommonCmd(t *testing.T) {
+	path, err := os.MkdirTemp(os.TempDir(), "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewStorage(filepath.Join(path, "redix.sqlite"), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		s.Close()
+		os.RemoveAll(path)
+	}()
+
+	ttl, err := s.TTL([]byte("key"))
+	assert.Equal(t, int64(-2), ttl)
+	assert.NoError(t, err)
+
+	err = s.Expire([]byte("key"), -1)
+	assert.ErrorIs(t, err, storage.ErrInvalidOpts)
+
+	n, err := s.DBSize()
+	assert.Equal(t, int64(0), n)
+	assert.NoError(t, err)
+
+	_, err = s.RandomKey()
+	assert.ErrorIs(t, err, storage.ErrNotExist)
+
+	err = s.Rename([]byte("a"), []byte("b"), false)
+	assert.ErrorIs(t, err, storage.ErrNotExist)
+
+	assert.NoError(t, s.Set([]byte("a"), []byte("1"), storage.SetOptions{TTL: time.Minute}))
+	assert.NoError(t, s.Set([]byte("b"), []byte("2"), storage.SetOptions{}))
+
+	err = s.Rename([]byte("a"), []byte("b"), true)
+	assert.ErrorIs(t, err, storage.ErrExist)
+
+	err = s.Rename([]byte("a"), []byte("c"), true)
+	assert.NoError(t, err)
+
+	ttl, err = s.TTL([]byte("c"))
+	assert.Equal(t, int64(59), ttl)
+	assert.NoError(t, err)
+
+	err = s.Copy([]byte("c"), []byte("b"), false)
+	assert.ErrorIs(t, err, storage.ErrExist)
+
+	err = s.Copy([]byte("c"), []byte("b"), true)
+	assert.NoError(t, err)
+
+	v, err := s.Get([]byte("b"))
+	assert.Equal(t, []byte("1"), v)
+	assert.NoError(t, err)
+
+	n, err = s.DBSize()
+	assert.Equal(t, int64(2), n)
+	assert.NoError(t, err)
+
+	k, err := s.RandomKey()
+	assert.Contains(t, []string{"b", "c"}, string(k))
+	assert.NoError(t, err)
+
+	cnt, err := s.Del([]byte("b"), []byte("b"), []byte("x"))
+	assert.Equal(t, 1, cnt)
+	assert.NoError(t, err)
+
+	n, err = s.DBSize()
+	assert.Equal(t, int64(1), n)
+	assert.NoError(t, err)
+}
+
+func Test_sqliteStorage_ActiveExpire(t *testing.T) {
+	path, err := os.MkdirTemp(os.TempDir(), "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewStorage(filepath.Join(path, "redix.sqlite"), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		s.Close()
+		os.RemoveAll(path)
+	}()
+
+	for i := 0; i < 100; i++ {
+		key := []byte{'k', byte(i)}
+		assert.NoError(t, s.Set(key, key, storage.SetOptions{TTL: 500 * time.Millisecond}))
+	}
+	assert.NoError(t, s.Set([]byte("persist"), []byte("1"), storage.SetOptions{}))
+
+	// Expired keys are removed from the table without being accessed.
+	rows := func() (n int64) {
+		err := s.(*sqliteStorage).rdb.QueryRow(`SELECT COUNT(*) FROM entries`).Scan(&n)
+		assert.NoError(t, err)
+		return n
+	}
+	assert.Equal(t, int64(101), rows())
+	time.Sleep(2 * time.Second)
+	assert.Equal(t, int64(1), rows())
+
+	var keys []string
+	err = s.ForEach(func(key, value []byte, expiresAt time.Time) error {
+		keys = append(keys, string(key))
+		assert.True(t, expiresAt.IsZero())
+		return nil
+	})
+	assert.Equal(t, []string{"persist"}, keys)
+	assert.NoError(t, err)
+}
+
+func Test_sqliteStorage_Keys(t *testing.T) {
+	path, err := os.MkdirTemp(os.TempDir(), "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewStorage(filepath.Join(path, "redix.sqlite"), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		s.Close()
+		os.RemoveAll(path)
+	}()
+
+	for _, k := range []string{"", "a*b", "ab", "abc", "b", "a\xff", "a\xff\xff", "\xff", "\xff\x00", "\xff\xff"} {
+		assert.NoError(t, s.Set([]byte(k), []byte(k), storage.SetOptions{}))
+	}
+
+	keys, err := s.Keys("a\\**")
+	assert.Equal(t, [][]byte{[]byte("a*b")}, keys)
+	assert.NoError(t, err)
+
+	keys, err = s.Keys("ab*")
+	assert.ElementsMatch(t, [][]byte{[]byte("ab"), []byte("abc")}, keys)
+	assert.NoError(t, err)
+
+	keys, err = s.Keys("a\xff*")
+	assert.ElementsMatch(t, [][]byte{[]byte("a\xff"), []byte("a\xff\xff")}, keys)
+	assert.NoError(t, err)
+
+	// The prefix can't be incremented: the range has no upper bound.
+	keys, err = s.Keys("\xff*")
+	assert.ElementsMatch(t, [][]byte{[]byte("\xff"), []byte("\xff\x00"), []byte("\xff\xff")}, keys)
+	assert.NoError(t, err)
+
+	keys, err = s.Keys("\xff\xff*")
+	assert.Equal(t, [][]byte{[]byte("\xff\xff")}, keys)
+	assert.NoError(t, err)
+
+	keys, err = s.Keys("*")
+	assert.Len(t, keys, 10)
+	assert.NoError(t, err)
+
+	// The empty key is a key like any other.
+	v, err := s.Get([]byte(""))
+	assert.Equal(t, []byte{}, v)
+	assert.NoError(t, err)
+
+	cnt, err := s.Del([]byte(""))
+	assert.Equal(t, 1, cnt)
+	assert.NoError(t, err)
+}
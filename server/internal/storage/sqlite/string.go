@@ -0,0 +1,104 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package sqlite
+
+import (
+	"database/sql"
+	"time"
+
+	"go.chensl.me/redix/server/internal/storage"
+)
+
+func (s *sqliteStorage) Set(key []byte, value []byte, opts storage.SetOptions) error {
+	if (opts.NX && opts.XX) || (opts.KeepTTL && opts.TTL > 0) {
+		return storage.ErrInvalidOpts
+	}
+
+	return s.withTx(func(tx *sql.Tx) error {
+		now := time.Now()
+		old, err := s.getLiveEntry(tx, key, now.UnixNano())
+		if err != nil && err != storage.ErrNotExist {
+			return err
+		}
+		exist := err == nil
+
+		if !exist && opts.XX {
+			return storage.ErrNotExist
+		} else if exist && opts.NX {
+			return storage.ErrExist
+		}
+
+		e := entry{value: value}
+		if opts.TTL > 0 {
+			e.expireAt.Valid = true
+			e.expireAt.Int64 = now.Add(opts.TTL).UnixNano()
+		} else if opts.KeepTTL && exist {
+			e.expireAt = old.expireAt
+		}
+
+		return s.upsert(tx, key, &e)
+	})
+}
+
+func (s *sqliteStorage) Get(key []byte) ([]byte, error) {
+	var value []byte
+	err := s.getStmt.QueryRow(blob(key), time.Now().UnixNano()).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, storage.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return blob(value), nil
+}
+
+func (s *sqliteStorage) Add(key []byte, delta int64) (int64, error) {
+	var i int64
+
+	err := s.update(key, func(val []byte) ([]byte, error) {
+		var err error
+		i, err = storage.IncrInt(val, delta)
+		if err != nil {
+			return nil, err
+		}
+		return storage.FormatInt(i), nil
+	})
+
+	return i, err
+}
+
+func (s *sqliteStorage) AddFloat(key []byte, delta float64) (float64, error) {
+	var f float64
+
+	err := s.update(key, func(val []byte) ([]byte, error) {
+		var err error
+		f, err = storage.IncrFloat(val, delta)
+		if err != nil {
+			return nil, err
+		}
+		return storage.FormatFloat(f), nil
+	})
+
+	return f, err
+}
+
+// update replaces the value of key with the result of fn, keeping the
+// original expiration time. fn receives nil if the key does not exist.
+func (s *sqliteStorage) update(key []byte, fn func(val []byte) ([]byte, error)) error {
+	return s.withTx(func(tx *sql.Tx) error {
+		e, err := s.getLiveEntry(tx, key, time.Now().UnixNano())
+		if err == storage.ErrNotExist {
+			e, err = &entry{}, nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if e.value, err = fn(e.value); err != nil {
+			return err
+		}
+		return s.upsert(tx, key, e)
+	})
+}
@@ -13,6 +13,14 @@ type Interface interface {
 
 	Keys(pattern string) ([][]byte, error)
 	Del(keys ...[]byte) (int, error)
+	Rename(key, newKey []byte, nx bool) error
+	Copy(src, dst []byte, replace bool) error
+	RandomKey() ([]byte, error)
+	DBSize() (int64, error)
+	// ForEach calls fn for every live key in a consistent view of the
+	// database. A zero expiresAt means that the key has no expire. key and
+	// value are only valid until fn returns.
+	ForEach(fn func(key, value []byte, expiresAt time.Time) error) error
 	Expire(key []byte, dur time.Duration) error
 	TTL(key []byte) (int64, error)
 	DropAll() error
@@ -22,5 +30,24 @@ type Interface interface {
 type StringCmd interface {
 	Set(key, value []byte, opts SetOptions) error
 	Get(key []byte) ([]byte, error)
-	Add(key []byte, delta int) (int, error)
+	Add(key []byte, delta int64) (int64, error)
+	AddFloat(key []byte, delta float64) (float64, error)
+}
+
+// Wrapper is implemented by the storages which wrap the storage of a
+// driver, e.g. a cache.
+type Wrapper interface {
+	Unwrap() Interface
+}
+
+// Unwrap returns the storage of the driver s wraps, whose optional
+// interfaces, e.g. Backuper, the wrappers don't implement.
+func Unwrap(s Interface) Interface {
+	for {
+		w, ok := s.(Wrapper)
+		if !ok {
+			return s
+		}
+		s = w.Unwrap()
+	}
 }
@@ -0,0 +1,853 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package storagetest implements a conformance suite for storage.Interface,
+// which every driver runs from its own tests:
+//
+//	func Test_fooStorage_Conformance(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T) storage.Interface {
+//			s, err := NewStorage(t.TempDir(), zap.NewNop())
+//			if err != nil {
+//				t.Fatal(err)
+//			}
+//			return s
+//		})
+//	}
+//
+// Expiration times are only checked to the second, as some drivers store
+// them as unix timestamps in seconds. The empty key is not covered since
+// Badger and bbolt reject it.
+package storagetest
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.chensl.me/redix/server/internal/storage"
+)
+
+// Factory returns an empty storage, which is closed by the test.
+type Factory func(t *testing.T) storage.Interface
+
+// Run runs the conformance tests against the storages returned by
+// newStorage, each subtest gets a new one.
+func Run(t *testing.T, newStorage Factory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s storage.Interface)
+	}{
+		{"Set", testSet},
+		{"SetKeepTTL", testSetKeepTTL},
+		{"Get", testGet},
+		{"Add", testAdd},
+		{"AddFloat", testAddFloat},
+		{"TTL", testTTL},
+		{"Expiration", testExpiration},
+		{"Keys", testKeys},
+		{"Del", testDel},
+		{"Rename", testRename},
+		{"Copy", testCopy},
+		{"RandomKey", testRandomKey},
+		{"DBSize", testDBSize},
+		{"ForEach", testForEach},
+		{"DropAll", testDropAll},
+		{"ConcurrentAdd", testConcurrentAdd},
+		{"ConcurrentSetNX", testConcurrentSetNX},
+		{"ConcurrentRename", testConcurrentRename},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			s := newStorage(t)
+			defer func() {
+				assert.NoError(t, s.Close())
+			}()
+			tt.fn(t, s)
+		})
+	}
+}
+
+func set(t *testing.T, s storage.Interface, key, value string, ttl time.Duration) {
+	t.Helper()
+	require.NoError(t, s.Set([]byte(key), []byte(value), storage.SetOptions{TTL: ttl}))
+}
+
+// get returns the value of key, or "<nil>" if it does not exist.
+func get(t *testing.T, s storage.Interface, key string) string {
+	t.Helper()
+	v, err := s.Get([]byte(key))
+	if errors.Is(err, storage.ErrNotExist) {
+		return "<nil>"
+	}
+	require.NoError(t, err)
+	return string(v)
+}
+
+func ttl(t *testing.T, s storage.Interface, key string) int64 {
+	t.Helper()
+	n, err := s.TTL([]byte(key))
+	require.NoError(t, err)
+	return n
+}
+
+func keys(t *testing.T, s storage.Interface, pattern string) []string {
+	t.Helper()
+	list, err := s.Keys(pattern)
+	require.NoError(t, err)
+	names := make([]string, 0, len(list))
+	for _, k := range list {
+		names = append(names, string(k))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// assertTTL checks a TTL in seconds, which is truncated by the drivers.
+func assertTTL(t *testing.T, want time.Duration, got int64) {
+	t.Helper()
+	assert.InDelta(t, int64(want/time.Second)-1, got, 1)
+}
+
+func testSet(t *testing.T, s storage.Interface) {
+	k := []byte("key")
+
+	err := s.Set(k, []byte("v"), storage.SetOptions{NX: true, XX: true})
+	assert.ErrorIs(t, err, storage.ErrInvalidOpts)
+	err = s.Set(k, []byte("v"), storage.SetOptions{TTL: time.Minute, KeepTTL: true})
+	assert.ErrorIs(t, err, storage.ErrInvalidOpts)
+	assert.Equal(t, "<nil>", get(t, s, "key"))
+
+	err = s.Set(k, []byte("v"), storage.SetOptions{XX: true})
+	assert.ErrorIs(t, err, storage.ErrNotExist)
+	assert.Equal(t, "<nil>", get(t, s, "key"))
+
+	assert.NoError(t, s.Set(k, []byte("v1"), storage.SetOptions{NX: true}))
+	assert.Equal(t, "v1", get(t, s, "key"))
+
+	err = s.Set(k, []byte("v2"), storage.SetOptions{NX: true})
+	assert.ErrorIs(t, err, storage.ErrExist)
+	assert.Equal(t, "v1", get(t, s, "key"))
+
+	assert.NoError(t, s.Set(k, []byte("v3"), storage.SetOptions{XX: true}))
+	assert.Equal(t, "v3", get(t, s, "key"))
+
+	// A plain SET discards the expiration time.
+	assert.NoError(t, s.Set(k, []byte("v4"), storage.SetOptions{TTL: time.Minute}))
+	assertTTL(t, time.Minute, ttl(t, s, "key"))
+	assert.NoError(t, s.Set(k, []byte("v5"), storage.SetOptions{}))
+	assert.Equal(t, int64(-1), ttl(t, s, "key"))
+	assert.Equal(t, "v5", get(t, s, "key"))
+}
+
+func testSetKeepTTL(t *testing.T, s storage.Interface) {
+	k := []byte("key")
+
+	// KEEPTTL on a missing key creates a persistent key.
+	assert.NoError(t, s.Set(k, []byte("v1"), storage.SetOptions{KeepTTL: true}))
+	assert.Equal(t, int64(-1), ttl(t, s, "key"))
+
+	assert.NoError(t, s.Expire(k, time.Minute))
+	assert.NoError(t, s.Set(k, []byte("v2"), storage.SetOptions{KeepTTL: true}))
+	assertTTL(t, time.Minute, ttl(t, s, "key"))
+	assert.Equal(t, "v2", get(t, s, "key"))
+
+	assert.NoError(t, s.Set(k, []byte("v3"), storage.SetOptions{KeepTTL: true, XX: true}))
+	assertTTL(t, time.Minute, ttl(t, s, "key"))
+	assert.Equal(t, "v3", get(t, s, "key"))
+}
+
+func testGet(t *testing.T, s storage.Interface) {
+	v, err := s.Get([]byte("missing"))
+	assert.Nil(t, v)
+	assert.ErrorIs(t, err, storage.ErrNotExist)
+
+	// Keys and values are binary safe.
+	bin := []byte{0, 1, 0xff, '\r', '\n', 0}
+	assert.NoError(t, s.Set(bin, bin, storage.SetOptions{}))
+	v, err = s.Get(bin)
+	assert.Equal(t, bin, v)
+	assert.NoError(t, err)
+
+	assert.NoError(t, s.Set([]byte("empty"), []byte{}, storage.SetOptions{}))
+	v, err = s.Get([]byte("empty"))
+	assert.Empty(t, v)
+	assert.NoError(t, err)
+
+	big := make([]byte, 1<<20)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	assert.NoError(t, s.Set([]byte("big"), big, storage.SetOptions{}))
+	v, err = s.Get([]byte("big"))
+	assert.Equal(t, big, v)
+	assert.NoError(t, err)
+
+	// The returned value is not affected by later writes.
+	set(t, s, "key", "value", 0)
+	v, err = s.Get([]byte("key"))
+	require.NoError(t, err)
+	set(t, s, "key", "overwritten", 0)
+	assert.Equal(t, "value", string(v))
+}
+
+func testAdd(t *testing.T, s storage.Interface) {
+	k := []byte("counter")
+
+	i, err := s.Add(k, 10)
+	assert.Equal(t, int64(10), i)
+	assert.NoError(t, err)
+
+	i, err = s.Add(k, -25)
+	assert.Equal(t, int64(-15), i)
+	assert.NoError(t, err)
+	assert.Equal(t, "-15", get(t, s, "counter"))
+
+	_, err = s.Add(k, math.MinInt64)
+	assert.ErrorIs(t, err, storage.ErrOverflow)
+	set(t, s, "counter", strconv.FormatInt(math.MaxInt64, 10), 0)
+	_, err = s.Add(k, 1)
+	assert.ErrorIs(t, err, storage.ErrOverflow)
+	assert.Equal(t, strconv.FormatInt(math.MaxInt64, 10), get(t, s, "counter"))
+
+	for _, v := range []string{"", "abc", "1.5", " 1", "1 ", "+1", "01", "99999999999999999999"} {
+		set(t, s, "counter", v, 0)
+		_, err = s.Add(k, 1)
+		assert.ErrorIs(t, err, storage.ErrInvalidInt, "value %q", v)
+		assert.Equal(t, v, get(t, s, "counter"), "value %q", v)
+	}
+
+	// The expiration time is kept.
+	set(t, s, "counter", "1", time.Minute)
+	i, err = s.Add(k, 1)
+	assert.Equal(t, int64(2), i)
+	assert.NoError(t, err)
+	assertTTL(t, time.Minute, ttl(t, s, "counter"))
+}
+
+func testAddFloat(t *testing.T, s storage.Interface) {
+	k := []byte("float")
+
+	f, err := s.AddFloat(k, 0.5)
+	assert.Equal(t, 0.5, f)
+	assert.NoError(t, err)
+
+	f, err = s.AddFloat(k, -2)
+	assert.Equal(t, -1.5, f)
+	assert.NoError(t, err)
+	assert.Equal(t, "-1.5", get(t, s, "float"))
+
+	// Integers are valid floats.
+	set(t, s, "float", "3", 0)
+	f, err = s.AddFloat(k, 0.25)
+	assert.Equal(t, 3.25, f)
+	assert.NoError(t, err)
+
+	_, err = s.AddFloat(k, math.Inf(1))
+	assert.ErrorIs(t, err, storage.ErrNaNOrInf)
+	assert.Equal(t, "3.25", get(t, s, "float"))
+
+	for _, v := range []string{"", "abc", "1.5x", " 1"} {
+		set(t, s, "float", v, 0)
+		_, err = s.AddFloat(k, 1)
+		assert.ErrorIs(t, err, storage.ErrInvalidFloat, "value %q", v)
+		assert.Equal(t, v, get(t, s, "float"), "value %q", v)
+	}
+
+	set(t, s, "float", "1", time.Minute)
+	_, err = s.AddFloat(k, 1)
+	assert.NoError(t, err)
+	assertTTL(t, time.Minute, ttl(t, s, "float"))
+}
+
+func testTTL(t *testing.T, s storage.Interface) {
+	k := []byte("key")
+
+	assert.Equal(t, int64(-2), ttl(t, s, "key"))
+	assert.ErrorIs(t, s.Expire(k, time.Minute), storage.ErrNotExist)
+	assert.Equal(t, int64(-2), ttl(t, s, "key"))
+
+	set(t, s, "key", "v", 0)
+	assert.Equal(t, int64(-1), ttl(t, s, "key"))
+
+	assert.ErrorIs(t, s.Expire(k, 0), storage.ErrInvalidOpts)
+	assert.ErrorIs(t, s.Expire(k, -time.Second), storage.ErrInvalidOpts)
+	assert.Equal(t, int64(-1), ttl(t, s, "key"))
+
+	assert.NoError(t, s.Expire(k, time.Minute))
+	assertTTL(t, time.Minute, ttl(t, s, "key"))
+	assert.NoError(t, s.Expire(k, time.Hour))
+	assertTTL(t, time.Hour, ttl(t, s, "key"))
+	assert.Equal(t, "v", get(t, s, "key"))
+
+	set(t, s, "key", "v", 10*time.Second)
+	assertTTL(t, 10*time.Second, ttl(t, s, "key"))
+}
+
+// testExpiration checks that expired keys are gone for every operation,
+// whether or not the driver has deleted them yet.
+func testExpiration(t *testing.T, s storage.Interface) {
+	set(t, s, "set", "1", 2*time.Second)
+	set(t, s, "expire", "1", 0)
+	assert.NoError(t, s.Expire([]byte("expire"), 2*time.Second))
+	set(t, s, "renamed", "1", 2*time.Second)
+	assert.NoError(t, s.Rename([]byte("renamed"), []byte("rename"), false))
+	set(t, s, "copied", "1", 2*time.Second)
+	assert.NoError(t, s.Copy([]byte("copied"), []byte("copy"), false))
+	set(t, s, "counter", "1", 2*time.Second)
+	_, err := s.Add([]byte("counter"), 1)
+	assert.NoError(t, err)
+	set(t, s, "live", "1", time.Minute)
+	set(t, s, "persist", "1", 0)
+
+	// Expiration times may be truncated to the second, so the keys are
+	// only guaranteed to live for a second.
+	time.Sleep(2100 * time.Millisecond)
+
+	expired := []string{"set", "expire", "rename", "copied", "copy", "counter"}
+	for _, k := range expired {
+		assert.Equal(t, "<nil>", get(t, s, k), k)
+		assert.Equal(t, int64(-2), ttl(t, s, k), k)
+		assert.ErrorIs(t, s.Expire([]byte(k), time.Minute), storage.ErrNotExist, k)
+	}
+	assert.Equal(t, []string{"live", "persist"}, keys(t, s, "*"))
+
+	n, err := s.Del([]byte("set"), []byte("live"))
+	assert.Equal(t, 1, n)
+	assert.NoError(t, err)
+
+	assert.ErrorIs(t, s.Rename([]byte("expire"), []byte("x"), false), storage.ErrNotExist)
+	assert.ErrorIs(t, s.Copy([]byte("expire"), []byte("x"), false), storage.ErrNotExist)
+	// An expired destination does not exist.
+	assert.NoError(t, s.Rename([]byte("persist"), []byte("rename"), true))
+	assert.NoError(t, s.Copy([]byte("rename"), []byte("copy"), false))
+	assert.Equal(t, int64(-1), ttl(t, s, "copy"))
+
+	assert.ErrorIs(t, s.Set([]byte("copied"), []byte("2"), storage.SetOptions{XX: true}), storage.ErrNotExist)
+	assert.NoError(t, s.Set([]byte("copied"), []byte("2"), storage.SetOptions{NX: true}))
+	assert.Equal(t, int64(-1), ttl(t, s, "copied"))
+
+	// KEEPTTL does not revive the expiration time of an expired key.
+	assert.NoError(t, s.Set([]byte("expire"), []byte("2"), storage.SetOptions{KeepTTL: true}))
+	assert.Equal(t, int64(-1), ttl(t, s, "expire"))
+
+	i, err := s.Add([]byte("counter"), 5)
+	assert.Equal(t, int64(5), i)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-1), ttl(t, s, "counter"))
+
+	var seen []string
+	err = s.ForEach(func(key, _ []byte, _ time.Time) error {
+		seen = append(seen, string(key))
+		return nil
+	})
+	assert.NoError(t, err)
+	sort.Strings(seen)
+	assert.Equal(t, []string{"copied", "copy", "counter", "expire", "rename"}, seen)
+
+	assert.NoError(t, s.DropAll())
+	set(t, s, "gone", "1", 2*time.Second)
+	time.Sleep(2100 * time.Millisecond)
+	_, err = s.RandomKey()
+	assert.ErrorIs(t, err, storage.ErrNotExist)
+}
+
+func testKeys(t *testing.T, s storage.Interface) {
+	assert.Empty(t, keys(t, s, "*"))
+
+	for _, k := range []string{"hello", "hallo", "hillo", "hllo", "heeeello", "a*b", "ab", "user:1", "user:2", "user:10", "\xff", "\xff\xff"} {
+		set(t, s, k, "v", 0)
+	}
+
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{"*", []string{"a*b", "ab", "hallo", "heeeello", "hello", "hillo", "hllo", "user:1", "user:10", "user:2", "\xff", "\xff\xff"}},
+		{"h?llo", []string{"hallo", "hello", "hillo"}},
+		{"h*llo", []string{"hallo", "heeeello", "hello", "hillo", "hllo"}},
+		{"user:*", []string{"user:1", "user:10", "user:2"}},
+		{"user:?", []string{"user:1", "user:2"}},
+		{"a\\*b", []string{"a*b"}},
+		{"a\\**", []string{"a*b"}},
+		{"\xff*", []string{"\xff", "\xff\xff"}},
+		{"hello", []string{"hello"}},
+		{"nomatch*", []string{}},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, keys(t, s, tt.pattern), "pattern %q", tt.pattern)
+	}
+}
+
+func testDel(t *testing.T, s storage.Interface) {
+	n, err := s.Del()
+	assert.Equal(t, 0, n)
+	assert.NoError(t, err)
+
+	set(t, s, "a", "1", 0)
+	set(t, s, "b", "2", time.Minute)
+	set(t, s, "c", "3", 0)
+
+	n, err = s.Del([]byte("x"))
+	assert.Equal(t, 0, n)
+	assert.NoError(t, err)
+
+	// A key given twice is only counted once.
+	n, err = s.Del([]byte("a"), []byte("b"), []byte("a"), []byte("x"))
+	assert.Equal(t, 2, n)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "<nil>", get(t, s, "a"))
+	assert.Equal(t, "<nil>", get(t, s, "b"))
+	assert.Equal(t, []string{"c"}, keys(t, s, "*"))
+
+	size, err := s.DBSize()
+	assert.Equal(t, int64(1), size)
+	assert.NoError(t, err)
+
+	n, err = s.Del([]byte("a"))
+	assert.Equal(t, 0, n)
+	assert.NoError(t, err)
+}
+
+func testRename(t *testing.T, s storage.Interface) {
+	assert.ErrorIs(t, s.Rename([]byte("a"), []byte("b"), false), storage.ErrNotExist)
+	assert.ErrorIs(t, s.Rename([]byte("a"), []byte("a"), false), storage.ErrNotExist)
+
+	set(t, s, "a", "1", time.Minute)
+	set(t, s, "b", "2", 0)
+
+	assert.NoError(t, s.Rename([]byte("a"), []byte("a"), false))
+	assert.ErrorIs(t, s.Rename([]byte("a"), []byte("a"), true), storage.ErrExist)
+	assert.ErrorIs(t, s.Rename([]byte("a"), []byte("b"), true), storage.ErrExist)
+	assert.Equal(t, "1", get(t, s, "a"))
+	assert.Equal(t, "2", get(t, s, "b"))
+
+	// The expiration time moves with the value.
+	assert.NoError(t, s.Rename([]byte("a"), []byte("c"), true))
+	assert.Equal(t, "<nil>", get(t, s, "a"))
+	assert.Equal(t, "1", get(t, s, "c"))
+	assertTTL(t, time.Minute, ttl(t, s, "c"))
+
+	// The destination is overwritten, including its expiration time.
+	assert.NoError(t, s.Expire([]byte("b"), time.Hour))
+	set(t, s, "d", "4", 0)
+	assert.NoError(t, s.Rename([]byte("d"), []byte("b"), false))
+	assert.Equal(t, "4", get(t, s, "b"))
+	assert.Equal(t, int64(-1), ttl(t, s, "b"))
+
+	assert.Equal(t, []string{"b", "c"}, keys(t, s, "*"))
+	size, err := s.DBSize()
+	assert.Equal(t, int64(2), size)
+	assert.NoError(t, err)
+}
+
+func testCopy(t *testing.T, s storage.Interface) {
+	assert.ErrorIs(t, s.Copy([]byte("a"), []byte("b"), false), storage.ErrNotExist)
+
+	set(t, s, "a", "1", time.Minute)
+	set(t, s, "b", "2", 0)
+
+	assert.ErrorIs(t, s.Copy([]byte("a"), []byte("b"), false), storage.ErrExist)
+	assert.Equal(t, "2", get(t, s, "b"))
+	assert.ErrorIs(t, s.Copy([]byte("a"), []byte("a"), false), storage.ErrExist)
+	assert.NoError(t, s.Copy([]byte("a"), []byte("a"), true))
+	assert.Equal(t, "1", get(t, s, "a"))
+
+	assert.NoError(t, s.Copy([]byte("a"), []byte("b"), true))
+	assert.Equal(t, "1", get(t, s, "b"))
+	assertTTL(t, time.Minute, ttl(t, s, "b"))
+
+	assert.NoError(t, s.Copy([]byte("a"), []byte("c"), false))
+	assert.Equal(t, "1", get(t, s, "c"))
+	assertTTL(t, time.Minute, ttl(t, s, "c"))
+
+	// The copy is independent of the source.
+	set(t, s, "a", "changed", 0)
+	assert.Equal(t, "1", get(t, s, "c"))
+	n, err := s.Del([]byte("a"))
+	assert.Equal(t, 1, n)
+	assert.NoError(t, err)
+	assert.Equal(t, "1", get(t, s, "c"))
+
+	size, err := s.DBSize()
+	assert.Equal(t, int64(2), size)
+	assert.NoError(t, err)
+}
+
+func testRandomKey(t *testing.T, s storage.Interface) {
+	_, err := s.RandomKey()
+	assert.ErrorIs(t, err, storage.ErrNotExist)
+
+	set(t, s, "only", "1", 0)
+	k, err := s.RandomKey()
+	assert.Equal(t, []byte("only"), k)
+	assert.NoError(t, err)
+
+	want := map[string]bool{"only": true}
+	for i := 0; i < 20; i++ {
+		k := fmt.Sprintf("key:%02d", i)
+		set(t, s, k, "1", 0)
+		want[k] = true
+	}
+	for i := 0; i < 50; i++ {
+		k, err := s.RandomKey()
+		require.NoError(t, err)
+		assert.True(t, want[string(k)], "unexpected key %q", k)
+	}
+}
+
+func testDBSize(t *testing.T, s storage.Interface) {
+	size := func() int64 {
+		t.Helper()
+		n, err := s.DBSize()
+		require.NoError(t, err)
+		return n
+	}
+
+	assert.Equal(t, int64(0), size())
+	set(t, s, "a", "1", 0)
+	set(t, s, "a", "2", 0)
+	assert.Equal(t, int64(1), size())
+	_, err := s.Add([]byte("b"), 1)
+	assert.NoError(t, err)
+	_, err = s.AddFloat([]byte("c"), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), size())
+	_ = s.Set([]byte("a"), []byte("3"), storage.SetOptions{NX: true})
+	_ = s.Set([]byte("d"), []byte("3"), storage.SetOptions{XX: true})
+	assert.Equal(t, int64(3), size())
+	_, err = s.Add([]byte("a"), math.MaxInt64)
+	assert.ErrorIs(t, err, storage.ErrOverflow)
+	assert.Equal(t, int64(3), size())
+	_, err = s.Del([]byte("a"), []byte("b"), []byte("c"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), size())
+}
+
+func testForEach(t *testing.T, s storage.Interface) {
+	err := s.ForEach(func(key, value []byte, expiresAt time.Time) error {
+		t.Errorf("unexpected key %q", key)
+		return nil
+	})
+	assert.NoError(t, err)
+
+	set(t, s, "a", "1", 0)
+	set(t, s, "b", "2", time.Minute)
+	set(t, s, "c", "3", 0)
+
+	got := make(map[string]string)
+	now := time.Now()
+	err = s.ForEach(func(key, value []byte, expiresAt time.Time) error {
+		got[string(key)] = string(value)
+		if string(key) == "b" {
+			assert.WithinDuration(t, now.Add(time.Minute), expiresAt, 2*time.Second)
+		} else {
+			assert.True(t, expiresAt.IsZero())
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "1", "b": "2", "c": "3"}, got)
+
+	// An error stops the iteration and is returned.
+	errStop := errors.New("stop")
+	var calls int
+	err = s.ForEach(func(key, value []byte, expiresAt time.Time) error {
+		calls++
+		return errStop
+	})
+	assert.Equal(t, errStop, err)
+	assert.Equal(t, 1, calls)
+}
+
+func testDropAll(t *testing.T, s storage.Interface) {
+	assert.NoError(t, s.DropAll())
+
+	for i := 0; i < 100; i++ {
+		set(t, s, strconv.Itoa(i), "v", 0)
+	}
+	set(t, s, "volatile", "v", time.Minute)
+	assert.NoError(t, s.DropAll())
+
+	assert.Empty(t, keys(t, s, "*"))
+	assert.Equal(t, "<nil>", get(t, s, "0"))
+	assert.Equal(t, int64(-2), ttl(t, s, "volatile"))
+	n, err := s.DBSize()
+	assert.Equal(t, int64(0), n)
+	assert.NoError(t, err)
+	_, err = s.RandomKey()
+	assert.ErrorIs(t, err, storage.ErrNotExist)
+
+	// The storage is still usable.
+	assert.NoError(t, s.Set([]byte("0"), []byte("new"), storage.SetOptions{NX: true}))
+	assert.Equal(t, "new", get(t, s, "0"))
+	n, err = s.DBSize()
+	assert.Equal(t, int64(1), n)
+	assert.NoError(t, err)
+}
+
+func testConcurrentAdd(t *testing.T, s storage.Interface) {
+	const workers, adds = 8, 50
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < adds; i++ {
+				if _, err := s.Add([]byte("counter"), 1); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, strconv.Itoa(workers*adds), get(t, s, "counter"))
+	n, err := s.DBSize()
+	assert.Equal(t, int64(1), n)
+	assert.NoError(t, err)
+}
+
+func testConcurrentSetNX(t *testing.T, s storage.Interface) {
+	const workers = 8
+
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+		won []int
+	)
+	for w := 0; w < workers; w++ {
+		w := w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := s.Set([]byte("lock"), []byte(strconv.Itoa(w)), storage.SetOptions{NX: true})
+			if errors.Is(err, storage.ErrExist) {
+				return
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			won = append(won, w)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	require.Len(t, won, 1)
+	assert.Equal(t, strconv.Itoa(won[0]), get(t, s, "lock"))
+}
+
+// testConcurrentRename moves a key around from several goroutines, it must
+// never be lost or duplicated.
+func testConcurrentRename(t *testing.T, s storage.Interface) {
+	const workers, renames = 4, 25
+
+	names := []string{"k0", "k1", "k2", "k3"}
+	set(t, s, names[0], "v", 0)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		w := w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < renames; i++ {
+				src := names[(w+i)%len(names)]
+				dst := names[(w+i+1)%len(names)]
+				err := s.Rename([]byte(src), []byte(dst), false)
+				if err != nil && !errors.Is(err, storage.ErrNotExist) {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	got := keys(t, s, "*")
+	require.Len(t, got, 1)
+	assert.Equal(t, "v", get(t, s, got[0]))
+	n, err := s.DBSize()
+	assert.Equal(t, int64(1), n)
+	assert.NoError(t, err)
+}
+
+// RunBackup checks the storage.Backuper implementation of the storages
+// returned by newStorage, open opens the data directory written by Backup.
+func RunBackup(t *testing.T, newStorage Factory, open func(t *testing.T, dir string) storage.Interface) {
+	s := newStorage(t)
+	defer func() {
+		assert.NoError(t, s.Close())
+	}()
+	b, ok := s.(storage.Backuper)
+	require.True(t, ok, "storage doesn't implement storage.Backuper")
+
+	for i := 0; i < 100; i++ {
+		set(t, s, fmt.Sprintf("key:%d", i), fmt.Sprintf("value:%d", i), 0)
+	}
+	set(t, s, "volatile", "v", time.Hour)
+	set(t, s, "deleted", "v", 0)
+	_, err := s.Del([]byte("deleted"))
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	require.NoError(t, b.Backup(dir))
+
+	// Later writes are not part of the snapshot.
+	set(t, s, "key:0", "changed", 0)
+	set(t, s, "after", "v", 0)
+
+	snap := open(t, dir)
+	defer func() {
+		assert.NoError(t, snap.Close())
+	}()
+	assert.Len(t, keys(t, snap, "*"), 101)
+	assert.Equal(t, "value:0", get(t, snap, "key:0"))
+	assert.Equal(t, "value:99", get(t, snap, "key:99"))
+	assert.Equal(t, "<nil>", get(t, snap, "after"))
+	assert.Equal(t, "<nil>", get(t, snap, "deleted"))
+	assertTTL(t, time.Hour, ttl(t, snap, "volatile"))
+	n, err := snap.DBSize()
+	assert.Equal(t, int64(101), n)
+	assert.NoError(t, err)
+}
+
+// RunBatch checks the storage.Batcher implementation of the storages
+// returned by newStorage.
+func RunBatch(t *testing.T, newStorage Factory) {
+	t.Run("Operations", func(t *testing.T) {
+		s := newStorage(t)
+		defer func() {
+			assert.NoError(t, s.Close())
+		}()
+		b, ok := s.(storage.Batcher)
+		require.True(t, ok, "storage doesn't implement storage.Batcher")
+
+		set(t, s, "str", "abc", 0)
+		set(t, s, "gone", "v", 0)
+		calls := 0
+		err := b.Batch(func(b storage.Batch) bool {
+			calls++
+			if calls == 2 {
+				return false
+			}
+			require.NoError(t, b.Set([]byte("k"), []byte("1"), storage.SetOptions{}))
+			v, err := b.Get([]byte("k"))
+			require.NoError(t, err)
+			assert.Equal(t, "1", string(v))
+
+			// A failed operation doesn't fail the others.
+			_, err = b.Add([]byte("str"), 1)
+			assert.ErrorIs(t, err, storage.ErrInvalidInt)
+			assert.ErrorIs(t, b.Set([]byte("k"), []byte("2"), storage.SetOptions{NX: true}), storage.ErrExist)
+			assert.ErrorIs(t, b.Set([]byte("k"), []byte("2"), storage.SetOptions{NX: true, XX: true}), storage.ErrInvalidOpts)
+
+			i, err := b.Add([]byte("k"), 41)
+			require.NoError(t, err)
+			assert.Equal(t, int64(42), i)
+			f, err := b.AddFloat([]byte("f"), 1.5)
+			require.NoError(t, err)
+			assert.Equal(t, 1.5, f)
+			require.NoError(t, b.Set([]byte("volatile"), []byte("v"), storage.SetOptions{TTL: time.Hour}))
+			n, err := b.TTL([]byte("volatile"))
+			require.NoError(t, err)
+			assertTTL(t, time.Hour, n)
+			cnt, err := b.Del([]byte("gone"), []byte("missing"))
+			require.NoError(t, err)
+			assert.Equal(t, 1, cnt)
+			n, err = b.TTL([]byte("gone"))
+			require.NoError(t, err)
+			assert.Equal(t, int64(-2), n)
+			return true
+		})
+		require.NoError(t, err)
+		assert.Equal(t, 2, calls)
+
+		assert.Equal(t, "42", get(t, s, "k"))
+		assert.Equal(t, "abc", get(t, s, "str"))
+		assert.Equal(t, "1.5", get(t, s, "f"))
+		assert.Equal(t, "<nil>", get(t, s, "gone"))
+		assertTTL(t, time.Hour, ttl(t, s, "volatile"))
+		n, err := s.DBSize()
+		assert.Equal(t, int64(4), n)
+		assert.NoError(t, err)
+	})
+
+	t.Run("Large", func(t *testing.T) {
+		s := newStorage(t)
+		defer func() {
+			assert.NoError(t, s.Close())
+		}()
+		b, ok := s.(storage.Batcher)
+		require.True(t, ok, "storage doesn't implement storage.Batcher")
+
+		// More than a transaction of some drivers can hold. The call
+		// which doesn't fit, two writes, is dropped whole.
+		const n = 10000
+		value := make([]byte, 1024)
+		calls := 0
+		err := b.Batch(func(b storage.Batch) bool {
+			i := strconv.Itoa(calls)
+			calls++
+			if err := b.Set([]byte("key:"+i), value, storage.SetOptions{}); err != nil {
+				assert.ErrorIs(t, err, storage.ErrBatchFull)
+				return false
+			}
+			if err := b.Set([]byte("key:"+i+":2"), value, storage.SetOptions{}); err != nil {
+				assert.ErrorIs(t, err, storage.ErrBatchFull)
+				return false
+			}
+			return calls < n
+		})
+		committed := calls
+		if err != nil {
+			require.ErrorIs(t, err, storage.ErrBatchFull)
+			committed--
+			assert.Equal(t, "<nil>", get(t, s, "key:"+strconv.Itoa(committed)))
+		}
+		size, err := s.DBSize()
+		assert.Equal(t, int64(2*committed), size)
+		assert.NoError(t, err)
+		assert.Len(t, get(t, s, "key:0"), len(value))
+		assert.Len(t, get(t, s, "key:"+strconv.Itoa(committed-1)+":2"), len(value))
+	})
+}
+
+// RunDiskSize checks the storage.DiskSizer implementation of the storages
+// returned by newStorage. lags is set for the drivers which only update the
+// size in the background.
+func RunDiskSize(t *testing.T, newStorage Factory, lags bool) {
+	s := newStorage(t)
+	defer func() {
+		assert.NoError(t, s.Close())
+	}()
+	d, ok := s.(storage.DiskSizer)
+	require.True(t, ok, "storage doesn't implement storage.DiskSizer")
+
+	value := strings.Repeat("v", 1024)
+	for i := 0; i < 1000; i++ {
+		set(t, s, "key:"+strconv.Itoa(i), value, 0)
+	}
+	size, err := d.DiskSize()
+	require.NoError(t, err)
+	if lags {
+		assert.GreaterOrEqual(t, size, int64(0))
+	} else {
+		assert.Greater(t, size, int64(1000*1024))
+	}
+}
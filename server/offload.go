@@ -0,0 +1,140 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+	"github.com/tidwall/redcon"
+	"go.uber.org/zap"
+)
+
+// The commands of the classes given by the offload option run on a pool of
+// workers rather than on the event loops, so that a slow command doesn't
+// stall the other clients of its loop. The connection is blocked until the
+// reply is back, see Context.block, so that the replies of a pipeline keep
+// their order.
+
+// loadOffloaded returns the flags of the classes given by the offload
+// option, separated by commas: the commands with one of them are offloaded.
+func loadOffloaded() (commandFlags, error) {
+	var offloaded commandFlags
+	for _, class := range strings.Split(viper.GetString("offload"), ",") {
+		switch strings.ToLower(strings.TrimSpace(class)) {
+		case "":
+		case "read":
+			offloaded |= flagRead
+		case "write":
+			offloaded |= flagWrite
+		case "slow":
+			offloaded |= flagSlow
+		default:
+			return 0, fmt.Errorf("invalid offload class %q", class)
+		}
+	}
+	return offloaded, nil
+}
+
+// queuedPerWorker is the number of functions queued per worker, beyond
+// which the offloaded commands run on the event loops.
+const queuedPerWorker = 64
+
+// workerPool runs functions on size workers, one per CPU if size isn't
+// positive.
+type workerPool struct {
+	queue   chan func()
+	done    chan struct{}
+	pending sync.WaitGroup
+}
+
+func newWorkerPool(size int) *workerPool {
+	if size <= 0 {
+		size = runtime.NumCPU()
+	}
+	p := &workerPool{
+		queue: make(chan func(), size*queuedPerWorker),
+		done:  make(chan struct{}),
+	}
+	for i := 0; i < size; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *workerPool) work() {
+	for {
+		select {
+		case fn := <-p.queue:
+			fn()
+			p.pending.Done()
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// tryRun queues fn without waiting, so that the event loops never block,
+// and reports false if the queue is full.
+func (p *workerPool) tryRun(fn func()) bool {
+	p.pending.Add(1)
+	select {
+	case p.queue <- fn:
+		return true
+	default:
+		p.pending.Done()
+		return false
+	}
+}
+
+// close waits for the queued functions and stops the workers.
+func (p *workerPool) close() {
+	p.pending.Wait()
+	close(p.done)
+}
+
+// offloads reports whether cmd runs on the workers. The writes proposed to
+// Raft are left on the loop, they already wait in the background.
+func (s *Server) offloads(cmd *command) bool {
+	return cmd.is(s.offloaded) && !(s.raft.node != nil && cmd.is(flagWrite))
+}
+
+// offload runs a command on the workers and blocks the connection until it
+// returns. The arguments are copied, the input buffer is reused by the loop.
+// The command runs on the loop if the workers are overloaded, which slows
+// the clients down rather than queuing their commands without bound.
+func (s *Server) offload(c *Context, cmd *command) {
+	wc := &Context{
+		cmd:      append([]byte(nil), c.cmd...),
+		Args:     make([][]byte, len(c.Args)),
+		auth:     c.auth,
+		conn:     c.conn,
+		replPort: c.replPort,
+	}
+	for i, arg := range c.Args {
+		wc.Args[i] = append([]byte(nil), arg...)
+	}
+	started := c.blockOn(s.workers.tryRun, func(closed <-chan struct{}) (out []byte) {
+		defer func() {
+			if err := recover(); err != nil {
+				s.logger.Error("panic",
+					zap.ByteString("cmd", wc.cmd),
+					zap.ByteStrings("args", wc.Args),
+					zap.Any("err", err),
+				)
+				out = redcon.AppendError(out, "ERR panic.")
+			}
+		}()
+		wc.out = &out
+		s.exec(wc, cmd)
+		return out
+	})
+	if !started {
+		s.exec(c, cmd)
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.chensl.me/redix/server/internal/client"
+)
+
+func TestLoadOffloaded(t *testing.T) {
+	viper.Set("offload", "")
+	t.Cleanup(viper.Reset)
+	offloaded, err := loadOffloaded()
+	require.NoError(t, err)
+	assert.Zero(t, offloaded)
+
+	viper.Set("offload", "read, SLOW")
+	offloaded, err = loadOffloaded()
+	require.NoError(t, err)
+	assert.Equal(t, flagRead|flagSlow, offloaded)
+
+	viper.Set("offload", "read,nope")
+	_, err = loadOffloaded()
+	assert.EqualError(t, err, `invalid offload class "nope"`)
+}
+
+func TestOffloadPipeline(t *testing.T) {
+	srv, c := newTestServer(t, map[string]interface{}{"offload": "read"})
+	defer srv.Cleanup()
+
+	// The replies keep the order of the commands, whether they are
+	// offloaded or not.
+	var in []byte
+	for _, args := range [][]string{
+		{"SET", "k", "1"}, {"GET", "k"}, {"SET", "k", "2"}, {"GET", "k"}, {"PING"},
+	} {
+		in = appendCommand(in, stringsToBytes(args))
+	}
+	out, _ := srv.dataHandler(c, in)
+	for c.ctx.(*Context).blocked != nil {
+		select {
+		case <-c.woken:
+		case <-time.After(5 * time.Second):
+			t.Fatal("offloaded command never returned")
+		}
+		more, _ := srv.dataHandler(c, nil)
+		out = append(out, more...)
+	}
+	assert.Equal(t, "+OK\r\n$1\r\n1\r\n+OK\r\n$1\r\n2\r\n+PONG\r\n", string(out))
+}
+
+func TestOffloadSlowCommand(t *testing.T) {
+	srv, _ := newTestServer(t, nil)
+	release := make(chan struct{})
+	srv.register("block", func(c *Context) {
+		<-release
+		c.AppendOK()
+	}, flagSlow, noKeys)
+	srv.offloaded = flagSlow
+	c, port := serve(t, srv)
+
+	slow, err := client.Dial("127.0.0.1:"+strconv.Itoa(port), 5*time.Second)
+	require.NoError(t, err)
+	defer slow.Close()
+	require.NoError(t, slow.Send("BLOCK"))
+	require.NoError(t, slow.Flush())
+
+	// The loop serves the other clients meanwhile.
+	assert.Equal(t, "PONG", do(t, c, "PING"))
+	assert.Equal(t, "OK", do(t, c, "SET", "k", "v"))
+	close(release)
+	reply, err := slow.Receive()
+	require.NoError(t, err)
+	assert.Equal(t, "OK", reply)
+}
+
+func TestWorkerPoolFull(t *testing.T) {
+	p := newWorkerPool(1)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	require.True(t, p.tryRun(func() {
+		close(started)
+		<-release
+	}))
+	<-started
+
+	var ran int
+	for i := 0; i < queuedPerWorker; i++ {
+		require.True(t, p.tryRun(func() { ran++ }))
+	}
+	// The queue is full, the caller runs the function itself.
+	assert.False(t, p.tryRun(func() { t.Error("queued past the limit") }))
+
+	close(release)
+	p.close()
+	assert.Equal(t, queuedPerWorker, ran)
+}
+
+func stringsToBytes(ss []string) [][]byte {
+	bs := make([][]byte, len(ss))
+	for i, s := range ss {
+		bs[i] = []byte(s)
+	}
+	return bs
+}
@@ -0,0 +1,151 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"sync"
+
+	"github.com/tidwall/redcon"
+)
+
+// The messages published on a channel are pushed to its subscribers, on
+// this server only: PUBLISH is neither replicated nor sent over the cluster
+// bus. A RESP2 client which subscribed can only run the commands with
+// flagPubSub, as in Redis. CLIENT TRACKING REDIRECT sends the invalidations
+// on __redis__:invalidate.
+
+type pubsubState struct {
+	mu sync.Mutex
+	// channels are the subscribers by channel.
+	channels map[string]map[*Context]bool
+}
+
+// subscribed reports whether c subscribed to channel.
+func (s *Server) subscribed(c *Context, channel string) bool {
+	s.pubsub.mu.Lock()
+	defer s.pubsub.mu.Unlock()
+	return s.pubsub.channels[channel][c]
+}
+
+// publish pushes msg, built by appendMsg in the protocol of each
+// subscriber, to the subscribers of channel, and returns their number.
+func (s *Server) publish(channel string, appendMsg func(out []byte, resp3 bool) []byte) int64 {
+	s.pubsub.mu.Lock()
+	subs := make([]*Context, 0, len(s.pubsub.channels[channel]))
+	for c := range s.pubsub.channels[channel] {
+		subs = append(subs, c)
+	}
+	s.pubsub.mu.Unlock()
+
+	for _, c := range subs {
+		c.push(func(resp3 bool) []byte {
+			return appendMessage(nil, channel, resp3, appendMsg)
+		})
+	}
+	return int64(len(subs))
+}
+
+// appendMessage appends a message published on channel, whose payload is
+// appended by appendMsg.
+func appendMessage(out []byte, channel string, resp3 bool, appendMsg func(out []byte, resp3 bool) []byte) []byte {
+	out = appendPush(out, 3, resp3)
+	out = redcon.AppendBulkString(out, "message")
+	out = redcon.AppendBulkString(out, channel)
+	return appendMsg(out, resp3)
+}
+
+// unsubscribeAll unsubscribes c from all its channels once its connection
+// is closed.
+func (s *Server) unsubscribeAll(c *Context) {
+	s.pubsub.mu.Lock()
+	defer s.pubsub.mu.Unlock()
+	for channel := range c.channels {
+		s.unsubscribeLocked(c, channel)
+	}
+}
+
+func (s *Server) unsubscribeLocked(c *Context, channel string) {
+	delete(c.channels, channel)
+	subs := s.pubsub.channels[channel]
+	delete(subs, c)
+	if len(subs) == 0 {
+		delete(s.pubsub.channels, channel)
+	}
+}
+
+// appendSubscription appends the reply of SUBSCRIBE or UNSUBSCRIBE for
+// channel, which is nil if there is none.
+func (c *Context) appendSubscription(kind string, channel []byte) {
+	out := appendPush(*c.out, 3, c.resp3)
+	out = redcon.AppendBulkString(out, kind)
+	if channel == nil {
+		out = appendNull(out, c.resp3)
+	} else {
+		out = redcon.AppendBulk(out, channel)
+	}
+	*c.out = redcon.AppendInt(out, int64(len(c.channels)))
+}
+
+// SUBSCRIBE channel [channel ...]
+func (s *Server) cmdSUBSCRIBE(c *Context) {
+	if len(c.Args) == 0 {
+		c.ErrInvalidArgs()
+		return
+	}
+
+	s.pubsub.mu.Lock()
+	defer s.pubsub.mu.Unlock()
+	if s.pubsub.channels == nil {
+		s.pubsub.channels = make(map[string]map[*Context]bool)
+	}
+	if c.channels == nil {
+		c.channels = make(map[string]bool)
+	}
+	for _, channel := range c.Args {
+		name := string(channel)
+		c.channels[name] = true
+		subs := s.pubsub.channels[name]
+		if subs == nil {
+			subs = make(map[*Context]bool)
+			s.pubsub.channels[name] = subs
+		}
+		subs[c] = true
+		c.appendSubscription("subscribe", channel)
+	}
+}
+
+// UNSUBSCRIBE [channel ...]
+func (s *Server) cmdUNSUBSCRIBE(c *Context) {
+	s.pubsub.mu.Lock()
+	defer s.pubsub.mu.Unlock()
+
+	channels := c.Args
+	if len(channels) == 0 {
+		for name := range c.channels {
+			channels = append(channels, []byte(name))
+		}
+	}
+	if len(channels) == 0 {
+		c.appendSubscription("unsubscribe", nil)
+		return
+	}
+	for _, channel := range channels {
+		s.unsubscribeLocked(c, string(channel))
+		c.appendSubscription("unsubscribe", channel)
+	}
+}
+
+// PUBLISH channel message
+func (s *Server) cmdPUBLISH(c *Context) {
+	if len(c.Args) != 2 {
+		c.ErrInvalidArgs()
+		return
+	}
+
+	msg := append([]byte(nil), c.Args[1]...)
+	c.AppendInt(s.publish(string(c.Args[0]), func(out []byte, resp3 bool) []byte {
+		return redcon.AppendBulk(out, msg)
+	}))
+}
@@ -0,0 +1,425 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	"github.com/spf13/viper"
+	"github.com/tidwall/redcon"
+	"go.chensl.me/redix/server/internal/client"
+	"go.chensl.me/redix/server/internal/raftstore"
+	"go.chensl.me/redix/server/internal/storage"
+	"go.chensl.me/redix/server/pkg/bytesconv"
+	"go.uber.org/zap"
+)
+
+// In raft mode the write commands are appended to a Raft log replicated
+// across the nodes, and applied to the store of every node in the order of
+// the log once committed, see raftFSM. Only the leader accepts writes, the
+// other nodes redirect the clients with a MOVED error. Reads are served
+// locally by every node. The node ID is the client address of the node,
+// so that it can be given in redirections.
+
+// raftTimeout bounds the proposals and the membership changes.
+const raftTimeout = 10 * time.Second
+
+type raftConfig struct {
+	// addr is the address of the Raft transport, raft mode is enabled
+	// when set.
+	addr      string
+	nodeID    string
+	dir       string
+	bootstrap bool
+	join      string
+}
+
+func loadRaftConfig() raftConfig {
+	conf := raftConfig{
+		addr:      viper.GetString("raft.addr"),
+		nodeID:    viper.GetString("raft.node_id"),
+		dir:       viper.GetString("raft.dir"),
+		bootstrap: viper.GetBool("raft.bootstrap"),
+		join:      viper.GetString("raft.join"),
+	}
+	if conf.nodeID == "" {
+		host := viper.GetString("host")
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			// Listening on all interfaces, the clients are expected to
+			// reach the node where the other nodes do.
+			host, _, _ = net.SplitHostPort(conf.addr)
+		}
+		conf.nodeID = net.JoinHostPort(host, strconv.Itoa(viper.GetInt("port")))
+	}
+	return conf
+}
+
+type raftState struct {
+	node      *raft.Raft
+	store     *raftstore.Store
+	transport *raft.NetworkTransport
+}
+
+// startRaft joins or bootstraps the cluster. The state of the store is
+// rebuilt from the snapshots and the log, except when a new cluster is
+// bootstrapped: the data already loaded is then kept and snapshotted.
+func (s *Server) startRaft() error {
+	conf := &s.raftConf
+	if err := os.MkdirAll(conf.dir, 0700); err != nil {
+		return err
+	}
+	logger := hclog.New(&hclog.LoggerOptions{
+		Name:       "raft",
+		Level:      hclog.Info,
+		Output:     os.Stderr,
+		JSONFormat: true,
+	})
+
+	var err error
+	s.raft.store, err = raftstore.Open(filepath.Join(conf.dir, "raft.db"))
+	if err != nil {
+		return err
+	}
+	snaps, err := raft.NewFileSnapshotStoreWithLogger(conf.dir, 2, logger)
+	if err != nil {
+		return err
+	}
+	advertise, err := net.ResolveTCPAddr("tcp", conf.addr)
+	if err != nil {
+		return err
+	}
+	s.raft.transport, err = raft.NewTCPTransportWithLogger(conf.addr, advertise, 3, raftTimeout, logger)
+	if err != nil {
+		return err
+	}
+
+	exists, err := raft.HasExistingState(s.raft.store, s.raft.store, snaps)
+	if err != nil {
+		return err
+	}
+	bootstrap := conf.bootstrap && !exists
+	if !bootstrap {
+		if err := s.store.DropAll(); err != nil {
+			return err
+		}
+	}
+
+	rc := raft.DefaultConfig()
+	rc.LocalID = raft.ServerID(conf.nodeID)
+	rc.Logger = logger
+	s.raft.node, err = raft.NewRaft(rc, (*raftFSM)(s), s.raft.store, s.raft.store, snaps, s.raft.transport)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case bootstrap:
+		return s.bootstrapRaft()
+	case !exists && conf.join != "":
+		s.closer.AddRunning(1)
+		go s.joinRaft()
+	case !exists:
+		s.logger.Warn("raft node has no state, add it to a cluster with RAFT.NODE ADD",
+			zap.String("id", conf.nodeID),
+			zap.String("addr", conf.addr),
+		)
+	}
+	return nil
+}
+
+// bootstrapRaft creates a cluster made of this node. The data of the store
+// is snapshotted once the node is elected, as it's not in the log.
+func (s *Server) bootstrapRaft() error {
+	r := s.raft.node
+	err := r.BootstrapCluster(raft.Configuration{Servers: []raft.Server{{
+		ID:      raft.ServerID(s.raftConf.nodeID),
+		Address: s.raft.transport.LocalAddr(),
+	}}}).Error()
+	if err != nil {
+		return err
+	}
+	s.logger.Info("raft cluster bootstrapped", zap.String("id", s.raftConf.nodeID))
+
+	n, err := s.store.DBSize()
+	if err != nil || n == 0 {
+		return err
+	}
+	deadline := time.Now().Add(raftTimeout)
+	for {
+		// The barrier makes the snapshot cover the bootstrap.
+		err = r.Barrier(raftTimeout).Error()
+		if err != raft.ErrNotLeader || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		return err
+	}
+	return r.Snapshot().Error()
+}
+
+// joinRaft asks the node at raft.join to add this node, following the
+// redirections to the leader, until it's done.
+func (s *Server) joinRaft() {
+	defer s.closer.Done()
+	addr := s.raftConf.join
+	for {
+		err := s.requestJoin(addr)
+		if err == nil {
+			s.logger.Info("raft cluster joined", zap.String("addr", addr))
+			return
+		}
+		if e, ok := err.(client.Error); ok && strings.HasPrefix(string(e), "MOVED ") {
+			fields := strings.Fields(string(e))
+			addr = fields[len(fields)-1]
+			continue
+		}
+		s.logger.Warn("failed to join raft cluster", zap.String("addr", addr), zap.Error(err))
+		addr = s.raftConf.join
+		select {
+		case <-s.closer.HasBeenClosed():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (s *Server) requestJoin(addr string) error {
+	conn, err := client.Dial(addr, raftTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if s.password != "" {
+		if _, err := conn.Do("AUTH", s.password); err != nil {
+			return err
+		}
+	}
+	_, err = conn.Do("RAFT.NODE", "ADD", s.raftConf.nodeID, string(s.raft.transport.LocalAddr()))
+	return err
+}
+
+// stopRaft shuts the node down, the cluster keeps running without it.
+func (s *Server) stopRaft() {
+	if s.raft.node != nil {
+		if err := s.raft.node.Shutdown().Error(); err != nil {
+			s.logger.Error("failed to shut down raft", zap.Error(err))
+		}
+	}
+	if s.raft.transport != nil {
+		_ = s.raft.transport.Close()
+	}
+	if s.raft.store != nil {
+		if err := s.raft.store.Close(); err != nil {
+			s.logger.Error("failed to close raft store", zap.Error(err))
+		}
+	}
+}
+
+// propose appends the write command of c to the Raft log. The reply is
+// the one of the command applied on this node, sent once committed.
+func (s *Server) propose(c *Context) {
+	r := s.raft.node
+	if strings.EqualFold(bytesconv.BytesToString(c.cmd), "MIGRATE") {
+		// It would be run by every node.
+		c.AppendError("ERR MIGRATE is not supported in raft mode")
+		return
+	}
+	if r.State() != raft.Leader {
+		c.AppendError(s.redirection())
+		return
+	}
+
+	args := append([][]byte{c.cmd}, c.Args...)
+	data := appendCommand(nil, raftCommand(args, time.Now()))
+	c.block(func(closed <-chan struct{}) []byte {
+		f := r.Apply(data, raftTimeout)
+		if err := f.Error(); err != nil {
+			return s.raftError(err)
+		}
+		out, _ := f.Response().([]byte)
+		return out
+	})
+}
+
+// raftCommand returns args in a form which applies to the same result
+// whenever the entry is applied, on every node and when the log is
+// replayed: the relative expiration times are made absolute. Invalid
+// commands are left as is, they fail the same way everywhere.
+func raftCommand(args [][]byte, now time.Time) [][]byte {
+	abs := func(n int64, unit time.Duration) []byte {
+		return storage.FormatInt(now.Add(time.Duration(n) * unit).UnixMilli())
+	}
+	switch strings.ToUpper(bytesconv.BytesToString(args[0])) {
+	case "SET":
+		if len(args) < 3 {
+			return args
+		}
+		cmd := append([][]byte(nil), args[:3]...)
+		for i := 3; i < len(args); i++ {
+			opt := strings.ToUpper(bytesconv.BytesToString(args[i]))
+			if (opt == "EX" || opt == "PX") && i+1 < len(args) {
+				if n, err := storage.ParseInt(args[i+1]); err == nil && n > 0 {
+					unit := time.Millisecond
+					if opt == "EX" {
+						unit = time.Second
+					}
+					cmd = append(cmd, []byte("PXAT"), abs(n, unit))
+					i++
+					continue
+				}
+			}
+			cmd = append(cmd, args[i])
+		}
+		return cmd
+	case "SETEX":
+		if len(args) != 4 {
+			return args
+		}
+		if n, err := storage.ParseInt(args[2]); err == nil && n > 0 {
+			return [][]byte{[]byte("SET"), args[1], args[3], []byte("PXAT"), abs(n, time.Second)}
+		}
+	case "EXPIRE":
+		if len(args) != 3 {
+			return args
+		}
+		if n, err := storage.ParseInt(args[2]); err == nil && n > 0 {
+			return [][]byte{[]byte("PEXPIREAT"), args[1], abs(n, time.Second)}
+		}
+	case "RESTORE":
+		if len(args) < 4 {
+			return args
+		}
+		for _, arg := range args[4:] {
+			if strings.EqualFold(bytesconv.BytesToString(arg), "ABSTTL") {
+				return args
+			}
+		}
+		if n, err := storage.ParseInt(args[2]); err == nil && n > 0 {
+			cmd := append([][]byte(nil), args...)
+			cmd[2] = abs(n, time.Millisecond)
+			return append(cmd, []byte("ABSTTL"))
+		}
+	}
+	return args
+}
+
+// redirection returns the error sent to the clients which write to a node
+// which isn't the leader.
+func (s *Server) redirection() string {
+	if _, id := s.raft.node.LeaderWithID(); id != "" {
+		return "MOVED 0 " + string(id)
+	}
+	return "CLUSTERDOWN No raft leader"
+}
+
+// raftError returns the reply of a proposal or a membership change which
+// failed.
+func (s *Server) raftError(err error) []byte {
+	if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipTransferInProgress) {
+		return redcon.AppendError(nil, s.redirection())
+	}
+	return redcon.AppendError(nil, "ERR "+err.Error())
+}
+
+// RAFT.NODE ADD id address | RAFT.NODE REMOVE id
+func (s *Server) cmdRAFTNODE(c *Context) {
+	r := s.raft.node
+	if r == nil {
+		c.AppendError("ERR raft mode is not enabled")
+		return
+	}
+	if len(c.Args) < 2 {
+		c.ErrInvalidArgs()
+		return
+	}
+
+	sub := strings.ToUpper(string(c.Args[0]))
+	id := raft.ServerID(c.Args[1])
+	var change func() raft.Future
+	switch sub {
+	case "ADD":
+		if len(c.Args) != 3 {
+			c.ErrInvalidArgs()
+			return
+		}
+		addr := raft.ServerAddress(c.Args[2])
+		change = func() raft.Future { return r.AddVoter(id, addr, 0, raftTimeout) }
+	case "REMOVE":
+		if len(c.Args) != 2 {
+			c.ErrInvalidArgs()
+			return
+		}
+		change = func() raft.Future { return r.RemoveServer(id, 0, raftTimeout) }
+	default:
+		c.ErrSyntax()
+		return
+	}
+	if r.State() != raft.Leader {
+		c.AppendError(s.redirection())
+		return
+	}
+
+	c.block(func(closed <-chan struct{}) []byte {
+		if err := change().Error(); err != nil {
+			return s.raftError(err)
+		}
+		s.logger.Info("raft membership changed",
+			zap.String("change", strings.ToLower(sub)),
+			zap.String("id", string(id)),
+		)
+		return redcon.AppendOK(nil)
+	})
+}
+
+// RAFT.INFO returns the state of the node and the members of the cluster,
+// in the format of INFO.
+func (s *Server) cmdRAFTINFO(c *Context) {
+	r := s.raft.node
+	if r == nil {
+		c.AppendError("ERR raft mode is not enabled")
+		return
+	}
+	if len(c.Args) != 0 {
+		c.ErrInvalidArgs()
+		return
+	}
+
+	// The configuration is read from the Raft goroutine.
+	c.block(func(closed <-chan struct{}) []byte {
+		f := r.GetConfiguration()
+		if err := f.Error(); err != nil {
+			return s.raftError(err)
+		}
+		stats := r.Stats()
+		_, leader := r.LeaderWithID()
+
+		var b strings.Builder
+		b.WriteString("# Raft\r\n")
+		b.WriteString("node_id:" + s.raftConf.nodeID + "\r\n")
+		b.WriteString("role:" + strings.ToLower(r.State().String()) + "\r\n")
+		b.WriteString("leader_id:" + string(leader) + "\r\n")
+		for _, k := range []string{"term", "commit_index", "applied_index", "last_snapshot_index"} {
+			b.WriteString(k + ":" + stats[k] + "\r\n")
+		}
+		servers := f.Configuration().Servers
+		b.WriteString("num_nodes:" + strconv.Itoa(len(servers)) + "\r\n")
+		for i, srv := range servers {
+			b.WriteString("node" + strconv.Itoa(i) + ":id=" + string(srv.ID) +
+				",addr=" + string(srv.Address) +
+				",suffrage=" + strings.ToLower(srv.Suffrage.String()) + "\r\n")
+		}
+		return redcon.AppendBulkString(nil, b.String())
+	})
+}
@@ -0,0 +1,188 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.chensl.me/redix/server/internal/client"
+)
+
+func TestRaftCommand(t *testing.T) {
+	now := time.UnixMilli(1000000)
+	cmd := func(args ...string) [][]byte {
+		var bs [][]byte
+		for _, arg := range args {
+			bs = append(bs, []byte(arg))
+		}
+		return bs
+	}
+
+	tests := []struct {
+		args, want [][]byte
+	}{
+		{cmd("SET", "k", "v"), cmd("SET", "k", "v")},
+		{cmd("set", "k", "v", "NX", "ex", "10"), cmd("set", "k", "v", "NX", "PXAT", "1010000")},
+		{cmd("SET", "k", "v", "PX", "10", "XX"), cmd("SET", "k", "v", "PXAT", "1000010", "XX")},
+		{cmd("SET", "k", "v", "EX", "0"), cmd("SET", "k", "v", "EX", "0")},
+		{cmd("SET", "k", "v", "EXAT", "10"), cmd("SET", "k", "v", "EXAT", "10")},
+		{cmd("SETEX", "k", "10", "v"), cmd("SET", "k", "v", "PXAT", "1010000")},
+		{cmd("SETEX", "k", "x", "v"), cmd("SETEX", "k", "x", "v")},
+		{cmd("EXPIRE", "k", "10"), cmd("PEXPIREAT", "k", "1010000")},
+		{cmd("EXPIRE", "k", "-1"), cmd("EXPIRE", "k", "-1")},
+		{cmd("RESTORE", "k", "10", "p", "REPLACE"), cmd("RESTORE", "k", "1000010", "p", "REPLACE", "ABSTTL")},
+		{cmd("RESTORE", "k", "10", "p", "absttl"), cmd("RESTORE", "k", "10", "p", "absttl")},
+		{cmd("RESTORE", "k", "0", "p"), cmd("RESTORE", "k", "0", "p")},
+		{cmd("INCR", "k"), cmd("INCR", "k")},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, raftCommand(tt.args, now), "%q", tt.args)
+	}
+}
+
+type raftNode struct {
+	srv  *Server
+	conn *client.Conn
+	addr string
+}
+
+// startRaftNode runs a raft node until the end of the test, on free ports
+// unless given by cfg.
+func startRaftNode(t *testing.T, cfg map[string]interface{}) *raftNode {
+	if _, ok := cfg["port"]; !ok {
+		cfg["port"] = freePort(t)
+	}
+	if _, ok := cfg["raft.addr"]; !ok {
+		cfg["raft.addr"] = "127.0.0.1:" + strconv.Itoa(freePort(t))
+	}
+	if _, ok := cfg["raft.dir"]; !ok {
+		cfg["raft.dir"] = t.TempDir()
+	}
+	port := cfg["port"].(int)
+	srv, _ := newTestServer(t, cfg)
+	return &raftNode{
+		srv:  srv,
+		conn: serveAt(t, srv, port),
+		addr: "127.0.0.1:" + strconv.Itoa(port),
+	}
+}
+
+// raftInfo returns the fields of RAFT.INFO.
+func raftInfo(t *testing.T, c *client.Conn) map[string]string {
+	info := map[string]string{}
+	for _, line := range strings.Split(string(do(t, c, "RAFT.INFO").([]byte)), "\r\n") {
+		if kv := strings.SplitN(line, ":", 2); len(kv) == 2 {
+			info[kv[0]] = kv[1]
+		}
+	}
+	return info
+}
+
+func waitLeader(t *testing.T, n *raftNode) {
+	require.Eventually(t, func() bool {
+		return raftInfo(t, n.conn)["role"] == "leader"
+	}, 10*time.Second, 20*time.Millisecond)
+}
+
+func TestRaftCluster(t *testing.T) {
+	n1 := startRaftNode(t, map[string]interface{}{"raft.bootstrap": true})
+	waitLeader(t, n1)
+	assert.Equal(t, "OK", do(t, n1.conn, "SET", "a", "1"))
+
+	// n3 joins through n2, which redirects it to the leader.
+	n2 := startRaftNode(t, map[string]interface{}{"raft.join": n1.addr})
+	require.Eventually(t, func() bool {
+		return raftInfo(t, n1.conn)["num_nodes"] == "2"
+	}, 10*time.Second, 20*time.Millisecond)
+	n3 := startRaftNode(t, map[string]interface{}{
+		"raft.join": n2.addr,
+		"driver":    "sqlite",
+		"data_dir":  t.TempDir(),
+	})
+	require.Eventually(t, func() bool {
+		return raftInfo(t, n1.conn)["num_nodes"] == "3"
+	}, 10*time.Second, 20*time.Millisecond)
+
+	assert.Equal(t, int64(1), do(t, n1.conn, "INCR", "counter"))
+	assert.Equal(t, int64(2), do(t, n1.conn, "INCR", "counter"))
+	assert.Equal(t, "OK", do(t, n1.conn, "SET", "volatile", "v", "EX", 100))
+	assert.Equal(t, client.Error("ERR MIGRATE is not supported in raft mode"),
+		do(t, n1.conn, "MIGRATE", "127.0.0.1", 1, "a", 0, 1000))
+	for _, n := range []*raftNode{n2, n3} {
+		require.Eventually(t, func() bool {
+			return do(t, n.conn, "EXISTS", "volatile") == int64(1)
+		}, 10*time.Second, 20*time.Millisecond)
+		assert.Equal(t, []byte("1"), do(t, n.conn, "GET", "a"))
+		assert.Equal(t, []byte("2"), do(t, n.conn, "GET", "counter"))
+		assert.InDelta(t, 100, do(t, n.conn, "TTL", "volatile"), 1)
+
+		assert.Equal(t, client.Error("MOVED 0 "+n1.addr), do(t, n.conn, "SET", "b", "2"))
+		assert.Equal(t, "follower", raftInfo(t, n.conn)["role"])
+		assert.Equal(t, n1.addr, raftInfo(t, n.conn)["leader_id"])
+	}
+	assert.Equal(t, client.Error("MOVED 0 "+n1.addr), do(t, n2.conn, "RAFT.NODE", "REMOVE", n3.addr))
+	assert.Equal(t, client.Error("ERR REPLICAOF not allowed in raft mode"), do(t, n2.conn, "REPLICAOF", "NO", "ONE"))
+
+	assert.Equal(t, "OK", do(t, n1.conn, "RAFT.NODE", "REMOVE", n3.addr))
+	info := raftInfo(t, n1.conn)
+	assert.Equal(t, "2", info["num_nodes"])
+	assert.NotContains(t, info, "node2")
+}
+
+func TestRaftRestart(t *testing.T) {
+	dataDir := t.TempDir()
+	raftDir := t.TempDir()
+	port := freePort(t)
+	raftAddr := "127.0.0.1:" + strconv.Itoa(freePort(t))
+	cfg := func() map[string]interface{} {
+		return map[string]interface{}{
+			"port":           port,
+			"driver":         "sqlite",
+			"data_dir":       dataDir,
+			"raft.addr":      raftAddr,
+			"raft.dir":       raftDir,
+			"raft.bootstrap": true,
+		}
+	}
+
+	// The data of the store becomes the initial state of the cluster.
+	srv, c := newTestServer(t, map[string]interface{}{"driver": "sqlite", "data_dir": dataDir})
+	assert.Equal(t, "+OK\r\n", c.do("SET", "a", "1"))
+	require.NoError(t, srv.Cleanup())
+
+	t.Run("bootstrap", func(t *testing.T) {
+		n := startRaftNode(t, cfg())
+		waitLeader(t, n)
+		assert.Equal(t, []byte("1"), do(t, n.conn, "GET", "a"))
+		assert.Equal(t, int64(1), do(t, n.conn, "INCR", "counter"))
+		assert.Equal(t, int64(2), do(t, n.conn, "INCR", "counter"))
+		assert.Equal(t, "OK", do(t, n.conn, "SET", "volatile", "v", "EX", 100))
+		assert.Equal(t, int64(1), do(t, n.conn, "DEL", "a"))
+		assert.Equal(t, "OK", do(t, n.conn, "SET", "a", "2"))
+	})
+
+	// Rebuilt from the snapshot taken on bootstrap and the log, which is
+	// applied once committed again.
+	n := startRaftNode(t, cfg())
+	waitLeader(t, n)
+	require.Eventually(t, func() bool {
+		v, _ := do(t, n.conn, "GET", "counter").([]byte)
+		return string(v) == "2"
+	}, 10*time.Second, 20*time.Millisecond)
+	assert.Equal(t, []byte("2"), do(t, n.conn, "GET", "a"))
+	// The expiration time was logged, not the TTL.
+	assert.InDelta(t, 95, do(t, n.conn, "TTL", "volatile"), 5)
+	assert.Equal(t, int64(3), do(t, n.conn, "DBSIZE"))
+
+	files, err := filepath.Glob(filepath.Join(raftDir, "snapshots", "*"))
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+}
@@ -0,0 +1,186 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/raft"
+	"github.com/tidwall/redcon"
+	"go.uber.org/zap"
+)
+
+// raftFSM applies the committed commands to the store. Its snapshots are
+// backups, see Backup, archived with tar.
+type raftFSM Server
+
+func (f *raftFSM) Apply(l *raft.Log) interface{} {
+	s := (*Server)(f)
+	_, args, _, _, err := redcon.ReadNextCommand(l.Data, nil)
+	if err != nil || len(args) == 0 {
+		s.logger.Error("invalid raft log entry", zap.Uint64("index", l.Index), zap.Error(err))
+		return redcon.AppendError(nil, "ERR invalid raft log entry")
+	}
+	cmd := s.lookup(args[0])
+	if cmd == nil {
+		return redcon.AppendError(nil, "ERR unknown command '"+string(args[0])+"'.")
+	}
+
+	var out []byte
+	c := &Context{out: &out, cmd: args[0], Args: args[1:]}
+	// The snapshots taken for PSYNC are consistent meanwhile.
+	s.repl.applyMu.Lock()
+	cmd.fn(c)
+	s.repl.applyMu.Unlock()
+	return out
+}
+
+// Snapshot backs the store up while the commands aren't applied, so that
+// the backup matches the index of the snapshot.
+func (f *raftFSM) Snapshot() (raft.FSMSnapshot, error) {
+	s := (*Server)(f)
+	dir, err := os.MkdirTemp(s.raftConf.dir, "snapshot-")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.writeBackup(dir); err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, err
+	}
+	return raftSnapshot(dir), nil
+}
+
+// Restore replaces the data of the store with the snapshot.
+func (f *raftFSM) Restore(rc io.ReadCloser) error {
+	s := (*Server)(f)
+	defer rc.Close()
+	dir, err := os.MkdirTemp(s.raftConf.dir, "restore-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir) //nolint:errcheck
+	if err := untar(rc, dir); err != nil {
+		return err
+	}
+	// The extracted backup is ours to modify, unlike those of RestoreBackup.
+	m, err := readManifest(dir)
+	if err != nil {
+		return err
+	}
+
+	s.repl.applyMu.Lock()
+	defer s.repl.applyMu.Unlock()
+	if err := s.store.DropAll(); err != nil {
+		return err
+	}
+	s.propagate([]byte("FLUSHALL"))
+	return s.loadBackup(dir, m)
+}
+
+// raftSnapshot is the directory of a backup.
+type raftSnapshot string
+
+func (dir raftSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := tarDir(sink, string(dir)); err != nil {
+		_ = sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (dir raftSnapshot) Release() {
+	_ = os.RemoveAll(string(dir))
+}
+
+// tarDir writes the files of dir to w, with paths relative to dir.
+func tarDir(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() && !info.IsDir() {
+			return fmt.Errorf("snapshot: unexpected file %s", path)
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		if hdr.Name, err = filepath.Rel(dir, path); err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(hdr.Name)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(tw, file)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// untar extracts the archive written by tarDir into dir.
+func untar(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("snapshot: invalid path %q", hdr.Name)
+		}
+		path := filepath.Join(dir, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+				return err
+			}
+			file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(file, tr)
+			if cerr := file.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("snapshot: unexpected entry %q", hdr.Name)
+		}
+	}
+}
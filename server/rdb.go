@@ -0,0 +1,215 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.chensl.me/redix/server/internal/rdb"
+	"go.chensl.me/redix/server/internal/storage"
+	"go.chensl.me/redix/server/pkg/bytesconv"
+	"go.uber.org/zap"
+)
+
+// LoadRDB imports every string key of database 0 from the RDB file at path
+// into the store, overwriting existing keys. Keys of other types or
+// databases and keys which have already expired are skipped. The imported
+// keys are added to the AOF, if enabled.
+func (s *Server) LoadRDB(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	start := time.Now()
+	st, err := s.loadRDB(bufio.NewReaderSize(f, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	s.logger.Info("RDB loaded",
+		zap.String("path", path),
+		zap.Int("keys", st.loaded),
+		zap.Int("expired", st.expired),
+		zap.Int("skipped", st.skipped),
+		zap.Duration("elapsed", time.Since(start)),
+	)
+	return nil
+}
+
+type loadStats struct {
+	loaded, expired, skipped int
+}
+
+// loadRDB imports an RDB file from r, see LoadRDB.
+func (s *Server) loadRDB(r io.Reader) (loadStats, error) {
+	var st loadStats
+	err := rdb.Parse(r, func(e *rdb.Entry) error {
+		if e.DB != 0 || e.Type != rdb.TypeString {
+			st.skipped++
+			return nil
+		}
+		var ttl time.Duration
+		if !e.ExpiresAt.IsZero() {
+			if ttl = time.Until(e.ExpiresAt); ttl <= 0 {
+				st.expired++
+				return nil
+			}
+		}
+		if err := s.store.Set(e.Key, e.Value, storage.SetOptions{TTL: ttl}); err != nil {
+			return err
+		}
+		if ttl > 0 {
+			s.propagate([]byte("SET"), e.Key, e.Value, []byte("PXAT"), storage.FormatInt(e.ExpiresAt.UnixMilli()))
+		} else {
+			s.propagate([]byte("SET"), e.Key, e.Value)
+		}
+		st.loaded++
+		return nil
+	})
+	if err != nil {
+		return st, err
+	}
+	if s.aof != nil {
+		if err := s.aof.Flush(); err != nil {
+			return st, err
+		}
+	}
+	return st, nil
+}
+
+// SaveRDB writes a snapshot of the store to path as an RDB file. The file
+// is written to a temporary file first and renamed once complete.
+func (s *Server) SaveRDB(path string) error {
+	tmp := filepath.Join(filepath.Dir(path), fmt.Sprintf("temp-%d.rdb", os.Getpid()))
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp) //nolint:errcheck
+
+	if err := s.writeRDB(f); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *Server) writeRDB(w io.Writer) error {
+	size, err := s.store.DBSize()
+	if err != nil {
+		return err
+	}
+	return encodeRDB(w, uint64(size), s.store.ForEach)
+}
+
+// encodeRDB writes the keys enumerated by forEach as an RDB file. size is
+// a hint for the number of keys.
+func encodeRDB(w io.Writer, size uint64, forEach func(fn func(key, value []byte, expiresAt time.Time) error) error) error {
+	enc := rdb.NewEncoder(w)
+	if err := enc.WriteHeader(); err != nil {
+		return err
+	}
+	if err := enc.WriteAux("redis-bits", strconv.Itoa(strconv.IntSize)); err != nil {
+		return err
+	}
+	if err := enc.WriteAux("ctime", strconv.FormatInt(time.Now().Unix(), 10)); err != nil {
+		return err
+	}
+	if err := enc.WriteSelectDB(0, size, 0); err != nil {
+		return err
+	}
+	err := forEach(func(key, value []byte, expiresAt time.Time) error {
+		return enc.WriteString(key, value, expiresAt)
+	})
+	if err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+func (s *Server) cmdSAVE(c *Context) {
+	if len(c.Args) != 0 {
+		c.ErrInvalidArgs()
+		return
+	}
+
+	if !atomic.CompareAndSwapInt32(&s.saving, 0, 1) {
+		c.AppendError("ERR Background save already in progress")
+		return
+	}
+	defer atomic.StoreInt32(&s.saving, 0)
+
+	if err := s.save(); err != nil {
+		c.AppendError("ERR " + err.Error())
+		return
+	}
+
+	c.AppendOK()
+}
+
+func (s *Server) cmdBGSAVE(c *Context) {
+	if len(c.Args) > 1 {
+		c.ErrInvalidArgs()
+		return
+	}
+	if len(c.Args) == 1 && strings.ToUpper(bytesconv.BytesToString(c.Args[0])) != "SCHEDULE" {
+		c.ErrSyntax()
+		return
+	}
+
+	if !atomic.CompareAndSwapInt32(&s.saving, 0, 1) {
+		c.AppendError("ERR Background save already in progress")
+		return
+	}
+
+	// Cleanup waits for the save before closing the store.
+	s.closer.AddRunning(1)
+	go func() {
+		defer s.closer.Done()
+		defer atomic.StoreInt32(&s.saving, 0)
+		_ = s.save()
+	}()
+
+	c.AppendString("Background saving started")
+}
+
+func (s *Server) cmdLASTSAVE(c *Context) {
+	if len(c.Args) != 0 {
+		c.ErrInvalidArgs()
+		return
+	}
+
+	c.AppendInt(atomic.LoadInt64(&s.lastSave))
+}
+
+func (s *Server) save() error {
+	path := viper.GetString("rdb_file")
+	start := time.Now()
+	if err := s.SaveRDB(path); err != nil {
+		s.logger.Error("failed to save RDB", zap.String("path", path), zap.Error(err))
+		return err
+	}
+	atomic.StoreInt64(&s.lastSave, time.Now().Unix())
+	s.logger.Info("RDB saved", zap.String("path", path), zap.Duration("elapsed", time.Since(start)))
+	return nil
+}
@@ -5,18 +5,28 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/dgraph-io/ristretto/z"
 	"github.com/spf13/viper"
 	"github.com/tidwall/evio"
 	"github.com/tidwall/redcon"
+	"go.chensl.me/redix/server/internal/aof"
+	"go.chensl.me/redix/server/internal/cluster"
+	"go.chensl.me/redix/server/internal/runid"
 	"go.chensl.me/redix/server/internal/storage"
-	"go.chensl.me/redix/server/internal/storage/badger"
-	"go.chensl.me/redix/server/internal/storage/bitcask"
-	"go.chensl.me/redix/server/internal/storage/boltdb"
+	"go.chensl.me/redix/server/internal/storage/cache"
 	"go.chensl.me/redix/server/pkg/bytesconv"
 	"go.uber.org/zap"
 )
@@ -24,47 +34,182 @@ import (
 type CommandFunc func(c *Context)
 
 type Server struct {
-	commands map[string]CommandFunc
+	commands map[string]*command
 	password string
+	driver   string
 	store    storage.Interface
 	logger   *zap.Logger
+	aof      *aof.AOF
+	saving   int32
+	lastSave int64
+
+	numLoops    int
+	loadBalance evio.LoadBalance
+	// execMu is held by the write commands, see exec.
+	execMu sync.Mutex
+	// offloaded are the flags of the commands run by workers, see offload.
+	offloaded commandFlags
+	workers   *workerPool
+	// batcher runs the pipelined writes in batches, see runBatch.
+	batcher storage.Batcher
+	// inflight is the number of blocked commands, which a shutdown waits
+	// for.
+	inflight        int64
+	shut            shutdownState
+	shutdownTimeout time.Duration
+
+	evict evictState
+
+	clients clientsState
+	pubsub  pubsubState
+	track   trackingState
+	// cache is the read-through cache of store, if cache_size is set.
+	cache     *cache.Storage
+	cacheSize int64
+	started   time.Time
+
+	backingUp int32
+	// closer stops the scheduled backups and the replication, and waits
+	// for them and the background saves and AOF rewrites.
+	closer *z.Closer
+	admin  *http.Server
+
+	repl     replState
+	replConf replConfig
+
+	raft     raftState
+	raftConf raftConfig
+
+	cluster *cluster.Cluster
+	// slotKeys indexes the keys by slot in cluster mode, see indexSlots.
+	slotKeys *cluster.SlotKeys
 }
 
 func New() (*Server, error) {
 	srv := &Server{
-		commands: make(map[string]CommandFunc),
+		commands: make(map[string]*command),
 		password: viper.GetString("password"),
+		driver:   viper.GetString("driver"),
+		numLoops: viper.GetInt("num_loops"),
+
+		shutdownTimeout: viper.GetDuration("shutdown_timeout"),
+		cacheSize:       int64(viper.GetSizeInBytes("cache_size")),
+		started:         time.Now(),
+		closer:          z.NewCloser(0),
+		replConf:        loadReplConfig(),
+		raftConf:        loadRaftConfig(),
 	}
+	srv.repl.id = runid.New()
+	srv.track.maxKeys = viper.GetInt("tracking_table_max_keys")
 	logger, err := zap.NewProduction()
 	if err != nil {
 		return nil, err
 	}
-	srv.logger = logger
-	dir := viper.GetString("data_dir")
-	driver := viper.GetString("driver")
-	if driver == "badger" {
-		srv.store, err = badger.NewStorage(dir, logger)
-	} else if driver == "boltdb" {
-		srv.store, err = boltdb.NewStorage(filepath.Join(dir, "redix.db"), logger)
-	} else if driver == "bitcask" {
-		srv.store, err = bitcask.NewStorage(dir, logger)
-	} else {
-		logger.Fatal("unknown driver", zap.String("driver", driver))
+	if srv.loadBalance, err = parseLoadBalance(viper.GetString("load_balance")); err != nil {
+		return nil, err
+	}
+	if srv.offloaded, err = loadOffloaded(); err != nil {
+		return nil, err
 	}
+	srv.workers = newWorkerPool(viper.GetInt("offload_workers"))
+	srv.logger = logger
+	srv.store, err = OpenStorage(srv.driver, viper.GetString("data_dir"), logger)
 	if err != nil {
 		return nil, err
 	}
+	if srv.cacheSize > 0 {
+		if srv.cache, err = cache.New(srv.store, srv.cacheSize); err != nil {
+			_ = srv.store.Close()
+			return nil, err
+		}
+		srv.store = srv.cache
+	}
+	// The cache runs the batches of the driver, if it has them.
+	if _, ok := storage.Unwrap(srv.store).(storage.Batcher); ok && viper.GetBool("batch_writes") {
+		srv.batcher = srv.store.(storage.Batcher)
+	}
 	srv.initCommands()
+	if err := srv.load(); err != nil {
+		_ = srv.Cleanup()
+		return nil, err
+	}
+	srv.lastSave = time.Now().Unix()
+	if srv.raftConf.addr != "" {
+		if err := srv.startRaft(); err != nil {
+			_ = srv.Cleanup()
+			return nil, err
+		}
+	}
+	if viper.GetBool("cluster.enabled") {
+		if err := srv.openCluster(); err != nil {
+			_ = srv.Cleanup()
+			return nil, err
+		}
+	}
+	if master := viper.GetString("replicaof"); master != "" {
+		host, port, err := parseReplicaOf(master)
+		if err != nil {
+			_ = srv.Cleanup()
+			return nil, err
+		}
+		srv.replicaOf(host, port)
+	}
 	return srv, nil
 }
 
-func (s *Server) Run() error {
-	events := evio.Events{
-		NumLoops: 1,
-		Opened:   s.openedHandler,
-		Data:     s.dataHandler,
+// load replays the AOF, if enabled, then restores the configured backup and
+// imports the configured RDB file.
+func (s *Server) load() error {
+	if s.replConf.backlogSize <= 0 {
+		return errors.New("repl_backlog_size must be positive")
+	}
+	if s.raftConf.addr != "" {
+		// The Raft log takes their place.
+		if viper.GetBool("appendonly") || viper.GetString("replicaof") != "" {
+			return errors.New("appendonly and replicaof can't be used in raft mode")
+		}
+	}
+	if viper.GetBool("cluster.enabled") && (s.raftConf.addr != "" || viper.GetString("replicaof") != "") {
+		return errors.New("raft and replicaof can't be used in cluster mode")
+	}
+	if err := s.loadEviction(); err != nil {
+		return err
+	}
+	if viper.GetBool("appendonly") {
+		if s.driver != "memory" {
+			return errors.New("appendonly requires the memory driver")
+		}
+		if err := s.openAOF(); err != nil {
+			return err
+		}
 	}
 
+	if path := viper.GetString("backup_restore"); path != "" {
+		if err := s.restoreBackup(path); err != nil {
+			return err
+		}
+	}
+	if path := viper.GetString("rdb_import"); path != "" {
+		return s.importRDB(path)
+	}
+	return nil
+}
+
+// importRDB loads the RDB file at path unless the store already has data,
+// so that the option can be left in the configuration.
+func (s *Server) importRDB(path string) error {
+	n, err := s.store.DBSize()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		s.logger.Info("store is not empty, skipping RDB import", zap.String("path", path))
+		return nil
+	}
+	return s.LoadRDB(path)
+}
+
+func (s *Server) Run() error {
 	path, err := filepath.Abs(viper.GetString("data_dir"))
 	if err != nil {
 		s.logger.Error("failed to get absolute path", zap.Error(err))
@@ -76,27 +221,143 @@ func (s *Server) Run() error {
 		zap.Int("port", viper.GetInt("port")),
 		zap.String("data_dir", path),
 		zap.String("driver", viper.GetString("driver")),
+		zap.Int("num_loops", s.numLoops),
 	)
 
+	if interval := viper.GetDuration("backup_interval"); interval > 0 {
+		s.closer.AddRunning(1)
+		go s.runScheduledBackups(interval)
+	}
+	if addr := viper.GetString("admin_addr"); addr != "" {
+		s.startAdmin(addr)
+	}
+
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	done := make(chan struct{})
+	defer close(done)
+	go s.handleSignals(sigs, done)
+
 	addr := fmt.Sprintf("tcp://%s:%d", viper.GetString("host"), viper.GetInt("port"))
-	return evio.Serve(events, addr)
+	if err := evio.Serve(s.events(), addr); err != nil {
+		return err
+	}
+	s.logger.Info("redix server stopped")
+	return nil
+}
+
+func (s *Server) events() evio.Events {
+	return evio.Events{
+		NumLoops:    s.numLoops,
+		LoadBalance: s.loadBalance,
+		Opened:      s.openedHandler,
+		Closed:      s.closedHandler,
+		Detached:    s.detachedHandler,
+		Data:        s.dataHandler,
+		Tick:        s.tickHandler,
+	}
+}
+
+// parseLoadBalance parses the load_balance option, which distributes the
+// connections between the event loops.
+func parseLoadBalance(s string) (evio.LoadBalance, error) {
+	switch strings.ToLower(s) {
+	case "", "random":
+		return evio.Random, nil
+	case "round-robin":
+		return evio.RoundRobin, nil
+	case "least-connections":
+		return evio.LeastConnections, nil
+	}
+	return 0, fmt.Errorf("invalid load_balance %q", s)
 }
 
 func (s *Server) Cleanup() error {
+	if s.admin != nil {
+		if err := s.admin.Shutdown(context.Background()); err != nil {
+			s.logger.Error("failed to shut down admin server", zap.Error(err))
+		}
+	}
+	s.repl.mu.Lock()
+	m := s.repl.master
+	s.repl.mu.Unlock()
+	if m != nil {
+		m.close()
+	}
+	s.disconnectReplicas()
+	// Waits for a running scheduled backup, BGSAVE, BGREWRITEAOF and the
+	// replication.
+	s.closer.SignalAndWait()
+	s.workers.close()
+	s.stopRaft()
+	if s.cluster != nil {
+		if err := s.cluster.Close(); err != nil {
+			s.logger.Error("failed to close cluster bus", zap.Error(err))
+		}
+	}
+	if s.aof != nil {
+		if err := s.aof.Close(); err != nil {
+			s.logger.Error("failed to close AOF", zap.Error(err))
+		}
+	}
 	return s.store.Close()
 }
 
-func (s *Server) register(cmd string, fn CommandFunc) {
-	s.commands[strings.ToUpper(cmd)] = fn
+// exec runs a command. The write commands run one at a time, so that they
+// are propagated in the order they are applied, and so do the commands
+// taking a snapshot, e.g. PSYNC, which must match a point of the
+// replication stream. The other commands run concurrently, on the event
+// loops and the workers, see offload.
+func (s *Server) exec(c *Context, cmd *command) {
+	if c.batch != nil || !cmd.is(flagWrite|flagSnapshot) {
+		// A batch already holds execMu.
+		cmd.fn(c)
+		return
+	}
+	s.execMu.Lock()
+	defer s.execMu.Unlock()
+	if cmd.is(flagGrow) {
+		if err := s.evictIfNeeded(); err != nil {
+			c.AppendError(err.Error())
+			return
+		}
+	}
+	if s.raft.node != nil && cmd.is(flagWrite) {
+		s.propose(c)
+	} else {
+		cmd.fn(c)
+	}
 }
 
 func (s *Server) openedHandler(ec evio.Conn) (out []byte, opts evio.Options, action evio.Action) {
-	ec.SetContext(new(Context))
+	c := &Context{conn: ec}
+	ec.SetContext(c)
+	s.addClient(c)
+	if s.closing() {
+		out = redcon.AppendError(out, "ERR Server is shutting down")
+		action = evio.Close
+		return //nolint:nakedret
+	}
 	opts.ReuseInputBuffer = true
 	opts.TCPKeepAlive = 300 * time.Second
 	return //nolint:nakedret
 }
 
+func (s *Server) closedHandler(ec evio.Conn, err error) (action evio.Action) {
+	c := ec.Context().(*Context)
+	if c.closed != nil {
+		close(c.closed)
+	}
+	if c.inflight {
+		atomic.AddInt64(&s.inflight, -1)
+	}
+	s.removeClient(c)
+	s.untrack(c.id)
+	s.unsubscribeAll(c)
+	return
+}
+
 func (s *Server) dataHandler(ec evio.Conn, in []byte) (out []byte, action evio.Action) {
 	defer func() {
 		if err := recover(); err != nil {
@@ -111,11 +372,29 @@ func (s *Server) dataHandler(ec evio.Conn, in []byte) (out []byte, action evio.A
 	}()
 
 	c := ec.Context().(*Context)
+	if c.blocked != nil {
+		select {
+		case reply := <-c.blocked:
+			c.blocked = nil
+			if c.inflight {
+				c.inflight = false
+				atomic.AddInt64(&s.inflight, -1)
+			}
+			out = append(out, reply...)
+			// The commands queued meanwhile are served during a shutdown.
+			c.resumed = true
+		default:
+			// Keep the input until the blocking command returns.
+			c.is.End(c.is.Begin(in))
+			out = c.appendPushed(out)
+			return //nolint:nakedret
+		}
+	}
 	data := c.is.Begin(in)
 	var complete bool
 	var err error
 	var args [][]byte
-	for action == evio.None {
+	for action == evio.None && c.blocked == nil {
 		complete, args, _, data, err = redcon.ReadNextCommand(data, args[:0])
 		if err != nil {
 			action = evio.Close
@@ -125,52 +404,110 @@ func (s *Server) dataHandler(ec evio.Conn, in []byte) (out []byte, action evio.A
 		if !complete {
 			break
 		}
-		cmd := strings.ToUpper(bytesconv.BytesToString(args[0]))
-		if cmd != "AUTH" && s.password != "" && !c.auth {
-			out = redcon.AppendError(out, "ERROR Authentication required.")
+		if s.batches(s.lookup(args[0])) {
+			out, data, action = s.runBatch(c, args, data, out)
 			continue
 		}
-		if len(args) > 0 {
-			switch cmd {
-			default:
-				if fn, ok := s.commands[cmd]; ok {
-					c.cmd = args[0]
-					c.Args = args[1:]
-					c.out = &out
-					fn(c)
-				} else {
-					s.logger.Warn("unknown command",
-						zap.ByteString("cmd", args[0]),
-						zap.ByteStrings("args", args[1:]),
-					)
-					out = redcon.AppendError(out, "ERR unknown command '"+string(args[0])+"'.")
-				}
-			case "AUTH":
-				if len(args) != 2 {
-					out = redcon.AppendError(out, "ERR wrong number of arguments for '"+string(args[0])+"' command.")
-				} else if bytesconv.BytesToString(args[1]) != s.password {
-					out = redcon.AppendError(out, "ERROR WRONGPASS invalid username-password pair or user is disabled.")
-				} else {
-					c.auth = true
-					out = redcon.AppendOK(out)
-				}
-			case "PING":
-				if len(args) > 2 {
-					out = redcon.AppendError(out, "ERR wrong number of arguments for '"+string(args[0])+"' command.")
-				} else if len(args) == 2 {
-					out = redcon.AppendBulk(out, args[1])
-				} else {
-					out = redcon.AppendString(out, "PONG")
-				}
-			case "QUIT":
-				out = redcon.AppendOK(out)
-				action = evio.Close
-			case "SHUTDOWN":
-				out = redcon.AppendOK(out)
-				action = evio.Shutdown
-			}
-		}
+		out, action = s.runCommand(c, args, out)
 	}
 	c.is.End(data)
+	c.resumed = false
+	out = c.appendPushed(out)
+	if s.stopping() {
+		action = evio.Shutdown
+	}
+	if s.aof != nil {
+		// Write the commands to the AOF before the replies are sent.
+		if err := s.aof.Flush(); err != nil {
+			s.logger.Error("failed to write AOF", zap.Error(err))
+		}
+	}
 	return //nolint:nakedret
 }
+
+// runCommand runs a complete command and appends its reply to out.
+func (s *Server) runCommand(c *Context, args [][]byte, out []byte) ([]byte, evio.Action) {
+	cmd := strings.ToUpper(bytesconv.BytesToString(args[0]))
+	if cmd != "AUTH" && s.password != "" && !c.auth {
+		return redcon.AppendError(out, "ERROR Authentication required."), evio.None
+	}
+	if s.closing() && !c.resumed && cmd != "SHUTDOWN" {
+		return redcon.AppendError(out, "ERR Server is shutting down"), evio.None
+	}
+	command := s.commands[cmd]
+	if len(c.channels) > 0 && !c.resp3 && cmd != "PING" && cmd != "QUIT" && !command.is(flagPubSub) {
+		return redcon.AppendError(out, "ERR Can't execute '"+strings.ToLower(cmd)+
+			"': only SUBSCRIBE / UNSUBSCRIBE / PING / QUIT are allowed in this context"), evio.None
+	}
+	// CLIENT CACHING applies to the next command only.
+	caching := c.caching
+	c.caching = 0
+	action := evio.None
+	switch cmd {
+	default:
+		if command == nil {
+			s.logger.Warn("unknown command",
+				zap.ByteString("cmd", args[0]),
+				zap.ByteStrings("args", args[1:]),
+			)
+			return redcon.AppendError(out, "ERR unknown command '"+string(args[0])+"'."), evio.None
+		}
+		if s.readOnly(command) {
+			return redcon.AppendError(out, "READONLY You can't write against a read only replica."), evio.None
+		}
+		if s.cluster != nil {
+			asking := c.asking
+			c.asking = false
+			if msg := s.clusterRedirection(command, args, asking); msg != "" {
+				return redcon.AppendError(out, msg), evio.None
+			}
+		}
+		if c.tracking && command.is(flagRead) {
+			// The keys are tracked before they are read, so that a write
+			// in between is never missed.
+			s.trackRead(c, command, args, caching)
+		}
+		c.cmd = args[0]
+		c.Args = args[1:]
+		c.out = &out
+		if s.offloads(command) {
+			s.offload(c, command)
+		} else {
+			s.exec(c, command)
+		}
+		if c.blocked != nil && cmd != "SHUTDOWN" {
+			atomic.AddInt64(&s.inflight, 1)
+			c.inflight = true
+		}
+		action, c.action = c.action, evio.None
+	case "AUTH":
+		if len(args) != 2 {
+			out = redcon.AppendError(out, "ERR wrong number of arguments for '"+string(args[0])+"' command.")
+		} else if bytesconv.BytesToString(args[1]) != s.password {
+			out = redcon.AppendError(out, "ERROR WRONGPASS invalid username-password pair or user is disabled.")
+		} else {
+			c.auth = true
+			out = redcon.AppendOK(out)
+		}
+	case "PING":
+		if len(args) > 2 {
+			out = redcon.AppendError(out, "ERR wrong number of arguments for '"+string(args[0])+"' command.")
+		} else if len(c.channels) > 0 && !c.resp3 {
+			out = redcon.AppendArray(out, 2)
+			out = redcon.AppendBulkString(out, "pong")
+			if len(args) == 2 {
+				out = redcon.AppendBulk(out, args[1])
+			} else {
+				out = redcon.AppendBulkString(out, "")
+			}
+		} else if len(args) == 2 {
+			out = redcon.AppendBulk(out, args[1])
+		} else {
+			out = redcon.AppendString(out, "PONG")
+		}
+	case "QUIT":
+		out = redcon.AppendOK(out)
+		action = evio.Close
+	}
+	return out, action
+}
@@ -0,0 +1,192 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/evio"
+	"go.chensl.me/redix/server/internal/client"
+	"go.chensl.me/redix/server/internal/config"
+)
+
+// testConn feeds commands to the data handler like a client connection.
+type testConn struct {
+	t   testing.TB
+	srv *Server
+	ctx interface{}
+	// woken receives the wake-ups of the blocked commands.
+	woken chan struct{}
+}
+
+func (c *testConn) Context() interface{}       { return c.ctx }
+func (c *testConn) SetContext(ctx interface{}) { c.ctx = ctx }
+func (c *testConn) AddrIndex() int             { return 0 }
+func (c *testConn) LocalAddr() net.Addr        { return nil }
+func (c *testConn) RemoteAddr() net.Addr       { return nil }
+
+func (c *testConn) Wake() {
+	select {
+	case c.woken <- struct{}{}:
+	default:
+	}
+}
+
+// do runs a command and returns the raw RESP reply. The reply of an
+// offloaded command is waited for.
+func (c *testConn) do(args ...string) string {
+	in := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		in = append(in, "$"+strconv.Itoa(len(arg))+"\r\n"+arg+"\r\n"...)
+	}
+	out, action := c.srv.dataHandler(c, in)
+	if c.srv.offloads(c.srv.lookup([]byte(args[0]))) && c.ctx.(*Context).blocked != nil {
+		<-c.woken
+		out, action = c.srv.dataHandler(c, nil)
+	}
+	if action != evio.None {
+		c.t.Fatalf("unexpected action %v", action)
+	}
+	return string(out)
+}
+
+// newTestServer creates a server with the memory driver, cfg overrides the
+// configuration. The caller must call Cleanup.
+func newTestServer(t testing.TB, cfg map[string]interface{}) (*Server, *testConn) {
+	viper.Reset()
+	config.SetDefaults()
+	viper.Set("driver", "memory")
+	for k, v := range cfg {
+		viper.Set(k, v)
+	}
+	t.Cleanup(viper.Reset)
+
+	srv, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testConn{t: t, srv: srv, woken: make(chan struct{}, 1)}
+	srv.openedHandler(c)
+	return srv, c
+}
+
+func TestLoops(t *testing.T) {
+	_, err := parseLoadBalance("fastest")
+	assert.EqualError(t, err, `invalid load_balance "fastest"`)
+
+	master, _ := newTestServer(t, map[string]interface{}{
+		"num_loops":    4,
+		"load_balance": "round-robin",
+	})
+	m, port := serve(t, master)
+	replica, _ := newTestServer(t, map[string]interface{}{
+		"replicaof": "127.0.0.1 " + strconv.Itoa(port),
+	})
+	r, _ := serve(t, replica)
+	waitConnected(t, r)
+
+	// The clients are spread over the loops, the replica must apply their
+	// writes in the order of the master.
+	const clients, incrs = 8, 100
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := client.Dial("127.0.0.1:"+strconv.Itoa(port), 5*time.Second)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer conn.Close()
+			for j := 0; j < incrs; j++ {
+				_, err := conn.Do("INCR", "counter")
+				assert.NoError(t, err)
+				_, err = conn.Do("SET", "last", i)
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(1), do(t, m, "WAIT", 1, 5000))
+	assert.Equal(t, []byte(strconv.Itoa(clients*incrs)), do(t, m, "GET", "counter"))
+	assert.Equal(t, do(t, m, "GET", "last"), do(t, r, "GET", "last"))
+	assert.Equal(t, do(t, m, "GET", "counter"), do(t, r, "GET", "counter"))
+}
+
+// BenchmarkLoops runs GET and SET like redis-benchmark, 50 clients sending
+// pipelines of 16 commands, with one and several event loops:
+//
+//	go test -run - -bench Loops -cpu 8
+func BenchmarkLoops(b *testing.B) {
+	const clients, pipeline = 50, 16
+
+	for _, driver := range []string{"memory", "boltdb"} {
+		for _, loops := range []int{1, 4} {
+			for _, cmd := range []string{"GET", "SET"} {
+				name := driver + "/loops=" + strconv.Itoa(loops) + "/" + cmd
+				b.Run(name, func(b *testing.B) {
+					srv, _ := newTestServer(b, map[string]interface{}{
+						"driver":    driver,
+						"data_dir":  b.TempDir(),
+						"num_loops": loops,
+					})
+					_, port := serve(b, srv)
+					addr := "127.0.0.1:" + strconv.Itoa(port)
+					conn, err := client.Dial(addr, 5*time.Second)
+					require.NoError(b, err)
+					defer conn.Close()
+					_, err = conn.Do("SET", "key:__rand_int__", "xxx")
+					require.NoError(b, err)
+
+					b.SetParallelism((clients + runtime.GOMAXPROCS(0) - 1) / runtime.GOMAXPROCS(0))
+					b.ResetTimer()
+					b.RunParallel(func(pb *testing.PB) {
+						conn, err := client.Dial(addr, 5*time.Second)
+						if err != nil {
+							b.Error(err)
+							return
+						}
+						defer conn.Close()
+						for more := true; more; {
+							n := 0
+							for ; n < pipeline && pb.Next(); n++ {
+								if cmd == "GET" {
+									err = conn.Send("GET", "key:__rand_int__")
+								} else {
+									err = conn.Send("SET", "key:__rand_int__", "xxx")
+								}
+								if err != nil {
+									b.Error(err)
+									return
+								}
+							}
+							more = n == pipeline
+							if err := conn.Flush(); err != nil {
+								b.Error(err)
+								return
+							}
+							for ; n > 0; n-- {
+								if _, err := conn.Receive(); err != nil {
+									b.Error(err)
+									return
+								}
+							}
+						}
+					})
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,489 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/redcon"
+	"go.chensl.me/redix/server/internal/backlog"
+	"go.chensl.me/redix/server/internal/client"
+	"go.chensl.me/redix/server/internal/runid"
+	"go.chensl.me/redix/server/pkg/bytesconv"
+	"go.uber.org/zap"
+)
+
+type linkState int32
+
+const (
+	replConnect linkState = iota
+	replConnecting
+	replSync
+	replConnected
+)
+
+func (st linkState) String() string {
+	switch st {
+	case replConnecting:
+		return "connecting"
+	case replSync:
+		return "sync"
+	case replConnected:
+		return "connected"
+	}
+	return "connect"
+}
+
+// masterLink is the connection of a replica to its master.
+type masterLink struct {
+	host  string
+	port  int
+	state int32
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	// mu guards conn and serializes the writes to it.
+	mu   sync.Mutex
+	conn net.Conn
+	// done is closed when runReplication returns.
+	done chan struct{}
+}
+
+func newMasterLink(host string, port int) *masterLink {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &masterLink{
+		host:   host,
+		port:   port,
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+}
+
+func (m *masterLink) addr() string {
+	return net.JoinHostPort(m.host, strconv.Itoa(m.port))
+}
+
+func (m *masterLink) getState() linkState {
+	return linkState(atomic.LoadInt32(&m.state))
+}
+
+func (m *masterLink) setState(st linkState) {
+	atomic.StoreInt32(&m.state, int32(st))
+}
+
+// setConn reports false if the link has been closed meanwhile.
+func (m *masterLink) setConn(conn net.Conn) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ctx.Err() != nil {
+		return false
+	}
+	m.conn = conn
+	return true
+}
+
+// close stops the replication, the current connection is closed.
+func (m *masterLink) close() {
+	m.cancel()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conn != nil {
+		_ = m.conn.Close()
+	}
+}
+
+func (m *masterLink) send(timeout time.Duration, args ...[]byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_ = m.conn.SetWriteDeadline(time.Now().Add(timeout))
+	_, err := m.conn.Write(appendCommand(nil, args))
+	return err
+}
+
+// timeoutConn sets the read deadline before every Read.
+type timeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c timeoutConn) Read(p []byte) (int, error) {
+	_ = c.SetReadDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(p)
+}
+
+// REPLICAOF host port | NO ONE
+func (s *Server) cmdREPLICAOF(c *Context) {
+	if len(c.Args) != 2 {
+		c.ErrInvalidArgs()
+		return
+	}
+	if s.raft.node != nil {
+		c.AppendError("ERR REPLICAOF not allowed in raft mode")
+		return
+	}
+	if s.cluster != nil {
+		c.AppendError("ERR REPLICAOF not allowed in cluster mode.")
+		return
+	}
+
+	if strings.EqualFold(string(c.Args[0]), "NO") && strings.EqualFold(string(c.Args[1]), "ONE") {
+		s.promote()
+		c.AppendOK()
+		return
+	}
+
+	port, err := strconv.Atoi(string(c.Args[1]))
+	if err != nil || port <= 0 || port > 65535 {
+		c.AppendError("ERR Invalid master port")
+		return
+	}
+	s.replicaOf(string(c.Args[0]), port)
+	c.AppendOK()
+}
+
+// parseReplicaOf parses the replicaof option, "host port".
+func parseReplicaOf(s string) (string, int, error) {
+	f := strings.Fields(s)
+	if len(f) == 2 {
+		if port, err := strconv.Atoi(f[1]); err == nil && port > 0 && port <= 65535 {
+			return f[0], port, nil
+		}
+	}
+	return "", 0, fmt.Errorf("invalid replicaof %q, expected \"host port\"", s)
+}
+
+// replicaOf makes this server a replica of host:port. The data is
+// replaced by the data of the master on the first sync.
+func (s *Server) replicaOf(host string, port int) {
+	r := &s.repl
+	r.mu.Lock()
+	old := r.master
+	r.mu.Unlock()
+	if old != nil {
+		if old.host == host && old.port == port {
+			return
+		}
+		old.close()
+		<-old.done
+	}
+
+	m := newMasterLink(host, port)
+	r.mu.Lock()
+	r.master = m
+	atomic.StoreInt32(&r.replica, 1)
+	r.mu.Unlock()
+	// The replicas of this server have to follow the new master.
+	s.disconnectReplicas()
+
+	s.logger.Info("replica of", zap.String("master", m.addr()))
+	s.closer.AddRunning(1)
+	go s.runReplication(m)
+}
+
+// promote turns a replica into a master. The replicas of the old master
+// can continue from this server with a partial resync.
+func (s *Server) promote() {
+	r := &s.repl
+	r.mu.Lock()
+	m := r.master
+	r.mu.Unlock()
+	if m == nil {
+		return
+	}
+	m.close()
+	// No command is applied from now on.
+	<-m.done
+
+	r.mu.Lock()
+	r.master = nil
+	atomic.StoreInt32(&r.replica, 0)
+	r.id2 = r.id
+	r.offset2 = r.offset() + 1
+	r.id = runid.New()
+	r.mu.Unlock()
+	s.logger.Info("master mode enabled", zap.String("old_master", m.addr()))
+}
+
+// runReplication syncs with the master until the link is closed,
+// reconnecting after a second when the connection is lost.
+func (s *Server) runReplication(m *masterLink) {
+	defer s.closer.Done()
+	defer close(m.done)
+	for {
+		err := s.syncWithMaster(m)
+		if m.ctx.Err() != nil {
+			return
+		}
+		m.setState(replConnect)
+		s.logger.Warn("lost connection with master", zap.String("master", m.addr()), zap.Error(err))
+
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (s *Server) syncWithMaster(m *masterLink) error {
+	m.setState(replConnecting)
+	d := net.Dialer{Timeout: s.replConf.timeout}
+	conn, err := d.DialContext(m.ctx, "tcp", m.addr())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if !m.setConn(conn) {
+		return m.ctx.Err()
+	}
+
+	r := bufio.NewReaderSize(timeoutConn{Conn: conn, timeout: s.replConf.timeout}, 64<<10)
+	do := func(args ...string) (interface{}, error) {
+		bs := make([][]byte, len(args))
+		for i, arg := range args {
+			bs[i] = []byte(arg)
+		}
+		if err := m.send(s.replConf.timeout, bs...); err != nil {
+			return nil, err
+		}
+		v, err := client.ReadReply(r)
+		if e, ok := v.(client.Error); ok {
+			return nil, e
+		}
+		return v, err
+	}
+
+	if auth := s.replConf.masterAuth; auth != "" {
+		if _, err := do("AUTH", auth); err != nil {
+			return fmt.Errorf("AUTH: %w", err)
+		}
+	}
+	if _, err := do("REPLCONF", "listening-port", strconv.Itoa(s.replConf.port)); err != nil {
+		return fmt.Errorf("REPLCONF: %w", err)
+	}
+
+	id, offset := "?", int64(-1)
+	s.repl.mu.Lock()
+	if s.repl.backlog != nil {
+		id, offset = s.repl.id, s.repl.backlog.Offset()+1
+	}
+	s.repl.mu.Unlock()
+	v, err := do("PSYNC", id, strconv.FormatInt(offset, 10))
+	if err != nil {
+		return fmt.Errorf("PSYNC: %w", err)
+	}
+	reply, _ := v.(string)
+	f := strings.Fields(reply)
+	switch {
+	case len(f) == 3 && f[0] == "FULLRESYNC":
+		offset, err := strconv.ParseInt(f[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("PSYNC: unexpected reply %q", reply)
+		}
+		m.setState(replSync)
+		if err := s.fullSync(r, f[1], offset); err != nil {
+			return err
+		}
+	case len(f) == 2 && f[0] == "CONTINUE":
+		s.continueSync(f[1])
+	default:
+		return fmt.Errorf("PSYNC: unexpected reply %q", reply)
+	}
+	m.setState(replConnected)
+	s.logger.Info("master link established",
+		zap.String("master", m.addr()),
+		zap.Bool("partial", f[0] == "CONTINUE"),
+	)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.sendAcks(m, stop)
+	}()
+	defer wg.Wait()
+	defer close(stop)
+	return s.applyStream(m, r)
+}
+
+// fullSync replaces the data with the RDB snapshot sent by the master.
+func (s *Server) fullSync(r *bufio.Reader, id string, offset int64) error {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "$") || !strings.HasSuffix(line, "\r\n") {
+		return fmt.Errorf("PSYNC: unexpected snapshot header %q", line)
+	}
+	n, err := strconv.ParseInt(line[1:len(line)-2], 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("PSYNC: unexpected snapshot header %q", line)
+	}
+
+	repl := &s.repl
+	repl.applyMu.Lock()
+	defer repl.applyMu.Unlock()
+
+	start := time.Now()
+	// Their offsets are meaningless from now on.
+	s.disconnectReplicas()
+	if err := s.store.DropAll(); err != nil {
+		return err
+	}
+	s.forgetAll()
+	s.propagate([]byte("FLUSHALL"))
+	lr := io.LimitReader(r, n)
+	st, err := s.loadRDB(lr)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.Discard, lr); err != nil {
+		return err
+	}
+
+	repl.mu.Lock()
+	repl.id = id
+	repl.id2 = ""
+	repl.offset2 = 0
+	repl.backlog = backlog.New(s.replConf.backlogSize, offset)
+	repl.mu.Unlock()
+
+	s.logger.Info("synced with master",
+		zap.Int("keys", st.loaded),
+		zap.Int64("offset", offset),
+		zap.Duration("elapsed", time.Since(start)),
+	)
+	return nil
+}
+
+// continueSync takes the replication ID of the master, which changes when
+// it's promoted.
+func (s *Server) continueSync(id string) {
+	r := &s.repl
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if id != r.id {
+		r.id2 = r.id
+		r.offset2 = r.offset() + 1
+		r.id = id
+	}
+}
+
+// applyStream applies the commands sent by the master until the
+// connection fails.
+func (s *Server) applyStream(m *masterLink, r io.Reader) error {
+	var (
+		buf  []byte
+		args [][]byte
+		out  []byte
+		c    = &Context{out: &out}
+		p    = make([]byte, 64<<10)
+	)
+	for {
+		n, err := r.Read(p)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, p[:n]...)
+		data := buf
+		for len(data) > 0 {
+			var complete bool
+			var rest []byte
+			complete, args, _, rest, err = redcon.ReadNextCommand(data, args[:0])
+			if err != nil {
+				return err
+			}
+			if !complete {
+				break
+			}
+			if len(args) > 0 {
+				if err := s.applyCommand(m, c, args, data[:len(data)-len(rest)]); err != nil {
+					return err
+				}
+			}
+			data = rest
+		}
+		buf = append(buf[:0], data...)
+		if s.aof != nil {
+			if err := s.aof.Flush(); err != nil {
+				s.logger.Error("failed to write AOF", zap.Error(err))
+			}
+		}
+	}
+}
+
+var errLinkClosed = errors.New("master link closed")
+
+// applyCommand runs a command of the master and adds it to the backlog, so
+// that the replicas of this server get the same stream.
+func (s *Server) applyCommand(m *masterLink, c *Context, args [][]byte, raw []byte) error {
+	r := &s.repl
+	r.applyMu.Lock()
+	defer r.applyMu.Unlock()
+	if m.ctx.Err() != nil {
+		return errLinkClosed
+	}
+
+	var ack bool
+	switch cmd := strings.ToUpper(bytesconv.BytesToString(args[0])); cmd {
+	case "PING":
+	case "REPLCONF":
+		ack = len(args) > 1 && strings.EqualFold(string(args[1]), "GETACK")
+	default:
+		command, ok := s.commands[cmd]
+		if !ok {
+			s.logger.Warn("unknown command from master", zap.ByteString("cmd", args[0]))
+			break
+		}
+		*c.out = (*c.out)[:0]
+		c.cmd = args[0]
+		c.Args = args[1:]
+		command.fn(c)
+		if out := *c.out; len(out) > 0 && out[0] == '-' {
+			s.logger.Warn("failed to apply command from master",
+				zap.ByteStrings("args", args),
+				zap.ByteString("reply", out),
+			)
+		}
+	}
+
+	// backlog is only replaced with applyMu held.
+	r.backlog.Write(raw)
+	if ack {
+		return m.send(s.replConf.timeout, []byte("REPLCONF"), []byte("ACK"), strconv.AppendInt(nil, r.backlog.Offset(), 10))
+	}
+	return nil
+}
+
+// sendAcks acknowledges the offset every second.
+func (s *Server) sendAcks(m *masterLink, stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		s.repl.mu.Lock()
+		offset := s.repl.offset()
+		s.repl.mu.Unlock()
+		if err := m.send(s.replConf.timeout, []byte("REPLCONF"), []byte("ACK"), strconv.AppendInt(nil, offset, 10)); err != nil {
+			return
+		}
+	}
+}
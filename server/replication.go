@@ -0,0 +1,528 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/tidwall/evio"
+	"github.com/tidwall/redcon"
+	"go.chensl.me/redix/server/internal/backlog"
+	"go.chensl.me/redix/server/internal/client"
+	"go.chensl.me/redix/server/internal/storage"
+	"go.chensl.me/redix/server/pkg/bytesconv"
+	"go.uber.org/zap"
+)
+
+// Replication works as in Redis. The replica sends PSYNC with the
+// replication ID and the offset it has. The master replies +CONTINUE and
+// streams the commands from its backlog, or +FULLRESYNC followed by an RDB
+// snapshot and the commands from the offset of the snapshot. The stream is
+// made of the commands propagated to the AOF, see propagate.
+
+type replConfig struct {
+	port        int
+	backlogSize int
+	timeout     time.Duration
+	pingPeriod  time.Duration
+	masterAuth  string
+	readOnly    bool
+}
+
+func loadReplConfig() replConfig {
+	return replConfig{
+		port:        viper.GetInt("port"),
+		backlogSize: int(viper.GetSizeInBytes("repl_backlog_size")),
+		timeout:     viper.GetDuration("repl_timeout"),
+		pingPeriod:  viper.GetDuration("repl_ping_replica_period"),
+		masterAuth:  viper.GetString("masterauth"),
+		readOnly:    viper.GetBool("replica_read_only"),
+	}
+}
+
+type replState struct {
+	// applyMu is held while a replica applies a command of its master, so
+	// that the snapshots taken for its own replicas are consistent.
+	applyMu sync.Mutex
+
+	mu sync.Mutex
+	id string
+	// id2 is the ID of the previous master, valid up to offset2.
+	id2     string
+	offset2 int64
+	// backlog is created on the first PSYNC, or the first sync with a
+	// master. Changing it requires both mutexes.
+	backlog  *backlog.Backlog
+	replicas map[*replicaLink]struct{}
+	// acked is closed when a replica acknowledges an offset.
+	acked  chan struct{}
+	master *masterLink
+	buf    []byte
+	// The PSYNC outcomes, as sync_full, sync_partial_ok and
+	// sync_partial_err in Redis.
+	syncFull       int64
+	syncPartialOK  int64
+	syncPartialErr int64
+
+	// replica is set while master is, it's read by dataHandler.
+	replica int32
+}
+
+// replicaLink is a replica connected to this server.
+type replicaLink struct {
+	addr string
+	port int
+	// offset is the offset of the next byte to send.
+	offset  int64
+	backlog *backlog.Backlog
+	// full is set if snapshot is sent first, see cmdPSYNC.
+	full     bool
+	snapshot []snapshotItem
+	id       string
+	// ack is the offset acknowledged by the replica.
+	ack int64
+
+	once    sync.Once
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func (l *replicaLink) close() {
+	l.once.Do(func() { close(l.done) })
+}
+
+func (l *replicaLink) closed() bool {
+	select {
+	case <-l.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// feed appends a command to the replication stream, unless this server
+// is a replica which streams the commands of its master.
+func (s *Server) feed(args [][]byte) {
+	r := &s.repl
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.backlog == nil || r.master != nil {
+		return
+	}
+	r.buf = appendCommand(r.buf[:0], args)
+	r.backlog.Write(r.buf)
+}
+
+func appendCommand(dst []byte, args [][]byte) []byte {
+	dst = redcon.AppendArray(dst, len(args))
+	for _, arg := range args {
+		dst = redcon.AppendBulk(dst, arg)
+	}
+	return dst
+}
+
+func (s *Server) readOnly(cmd *command) bool {
+	return s.replConf.readOnly && cmd.is(flagWrite) && atomic.LoadInt32(&s.repl.replica) == 1
+}
+
+// offset returns the offset of the last byte of the replication
+// stream.
+func (r *replState) offset() int64 {
+	if r.backlog == nil {
+		return 0
+	}
+	return r.backlog.Offset()
+}
+
+// ackedReplicas returns the number of replicas which acknowledged offset.
+func (r *replState) ackedReplicas(offset int64) int {
+	var n int
+	for l := range r.replicas {
+		if atomic.LoadInt64(&l.ack) >= offset {
+			n++
+		}
+	}
+	return n
+}
+
+// PSYNC replicationid offset
+func (s *Server) cmdPSYNC(c *Context) {
+	if len(c.Args) != 2 {
+		c.ErrInvalidArgs()
+		return
+	}
+	offset, err := storage.ParseInt(c.Args[1])
+	if err != nil {
+		c.ErrInvalidInt()
+		return
+	}
+
+	r := &s.repl
+	// A replica doesn't apply commands from its master meanwhile.
+	r.applyMu.Lock()
+	defer r.applyMu.Unlock()
+
+	if m := r.master; m != nil && m.getState() != replConnected {
+		c.AppendError("NOMASTERLINK Can't SYNC while not connected with my master")
+		return
+	}
+
+	l := &replicaLink{
+		port:    c.replPort,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if addr := c.conn.RemoteAddr(); addr != nil {
+		l.addr, _, _ = net.SplitHostPort(addr.String())
+	}
+
+	r.mu.Lock()
+	if r.backlog == nil {
+		r.backlog = backlog.New(s.replConf.backlogSize, 0)
+		s.closer.AddRunning(1)
+		go s.pingReplicas()
+	}
+	id := string(c.Args[0])
+	partial := (id == r.id || (id == r.id2 && offset <= r.offset2)) && r.backlog.Contains(offset)
+	switch {
+	case partial:
+		r.syncPartialOK++
+	case id != "?":
+		r.syncPartialErr++
+		fallthrough
+	default:
+		r.syncFull++
+	}
+	r.mu.Unlock()
+
+	if partial {
+		l.offset = offset
+	} else {
+		l.full = true
+		// The write commands don't run meanwhile, see exec, so the
+		// snapshot matches the offset.
+		l.snapshot, err = s.snapshot()
+		if err != nil {
+			s.logUnknownError("store.ForEach", err)
+			c.ErrUnknown(err)
+			return
+		}
+	}
+
+	r.mu.Lock()
+	if !partial {
+		l.offset = r.backlog.Offset() + 1
+	}
+	l.id = r.id
+	l.backlog = r.backlog
+	if r.replicas == nil {
+		r.replicas = make(map[*replicaLink]struct{})
+	}
+	r.replicas[l] = struct{}{}
+	r.mu.Unlock()
+
+	s.logger.Info("replica connected",
+		zap.String("addr", l.addr),
+		zap.Int("port", l.port),
+		zap.Bool("partial", partial),
+		zap.Int64("offset", l.offset),
+	)
+	// The connection is served by serveReplica once detached.
+	c.link = l
+	c.action = evio.Detach
+}
+
+func (s *Server) detachedHandler(ec evio.Conn, rwc io.ReadWriteCloser) (action evio.Action) {
+	c := ec.Context().(*Context)
+	if c.link == nil {
+		_ = rwc.Close()
+		return
+	}
+	s.closer.AddRunning(1)
+	go s.sendStream(c.link, rwc)
+	go s.serveReplica(c.link, rwc)
+	return
+}
+
+// sendStream writes the snapshot, if any, then the replication stream to
+// the replica until the link is closed.
+func (s *Server) sendStream(l *replicaLink, w io.Writer) {
+	defer s.closer.Done()
+	defer close(l.stopped)
+	defer l.close()
+
+	var buf bytes.Buffer
+	if l.full {
+		buf.WriteString("+FULLRESYNC " + l.id + " " + strconv.FormatInt(l.offset-1, 10) + "\r\n")
+		var rdb bytes.Buffer
+		err := encodeRDB(&rdb, uint64(len(l.snapshot)), func(fn func(key, value []byte, expiresAt time.Time) error) error {
+			for _, it := range l.snapshot {
+				if err := fn(it.key, it.value, it.expiresAt); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			s.logger.Error("failed to encode snapshot", zap.Error(err))
+			return
+		}
+		l.snapshot = nil
+		// As in Redis, there is no CRLF after the RDB file.
+		buf.WriteString("$" + strconv.Itoa(rdb.Len()) + "\r\n")
+		buf.Write(rdb.Bytes())
+	} else {
+		buf.WriteString("+CONTINUE " + l.id + "\r\n")
+	}
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return
+	}
+
+	p := make([]byte, 64<<10)
+	for {
+		wait := l.backlog.Wait()
+		n, err := l.backlog.Read(l.offset, p)
+		if err != nil {
+			s.logger.Warn("replica is too far behind, disconnecting",
+				zap.String("addr", l.addr),
+				zap.Int("port", l.port),
+			)
+			return
+		}
+		if n == 0 {
+			select {
+			case <-wait:
+			case <-l.done:
+				return
+			case <-s.closer.HasBeenClosed():
+				return
+			}
+			continue
+		}
+		if _, err := w.Write(p[:n]); err != nil {
+			return
+		}
+		l.offset += int64(n)
+	}
+}
+
+// serveReplica reads the acknowledgements of the replica. The connection
+// is closed on the next one after the link is closed, replicas send one
+// every second.
+func (s *Server) serveReplica(l *replicaLink, rwc io.ReadWriteCloser) {
+	r := bufio.NewReader(rwc)
+	for !l.closed() {
+		v, err := client.ReadReply(r)
+		if err != nil {
+			break
+		}
+		args, ok := v.([]interface{})
+		if !ok || len(args) != 3 {
+			continue
+		}
+		cmd, _ := args[0].([]byte)
+		sub, _ := args[1].([]byte)
+		if !strings.EqualFold(string(cmd), "REPLCONF") || !strings.EqualFold(string(sub), "ACK") {
+			continue
+		}
+		off, _ := args[2].([]byte)
+		if n, err := strconv.ParseInt(string(off), 10, 64); err == nil {
+			atomic.StoreInt64(&l.ack, n)
+			s.notifyAck()
+		}
+	}
+
+	l.close()
+	// The stream mustn't be written once closed.
+	<-l.stopped
+	_ = rwc.Close()
+
+	s.repl.mu.Lock()
+	delete(s.repl.replicas, l)
+	s.repl.mu.Unlock()
+	s.logger.Info("replica disconnected", zap.String("addr", l.addr), zap.Int("port", l.port))
+}
+
+func (s *Server) notifyAck() {
+	s.repl.mu.Lock()
+	defer s.repl.mu.Unlock()
+	if s.repl.acked != nil {
+		close(s.repl.acked)
+		s.repl.acked = nil
+	}
+}
+
+// pingReplicas feeds a PING every repl_ping_replica_period, so that the
+// replicas can tell a broken link from an idle one.
+func (s *Server) pingReplicas() {
+	defer s.closer.Done()
+	ticker := time.NewTicker(s.replConf.pingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closer.HasBeenClosed():
+			return
+		case <-ticker.C:
+		}
+		s.repl.mu.Lock()
+		n := len(s.repl.replicas)
+		s.repl.mu.Unlock()
+		if n > 0 {
+			s.feed([][]byte{[]byte("PING")})
+		}
+	}
+}
+
+// disconnectReplicas closes the links of the replicas, they have to sync
+// again.
+func (s *Server) disconnectReplicas() {
+	s.repl.mu.Lock()
+	defer s.repl.mu.Unlock()
+	for l := range s.repl.replicas {
+		l.close()
+	}
+}
+
+// REPLCONF option value [option value ...]
+func (s *Server) cmdREPLCONF(c *Context) {
+	if len(c.Args) == 0 || len(c.Args)%2 != 0 {
+		c.ErrInvalidArgs()
+		return
+	}
+
+	for i := 0; i < len(c.Args); i += 2 {
+		switch strings.ToUpper(bytesconv.BytesToString(c.Args[i])) {
+		case "LISTENING-PORT":
+			port, err := strconv.Atoi(string(c.Args[i+1]))
+			if err != nil {
+				c.ErrInvalidInt()
+				return
+			}
+			c.replPort = port
+		case "ACK", "GETACK":
+			// Only meaningful on replication links.
+			return
+		case "IP-ADDRESS", "CAPA":
+		default:
+			c.AppendError("ERR Unrecognized REPLCONF option: " + string(c.Args[i]))
+			return
+		}
+	}
+	c.AppendOK()
+}
+
+// WAIT numreplicas timeout
+func (s *Server) cmdWAIT(c *Context) {
+	if len(c.Args) != 2 {
+		c.ErrInvalidArgs()
+		return
+	}
+	want, err := storage.ParseInt(c.Args[0])
+	if err != nil {
+		c.ErrInvalidInt()
+		return
+	}
+	timeout, err := storage.ParseInt(c.Args[1])
+	if err != nil {
+		c.ErrInvalidInt()
+		return
+	}
+	if timeout < 0 {
+		c.AppendError("ERR timeout is negative")
+		return
+	}
+
+	r := &s.repl
+	r.mu.Lock()
+	if r.master != nil {
+		r.mu.Unlock()
+		c.AppendError("ERR WAIT cannot be used with replica instances")
+		return
+	}
+	offset := r.offset()
+	n := r.ackedReplicas(offset)
+	r.mu.Unlock()
+	if int64(n) >= want {
+		c.AppendInt(int64(n))
+		return
+	}
+
+	// Asks the replicas to acknowledge now, instead of within a second.
+	s.feed([][]byte{[]byte("REPLCONF"), []byte("GETACK"), []byte("*")})
+
+	c.block(func(closed <-chan struct{}) []byte {
+		var expired <-chan time.Time
+		if timeout > 0 {
+			timer := time.NewTimer(time.Duration(timeout) * time.Millisecond)
+			defer timer.Stop()
+			expired = timer.C
+		}
+		for {
+			r.mu.Lock()
+			n := r.ackedReplicas(offset)
+			if r.acked == nil {
+				r.acked = make(chan struct{})
+			}
+			acked := r.acked
+			r.mu.Unlock()
+			if int64(n) >= want {
+				return redcon.AppendInt(nil, int64(n))
+			}
+
+			select {
+			case <-acked:
+			case <-expired:
+				return redcon.AppendInt(nil, int64(n))
+			case <-closed:
+				return nil
+			case <-s.closer.HasBeenClosed():
+				return nil
+			}
+		}
+	})
+}
+
+func (s *Server) cmdROLE(c *Context) {
+	if len(c.Args) != 0 {
+		c.ErrInvalidArgs()
+		return
+	}
+
+	r := &s.repl
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if m := r.master; m != nil {
+		c.AppendArray(5)
+		c.AppendBulk([]byte("slave"))
+		c.AppendBulk([]byte(m.host))
+		c.AppendInt(int64(m.port))
+		c.AppendBulk([]byte(m.getState().String()))
+		c.AppendInt(r.offset())
+		return
+	}
+
+	c.AppendArray(3)
+	c.AppendBulk([]byte("master"))
+	c.AppendInt(r.offset())
+	c.AppendArray(len(r.replicas))
+	for l := range r.replicas {
+		c.AppendBulkArray([][]byte{
+			[]byte(l.addr),
+			[]byte(strconv.Itoa(l.port)),
+			[]byte(strconv.FormatInt(atomic.LoadInt64(&l.ack), 10)),
+		})
+	}
+}
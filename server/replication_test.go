@@ -0,0 +1,160 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/evio"
+	"go.chensl.me/redix/server/internal/client"
+)
+
+func freePort(t testing.TB) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := ln.Addr().(*net.TCPAddr).Port
+	require.NoError(t, ln.Close())
+	return port
+}
+
+// serve runs srv on a free port until the end of the test and returns a
+// client connection and the port.
+func serve(t testing.TB, srv *Server) (*client.Conn, int) {
+	port := freePort(t)
+	return serveAt(t, srv, port), port
+}
+
+// serveAt runs srv on port until the end of the test and returns a client
+// connection.
+func serveAt(t testing.TB, srv *Server, port int) *client.Conn {
+	addr := "127.0.0.1:" + strconv.Itoa(port)
+	var err error
+
+	done := make(chan error, 1)
+	go func() {
+		done <- evio.Serve(srv.events(), "tcp://"+addr)
+	}()
+
+	var conn *client.Conn
+	require.Eventually(t, func() bool {
+		conn, err = client.Dial(addr, 5*time.Second)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	t.Cleanup(func() {
+		_ = conn.Send("SHUTDOWN")
+		_ = conn.Flush()
+		_ = conn.Close()
+		<-done
+		_ = srv.Cleanup()
+	})
+	return conn
+}
+
+func do(t testing.TB, c *client.Conn, args ...interface{}) interface{} {
+	v, err := c.Do(args...)
+	if _, ok := err.(client.Error); !ok {
+		require.NoError(t, err)
+	}
+	if err != nil {
+		return err
+	}
+	return v
+}
+
+func waitConnected(t *testing.T, c *client.Conn) {
+	require.Eventually(t, func() bool {
+		role := do(t, c, "ROLE").([]interface{})
+		return string(role[3].([]byte)) == "connected"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestReplication(t *testing.T) {
+	master, _ := newTestServer(t, nil)
+	m, port := serve(t, master)
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, "OK", do(t, m, "SET", "key:"+strconv.Itoa(i), i))
+	}
+	assert.Equal(t, "OK", do(t, m, "SET", "volatile", "v", "EX", 100))
+
+	replica, _ := newTestServer(t, map[string]interface{}{
+		"replicaof": "127.0.0.1 " + strconv.Itoa(port),
+	})
+	r, _ := serve(t, replica)
+	waitConnected(t, r)
+	assert.Equal(t, int64(101), do(t, r, "DBSIZE"))
+	assert.Equal(t, []byte("42"), do(t, r, "GET", "key:42"))
+	assert.Equal(t, int64(99), do(t, r, "TTL", "volatile"))
+
+	// Streamed writes.
+	assert.Equal(t, int64(1), do(t, m, "INCR", "counter"))
+	assert.Equal(t, int64(1), do(t, m, "DEL", "key:0"))
+	assert.Equal(t, "OK", do(t, m, "RENAME", "key:1", "renamed"))
+	assert.Equal(t, int64(1), do(t, m, "WAIT", 1, 5000))
+	assert.Equal(t, []byte("1"), do(t, r, "GET", "counter"))
+	assert.Equal(t, int64(0), do(t, r, "EXISTS", "key:0"))
+	assert.Equal(t, []byte("1"), do(t, r, "GET", "renamed"))
+
+	assert.Equal(t, client.Error("READONLY You can't write against a read only replica."), do(t, r, "SET", "a", "b"))
+	assert.Equal(t, client.Error("ERR WAIT cannot be used with replica instances"), do(t, r, "WAIT", 1, 0))
+
+	role := do(t, m, "ROLE").([]interface{})
+	assert.Equal(t, []byte("master"), role[0])
+	offset := role[1].(int64)
+	assert.Len(t, role[2], 1)
+	role = do(t, r, "ROLE").([]interface{})
+	assert.Equal(t, []interface{}{[]byte("slave"), []byte("127.0.0.1"), int64(port), []byte("connected"), offset}, role)
+
+	assert.Equal(t, "OK", do(t, r, "REPLICAOF", "NO", "ONE"))
+	assert.Equal(t, "OK", do(t, r, "SET", "a", "b"))
+	assert.Equal(t, []byte("master"), do(t, r, "ROLE").([]interface{})[0])
+}
+
+func TestReplicationPartialResync(t *testing.T) {
+	master, _ := newTestServer(t, nil)
+	m, mport := serve(t, master)
+	replica, _ := newTestServer(t, map[string]interface{}{
+		"replicaof": "127.0.0.1 " + strconv.Itoa(mport),
+	})
+	r, rport := serve(t, replica)
+	waitConnected(t, r)
+	assert.Equal(t, "OK", do(t, m, "SET", "a", "1"))
+	assert.Equal(t, int64(1), do(t, m, "WAIT", 1, 5000))
+
+	// The old master follows the promoted replica from where it is.
+	assert.Equal(t, "OK", do(t, r, "REPLICAOF", "NO", "ONE"))
+	assert.Equal(t, "OK", do(t, r, "SET", "b", "2"))
+	assert.Equal(t, "OK", do(t, m, "REPLICAOF", "127.0.0.1", rport))
+	waitConnected(t, m)
+	assert.Equal(t, int64(1), do(t, r, "WAIT", 1, 5000))
+	assert.Equal(t, []byte("2"), do(t, m, "GET", "b"))
+
+	replica.repl.mu.Lock()
+	defer replica.repl.mu.Unlock()
+	assert.Equal(t, int64(1), replica.repl.syncPartialOK)
+	assert.Equal(t, int64(0), replica.repl.syncFull)
+}
+
+func TestWAITTimeout(t *testing.T) {
+	srv, c := newTestServer(t, nil)
+	defer srv.Cleanup()
+
+	assert.Equal(t, ":0\r\n", c.do("WAIT", "0", "0"))
+	assert.Equal(t, "-ERR timeout is negative\r\n", c.do("WAIT", "1", "-1"))
+
+	// The reply and the following commands wait for the timeout.
+	assert.Equal(t, "", c.do("WAIT", "1", "50"))
+	out, _ := srv.dataHandler(c, []byte("*1\r\n$4\r\nPING\r\n"))
+	assert.Empty(t, out)
+	require.Eventually(t, func() bool {
+		out, _ = srv.dataHandler(c, nil)
+		return len(out) > 0
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, ":0\r\n+PONG\r\n", string(out))
+}
@@ -0,0 +1,206 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/evio"
+	"github.com/tidwall/redcon"
+	"go.chensl.me/redix/server/pkg/bytesconv"
+	"go.uber.org/zap"
+)
+
+// A shutdown, started by SHUTDOWN or by SIGINT and SIGTERM, drains the server
+// before its event loops stop: the new connections are closed and the new
+// commands refused, while the blocked commands, e.g. the offloaded ones, and
+// the commands queued behind them finish, for at most shutdown_timeout. The
+// RDB file is saved then if asked for, and Run returns.
+
+var (
+	errShutdownInProgress = errors.New("shutdown already in progress")
+	errShutdownAborted    = errors.New("shutdown aborted")
+)
+
+type shutdownState struct {
+	mu sync.Mutex
+	// abort is closed by SHUTDOWN ABORT, it is nil unless a shutdown is in
+	// progress.
+	abort chan struct{}
+	// closing is set during a shutdown, stopping once the loops can stop.
+	closing  int32
+	stopping int32
+}
+
+// closing reports whether the server is shutting down.
+func (s *Server) closing() bool {
+	return atomic.LoadInt32(&s.shut.closing) == 1
+}
+
+// stopping reports whether the event loops should stop.
+func (s *Server) stopping() bool {
+	return atomic.LoadInt32(&s.shut.stopping) == 1
+}
+
+// shutdown drains the server, saves the RDB file if save is set, then lets
+// the event loops stop. The server keeps serving if it fails.
+func (s *Server) shutdown(save bool) error {
+	s.shut.mu.Lock()
+	if s.shut.abort != nil {
+		s.shut.mu.Unlock()
+		return errShutdownInProgress
+	}
+	abort := make(chan struct{})
+	s.shut.abort = abort
+	atomic.StoreInt32(&s.shut.closing, 1)
+	s.shut.mu.Unlock()
+	s.logger.Info("shutting down", zap.Bool("save", save))
+
+	err := s.drain(abort)
+	if err == nil && save {
+		err = s.saveOnShutdown(abort)
+	}
+
+	s.shut.mu.Lock()
+	defer s.shut.mu.Unlock()
+	if s.shut.abort != abort {
+		err = errShutdownAborted
+	}
+	if err != nil {
+		if s.shut.abort == abort {
+			s.shut.abort = nil
+			atomic.StoreInt32(&s.shut.closing, 0)
+		}
+		s.logger.Error("failed to shut down", zap.Error(err))
+		return err
+	}
+	atomic.StoreInt32(&s.shut.stopping, 1)
+	return nil
+}
+
+// drain waits for the blocked commands.
+func (s *Server) drain(abort <-chan struct{}) error {
+	deadline := time.NewTimer(s.shutdownTimeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&s.inflight) > 0 {
+		select {
+		case <-abort:
+			return errShutdownAborted
+		case <-deadline.C:
+			s.logger.Warn("shutdown timeout, commands still in flight",
+				zap.Int64("inflight", atomic.LoadInt64(&s.inflight)),
+			)
+			return nil
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// saveOnShutdown saves the RDB file once a running BGSAVE is done.
+func (s *Server) saveOnShutdown(abort <-chan struct{}) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for !atomic.CompareAndSwapInt32(&s.saving, 0, 1) {
+		select {
+		case <-abort:
+			return errShutdownAborted
+		case <-ticker.C:
+		}
+	}
+	defer atomic.StoreInt32(&s.saving, 0)
+	return s.save()
+}
+
+// abortShutdown aborts the shutdown in progress, unless the event loops are
+// already stopping.
+func (s *Server) abortShutdown() bool {
+	s.shut.mu.Lock()
+	defer s.shut.mu.Unlock()
+	if s.shut.abort == nil || s.stopping() {
+		return false
+	}
+	close(s.shut.abort)
+	s.shut.abort = nil
+	atomic.StoreInt32(&s.shut.closing, 0)
+	s.logger.Info("shutdown aborted")
+	return true
+}
+
+// handleSignals shuts the server down on the first signal, and stops it
+// right away on the next one.
+func (s *Server) handleSignals(sigs <-chan os.Signal, done <-chan struct{}) {
+	select {
+	case sig := <-sigs:
+		s.logger.Info("received signal", zap.Stringer("signal", sig))
+		go func() {
+			_ = s.shutdown(false)
+		}()
+	case <-done:
+		return
+	}
+	select {
+	case sig := <-sigs:
+		s.logger.Warn("received signal again, stopping now", zap.Stringer("signal", sig))
+		atomic.StoreInt32(&s.shut.stopping, 1)
+	case <-done:
+	}
+}
+
+// tickHandler stops the event loops at the end of a shutdown, and
+// invalidates the keys tracked which expired.
+func (s *Server) tickHandler() (delay time.Duration, action evio.Action) {
+	if s.stopping() {
+		return 0, evio.Shutdown
+	}
+	s.expireTracked()
+	return 100 * time.Millisecond, evio.None
+}
+
+func (s *Server) cmdSHUTDOWN(c *Context) {
+	var save, nosave, abort bool
+	for _, arg := range c.Args {
+		switch strings.ToUpper(bytesconv.BytesToString(arg)) {
+		case "SAVE":
+			save = true
+		case "NOSAVE":
+			nosave = true
+		case "ABORT":
+			abort = true
+		default:
+			c.ErrSyntax()
+			return
+		}
+	}
+	if (save && nosave) || (abort && len(c.Args) > 1) {
+		c.ErrSyntax()
+		return
+	}
+
+	if abort {
+		if !s.abortShutdown() {
+			c.AppendError("ERR No shutdown in progress.")
+			return
+		}
+		c.AppendOK()
+		return
+	}
+
+	// The connection is closed with the others once the loops stop, there
+	// is no reply unless the shutdown fails.
+	c.block(func(closed <-chan struct{}) []byte {
+		if err := s.shutdown(save); err != nil {
+			return redcon.AppendError(nil, "ERR Errors trying to SHUTDOWN. Check logs.")
+		}
+		return nil
+	})
+}
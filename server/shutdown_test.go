@@ -0,0 +1,145 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/evio"
+	"go.chensl.me/redix/server/internal/client"
+)
+
+// serveBlocking runs srv, whose BLOCK command waits for release, until it
+// stops, which closes stopped.
+func serveBlocking(t *testing.T, srv *Server) (addr string, release, stopped chan struct{}) {
+	release = make(chan struct{})
+	srv.register("block", func(c *Context) {
+		<-release
+		c.AppendOK()
+	}, flagSlow, noKeys)
+	srv.offloaded = flagSlow
+
+	addr = "127.0.0.1:" + strconv.Itoa(freePort(t))
+	stopped = make(chan struct{})
+	go func() {
+		defer close(stopped)
+		assert.NoError(t, evio.Serve(srv.events(), "tcp://"+addr))
+	}()
+	require.Eventually(t, func() bool {
+		c, err := client.Dial(addr, 5*time.Second)
+		if err == nil {
+			_ = c.Close()
+		}
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	return addr, release, stopped
+}
+
+func dial(t *testing.T, addr string) *client.Conn {
+	c, err := client.Dial(addr, 5*time.Second)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+func TestShutdown(t *testing.T) {
+	rdbFile := filepath.Join(t.TempDir(), "dump.rdb")
+	srv, _ := newTestServer(t, map[string]interface{}{"rdb_file": rdbFile})
+	defer srv.Cleanup()
+	addr, release, stopped := serveBlocking(t, srv)
+
+	a, b, c := dial(t, addr), dial(t, addr), dial(t, addr)
+	assert.Equal(t, "OK", do(t, a, "SET", "k", "v"))
+	assert.Equal(t, client.Error("ERR syntax error"), do(t, b, "SHUTDOWN", "SAVE", "NOSAVE"))
+
+	// The pipeline of a waits for BLOCK, then runs during the shutdown.
+	require.NoError(t, a.Send("BLOCK"))
+	require.NoError(t, a.Send("SET", "k", "w"))
+	require.NoError(t, a.Flush())
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&srv.inflight) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, b.Send("SHUTDOWN", "SAVE"))
+	require.NoError(t, b.Flush())
+	require.Eventually(t, srv.closing, 5*time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, client.Error("ERR Server is shutting down"), do(t, c, "GET", "k"))
+	d := dial(t, addr)
+	_, err := d.Receive()
+	assert.Equal(t, client.Error("ERR Server is shutting down"), err)
+
+	close(release)
+	for _, want := range []string{"OK", "OK"} {
+		reply, err := a.Receive()
+		require.NoError(t, err)
+		assert.Equal(t, want, reply)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server never stopped")
+	}
+	_, err = b.Receive()
+	assert.Error(t, err)
+
+	// The RDB file was saved after the pipeline of a.
+	_, err = os.Stat(rdbFile)
+	require.NoError(t, err)
+	srv, c2 := newTestServer(t, map[string]interface{}{"rdb_import": rdbFile})
+	defer srv.Cleanup()
+	assert.Equal(t, "$1\r\nw\r\n", c2.do("GET", "k"))
+}
+
+func TestCleanupWaitsForBGSAVE(t *testing.T) {
+	rdbFile := filepath.Join(t.TempDir(), "dump.rdb")
+	srv, c := newTestServer(t, map[string]interface{}{"rdb_file": rdbFile})
+	assert.Equal(t, "+OK\r\n", c.do("SET", "k", "v"))
+	assert.Equal(t, "+Background saving started\r\n", c.do("BGSAVE"))
+	// The save is done before the store is closed.
+	require.NoError(t, srv.Cleanup())
+
+	srv, c = newTestServer(t, map[string]interface{}{"rdb_import": rdbFile})
+	defer srv.Cleanup()
+	assert.Equal(t, "$1\r\nv\r\n", c.do("GET", "k"))
+}
+
+func TestShutdownAbort(t *testing.T) {
+	srv, _ := newTestServer(t, map[string]interface{}{"shutdown_timeout": "1m"})
+	defer srv.Cleanup()
+	addr, release, stopped := serveBlocking(t, srv)
+	defer func() {
+		close(release)
+		<-stopped
+	}()
+
+	a, b, c := dial(t, addr), dial(t, addr), dial(t, addr)
+	assert.Equal(t, client.Error("ERR No shutdown in progress."), do(t, c, "SHUTDOWN", "ABORT"))
+
+	require.NoError(t, a.Send("BLOCK"))
+	require.NoError(t, a.Flush())
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&srv.inflight) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, b.Send("SHUTDOWN"))
+	require.NoError(t, b.Flush())
+	require.Eventually(t, srv.closing, 5*time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, "OK", do(t, c, "SHUTDOWN", "ABORT"))
+	_, err := b.Receive()
+	assert.Equal(t, client.Error("ERR Errors trying to SHUTDOWN. Check logs."), err)
+	assert.Equal(t, "PONG", do(t, c, "PING"))
+	assert.Equal(t, "PONG", do(t, dial(t, addr), "PING"))
+
+	// Stops the server once BLOCK returns.
+	require.NoError(t, c.Send("SHUTDOWN"))
+	require.NoError(t, c.Flush())
+}
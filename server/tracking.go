@@ -0,0 +1,468 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/redcon"
+	"go.chensl.me/redix/server/internal/storage"
+	"go.chensl.me/redix/server/pkg/bytesconv"
+)
+
+// With CLIENT TRACKING, a client is sent an invalidation message once a key
+// it read is modified, as Redis does for client-side caching, or, in BCAST
+// mode, once any key with one of its prefixes is. The modified keys are the
+// ones of the commands propagated, whoever wrote them: the clients, the
+// master of a replica or the eviction. The keys read with an expire are
+// invalidated too once it is reached; BCAST mode knows of no expire. A key
+// read is only tracked until its invalidation, as in Redis. The keys read
+// are bounded by tracking_table_max_keys: past it, the keys read first are
+// invalidated. The messages are pushed to RESP3 clients, see HELLO, or
+// published on __redis__:invalidate to the client given by REDIRECT.
+
+const invalidateChannel = "__redis__:invalidate"
+
+// tracker is the tracking mode of a client.
+type tracker struct {
+	id       int64
+	redirect int64
+	bcast    bool
+	optIn    bool
+	optOut   bool
+	prefixes []string
+}
+
+type trackingState struct {
+	mu sync.Mutex
+	// maxKeys bounds keys, 0 if they aren't.
+	maxKeys int
+	// keys are the keys read, by key.
+	keys map[string]*trackedKey
+	// order are the keys read, the ones read last at the back.
+	order *list.List
+	// prefixes are the ids of the clients in BCAST mode, by prefix.
+	prefixes map[string]map[int64]bool
+	// trackers are the modes of the clients tracking, by id.
+	trackers map[int64]*tracker
+	// expiry are the expires of the keys read, in milliseconds.
+	expiry *storage.ExpiryIndex
+}
+
+// trackedKey is a key read.
+type trackedKey struct {
+	// ids are the ids of the clients which read the key.
+	ids  map[int64]bool
+	elem *list.Element
+}
+
+// trackingRedirect returns the id the invalidations of c are sent to, 0 if
+// c gets them itself and -1 if it isn't tracking.
+func (s *Server) trackingRedirect(c *Context) int64 {
+	s.track.mu.Lock()
+	defer s.track.mu.Unlock()
+	t := s.track.trackers[c.id]
+	if t == nil {
+		return -1
+	}
+	return t.redirect
+}
+
+// CLIENT TRACKING ON|OFF [REDIRECT id] [PREFIX prefix ...] [BCAST] [OPTIN]
+// [OPTOUT]
+func (s *Server) clientTracking(c *Context) {
+	if len(c.Args) < 2 {
+		c.ErrInvalidArgs()
+		return
+	}
+
+	var on bool
+	switch strings.ToUpper(bytesconv.BytesToString(c.Args[1])) {
+	case "ON":
+		on = true
+	case "OFF":
+	default:
+		c.ErrSyntax()
+		return
+	}
+	t := &tracker{id: c.id}
+	var hasPrefix bool
+	for args := c.Args[2:]; len(args) > 0; args = args[1:] {
+		switch strings.ToUpper(bytesconv.BytesToString(args[0])) {
+		case "REDIRECT":
+			if len(args) < 2 {
+				c.ErrSyntax()
+				return
+			}
+			id, err := storage.ParseInt(args[1])
+			if err != nil {
+				c.ErrInvalidInt()
+				return
+			}
+			t.redirect = id
+			args = args[1:]
+		case "PREFIX":
+			if len(args) < 2 {
+				c.ErrSyntax()
+				return
+			}
+			hasPrefix = true
+			t.prefixes = append(t.prefixes, string(args[1]))
+			args = args[1:]
+		case "BCAST":
+			t.bcast = true
+		case "OPTIN":
+			t.optIn = true
+		case "OPTOUT":
+			t.optOut = true
+		default:
+			c.ErrSyntax()
+			return
+		}
+	}
+
+	if !on {
+		s.untrack(c.id)
+		c.tracking = false
+		c.AppendOK()
+		return
+	}
+	if hasPrefix && !t.bcast {
+		c.AppendError("ERR PREFIX option requires BCAST mode to be enabled")
+		return
+	}
+	if t.optIn && t.optOut {
+		c.AppendError("ERR You can't use both OPTIN and OPTOUT")
+		return
+	}
+	if t.bcast && (t.optIn || t.optOut) {
+		c.AppendError("ERR OPTIN and OPTOUT are not compatible with BCAST")
+		return
+	}
+	if t.redirect != 0 && t.redirect != c.id && s.client(t.redirect) == nil {
+		c.AppendError("ERR The client ID you want redirect to does not exist")
+		return
+	}
+	if t.redirect == c.id {
+		t.redirect = 0
+	}
+	if t.bcast && len(t.prefixes) == 0 {
+		t.prefixes = []string{""}
+	}
+
+	s.track.mu.Lock()
+	defer s.track.mu.Unlock()
+	if old := s.track.trackers[c.id]; old != nil {
+		if old.bcast != t.bcast {
+			c.AppendError("ERR You can't switch BCAST mode on/off before disabling tracking for this client, and then re-enabling it with a different mode.")
+			return
+		}
+		s.untrackLocked(c.id)
+	}
+	if s.track.trackers == nil {
+		s.track.keys = make(map[string]*trackedKey)
+		s.track.order = list.New()
+		s.track.prefixes = make(map[string]map[int64]bool)
+		s.track.trackers = make(map[int64]*tracker)
+		s.track.expiry = storage.NewExpiryIndex()
+	}
+	s.track.trackers[c.id] = t
+	for _, prefix := range t.prefixes {
+		ids := s.track.prefixes[prefix]
+		if ids == nil {
+			ids = make(map[int64]bool)
+			s.track.prefixes[prefix] = ids
+		}
+		ids[c.id] = true
+	}
+	c.tracking = true
+	c.AppendOK()
+}
+
+// CLIENT CACHING YES|NO
+func (s *Server) clientCaching(c *Context) {
+	if len(c.Args) != 2 {
+		c.ErrInvalidArgs()
+		return
+	}
+
+	s.track.mu.Lock()
+	t := s.track.trackers[c.id]
+	s.track.mu.Unlock()
+	switch strings.ToUpper(bytesconv.BytesToString(c.Args[1])) {
+	case "YES":
+		if t == nil || !t.optIn {
+			c.AppendError("ERR CLIENT CACHING YES is only valid when tracking is enabled in OPTIN mode.")
+			return
+		}
+		c.caching = 1
+	case "NO":
+		if t == nil || !t.optOut {
+			c.AppendError("ERR CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode.")
+			return
+		}
+		c.caching = -1
+	default:
+		c.ErrSyntax()
+		return
+	}
+	c.AppendOK()
+}
+
+// untrack turns the tracking of the client id off. The keys it read are
+// forgotten once invalidated, or once no client tracks.
+func (s *Server) untrack(id int64) {
+	s.track.mu.Lock()
+	defer s.track.mu.Unlock()
+	s.untrackLocked(id)
+}
+
+func (s *Server) untrackLocked(id int64) {
+	t := s.track.trackers[id]
+	if t == nil {
+		return
+	}
+	delete(s.track.trackers, id)
+	for _, prefix := range t.prefixes {
+		ids := s.track.prefixes[prefix]
+		delete(ids, id)
+		if len(ids) == 0 {
+			delete(s.track.prefixes, prefix)
+		}
+	}
+	if len(s.track.trackers) == 0 {
+		// The keys left are only read by clients gone.
+		s.track.keys = make(map[string]*trackedKey)
+		s.track.order.Init()
+		s.track.expiry = storage.NewExpiryIndex()
+	}
+}
+
+// trackRead records the keys read by the command args of c, if it tracks
+// them. caching is the flag set by CLIENT CACHING before the command.
+func (s *Server) trackRead(c *Context, cmd *command, args [][]byte, caching int8) {
+	keys := cmd.keys.keys(args)
+	if len(keys) == 0 || !cmd.is(flagRead) {
+		return
+	}
+	s.track.mu.Lock()
+	t := s.track.trackers[c.id]
+	s.track.mu.Unlock()
+	if t == nil || t.bcast || (t.optIn && caching != 1) || (t.optOut && caching == -1) {
+		return
+	}
+
+	expires := make([]int64, len(keys))
+	now := time.Now()
+	for i, key := range keys {
+		// The store only gives the TTL in seconds, rounded down: a key is
+		// invalidated up to a second before it expires, right away if it
+		// expires in less than a second.
+		if ttl, err := s.store.TTL(key); err == nil && ttl >= 0 {
+			expires[i] = now.Add(time.Duration(ttl) * time.Second).UnixMilli()
+		}
+	}
+
+	s.track.mu.Lock()
+	for i, key := range keys {
+		k := s.track.keys[string(key)]
+		if k == nil {
+			k = &trackedKey{ids: make(map[int64]bool)}
+			k.elem = s.track.order.PushBack(string(key))
+			s.track.keys[string(key)] = k
+		} else {
+			s.track.order.MoveToBack(k.elem)
+		}
+		k.ids[c.id] = true
+		if expires[i] > 0 {
+			s.track.expiry.Set(key, expires[i])
+		}
+	}
+	invalidated := make(map[*tracker][][]byte)
+	for s.track.maxKeys > 0 && len(s.track.keys) > s.track.maxKeys {
+		s.forgetTrackedLocked(s.track.order.Front().Value.(string), invalidated)
+	}
+	s.track.mu.Unlock()
+
+	s.sendInvalidations(invalidated)
+}
+
+// forgetTrackedLocked stops tracking the key read, which is added to the
+// keys invalidated for the clients which read it.
+func (s *Server) forgetTrackedLocked(key string, invalidated map[*tracker][][]byte) {
+	k := s.track.keys[key]
+	if k == nil {
+		return
+	}
+	delete(s.track.keys, key)
+	s.track.order.Remove(k.elem)
+	s.track.expiry.Remove([]byte(key))
+	for id := range k.ids {
+		if t := s.track.trackers[id]; t != nil && !t.bcast {
+			invalidated[t] = append(invalidated[t], []byte(key))
+		}
+	}
+}
+
+// invalidate sends the invalidations of the keys written by the command
+// args, which was propagated.
+func (s *Server) invalidate(args [][]byte) {
+	cmd := strings.ToUpper(bytesconv.BytesToString(args[0]))
+	if cmd == "FLUSHALL" {
+		s.invalidateAll()
+		return
+	}
+	if command := s.commands[cmd]; command != nil {
+		s.invalidateKeys(command.keys.keys(args))
+	}
+}
+
+// invalidateKeys sends the invalidations of keys to the clients tracking
+// them.
+func (s *Server) invalidateKeys(keys [][]byte) {
+	s.track.mu.Lock()
+	if len(s.track.trackers) == 0 {
+		s.track.mu.Unlock()
+		return
+	}
+	invalidated := make(map[*tracker][][]byte)
+	for _, key := range keys {
+		s.forgetTrackedLocked(string(key), invalidated)
+		// The trackers in BCAST mode, a client may have several of its
+		// prefixes.
+		trackers := make(map[*tracker]bool)
+		for prefix, ids := range s.track.prefixes {
+			if bytes.HasPrefix(key, []byte(prefix)) {
+				for id := range ids {
+					trackers[s.track.trackers[id]] = true
+				}
+			}
+		}
+		for t := range trackers {
+			invalidated[t] = append(invalidated[t], key)
+		}
+	}
+	s.track.mu.Unlock()
+
+	s.sendInvalidations(invalidated)
+}
+
+// sendInvalidations sends the invalidations of the keys, by tracker.
+func (s *Server) sendInvalidations(invalidated map[*tracker][][]byte) {
+	for t, keys := range invalidated {
+		keys := copyArgs(keys)
+		s.sendInvalidation(t, func(out []byte, resp3 bool) []byte {
+			return appendKeys(out, keys)
+		})
+	}
+}
+
+// invalidateAll sends a null invalidation, which invalidates all the keys,
+// to the clients tracking, once the store is flushed.
+func (s *Server) invalidateAll() {
+	s.track.mu.Lock()
+	if len(s.track.trackers) == 0 {
+		s.track.mu.Unlock()
+		return
+	}
+	trackers := make([]*tracker, 0, len(s.track.trackers))
+	for _, t := range s.track.trackers {
+		trackers = append(trackers, t)
+	}
+	s.track.keys = make(map[string]*trackedKey)
+	s.track.order.Init()
+	s.track.expiry = storage.NewExpiryIndex()
+	s.track.mu.Unlock()
+
+	for _, t := range trackers {
+		s.sendInvalidation(t, appendNull)
+	}
+}
+
+// expireTracked invalidates the keys read whose expire is reached.
+func (s *Server) expireTracked() {
+	s.track.mu.Lock()
+	if len(s.track.trackers) == 0 {
+		s.track.mu.Unlock()
+		return
+	}
+	expired := s.track.expiry.PopExpired(time.Now().UnixMilli())
+	s.track.mu.Unlock()
+
+	if len(expired) == 0 {
+		return
+	}
+	keys := make([][]byte, len(expired))
+	for i, key := range expired {
+		keys[i] = []byte(key)
+	}
+	s.invalidateKeys(keys)
+}
+
+// sendInvalidation sends an invalidation message, whose keys are appended
+// by appendMsg, to the client of t or the one it redirects to.
+func (s *Server) sendInvalidation(t *tracker, appendMsg func(out []byte, resp3 bool) []byte) {
+	if t.redirect == 0 {
+		if c := s.client(t.id); c != nil {
+			c.push(func(resp3 bool) []byte {
+				if !resp3 {
+					// A RESP2 client can't be sent pushes.
+					return nil
+				}
+				out := appendPush(nil, 2, true)
+				out = redcon.AppendBulkString(out, "invalidate")
+				return appendMsg(out, true)
+			})
+		}
+		return
+	}
+
+	target := s.client(t.redirect)
+	if target == nil {
+		if c := s.client(t.id); c != nil {
+			c.push(func(resp3 bool) []byte {
+				if !resp3 {
+					return nil
+				}
+				out := appendPush(nil, 2, true)
+				out = redcon.AppendBulkString(out, "tracking-redir-broken")
+				return redcon.AppendInt(out, t.redirect)
+			})
+		}
+		return
+	}
+	subscribed := s.subscribed(target, invalidateChannel)
+	target.push(func(resp3 bool) []byte {
+		if resp3 {
+			out := appendPush(nil, 2, true)
+			out = redcon.AppendBulkString(out, "invalidate")
+			return appendMsg(out, true)
+		}
+		if !subscribed {
+			return nil
+		}
+		return appendMessage(nil, invalidateChannel, false, appendMsg)
+	})
+}
+
+func appendKeys(out []byte, keys [][]byte) []byte {
+	out = redcon.AppendArray(out, len(keys))
+	for _, key := range keys {
+		out = redcon.AppendBulk(out, key)
+	}
+	return out
+}
+
+func copyArgs(args [][]byte) [][]byte {
+	cp := make([][]byte, len(args))
+	for i, arg := range args {
+		cp[i] = append([]byte(nil), arg...)
+	}
+	return cp
+}
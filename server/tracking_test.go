@@ -0,0 +1,206 @@
+// Copyright 2022 MaoLongLong. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestClient connects another client to srv.
+func newTestClient(t *testing.T, srv *Server) *testConn {
+	c := &testConn{t: t, srv: srv, woken: make(chan struct{}, 1)}
+	srv.openedHandler(c)
+	return c
+}
+
+// pushed returns the messages pushed to c.
+func (c *testConn) pushed() string {
+	out, _ := c.srv.dataHandler(c, nil)
+	return string(out)
+}
+
+func invalidation(keys ...string) string {
+	s := ">2\r\n$10\r\ninvalidate\r\n*" + strconv.Itoa(len(keys)) + "\r\n"
+	for _, key := range keys {
+		s += "$" + strconv.Itoa(len(key)) + "\r\n" + key + "\r\n"
+	}
+	return s
+}
+
+func TestHello(t *testing.T) {
+	srv, c := newTestServer(t, nil)
+	defer srv.Cleanup()
+
+	assert.Equal(t, ":1\r\n", c.do("CLIENT", "ID"))
+	assert.Equal(t, "*10\r\n$6\r\nserver\r\n$5\r\nredix\r\n$5\r\nproto\r\n:2\r\n$2\r\nid\r\n:1\r\n$4\r\nmode\r\n$10\r\nstandalone\r\n$4\r\nrole\r\n$6\r\nmaster\r\n", c.do("HELLO"))
+	assert.Equal(t, "%5\r\n$6\r\nserver\r\n$5\r\nredix\r\n$5\r\nproto\r\n:3\r\n$2\r\nid\r\n:1\r\n$4\r\nmode\r\n$10\r\nstandalone\r\n$4\r\nrole\r\n$6\r\nmaster\r\n", c.do("HELLO", "3"))
+	assert.Equal(t, "-NOPROTO unsupported protocol version\r\n", c.do("HELLO", "4"))
+	assert.Equal(t, "-ERR unknown subcommand 'LIST'. Try CLIENT HELP.\r\n", c.do("CLIENT", "LIST"))
+}
+
+func TestTracking(t *testing.T) {
+	srv, c := newTestServer(t, nil)
+	defer srv.Cleanup()
+	w := newTestClient(t, srv)
+
+	c.do("HELLO", "3")
+	assert.Equal(t, ":-1\r\n", c.do("CLIENT", "GETREDIR"))
+	assert.Equal(t, "+OK\r\n", c.do("CLIENT", "TRACKING", "ON"))
+	assert.Equal(t, ":0\r\n", c.do("CLIENT", "GETREDIR"))
+	assert.Equal(t, "$-1\r\n", c.do("GET", "a"))
+	assert.Equal(t, "*2\r\n$-1\r\n$-1\r\n", c.do("MGET", "b", "c"))
+
+	assert.Equal(t, "+OK\r\n", w.do("SET", "a", "1"))
+	<-c.woken
+	assert.Equal(t, invalidation("a"), c.pushed())
+
+	// A key is only invalidated once until read again.
+	assert.Equal(t, "+OK\r\n", w.do("SET", "a", "2"))
+	assert.Equal(t, "+OK\r\n", w.do("MSET", "b", "1", "c", "1"))
+	assert.Equal(t, invalidation("b", "c"), c.pushed())
+
+	// The messages are sent along with the replies of the client.
+	assert.Equal(t, "$1\r\n1\r\n", c.do("GET", "b"))
+	assert.Equal(t, ":1\r\n", w.do("DEL", "b"))
+	assert.Equal(t, "+OK\r\n"+invalidation("b"), c.do("SET", "d", "1"))
+
+	// The client writing a key it read is sent its invalidation too.
+	assert.Equal(t, "$1\r\n1\r\n", c.do("GET", "d"))
+	assert.Equal(t, ":2\r\n"+invalidation("d"), c.do("INCR", "d"))
+
+	assert.Equal(t, "$1\r\n2\r\n", c.do("GET", "d"))
+	assert.Equal(t, "+OK\r\n", w.do("FLUSHALL"))
+	assert.Equal(t, ">2\r\n$10\r\ninvalidate\r\n_\r\n", c.pushed())
+
+	assert.Equal(t, "$-1\r\n", c.do("GET", "a"))
+	assert.Equal(t, "+OK\r\n", c.do("CLIENT", "TRACKING", "OFF"))
+	assert.Equal(t, "+OK\r\n", w.do("SET", "a", "1"))
+	assert.Equal(t, "", c.pushed())
+}
+
+func TestTrackingExpire(t *testing.T) {
+	srv, c := newTestServer(t, nil)
+	defer srv.Cleanup()
+
+	c.do("HELLO", "3")
+	assert.Equal(t, "+OK\r\n", c.do("SET", "a", "1", "EX", "2"))
+	assert.Equal(t, "+OK\r\n", c.do("CLIENT", "TRACKING", "ON"))
+	assert.Equal(t, "$1\r\n1\r\n", c.do("GET", "a"))
+	srv.expireTracked()
+	assert.Equal(t, "", c.pushed())
+
+	require.Eventually(t, func() bool {
+		srv.expireTracked()
+		return c.pushed() == invalidation("a")
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestTrackingMaxKeys(t *testing.T) {
+	srv, c := newTestServer(t, map[string]interface{}{"tracking_table_max_keys": 2})
+	defer srv.Cleanup()
+	w := newTestClient(t, srv)
+
+	// Past the bound, the keys read first are invalidated.
+	c.do("HELLO", "3")
+	assert.Equal(t, "+OK\r\n", c.do("CLIENT", "TRACKING", "ON"))
+	assert.Equal(t, "*2\r\n$-1\r\n$-1\r\n", c.do("MGET", "a", "b"))
+	assert.Equal(t, "$-1\r\n", c.do("GET", "a"))
+	assert.Equal(t, "$-1\r\n"+invalidation("b"), c.do("GET", "c"))
+	assert.Equal(t, "*2\r\n$-1\r\n$-1\r\n"+invalidation("a", "c"), c.do("MGET", "d", "e"))
+	assert.Len(t, srv.track.keys, 2)
+
+	assert.Equal(t, "+OK\r\n", w.do("MSET", "a", "1", "b", "1", "c", "1", "d", "1"))
+	assert.Equal(t, invalidation("d"), c.pushed())
+}
+
+func TestTrackingRedirect(t *testing.T) {
+	srv, c := newTestServer(t, nil)
+	defer srv.Cleanup()
+	sub := newTestClient(t, srv)
+
+	assert.Equal(t, "-ERR The client ID you want redirect to does not exist\r\n", c.do("CLIENT", "TRACKING", "ON", "REDIRECT", "9"))
+	assert.Equal(t, "*3\r\n$9\r\nsubscribe\r\n$20\r\n__redis__:invalidate\r\n:1\r\n", sub.do("SUBSCRIBE", "__redis__:invalidate"))
+	assert.Equal(t, "-ERR Can't execute 'get': only SUBSCRIBE / UNSUBSCRIBE / PING / QUIT are allowed in this context\r\n", sub.do("GET", "a"))
+	assert.Equal(t, "*2\r\n$4\r\npong\r\n$0\r\n\r\n", sub.do("PING"))
+
+	assert.Equal(t, "+OK\r\n", c.do("CLIENT", "TRACKING", "ON", "REDIRECT", "2"))
+	assert.Equal(t, ":2\r\n", c.do("CLIENT", "GETREDIR"))
+	assert.Equal(t, "$-1\r\n", c.do("GET", "a"))
+	assert.Equal(t, "+OK\r\n", c.do("SET", "a", "1"))
+	assert.Equal(t, "*3\r\n$7\r\nmessage\r\n$20\r\n__redis__:invalidate\r\n*1\r\n$1\r\na\r\n", sub.pushed())
+
+	// The client is told once the one it redirects to is gone.
+	c.do("HELLO", "3")
+	assert.Equal(t, "$1\r\n1\r\n", c.do("GET", "a"))
+	srv.closedHandler(sub, nil)
+	assert.Equal(t, "+OK\r\n", c.do("SET", "b", "1"))
+	assert.Equal(t, ":1\r\n>2\r\n$21\r\ntracking-redir-broken\r\n:2\r\n", c.do("DEL", "a"))
+}
+
+func TestTrackingBroadcast(t *testing.T) {
+	srv, c := newTestServer(t, nil)
+	defer srv.Cleanup()
+	w := newTestClient(t, srv)
+
+	c.do("HELLO", "3")
+	assert.Equal(t, "-ERR PREFIX option requires BCAST mode to be enabled\r\n", c.do("CLIENT", "TRACKING", "ON", "PREFIX", "a"))
+	assert.Equal(t, "-ERR OPTIN and OPTOUT are not compatible with BCAST\r\n", c.do("CLIENT", "TRACKING", "ON", "BCAST", "OPTIN"))
+	assert.Equal(t, "+OK\r\n", c.do("CLIENT", "TRACKING", "ON", "BCAST", "PREFIX", "user:", "PREFIX", "u"))
+	assert.Equal(t, "-ERR You can't switch BCAST mode on/off before disabling tracking for this client, and then re-enabling it with a different mode.\r\n", c.do("CLIENT", "TRACKING", "ON"))
+
+	// The keys needn't be read, and are sent once with both prefixes.
+	assert.Equal(t, "+OK\r\n", w.do("MSET", "user:1", "a", "item:1", "b"))
+	assert.Equal(t, invalidation("user:1"), c.pushed())
+	assert.Equal(t, "+OK\r\n", w.do("SET", "user:1", "c"))
+	assert.Equal(t, invalidation("user:1"), c.pushed())
+}
+
+func TestTrackingOptIn(t *testing.T) {
+	srv, c := newTestServer(t, nil)
+	defer srv.Cleanup()
+	w := newTestClient(t, srv)
+
+	c.do("HELLO", "3")
+	assert.Equal(t, "-ERR You can't use both OPTIN and OPTOUT\r\n", c.do("CLIENT", "TRACKING", "ON", "OPTIN", "OPTOUT"))
+	assert.Equal(t, "-ERR CLIENT CACHING YES is only valid when tracking is enabled in OPTIN mode.\r\n", c.do("CLIENT", "CACHING", "YES"))
+	assert.Equal(t, "+OK\r\n", c.do("CLIENT", "TRACKING", "ON", "OPTIN"))
+	assert.Equal(t, "-ERR CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode.\r\n", c.do("CLIENT", "CACHING", "NO"))
+
+	// Only the command following CLIENT CACHING YES is tracked.
+	assert.Equal(t, "$-1\r\n", c.do("GET", "a"))
+	assert.Equal(t, "+OK\r\n", c.do("CLIENT", "CACHING", "YES"))
+	assert.Equal(t, "$-1\r\n", c.do("GET", "b"))
+	assert.Equal(t, "$-1\r\n", c.do("GET", "c"))
+	w.do("MSET", "a", "1", "b", "1", "c", "1")
+	assert.Equal(t, invalidation("b"), c.pushed())
+
+	assert.Equal(t, "+OK\r\n", c.do("CLIENT", "TRACKING", "ON", "OPTOUT"))
+	assert.Equal(t, "+OK\r\n", c.do("CLIENT", "CACHING", "NO"))
+	assert.Equal(t, "$1\r\n1\r\n", c.do("GET", "a"))
+	assert.Equal(t, "$1\r\n1\r\n", c.do("GET", "b"))
+	w.do("MSET", "a", "2", "b", "2")
+	assert.Equal(t, invalidation("b"), c.pushed())
+}
+
+func TestPublish(t *testing.T) {
+	srv, c := newTestServer(t, nil)
+	defer srv.Cleanup()
+	sub := newTestClient(t, srv)
+
+	assert.Equal(t, ":0\r\n", c.do("PUBLISH", "ch", "hi"))
+	assert.Equal(t, "*3\r\n$9\r\nsubscribe\r\n$2\r\nch\r\n:1\r\n*3\r\n$9\r\nsubscribe\r\n$3\r\nch2\r\n:2\r\n", sub.do("SUBSCRIBE", "ch", "ch2"))
+	assert.Equal(t, ":1\r\n", c.do("PUBLISH", "ch", "hi"))
+	assert.Equal(t, "*3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n", sub.pushed())
+
+	assert.Equal(t, "*3\r\n$11\r\nunsubscribe\r\n$2\r\nch\r\n:1\r\n", sub.do("UNSUBSCRIBE", "ch"))
+	assert.Equal(t, ":0\r\n", c.do("PUBLISH", "ch", "hi"))
+	assert.Equal(t, "*3\r\n$11\r\nunsubscribe\r\n$3\r\nch2\r\n:0\r\n", sub.do("UNSUBSCRIBE"))
+	assert.Equal(t, "$-1\r\n", sub.do("GET", "a"))
+}